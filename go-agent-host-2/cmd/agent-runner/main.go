@@ -8,15 +8,20 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"strings"
 	"syscall"
 	"time"
 
 	"github.com/somnia-chain/agent-runner/internal/agents"
 	"github.com/somnia-chain/agent-runner/internal/api"
 	"github.com/somnia-chain/agent-runner/internal/config"
+	"github.com/somnia-chain/agent-runner/internal/engine"
 	"github.com/somnia-chain/agent-runner/internal/heartbeater"
 	"github.com/somnia-chain/agent-runner/internal/listener"
 	"github.com/somnia-chain/agent-runner/internal/logging"
+	"github.com/somnia-chain/agent-runner/internal/metrics"
+	"github.com/somnia-chain/agent-runner/internal/prewarmer"
 	"github.com/somnia-chain/agent-runner/internal/sandbox"
 	"github.com/somnia-chain/agent-runner/internal/sessionrpc"
 	"github.com/somnia-chain/agent-runner/internal/startup"
@@ -43,6 +48,10 @@ func main() {
 		os.Exit(1)
 	}
 	slog.Info("SomniaAgents contract", "address", cfg.SomniaAgentsContract)
+	if cfg.SandboxDNS && cfg.EgressPolicyFile == "" {
+		slog.Error("--sandbox-dns requires --egress-policy-file")
+		os.Exit(1)
+	}
 	fmt.Println("")
 
 	// =========================================================================
@@ -52,8 +61,8 @@ func main() {
 	ctx := context.Background()
 	checker := startup.NewChecker()
 
-	// Check 1: Docker daemon
-	if err := checker.CheckDocker(ctx); err != nil {
+	// Check 1: Container engine
+	if err := checker.CheckContainerEngine(ctx, cfg.ContainerEngine, cfg.ContainerHost); err != nil {
 		os.Exit(1)
 	}
 
@@ -63,6 +72,8 @@ func main() {
 		cfg.SandboxNetworkName,
 		cfg.SandboxNetworkSubnet,
 		cfg.SandboxNetworkGateway,
+		cfg.SandboxNetworkSubnet6,
+		cfg.SandboxNetworkGateway6,
 	)
 	if err != nil {
 		os.Exit(1)
@@ -73,12 +84,18 @@ func main() {
 	if cfg.LLMProxyEnabled {
 		inputPorts = append(inputPorts, cfg.LLMProxyPort)
 	}
+	if cfg.TransparentProxyPort > 0 {
+		inputPorts = append(inputPorts, cfg.TransparentProxyPort)
+	}
+	if cfg.SandboxDNS {
+		inputPorts = append(inputPorts, cfg.SandboxDNSPort)
+	}
 	if err := sandbox.EnsureInputRules(sandboxNet, inputPorts); err != nil {
 		slog.Warn("Failed to add INPUT rules for sandbox", "error", err)
 	}
 
 	// Check 3: Stale containers cleanup
-	if _, err := checker.CheckStaleContainers(ctx); err != nil {
+	if _, err := checker.CheckStaleContainers(ctx, cfg.AdoptContainers); err != nil {
 		// Log but don't fail - partial cleanup is okay
 		slog.Warn("Some stale containers could not be removed", "error", err)
 	}
@@ -88,10 +105,16 @@ func main() {
 	if cfg.LLMProxyEnabled {
 		allowedPorts = append(allowedPorts, cfg.LLMProxyPort)
 	}
+	dnsPort := 0
+	if cfg.SandboxDNS {
+		dnsPort = cfg.SandboxDNSPort
+	}
 	firewallRules, err := checker.CheckFirewall(
 		sandboxNet,
 		allowedPorts,
 		cfg.EnableFirewall,
+		cfg.TransparentProxyPort,
+		dnsPort,
 	)
 	if err != nil {
 		os.Exit(1)
@@ -115,9 +138,26 @@ func main() {
 	// Initialize Services
 	// =========================================================================
 
-	// Create agents manager with the client from startup checks
+	// Route containers on the microvm runtime to the microVM backend if configured
+	var runtime engine.Runtime = checker.Runtime()
+	if cfg.MicroVMKernel != "" {
+		vm, err := engine.NewMicroVM(ctx, runtime, engine.MicroVMConfig{
+			VMM:      cfg.MicroVMVMM,
+			Binary:   cfg.MicroVMBinary,
+			Kernel:   cfg.MicroVMKernel,
+			StateDir: cfg.MicroVMStateDir,
+			Network:  sandboxNet.Name,
+		})
+		if err != nil {
+			slog.Error("Failed to configure microVM backend", "error", err)
+			os.Exit(1)
+		}
+		runtime = engine.NewRouter(runtime, vm)
+	}
+
+	// Create agents manager with the engine from startup checks
 	agentManager := agents.NewManager(
-		checker.DockerClient(),
+		runtime,
 		cfg.CacheDir,
 		cfg.StartPort,
 		cfg.Runtime,
@@ -129,23 +169,249 @@ func main() {
 		llmProxyPort = cfg.LLMProxyPort
 	}
 	agentManager.SetSandboxNetwork(sandboxNet.Name, sandboxNet.Gateway, cfg.SandboxProxyPort, llmProxyPort)
+	agentManager.SetSandboxDNS(cfg.SandboxDNS)
+
+	// Load the CA for intercepting sandbox HTTPS and make containers trust it
+	var sandboxCA *sandbox.CA
+	if cfg.SandboxMITM {
+		sandboxCA, err = sandbox.LoadOrCreateCA(cfg.SandboxCADir)
+		if err != nil {
+			slog.Error("Failed to load sandbox CA", "dir", cfg.SandboxCADir, "error", err)
+			os.Exit(1)
+		}
+		bundle, err := filepath.Abs(filepath.Join(cfg.SandboxCADir, "ca-bundle.pem"))
+		if err == nil {
+			err = sandboxCA.WriteBundle(bundle)
+		}
+		if err != nil {
+			slog.Error("Failed to write sandbox CA bundle", "dir", cfg.SandboxCADir, "error", err)
+			os.Exit(1)
+		}
+		agentManager.SetSandboxCA(bundle)
+		slog.Info("Sandbox HTTPS interception enabled", "ca_dir", cfg.SandboxCADir, "ca_fingerprint", sandboxCA.Fingerprint())
+	}
+
+	// Configure host port allocation
+	agentManager.SetPortConfig(agents.PortConfig{
+		Start:          cfg.StartPort,
+		End:            cfg.EndPort,
+		BindIP:         cfg.ContainerBindIP,
+		UseContainerIP: cfg.ContainerIPAddress,
+	})
+
+	// Configure container resource limits
+	var resourcePolicy *agents.ResourcePolicy
+	usesMicroVM := cfg.Runtime == engine.MicroVMRuntime
+	if cfg.AgentPolicyFile != "" {
+		resourcePolicy, err = agents.LoadResourcePolicy(cfg.AgentPolicyFile)
+		if err != nil {
+			slog.Error("Failed to load agent policy file", "path", cfg.AgentPolicyFile, "error", err)
+			os.Exit(1)
+		}
+		usesMicroVM = usesMicroVM || resourcePolicy.UsesRuntime(engine.MicroVMRuntime)
+	}
+	if usesMicroVM && cfg.MicroVMKernel == "" {
+		slog.Error("The microvm runtime is selected but --microvm-kernel is not set")
+		os.Exit(1)
+	}
+	if usesMicroVM && cfg.Deterministic {
+		// The clock and seed files change per request, but VMs get copies made at create
+		slog.Error("The microvm runtime is selected but cannot run agents with --deterministic")
+		os.Exit(1)
+	}
+	agentManager.SetResourceLimits(agents.ResourceLimits{
+		MemoryMB:  cfg.ContainerMemoryMB,
+		CPUs:      cfg.ContainerCPUs,
+		PidsLimit: cfg.ContainerPidsLimit,
+		DiskMB:    cfg.ContainerDiskMB,
+	}, resourcePolicy)
+
+	// Configure replica pooling and autoscaling
+	poolCfg := agents.DefaultPoolConfig()
+	poolCfg.MaxReplicas = cfg.MaxReplicas
+	poolCfg.WarmReplicas = cfg.WarmReplicas
+	poolCfg.PopularThreshold = cfg.PopularAgentRPM
+	poolCfg.TargetInFlight = cfg.TargetInFlight
+	poolCfg.LatencyThreshold = cfg.ScaleLatencyTarget
+	poolCfg.ScaleInterval = cfg.AutoscaleInterval
+	agentManager.SetPoolConfig(poolCfg)
+	agentManager.StartAutoscaler()
+
+	// Configure idle reaping and eviction
+	agentManager.SetEvictionConfig(agents.EvictionConfig{
+		IdleTimeout:     cfg.ContainerIdleTimeout,
+		MaxContainers:   cfg.MaxContainers,
+		MinFreeMemoryMB: cfg.MinFreeMemoryMB,
+	})
+	agentManager.StartReaper()
+
+	// Configure container health checks
+	agentManager.SetHealthCheckDefaults(agents.HealthCheck{
+		StartupTimeoutSec: int(cfg.ContainerStartupTimeout.Seconds()),
+		IntervalSec:       int(cfg.HealthCheckInterval.Seconds()),
+		TimeoutSec:        int(cfg.HealthCheckTimeout.Seconds()),
+		FailureThreshold:  cfg.HealthCheckFailures,
+	})
+	agentManager.StartHealthMonitor()
+	agentManager.StartEventWatcher()
+	agentManager.SetMaxResultSize(cfg.MaxResultBytes)
+
+	// Configure per-request container log capture
+	agentManager.SetLogCaptureConfig(agents.LogCaptureConfig{
+		MaxBytes: cfg.RequestLogBytes,
+		Retain:   cfg.RequestLogRetain,
+	})
+
+	// Configure determinism mode
+	if err := agentManager.SetDeterminismConfig(agents.DeterminismConfig{
+		Enabled:     cfg.Deterministic,
+		StateDir:    cfg.DeterminismStateDir,
+		FaketimeLib: cfg.FaketimeLib,
+	}); err != nil {
+		slog.Error("Failed to configure determinism mode", "error", err)
+		os.Exit(1)
+	}
+
+	// Adopt containers left running by the previous run, once the manager is
+	// configured to reach and check them the same way
+	if cfg.AdoptContainers {
+		if _, err := agentManager.AdoptContainers(ctx); err != nil {
+			slog.Warn("Failed to adopt running containers", "error", err)
+		}
+	}
 
 	// Start the sandbox HTTP/HTTPS proxy
 	proxyAddr := fmt.Sprintf("%s:%d", sandboxNet.Gateway, cfg.SandboxProxyPort)
 	sandboxProxy := sandbox.NewProxy(proxyAddr)
+	if cfg.TransparentProxyPort > 0 {
+		sandboxProxy.TransparentAddr = fmt.Sprintf("%s:%d", sandboxNet.Gateway, cfg.TransparentProxyPort)
+	}
+	if sandboxNet.Gateway6 != "" {
+		// Listen on the IPv6 gateway too, where the ip6tables rules send traffic
+		sandboxProxy.ListenAddr6 = fmt.Sprintf("[%s]:%d", sandboxNet.Gateway6, cfg.SandboxProxyPort)
+		if cfg.TransparentProxyPort > 0 {
+			sandboxProxy.TransparentAddr6 = fmt.Sprintf("[%s]:%d", sandboxNet.Gateway6, cfg.TransparentProxyPort)
+		}
+	}
+	sandboxProxy.MITM = sandboxCA
 
-	// Add request logging
-	sandboxProxy.OnComplete = func(r *http.Request, statusCode int, bytesIn, bytesOut int64, duration time.Duration, err error) {
+	// Attribute proxy requests to agents and requests by per-container credentials
+	agentManager.SetProxyAuthRequired(cfg.SandboxProxyAuth)
+	sandboxProxy.AuthFunc = agentManager.AuthenticateProxy
+	sandboxProxy.ClientFunc = agentManager.ProxyClient
+
+	// Restrict proxy destinations to the egress policy
+	var egressPolicy *sandbox.EgressPolicy
+	if cfg.EgressPolicyFile != "" {
+		egressPolicy, err = sandbox.LoadEgressPolicy(cfg.EgressPolicyFile)
+		if err != nil {
+			slog.Error("Failed to load egress policy file", "path", cfg.EgressPolicyFile, "error", err)
+			os.Exit(1)
+		}
+		agentManager.SetEgressPolicy(egressPolicy)
+		sandboxProxy.Egress = egressPolicy
+		sandboxProxy.OnBlocked = func(r *http.Request, client *sandbox.ProxyClient, host string, decision sandbox.EgressDecision) {
+			agentURL := "unknown"
+			var agentID, requestID string
+			if client != nil {
+				agentURL, agentID, requestID = client.AgentURL, client.AgentID, client.RequestID
+			}
+			metrics.EgressBlockedTotal.WithLabelValues(agentURL, decision.Reason).Inc()
+			slog.Warn("Proxy request blocked by egress policy",
+				"method", r.Method,
+				"host", host,
+				"agent_id", agentID,
+				"agent_url", agentURL,
+				"request_id", requestID,
+				"source", r.RemoteAddr,
+				"reason", decision.Reason,
+				"rule", decision.Rule,
+			)
+		}
+		slog.Info("Egress policy loaded", "path", cfg.EgressPolicyFile, "agents", len(egressPolicy.Agents))
+	}
+
+	// Enforce per-agent and per-request proxy quotas
+	agentQuota := sandbox.QuotaLimits{Requests: cfg.EgressAgentRequests, Bytes: cfg.EgressAgentBytes}
+	requestQuota := sandbox.QuotaLimits{Requests: cfg.EgressRequestRequests, Bytes: cfg.EgressRequestBytes}
+	if agentQuota != (sandbox.QuotaLimits{}) || requestQuota != (sandbox.QuotaLimits{}) {
+		sandboxProxy.Quotas = sandbox.NewQuotas(agentQuota, requestQuota, cfg.EgressQuotaWindow)
+		sandboxProxy.OnThrottled = func(r *http.Request, client *sandbox.ProxyClient, reason string) {
+			agentURL := "unknown"
+			var agentID, requestID string
+			if client != nil {
+				agentURL, agentID, requestID = client.AgentURL, client.AgentID, client.RequestID
+			}
+			metrics.EgressThrottledTotal.WithLabelValues(agentURL, reason).Inc()
+			slog.Warn("Proxy request exceeded egress quota",
+				"method", r.Method,
+				"host", r.Host,
+				"agent_id", agentID,
+				"agent_url", agentURL,
+				"request_id", requestID,
+				"quota", reason,
+			)
+		}
+	}
+
+	// Record and replay proxied HTTP responses per request
+	if cfg.EgressCacheMode != "" {
+		egressCache, err := sandbox.NewEgressCache(sandbox.EgressCacheConfig{
+			Mode:         cfg.EgressCacheMode,
+			ServiceURL:   cfg.EgressCacheURL,
+			ServiceToken: cfg.EgressCacheToken,
+			TapeDir:      cfg.EgressCacheDir,
+			ReplayFile:   cfg.EgressReplayFile,
+			MaxBody:      cfg.EgressCacheMaxBody,
+		})
+		if err != nil {
+			slog.Error("Failed to configure egress cache", "error", err)
+			os.Exit(1)
+		}
+		agentManager.SetEgressCache(egressCache)
+		sandboxProxy.Cache = egressCache
+		sandboxProxy.OnCache = func(r *http.Request, client *sandbox.ProxyClient, outcome string) {
+			agentURL := "unknown"
+			var agentID, requestID string
+			if client != nil {
+				agentURL, agentID, requestID = client.AgentURL, client.AgentID, client.RequestID
+			}
+			metrics.EgressCacheTotal.WithLabelValues(agentURL, outcome).Inc()
+			if outcome == sandbox.CacheReplayMiss {
+				slog.Warn("Proxy request not on the replayed egress tape",
+					"method", r.Method,
+					"url", r.URL.String(),
+					"agent_id", agentID,
+					"request_id", requestID,
+				)
+			}
+		}
+	}
+
+	// Add request logging and egress metering
+	sandboxProxy.OnComplete = func(r *http.Request, client *sandbox.ProxyClient, statusCode int, bytesIn, bytesOut int64, duration time.Duration, err error) {
+		agentURL := "unknown"
+		var agentID, requestID string
+		if client != nil {
+			agentURL, agentID, requestID = client.AgentURL, client.AgentID, client.RequestID
+		}
+		metrics.EgressRequestsTotal.WithLabelValues(agentURL).Inc()
+		metrics.EgressBytesTotal.WithLabelValues(agentURL, "sent").Add(float64(bytesIn))
+		metrics.EgressBytesTotal.WithLabelValues(agentURL, "received").Add(float64(bytesOut))
 		if err != nil {
 			slog.Warn("Proxy request failed",
 				"method", r.Method,
 				"host", r.Host,
+				"agent_id", agentID,
+				"request_id", requestID,
 				"error", err,
 			)
 		} else {
 			slog.Debug("Proxy request completed",
 				"method", r.Method,
 				"host", r.Host,
+				"agent_id", agentID,
+				"request_id", requestID,
 				"status", statusCode,
 				"bytes_in", bytesIn,
 				"bytes_out", bytesOut,
@@ -201,6 +467,58 @@ func main() {
 		slog.Info("LLM proxy started", "addr", llmProxyAddr, "upstream", cfg.LLMUpstreamURL)
 	}
 
+	// Start the sandbox DNS server if enabled
+	var dnsServer *sandbox.DNSServer
+	if cfg.SandboxDNS {
+		dnsAddr := fmt.Sprintf("%s:%d", sandboxNet.Gateway, cfg.SandboxDNSPort)
+		dnsServer = sandbox.NewDNSServer(dnsAddr)
+		if sandboxNet.Gateway6 != "" {
+			dnsServer.ListenAddr6 = fmt.Sprintf("[%s]:%d", sandboxNet.Gateway6, cfg.SandboxDNSPort)
+		}
+		dnsServer.MaxLabelLength = cfg.DNSMaxLabelLength
+		dnsServer.MaxLabelEntropy = cfg.DNSMaxLabelEntropy
+		dnsServer.Egress = egressPolicy
+		dnsServer.ClientFunc = agentManager.SandboxClient
+		dnsServer.OnQuery = func(client *sandbox.ProxyClient, name, qtype string, decision sandbox.EgressDecision) {
+			agentURL := "unknown"
+			var agentID, requestID, container string
+			if client != nil {
+				agentURL, agentID, requestID, container = client.AgentURL, client.AgentID, client.RequestID, client.Container
+			}
+			result := "allowed"
+			if !decision.Allowed {
+				result = decision.Reason
+			}
+			metrics.DNSQueriesTotal.WithLabelValues(agentURL, result).Inc()
+			if decision.Allowed {
+				slog.Debug("Sandbox DNS query",
+					"name", name,
+					"type", qtype,
+					"agent_id", agentID,
+					"request_id", requestID,
+					"container", container,
+				)
+				return
+			}
+			slog.Warn("Sandbox DNS query blocked",
+				"name", name,
+				"type", qtype,
+				"agent_id", agentID,
+				"agent_url", agentURL,
+				"request_id", requestID,
+				"container", container,
+				"reason", decision.Reason,
+				"rule", decision.Rule,
+			)
+		}
+
+		if err := dnsServer.Start(); err != nil {
+			slog.Error("Failed to start sandbox DNS server", "error", err)
+			os.Exit(1)
+		}
+		slog.Info("Sandbox DNS server started", "addr", dnsAddr)
+	}
+
 	// Initialize session RPC client (replaces submitter — node manages nonces)
 	sessionSeed := os.Getenv("SECRET_KEY")
 	if sessionSeed == "" {
@@ -214,11 +532,23 @@ func main() {
 	}
 
 	// Create listener to resolve contract addresses from SomniaAgents
+	var selfCheckAgents []string
+	for _, id := range strings.Split(cfg.SelfCheckAgents, ",") {
+		if id = strings.TrimSpace(id); id != "" {
+			selfCheckAgents = append(selfCheckAgents, id)
+		}
+	}
+
 	listenerCfg := listener.Config{
-		SomniaAgentsContract:  cfg.SomniaAgentsContract,
-		RPCURL:                cfg.RPCURL,
-		ReceiptsServiceURL:    cfg.ReceiptsServiceURL,
-		MaxConcurrentRequests: cfg.MaxConcurrentRequests,
+		SomniaAgentsContract:    cfg.SomniaAgentsContract,
+		RPCURL:                  cfg.RPCURL,
+		ReceiptsServiceURL:      cfg.ReceiptsServiceURL,
+		MaxConcurrentRequests:   cfg.MaxConcurrentRequests,
+		RequestTimeout:          cfg.RequestTimeout,
+		SelfCheckRate:           cfg.SelfCheckRate,
+		SelfCheckAgents:         selfCheckAgents,
+		SelfCheckFailOnMismatch: cfg.SelfCheckFailOnMismatch,
+		JournalFile:             cfg.JournalFile,
 	}
 
 	eventListener, err := listener.New(listenerCfg, agentManager, session)
@@ -230,6 +560,31 @@ func main() {
 	// Configure AgentRegistry address for containers
 	agentManager.SetAgentRegistryAddress(eventListener.AgentRegistryAddress())
 
+	// Start prewarmer (uses resolved AgentRegistry address)
+	var pw *prewarmer.Prewarmer
+	if cfg.PrewarmEnabled {
+		var allowlist []string
+		for _, id := range strings.Split(cfg.PrewarmAgents, ",") {
+			if id = strings.TrimSpace(id); id != "" {
+				allowlist = append(allowlist, id)
+			}
+		}
+
+		pw, err = prewarmer.New(prewarmer.Config{
+			AgentRegistryAddress: eventListener.AgentRegistryAddress(),
+			RPCURL:               cfg.RPCURL,
+			Allowlist:            allowlist,
+			Parallelism:          cfg.PrewarmParallelism,
+			StartContainers:      cfg.PrewarmContainers,
+		}, agentManager)
+		if err != nil {
+			slog.Error("Failed to create prewarmer", "error", err)
+			os.Exit(1)
+		}
+		eventListener.OnAgentSet = pw.HandleAgentSet
+		pw.Start()
+	}
+
 	// Start heartbeater (uses resolved committee address)
 	hbCfg := heartbeater.Config{
 		ContractAddress: eventListener.CommitteeAddress(),
@@ -249,6 +604,7 @@ func main() {
 
 	// Create API server (health, version, metrics only - agent requests handled via blockchain listener)
 	server := api.NewServer(cfg.APIKey)
+	server.SetRequestLogSource(agentManager)
 	http.HandleFunc("/", server.HandleRequest)
 
 	// =========================================================================
@@ -269,6 +625,11 @@ func main() {
 		// Stop the heartbeater (sends leave transaction via session RPC)
 		hb.Stop()
 
+		// Stop the prewarmer if running
+		if pw != nil {
+			pw.Stop()
+		}
+
 		// Stop the sandbox proxy
 		shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 		defer cancel()
@@ -283,6 +644,13 @@ func main() {
 			}
 		}
 
+		// Stop the sandbox DNS server if running
+		if dnsServer != nil {
+			if err := dnsServer.Stop(shutdownCtx); err != nil {
+				slog.Warn("Failed to stop sandbox DNS server", "error", err)
+			}
+		}
+
 		agentManager.Cleanup()
 		os.Exit(0)
 	}()
@@ -301,6 +669,26 @@ func main() {
 		firewallStatus = "enabled"
 	}
 
+	mitmStatus := "disabled"
+	if sandboxCA != nil {
+		mitmStatus = "enabled"
+	}
+
+	transparentStatus := "disabled"
+	if sandboxProxy.TransparentAddr != "" {
+		transparentStatus = sandboxProxy.TransparentAddr
+	}
+
+	dnsStatus := "disabled"
+	if cfg.SandboxDNS {
+		dnsStatus = fmt.Sprintf("%s:%d", sandboxNet.Gateway, cfg.SandboxDNSPort)
+	}
+
+	egressCacheStatus := "disabled"
+	if cfg.EgressCacheMode != "" {
+		egressCacheStatus = cfg.EgressCacheMode
+	}
+
 	llmProxyStatus := "disabled"
 	if cfg.LLMProxyEnabled {
 		llmProxyStatus = fmt.Sprintf("enabled (%s:%d -> %s)", sandboxNet.Gateway, cfg.LLMProxyPort, cfg.LLMUpstreamURL)
@@ -314,11 +702,19 @@ func main() {
 		"cache_dir", cfg.CacheDir,
 		"start_port", cfg.StartPort,
 		"runtime", cfg.Runtime,
+		"max_replicas", cfg.MaxReplicas,
+		"prewarm", cfg.PrewarmEnabled,
+		"container_limits", fmt.Sprintf("memory=%dMiB cpus=%g pids=%d disk=%dMiB", cfg.ContainerMemoryMB, cfg.ContainerCPUs, cfg.ContainerPidsLimit, cfg.ContainerDiskMB),
 		"receipts_url", cfg.ReceiptsServiceURL,
 		"api_key", apiKeyStatus,
 		"sandbox_network", sandboxNet.Name,
 		"sandbox_gateway", sandboxNet.Gateway,
+		"sandbox_subnet6", sandboxNet.Subnet6,
 		"sandbox_proxy", proxyAddr,
+		"transparent_proxy", transparentStatus,
+		"sandbox_mitm", mitmStatus,
+		"sandbox_dns", dnsStatus,
+		"egress_cache", egressCacheStatus,
 		"firewall", firewallStatus,
 		"llm_proxy", llmProxyStatus,
 		"committee", committeeStatus,
@@ -8,10 +8,22 @@ import (
 	"github.com/ethereum/go-ethereum/accounts/abi"
 	"github.com/ethereum/go-ethereum/accounts/abi/bind"
 	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
 )
 
 // AgentRegistryABI is the ABI of the AgentRegistry contract.
 const AgentRegistryABI = `[
+	{
+		"anonymous": false,
+		"inputs": [
+			{"indexed": true, "internalType": "uint256", "name": "agentId", "type": "uint256"},
+			{"indexed": true, "internalType": "address", "name": "owner", "type": "address"},
+			{"indexed": false, "internalType": "string", "name": "metadataUri", "type": "string"},
+			{"indexed": false, "internalType": "string", "name": "containerImageUri", "type": "string"}
+		],
+		"name": "AgentSet",
+		"type": "event"
+	},
 	{
 		"inputs": [{"internalType": "uint256", "name": "agentId", "type": "uint256"}],
 		"name": "getAgent",
@@ -57,10 +69,20 @@ type Agent struct {
 	Cost              *big.Int
 }
 
+// AgentSetEvent represents the AgentSet event from the contract.
+type AgentSetEvent struct {
+	AgentId           *big.Int
+	Owner             common.Address
+	MetadataUri       string
+	ContainerImageUri string
+}
+
 // AgentRegistry is a Go binding for the AgentRegistry smart contract.
 type AgentRegistry struct {
 	AgentRegistryCaller
+	AgentRegistryFilterer
 	address common.Address
+	abi     abi.ABI
 }
 
 // AgentRegistryCaller provides read-only contract methods.
@@ -68,6 +90,11 @@ type AgentRegistryCaller struct {
 	contract *bind.BoundContract
 }
 
+// AgentRegistryFilterer provides event filtering methods.
+type AgentRegistryFilterer struct {
+	abi abi.ABI
+}
+
 // NewAgentRegistry creates a new instance of AgentRegistry bound to a specific address.
 func NewAgentRegistry(address common.Address, backend bind.ContractBackend) (*AgentRegistry, error) {
 	parsed, err := abi.JSON(strings.NewReader(AgentRegistryABI))
@@ -78,8 +105,10 @@ func NewAgentRegistry(address common.Address, backend bind.ContractBackend) (*Ag
 	contract := bind.NewBoundContract(address, parsed, backend, backend, backend)
 
 	return &AgentRegistry{
-		AgentRegistryCaller: AgentRegistryCaller{contract: contract},
-		address:             address,
+		AgentRegistryCaller:   AgentRegistryCaller{contract: contract},
+		AgentRegistryFilterer: AgentRegistryFilterer{abi: parsed},
+		address:               address,
+		abi:                   parsed,
 	}, nil
 }
 
@@ -88,6 +117,11 @@ func (a *AgentRegistry) Address() common.Address {
 	return a.address
 }
 
+// ABI returns the contract ABI.
+func (a *AgentRegistry) ABI() abi.ABI {
+	return a.abi
+}
+
 // GetAgent returns the agent info for a given agent ID.
 func (c *AgentRegistryCaller) GetAgent(opts *bind.CallOpts, agentId *big.Int) (*Agent, error) {
 	var out []interface{}
@@ -133,3 +167,24 @@ func (c *AgentRegistryCaller) GetAllAgents(opts *bind.CallOpts) ([]*big.Int, err
 	}
 	return out[0].([]*big.Int), nil
 }
+
+// ParseAgentSet parses an AgentSet event from a log.
+func (f *AgentRegistryFilterer) ParseAgentSet(log types.Log) (*AgentSetEvent, error) {
+	event := new(AgentSetEvent)
+
+	// Indexed fields are in topics
+	if len(log.Topics) < 3 {
+		return nil, nil
+	}
+
+	event.AgentId = new(big.Int).SetBytes(log.Topics[1].Bytes())
+	event.Owner = common.BytesToAddress(log.Topics[2].Bytes())
+
+	// Non-indexed fields are in data
+	err := f.abi.UnpackIntoInterface(event, "AgentSet", log.Data)
+	if err != nil {
+		return nil, err
+	}
+
+	return event, nil
+}
@@ -0,0 +1,262 @@
+package agents
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/somnia-chain/agent-runner/internal/metrics"
+)
+
+// Labels set on every agent container, read back when adopting it.
+const (
+	labelAgentURL    = "agent-host.url"
+	labelReplica     = "agent-host.replica"
+	labelAgentID     = "agent-host.agent-id"
+	labelMetadataURI = "agent-host.metadata-uri"
+)
+
+// adoptReadinessTimeoutSec bounds the readiness check of an adopted container,
+// which is already running and should answer at once.
+const adoptReadinessTimeoutSec = 5
+
+// containerNamePattern matches agent-<version hash>-<replica>.
+var containerNamePattern = regexp.MustCompile(`^agent-([0-9a-f]+)-(\d+)$`)
+
+// AdoptContainers registers the agent containers a previous runner left
+// running, so a restart does not cold-start every agent. A container is
+// adopted if its name and labels are intact, it still runs the image its tag
+// points to, it is reachable the way this runner is configured to reach
+// containers, and it passes its readiness check. Anything else is removed.
+// It returns the number of adopted containers.
+func (m *Manager) AdoptContainers(ctx context.Context) (int, error) {
+	containers, err := m.client.ContainerList(ctx, container.ListOptions{
+		Filters: filters.NewArgs(filters.Arg("label", labelVersionHash)),
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to list containers: %w", err)
+	}
+
+	adopted := 0
+	for _, ctr := range containers {
+		info, err := m.adoptContainer(ctx, ctr.ID)
+		if err == nil {
+			adopted++
+			metrics.ContainerOperationsTotal.WithLabelValues(info.URL, "adopt", "success").Inc()
+			continue
+		}
+
+		agentURL := ctr.Labels[labelAgentURL]
+		metrics.ContainerOperationsTotal.WithLabelValues(agentURL, "adopt", "error").Inc()
+		slog.Warn("Not adopting container, removing it",
+			"agent_url", agentURL,
+			"container_id", ctr.ID[:12],
+			"names", ctr.Names,
+			"error", err,
+		)
+		if err := m.client.ContainerRemove(ctx, ctr.ID, container.RemoveOptions{Force: true}); err != nil {
+			slog.Error("Failed to remove container", "container_id", ctr.ID[:12], "error", err)
+		}
+	}
+
+	slog.Info("Adopted running agent containers", "adopted", adopted, "found", len(containers))
+	return adopted, nil
+}
+
+// adoptContainer verifies a running container and registers it as a replica.
+func (m *Manager) adoptContainer(ctx context.Context, containerID string) (*ContainerInfo, error) {
+	containerJSON, err := m.client.ContainerInspect(ctx, containerID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to inspect container: %w", err)
+	}
+	if containerJSON.State == nil || !containerJSON.State.Running {
+		return nil, fmt.Errorf("container is not running")
+	}
+	if containerJSON.Config == nil || containerJSON.HostConfig == nil {
+		return nil, fmt.Errorf("container has no configuration")
+	}
+
+	// Name and labels must agree with each other
+	name := strings.TrimPrefix(containerJSON.Name, "/")
+	match := containerNamePattern.FindStringSubmatch(name)
+	if match == nil {
+		return nil, fmt.Errorf("unexpected container name %q", name)
+	}
+	labels := containerJSON.Config.Labels
+	versionHash := labels[labelVersionHash]
+	agentURL := labels[labelAgentURL]
+	if versionHash != match[1] || labels[labelReplica] != match[2] {
+		return nil, fmt.Errorf("container name %q does not match its labels", name)
+	}
+	if agentURL == "" {
+		return nil, fmt.Errorf("container has no %s label", labelAgentURL)
+	}
+	replica, _ := strconv.Atoi(match[2])
+
+	// The image tag must still point at the image the container runs
+	imageName := containerJSON.Config.Image
+	image, _, err := m.client.ImageInspectWithRaw(ctx, imageName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to inspect image %s: %w", imageName, err)
+	}
+	if image.ID != containerJSON.Image {
+		return nil, fmt.Errorf("image %s was replaced since the container started", imageName)
+	}
+
+	runtime := m.resolveRuntime(Agent{ID: labels[labelAgentID], URL: agentURL})
+	if runtime != "" && containerJSON.HostConfig.Runtime != runtime {
+		return nil, fmt.Errorf("container runs on runtime %q, want %q", containerJSON.HostConfig.Runtime, runtime)
+	}
+	if m.sandboxNetwork != nil {
+		if containerJSON.NetworkSettings == nil || containerJSON.NetworkSettings.Networks[m.sandboxNetwork.Name] == nil {
+			return nil, fmt.Errorf("container is not attached to network %s", m.sandboxNetwork.Name)
+		}
+	}
+
+	if m.sandboxNetwork != nil && (m.sandboxNetwork.CABundle != "") != trustsSandboxCA(containerJSON.Config.Env) {
+		return nil, fmt.Errorf("container trust store does not match the proxy's TLS interception mode")
+	}
+
+	stateDir, err := m.adoptedStateDir(containerJSON)
+	if err != nil {
+		return nil, err
+	}
+
+	hostPort := 0
+	if !m.useContainerIP {
+		hostPort, err = m.adoptedPort(containerJSON)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	agent := Agent{
+		ID:          labels[labelAgentID],
+		URL:         agentURL,
+		MetadataURI: labels[labelMetadataURI],
+	}
+	var imageLabels map[string]string
+	if image.Config != nil {
+		imageLabels = image.Config.Labels
+	}
+	metadata, err := m.getMetadata(ctx, agent)
+	if err != nil {
+		slog.Warn("Failed to load agent metadata, using default health check",
+			"agent_id", agent.ID,
+			"metadata_uri", agent.MetadataURI,
+			"error", err,
+		)
+	}
+	info := &ContainerInfo{
+		ContainerID: containerJSON.ID,
+		Name:        name,
+		Port:        hostPort,
+		URL:         agentURL,
+		VersionHash: versionHash,
+		Limits:      limitsFromHostConfig(containerJSON.HostConfig),
+		Health:      m.resolveHealthCheck(imageLabels, metadata),
+		stateDir:    stateDir,
+		sandboxIP:   m.endpointIP(containerJSON),
+		sandboxIP6:  m.endpointIP6(containerJSON),
+		egress:      m.declaredEgress(agent, metadata),
+		proxyToken:  proxyTokenFromEnv(containerJSON.Config.Env),
+	}
+	info.touch()
+
+	addr, err := m.containerAddr(ctx, info)
+	if err != nil {
+		return nil, err
+	}
+	info.Addr = addr
+
+	health := info.Health
+	health.StartupTimeoutSec = adoptReadinessTimeoutSec
+	if err := m.waitForContainerReady(ctx, addr, health); err != nil {
+		return nil, err
+	}
+	info.Protocol = m.negotiateProtocol(ctx, addr, imageLabels)
+
+	if hostPort > 0 {
+		m.ports.Reserve(hostPort)
+	}
+	m.streamContainerLogs(info.ContainerID, name, versionHash, agentURL, time.Now())
+
+	m.containersMutex.Lock()
+	set, exists := m.runningContainers[versionHash]
+	if !exists {
+		set = newReplicaSet(agent, versionHash)
+		m.runningContainers[versionHash] = set
+	}
+	set.imageName = imageName
+	set.nextReplica = max(set.nextReplica, replica+1)
+	set.replicas = append(set.replicas, info)
+	metrics.ContainersActive.WithLabelValues(agentURL).Inc()
+	m.containersMutex.Unlock()
+
+	metrics.AgentHealthy.WithLabelValues(agentURL).Set(1)
+	slog.Info("Adopted container",
+		"container_id", info.ContainerID[:12],
+		"agent_url", agentURL,
+		"version", versionHash,
+		"replica", replica,
+		"addr", addr,
+		"image", imageName,
+		"protocol", info.Protocol,
+	)
+	return info, nil
+}
+
+// adoptedPort returns the host port a container's agent port is bound to.
+func (m *Manager) adoptedPort(containerJSON types.ContainerJSON) (int, error) {
+	if containerJSON.NetworkSettings != nil {
+		for _, binding := range containerJSON.NetworkSettings.Ports["80/tcp"] {
+			if binding.HostIP != m.bindIP {
+				continue
+			}
+			if port, err := strconv.Atoi(binding.HostPort); err == nil && port > 0 {
+				return port, nil
+			}
+		}
+	}
+	return 0, fmt.Errorf("container has no host port bound on %s", m.bindIP)
+}
+
+// adoptedStateDir returns the host state directory of a container started in
+// determinism mode. Containers must have been started in the current mode.
+func (m *Manager) adoptedStateDir(containerJSON types.ContainerJSON) (string, error) {
+	var stateDir string
+	for _, mnt := range containerJSON.Mounts {
+		if mnt.Destination == containerStateDir {
+			stateDir = mnt.Source
+		}
+	}
+	switch {
+	case m.determinism.Enabled && stateDir == "":
+		return "", fmt.Errorf("container was started without determinism mode")
+	case !m.determinism.Enabled && stateDir != "":
+		return "", fmt.Errorf("container was started in determinism mode")
+	}
+	return stateDir, nil
+}
+
+// limitsFromHostConfig reads back the resource limits a container was created with.
+func limitsFromHostConfig(hostConfig *container.HostConfig) ResourceLimits {
+	limits := ResourceLimits{
+		MemoryMB: hostConfig.Memory / (1024 * 1024),
+		CPUs:     float64(hostConfig.NanoCPUs) / 1e9,
+	}
+	if hostConfig.PidsLimit != nil {
+		limits.PidsLimit = *hostConfig.PidsLimit
+	}
+	if size, ok := hostConfig.StorageOpt["size"]; ok {
+		limits.DiskMB, _ = strconv.ParseInt(strings.TrimSuffix(size, "M"), 10, 64)
+	}
+	return limits
+}
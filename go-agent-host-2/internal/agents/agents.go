@@ -8,6 +8,7 @@ import (
 	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
@@ -15,29 +16,62 @@ import (
 	"os"
 	"path/filepath"
 	"regexp"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/mount"
 	"github.com/docker/docker/api/types/network"
-	"github.com/docker/docker/client"
+	"github.com/docker/docker/errdefs"
 	"github.com/docker/go-connections/nat"
+	"github.com/somnia-chain/agent-runner/internal/engine"
 	"github.com/somnia-chain/agent-runner/internal/metrics"
+	"github.com/somnia-chain/agent-runner/internal/sandbox"
 )
 
 // ContainerInfo holds information about a running container.
 type ContainerInfo struct {
 	ContainerID string
-	Port        int
+	Name        string
+	Port        int    // Host port, 0 when reached on the container IP
+	Addr        string // host:port used to reach the container
 	URL         string
+	VersionHash string
+	Limits      ResourceLimits
+	Health      HealthCheck
+	Protocol    int // Negotiated execution protocol version
+
+	inFlight         atomic.Int64 // Requests currently being handled by this replica
+	lastUsed         atomic.Int64 // Unix nanoseconds of the last request start or finish
+	throttledPeriods uint64       // Last sampled CPU throttled periods
+	lastProbe        time.Time    // Last liveness probe start (health monitor only)
+	probeFailures    int          // Consecutive liveness probe failures
+	probing          atomic.Bool  // A liveness probe is in progress
+	killSignal       string       // Last signal Docker sent the container (guarded by containersMutex)
+	surplus          bool         // Started beyond MaxReplicas to exclude another replica (guarded by containersMutex)
+	oomRecorded      atomic.Bool  // The container's OOM kill was counted
+	stateDir         string       // Host directory with clock and seed files (determinism mode)
+	sandboxIP        string       // Address on the sandbox network, used to identify proxy clients
+	sandboxIP6       string       // IPv6 address on a dual-stack sandbox network
+	egress           []string     // Egress destinations declared in the agent's metadata
+	proxyToken       string       // Sandbox proxy password, with the container name as user
+	execMu           sync.Mutex   // Serializes requests while the state files are in use
+	requestsMu       sync.Mutex   // Guards requests
+	requests         []string     // In-flight request IDs, to attribute proxy requests
 }
 
 // Response represents the response from forwarding to an agent.
 type Response struct {
-	Status  int
-	Body    []byte
-	Receipt map[string]interface{}
+	Status   int
+	Body     []byte
+	Receipt  map[string]interface{}
+	Success  bool           // Whether the agent reported success
+	Error    *ProtocolError // Why the agent failed (v1 agents, or set by the runner)
+	Protocol int            // Protocol version the agent spoke
+	Replica  string         // Name of the container that handled the request
 }
 
 // versionCacheEntry holds a cached version hash with expiry time.
@@ -52,46 +86,77 @@ type SandboxNetworkConfig struct {
 	Gateway      string // Gateway IP on host (e.g., "172.30.0.1")
 	ProxyPort    int    // Proxy port (e.g., 3128)
 	LLMProxyPort int    // LLM proxy port (e.g., 11434), 0 = disabled
+	DNS          bool   // Containers resolve names through the sandbox DNS server on the gateway
+	CABundle     string // Host path of the trust store with the proxy's MITM CA ("" = not injected)
 }
 
-// Manager manages Docker containers for agents.
+// Manager manages agent containers on a container engine.
 type Manager struct {
-	client            *client.Client
-	runningContainers map[string]*ContainerInfo
+	client            engine.Runtime
+	runningContainers map[string]*replicaSet // Keyed by version hash
 	containersMutex   sync.RWMutex
-	nextPort          int
-	portMutex         sync.Mutex
+	pendingStarts     int            // Replicas being started, counted against MaxContainers (guarded by containersMutex)
+	ports             *portAllocator // Host port allocation for container bindings
+	bindIP            string         // Host IP container ports are bound to
+	useContainerIP    bool           // Reach containers on their sandbox-network IP instead of host ports
 	imageCacheDir     string
 	containerRuntime  string
 	startingMutex     sync.Map // Prevents concurrent starts of same container
 	httpClient        *http.Client
+	agentClient       *http.Client // Requests to agent containers; bounded by the caller's context
 	versionCache      map[string]*versionCacheEntry
 	versionCacheMutex sync.RWMutex
 	versionCacheTTL   time.Duration
 	versionFetchMutex sync.Map              // Prevents concurrent HEAD requests for same URL
 	sandboxNetwork    *SandboxNetworkConfig // Sandbox network configuration (nil = no sandbox network)
 	agentRegistryAddr string                // AgentRegistry contract address for containers
+
+	resourceDefaults   ResourceLimits  // Default container limits from flags
+	resourcePolicy     *ResourcePolicy // Operator resource policy (nil = flags only)
+	healthDefaults     HealthCheck     // Health check for agents that declare none
+	maxResultSize      int             // Largest agent result accepted, in bytes
+	determinism        DeterminismConfig
+	logs               *logCaptures          // Per-request container log capture
+	egressPolicy       *sandbox.EgressPolicy // Sandbox proxy egress policy (nil = unrestricted)
+	egressCache        *sandbox.EgressCache  // Sandbox proxy record/replay cache (nil = disabled)
+	proxyAuthRequired  bool                  // Reject sandbox proxy requests without credentials
+	metadataCache      map[string]*metadataCacheEntry
+	metadataCacheMutex sync.RWMutex
+	metadataCacheTTL   time.Duration
+
+	pool     PoolConfig     // Replica pool and autoscaling configuration
+	eviction EvictionConfig // Idle reaping and eviction configuration
+	stopCh   chan struct{}  // Closed on Cleanup to stop background loops
 }
 
-// NewManager creates a new Manager with a pre-existing Docker client.
-// Use this when the Docker client has already been created (e.g., by startup checks).
-func NewManager(dockerClient *client.Client, cacheDir string, startPort int, runtime string) *Manager {
+// NewManager creates a new Manager on a connected container engine.
+// Use this when the engine has already been connected (e.g., by startup checks).
+func NewManager(rt engine.Runtime, cacheDir string, startPort int, runtime string) *Manager {
 	return &Manager{
-		client:            dockerClient,
-		runningContainers: make(map[string]*ContainerInfo),
-		nextPort:          startPort,
+		client:            rt,
+		runningContainers: make(map[string]*replicaSet),
+		ports:             newPortAllocator(startPort, startPort+9999, "127.0.0.1"),
+		bindIP:            "127.0.0.1",
 		imageCacheDir:     cacheDir,
 		containerRuntime:  runtime,
 		httpClient: &http.Client{
 			Timeout: 60 * time.Second,
 		},
-		versionCache:    make(map[string]*versionCacheEntry),
-		versionCacheTTL: 30 * time.Second,
+		agentClient:      &http.Client{},
+		versionCache:     make(map[string]*versionCacheEntry),
+		versionCacheTTL:  30 * time.Second,
+		metadataCache:    make(map[string]*metadataCacheEntry),
+		metadataCacheTTL: 5 * time.Minute,
+		pool:             DefaultPoolConfig(),
+		healthDefaults:   DefaultHealthCheck(),
+		maxResultSize:    DefaultMaxResultSize,
+		logs:             newLogCaptures(DefaultLogCaptureConfig()),
+		stopCh:           make(chan struct{}),
 	}
 }
 
-// Client returns the underlying Docker client.
-func (m *Manager) Client() *client.Client {
+// Client returns the underlying container engine.
+func (m *Manager) Client() engine.Runtime {
 	return m.client
 }
 
@@ -114,15 +179,46 @@ func (m *Manager) SetSandboxNetwork(networkName, gatewayIP string, proxyPort, ll
 	)
 }
 
+// SetSandboxDNS makes containers use the sandbox DNS server on the gateway
+// as their resolver. Call after SetSandboxNetwork.
+func (m *Manager) SetSandboxDNS(enabled bool) {
+	if m.sandboxNetwork != nil {
+		m.sandboxNetwork.DNS = enabled
+	}
+}
+
+// SetSandboxCA makes containers trust the sandbox proxy's MITM CA by
+// mounting bundlePath, an absolute host path, as their trust store. Call
+// after SetSandboxNetwork.
+func (m *Manager) SetSandboxCA(bundlePath string) {
+	if m.sandboxNetwork != nil {
+		m.sandboxNetwork.CABundle = bundlePath
+	}
+}
+
 // SetAgentRegistryAddress configures the AgentRegistry contract address for containers.
 func (m *Manager) SetAgentRegistryAddress(addr string) {
 	m.agentRegistryAddr = addr
 	slog.Info("AgentRegistry address configured for containers", "address", addr)
 }
 
+// SetResourceLimits configures the default container resource limits and an
+// optional operator policy with per-agent overrides.
+func (m *Manager) SetResourceLimits(defaults ResourceLimits, policy *ResourcePolicy) {
+	m.resourceDefaults = defaults
+	m.resourcePolicy = policy
+	slog.Info("Container resource limits configured",
+		"memory_mb", defaults.MemoryMB,
+		"cpus", defaults.CPUs,
+		"pids_limit", defaults.PidsLimit,
+		"disk_mb", defaults.DiskMB,
+		"policy", policy != nil,
+	)
+}
+
 // getVersionHash fetches HEAD from URL and creates a version hash from the response headers.
 // Results are cached for versionCacheTTL to avoid redundant HEAD requests.
-func (m *Manager) getVersionHash(agentURL string) (string, error) {
+func (m *Manager) getVersionHash(ctx context.Context, agentURL string) (string, error) {
 	// Check cache first
 	m.versionCacheMutex.RLock()
 	if entry, exists := m.versionCache[agentURL]; exists && time.Now().Before(entry.expiresAt) {
@@ -137,7 +233,11 @@ func (m *Manager) getVersionHash(agentURL string) (string, error) {
 	actual, loaded := m.versionFetchMutex.LoadOrStore(agentURL, fetchChan)
 	if loaded {
 		// Another goroutine is fetching, wait for it
-		<-actual.(chan struct{})
+		select {
+		case <-actual.(chan struct{}):
+		case <-ctx.Done():
+			return "", ctx.Err()
+		}
 		// Check cache again - should be populated now
 		m.versionCacheMutex.RLock()
 		if entry, exists := m.versionCache[agentURL]; exists {
@@ -160,7 +260,7 @@ func (m *Manager) getVersionHash(agentURL string) (string, error) {
 	}
 	m.versionCacheMutex.RUnlock()
 
-	req, err := http.NewRequest("HEAD", agentURL, nil)
+	req, err := http.NewRequestWithContext(ctx, "HEAD", agentURL, nil)
 	if err != nil {
 		return "", fmt.Errorf("failed to create HEAD request: %w", err)
 	}
@@ -204,7 +304,8 @@ func (m *Manager) getVersionHash(agentURL string) (string, error) {
 }
 
 // downloadImage downloads a container image from a URL.
-func (m *Manager) downloadImage(agentURL, versionHash string) (string, error) {
+// The download is abandoned if ctx is cancelled.
+func (m *Manager) downloadImage(ctx context.Context, agentURL, versionHash string) (string, error) {
 	start := time.Now()
 
 	if err := os.MkdirAll(m.imageCacheDir, 0755); err != nil {
@@ -226,7 +327,7 @@ func (m *Manager) downloadImage(agentURL, versionHash string) (string, error) {
 		"destination", filePath,
 	)
 
-	req, err := http.NewRequest("GET", agentURL, nil)
+	req, err := http.NewRequestWithContext(ctx, "GET", agentURL, nil)
 	if err != nil {
 		metrics.ImageDownloadsTotal.WithLabelValues(agentURL, "error").Inc()
 		slog.Error("Image download failed: cannot create HTTP request",
@@ -285,6 +386,8 @@ func (m *Manager) downloadImage(agentURL, versionHash string) (string, error) {
 
 	bytesWritten, err := io.Copy(file, resp.Body)
 	if err != nil {
+		// Don't leave a truncated tar behind
+		os.Remove(filePath)
 		metrics.ImageDownloadsTotal.WithLabelValues(agentURL, "error").Inc()
 		slog.Error("Image download failed: write error",
 			"url", agentURL,
@@ -310,7 +413,7 @@ func (m *Manager) downloadImage(agentURL, versionHash string) (string, error) {
 }
 
 // loadImage loads a Docker image from a tar file.
-func (m *Manager) loadImage(tarPath string) (string, error) {
+func (m *Manager) loadImage(ctx context.Context, tarPath string) (string, error) {
 	start := time.Now()
 
 	// Get file info for logging
@@ -338,7 +441,6 @@ func (m *Manager) loadImage(tarPath string) (string, error) {
 	}
 	defer file.Close()
 
-	ctx := context.Background()
 	resp, err := m.client.ImageLoad(ctx, file, true)
 	if err != nil {
 		slog.Error("Image load failed: Docker ImageLoad error",
@@ -389,7 +491,8 @@ func (m *Manager) loadImage(tarPath string) (string, error) {
 }
 
 // streamContainerLogs starts a goroutine that streams container logs to slog.
-func (m *Manager) streamContainerLogs(containerID, versionHash, agentURL string) {
+// Lines written before since are skipped unless since is zero.
+func (m *Manager) streamContainerLogs(containerID, containerName, versionHash, agentURL string, since time.Time) {
 	go func() {
 		ctx := context.Background()
 		options := container.LogsOptions{
@@ -398,6 +501,9 @@ func (m *Manager) streamContainerLogs(containerID, versionHash, agentURL string)
 			Follow:     true,
 			Timestamps: true,
 		}
+		if !since.IsZero() {
+			options.Since = since.Format(time.RFC3339Nano)
+		}
 
 		logs, err := m.client.ContainerLogs(ctx, containerID, options)
 		if err != nil {
@@ -429,43 +535,42 @@ func (m *Manager) streamContainerLogs(containerID, versionHash, agentURL string)
 					return
 				}
 
-				line := strings.TrimSpace(string(payload))
-				if line != "" {
-					if streamType == 2 {
-						slog.Error("Container stderr", "version", versionHash, "agent_url", agentURL, "message", line)
-					} else {
-						slog.Info("Container stdout", "version", versionHash, "agent_url", agentURL, "message", line)
-					}
+				stream := "stdout"
+				if streamType == 2 {
+					stream = "stderr"
 				}
+				m.logContainerLine(containerID, containerName, versionHash, agentURL, stream, string(payload))
 			}
 		}
 	}()
 }
 
 // waitForContainerReady waits for a container to be ready to accept requests.
-func (m *Manager) waitForContainerReady(port int, maxAttempts int, delayMs int) error {
+// Readiness is polled once per second for up to the startup timeout.
+func (m *Manager) waitForContainerReady(ctx context.Context, addr string, hc HealthCheck) error {
+	maxAttempts := hc.StartupTimeoutSec
+	delayMs := 1000
 	slog.Info("Waiting for container readiness",
-		"port", port,
+		"addr", addr,
+		"path", hc.ReadinessPath,
 		"max_attempts", maxAttempts,
 		"delay_ms", delayMs,
 	)
 
 	client := &http.Client{
-		Timeout: 2 * time.Second,
+		Timeout: time.Duration(hc.TimeoutSec) * time.Second,
 	}
 
 	var lastError error
 	consecutiveConnectionRefused := 0
 
 	for attempt := 1; attempt <= maxAttempts; attempt++ {
-		url := fmt.Sprintf("http://localhost:%d/", port)
-		resp, err := client.Get(url)
+		statusCode, err := probeContainer(ctx, client, addr, hc.ReadinessPath)
 		if err == nil {
-			resp.Body.Close()
 			slog.Info("Container ready",
-				"port", port,
+				"addr", addr,
 				"attempts", attempt,
-				"status_code", resp.StatusCode,
+				"status_code", statusCode,
 			)
 			return nil
 		}
@@ -484,7 +589,7 @@ func (m *Manager) waitForContainerReady(port int, maxAttempts int, delayMs int)
 		// Log every 5 attempts to avoid spam
 		if attempt%5 == 0 || attempt == 1 {
 			slog.Debug("Container readiness check failed",
-				"port", port,
+				"addr", addr,
 				"attempt", attempt,
 				"max_attempts", maxAttempts,
 				"error", errStr,
@@ -494,7 +599,7 @@ func (m *Manager) waitForContainerReady(port int, maxAttempts int, delayMs int)
 		// If we get many consecutive connection refused errors, warn early
 		if consecutiveConnectionRefused >= 5 && attempt < maxAttempts {
 			slog.Warn("Container readiness: persistent connection refused - container may be listening on 127.0.0.1 instead of 0.0.0.0",
-				"port", port,
+				"addr", addr,
 				"attempts", attempt,
 				"consecutive_refused", consecutiveConnectionRefused,
 			)
@@ -504,86 +609,124 @@ func (m *Manager) waitForContainerReady(port int, maxAttempts int, delayMs int)
 			return fmt.Errorf("container did not become ready after %d attempts: %w", maxAttempts, lastError)
 		}
 
-		time.Sleep(time.Duration(delayMs) * time.Millisecond)
+		select {
+		case <-time.After(time.Duration(delayMs) * time.Millisecond):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
 	}
 
 	return nil
 }
 
-// stopContainer stops and removes a container by version hash.
-func (m *Manager) stopContainer(versionHash string) error {
-	m.containersMutex.Lock()
-	info, exists := m.runningContainers[versionHash]
-	if !exists {
-		m.containersMutex.Unlock()
-		return nil
-	}
-	agentURL := info.URL
-	delete(m.runningContainers, versionHash)
-	metrics.ContainersActive.WithLabelValues(agentURL).Dec()
-	m.containersMutex.Unlock()
-
+// stopReplica stops and removes a single replica container.
+// The caller must have already removed it from its replica set.
+func (m *Manager) stopReplica(info *ContainerInfo) error {
 	ctx := context.Background()
-	slog.Info("Stopping container", "version", versionHash)
+	slog.Info("Stopping container", "version", info.VersionHash, "name", info.Name)
 
 	timeout := 10
 	if err := m.client.ContainerStop(ctx, info.ContainerID, container.StopOptions{Timeout: &timeout}); err != nil {
-		slog.Warn("Failed to stop container", "version", versionHash, "error", err)
+		slog.Warn("Failed to stop container", "version", info.VersionHash, "name", info.Name, "error", err)
 	}
 
 	if err := m.client.ContainerRemove(ctx, info.ContainerID, container.RemoveOptions{Force: true}); err != nil {
-		slog.Error("Failed to remove container", "version", versionHash, "error", err)
-		metrics.ContainerOperationsTotal.WithLabelValues(agentURL, "stop", "error").Inc()
+		slog.Error("Failed to remove container", "version", info.VersionHash, "name", info.Name, "error", err)
+		metrics.ContainerOperationsTotal.WithLabelValues(info.URL, "stop", "error").Inc()
 		return err
 	}
+	if info.Port > 0 {
+		m.ports.Release(info.Port)
+	}
+	if info.stateDir != "" {
+		os.RemoveAll(info.stateDir)
+	}
 
-	metrics.ContainerOperationsTotal.WithLabelValues(agentURL, "stop", "success").Inc()
-	slog.Info("Removed container", "version", versionHash)
+	metrics.ContainerOperationsTotal.WithLabelValues(info.URL, "stop", "success").Inc()
+	slog.Info("Removed container", "version", info.VersionHash, "name", info.Name)
 	return nil
 }
 
-// EnsureRunning ensures a container is running for the given agent URL and version.
-func (m *Manager) EnsureRunning(agentURL string) (int, bool, error) {
-	start := time.Now()
+// stopContainer stops and removes all replicas of a version hash.
+func (m *Manager) stopContainer(versionHash string) error {
+	m.containersMutex.Lock()
+	set, exists := m.runningContainers[versionHash]
+	if !exists {
+		m.containersMutex.Unlock()
+		return nil
+	}
+	delete(m.runningContainers, versionHash)
+	replicas := set.replicas
+	set.replicas = nil
+	for range replicas {
+		metrics.ContainersActive.WithLabelValues(set.agent.URL).Dec()
+	}
+	m.containersMutex.Unlock()
 
-	versionHash, err := m.getVersionHash(agentURL)
+	var firstErr error
+	for _, info := range replicas {
+		if err := m.stopReplica(info); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// removeDeadReplica drops a replica that is no longer running from its set.
+// The caller starts a replacement itself.
+func (m *Manager) removeDeadReplica(info *ContainerInfo) {
+	m.handleContainerExit(info, -1, false)
+}
+
+// EnsureRunning ensures at least one container replica is running for the
+// given agent and version, and returns the port of the least-loaded replica.
+// A cold start is abandoned if ctx is cancelled.
+func (m *Manager) EnsureRunning(ctx context.Context, agent Agent) (int, bool, error) {
+	info, newlyStarted, err := m.ensureReplica(ctx, agent)
 	if err != nil {
 		return 0, false, err
 	}
+	return info.Port, newlyStarted, nil
+}
 
-	// Check if already running this exact version
-	m.containersMutex.RLock()
-	info, exists := m.runningContainers[versionHash]
-	m.containersMutex.RUnlock()
+// ensureReplica returns the least-loaded running replica for the agent,
+// cold-starting the first replica inline if none is running.
+func (m *Manager) ensureReplica(ctx context.Context, agent Agent) (*ContainerInfo, bool, error) {
+	agentURL := agent.URL
 
-	if exists {
-		ctx := context.Background()
-		containerJSON, err := m.client.ContainerInspect(ctx, info.ContainerID)
-		if err == nil && containerJSON.State.Running {
-			slog.Debug("Container already running", "version", versionHash, "port", info.Port)
-			return info.Port, false, nil
-		}
-		m.containersMutex.Lock()
-		delete(m.runningContainers, versionHash)
-		metrics.ContainersActive.WithLabelValues(agentURL).Dec()
-		m.containersMutex.Unlock()
+	versionHash, err := m.getVersionHash(ctx, agentURL)
+	if err != nil {
+		return nil, false, err
 	}
 
-	// Prevent concurrent container starts for the same version
+	// Check if already running this exact version
+	if info := m.liveReplica(versionHash); info != nil {
+		return info, false, nil
+	}
+
+	// Prevent concurrent cold starts for the same version
 	// Use a channel as a mutex per versionHash
 	startChan := make(chan struct{})
 	actual, loaded := m.startingMutex.LoadOrStore(versionHash, startChan)
 	if loaded {
 		// Another goroutine is already starting this container, wait for it
-		<-actual.(chan struct{})
+		select {
+		case <-actual.(chan struct{}):
+		case <-ctx.Done():
+			return nil, false, ctx.Err()
+		}
 		// Now check if the container is running
 		m.containersMutex.RLock()
-		info, exists := m.runningContainers[versionHash]
-		m.containersMutex.RUnlock()
+		set, exists := m.runningContainers[versionHash]
+		var info *ContainerInfo
 		if exists {
-			return info.Port, false, nil
+			info = set.leastLoaded()
 		}
-		return 0, false, fmt.Errorf("concurrent container start failed for %s", versionHash)
+		m.containersMutex.RUnlock()
+		if info != nil {
+			return info, false, nil
+		}
+		return nil, false, fmt.Errorf("concurrent container start failed for %s", versionHash)
 	}
 	// We're the one starting this container, clean up when done
 	defer func() {
@@ -592,23 +735,24 @@ func (m *Manager) EnsureRunning(agentURL string) (int, bool, error) {
 	}()
 
 	// Double-check after acquiring start lock
-	m.containersMutex.RLock()
-	info, exists = m.runningContainers[versionHash]
-	m.containersMutex.RUnlock()
-	if exists {
-		ctx := context.Background()
-		containerJSON, err := m.client.ContainerInspect(ctx, info.ContainerID)
-		if err == nil && containerJSON.State.Running {
-			slog.Debug("Container already running (after lock)", "version", versionHash, "port", info.Port)
-			return info.Port, false, nil
+	if info := m.liveReplica(versionHash); info != nil {
+		slog.Debug("Container already running (after lock)", "version", versionHash, "port", info.Port)
+		return info, false, nil
+	}
+
+	// Don't hammer an agent that keeps crashing
+	if delay := m.crashLoopDelay(versionHash); delay > 0 {
+		if exit, ok := m.lastExit(versionHash); ok {
+			return nil, false, fmt.Errorf("%w for %s (retry in %s, last %s)", ErrCrashLoopBackoff, agentURL, delay.Round(time.Second), exit)
 		}
+		return nil, false, fmt.Errorf("%w for %s (retry in %s)", ErrCrashLoopBackoff, agentURL, delay.Round(time.Second))
 	}
 
 	// Check if there's an old version running for this URL and stop it
 	m.containersMutex.RLock()
 	var hashesToStop []string
-	for hash, info := range m.runningContainers {
-		if info.URL == agentURL && hash != versionHash {
+	for hash, set := range m.runningContainers {
+		if set.agent.URL == agentURL && hash != versionHash {
 			hashesToStop = append(hashesToStop, hash)
 		}
 	}
@@ -619,26 +763,124 @@ func (m *Manager) EnsureRunning(agentURL string) (int, bool, error) {
 		m.stopContainer(hash)
 	}
 
+	info, err := m.startReplica(ctx, agent, versionHash)
+	if err != nil {
+		return nil, false, err
+	}
+	return info, true, nil
+}
+
+// liveReplica returns the least-loaded replica of a version after verifying
+// it is still running. Replicas whose container is gone or stopped are dropped
+// and the next one is tried; if the engine cannot be asked, the replica is kept.
+func (m *Manager) liveReplica(versionHash string) *ContainerInfo {
+	for {
+		m.containersMutex.RLock()
+		set, exists := m.runningContainers[versionHash]
+		var info *ContainerInfo
+		if exists {
+			info = set.leastLoaded()
+		}
+		m.containersMutex.RUnlock()
+
+		if info == nil {
+			return nil
+		}
+
+		containerJSON, err := m.client.ContainerInspect(context.Background(), info.ContainerID)
+		if err == nil && containerJSON.State != nil && containerJSON.State.Running {
+			slog.Debug("Container already running", "version", versionHash, "port", info.Port)
+			return info
+		}
+		if err != nil && !errdefs.IsNotFound(err) {
+			// A slow or restarting engine says nothing about the container
+			slog.Warn("Failed to inspect container, keeping replica",
+				"version", versionHash,
+				"name", info.Name,
+				"error", err,
+			)
+			return info
+		}
+		m.removeDeadReplica(info)
+	}
+}
+
+// imageFor returns the loaded image name for a version, downloading and
+// loading the image if no replica of this version has done so yet.
+func (m *Manager) imageFor(ctx context.Context, agentURL, versionHash string) (string, error) {
+	m.containersMutex.RLock()
+	if set, exists := m.runningContainers[versionHash]; exists && set.imageName != "" {
+		imageName := set.imageName
+		m.containersMutex.RUnlock()
+		return imageName, nil
+	}
+	m.containersMutex.RUnlock()
+
 	// Download and load the image
-	tarPath, err := m.downloadImage(agentURL, versionHash)
+	tarPath, err := m.downloadImage(ctx, agentURL, versionHash)
 	if err != nil {
-		return 0, false, err
+		return "", err
 	}
 
-	imageName, err := m.loadImage(tarPath)
+	imageName, err := m.loadImage(ctx, tarPath)
 	if err != nil {
-		return 0, false, err
+		return "", err
 	}
 	slog.Info("Loaded image", "name", imageName)
+	return imageName, nil
+}
 
-	// Allocate port
-	m.portMutex.Lock()
-	hostPort := m.nextPort
-	m.nextPort++
-	m.portMutex.Unlock()
+// startReplica starts a new container replica for an agent version, waits
+// for it to become ready and registers it in the version's replica set.
+// Docker calls and the readiness wait are bound to ctx; a replica abandoned
+// after its container was created is stopped again.
+func (m *Manager) startReplica(ctx context.Context, agent Agent, versionHash string) (*ContainerInfo, error) {
+	start := time.Now()
+	agentURL := agent.URL
 
-	containerName := fmt.Sprintf("agent-%s", versionHash)
-	ctx := context.Background()
+	imageName, err := m.imageFor(ctx, agentURL, versionHash)
+	if err != nil {
+		return nil, err
+	}
+
+	// Resolve resource limits from flags, operator policy and agent metadata
+	metadata, err := m.getMetadata(ctx, agent)
+	if err != nil {
+		slog.Warn("Failed to load agent metadata, using default resource limits",
+			"agent_id", agent.ID,
+			"metadata_uri", agent.MetadataURI,
+			"error", err,
+		)
+	}
+	limits := m.resolveLimits(agent, metadata)
+	labels := m.imageLabels(ctx, imageName)
+	health := m.resolveHealthCheck(labels, metadata)
+
+	// Make room under the global container cap until the replica is registered
+	if err := m.reserveCapacity(); err != nil {
+		metrics.ContainerOperationsTotal.WithLabelValues(agentURL, "start", "error").Inc()
+		return nil, err
+	}
+	registered := false
+	defer func() {
+		if !registered {
+			m.releaseCapacity()
+		}
+	}()
+
+	// Reserve a replica slot so concurrent scale-ups pick distinct names
+	m.containersMutex.Lock()
+	set, exists := m.runningContainers[versionHash]
+	if !exists {
+		set = newReplicaSet(agent, versionHash)
+		m.runningContainers[versionHash] = set
+	}
+	set.imageName = imageName
+	replica := set.nextReplica
+	set.nextReplica++
+	m.containersMutex.Unlock()
+
+	containerName := fmt.Sprintf("agent-%s-%d", versionHash, replica)
 
 	// Cleanup orphaned container if exists
 	if existingContainer, err := m.client.ContainerInspect(ctx, containerName); err == nil {
@@ -646,13 +888,26 @@ func (m *Manager) EnsureRunning(agentURL string) (int, bool, error) {
 		m.client.ContainerRemove(ctx, existingContainer.ID, container.RemoveOptions{Force: true})
 	}
 
-	slog.Info("Starting container", "agent_url", agentURL, "version", versionHash, "port", hostPort)
-
-	hostPortStr := fmt.Sprintf("%d", hostPort)
+	slog.Info("Starting container",
+		"agent_url", agentURL,
+		"version", versionHash,
+		"replica", replica,
+		"memory_mb", limits.MemoryMB,
+		"cpus", limits.CPUs,
+		"pids_limit", limits.PidsLimit,
+		"disk_mb", limits.DiskMB,
+	)
 
 	// Build environment variables
 	var envVars []string
+	var proxyToken string
 	if m.sandboxNetwork != nil {
+		// Route HTTP traffic through the sandbox proxy with per-container credentials
+		if m.sandboxNetwork.ProxyPort > 0 {
+			proxyToken = newProxyToken()
+			envVars = append(envVars, m.proxyEnv(containerName, proxyToken)...)
+		}
+
 		// Inject LLM proxy configuration if enabled
 		if m.sandboxNetwork.LLMProxyPort > 0 {
 			llmBaseURL := fmt.Sprintf("http://%s:%d/v1", m.sandboxNetwork.Gateway, m.sandboxNetwork.LLMProxyPort)
@@ -686,23 +941,51 @@ func (m *Manager) EnsureRunning(agentURL string) (int, bool, error) {
 			"80/tcp": struct{}{},
 		},
 		Labels: map[string]string{
-			"agent-host.version-hash": versionHash,
-			"agent-host.url":          agentURL,
+			labelVersionHash: versionHash,
+			labelAgentURL:    agentURL,
+			labelReplica:     fmt.Sprintf("%d", replica),
+			labelAgentID:     agent.ID,
+			labelMetadataURI: agent.MetadataURI,
 		},
 	}
 
 	hostConfig := &container.HostConfig{
-		PortBindings: nat.PortMap{
-			"80/tcp": []nat.PortBinding{
-				{HostIP: "0.0.0.0", HostPort: hostPortStr},
-			},
-		},
-		Runtime: m.containerRuntime,
+		Runtime:    m.resolveRuntime(agent),
+		Resources:  limits.resources(),
+		StorageOpt: limits.storageOpt(),
+	}
+
+	// Fake the clock and seed randomness from files the runner rewrites per request
+	var stateDir string
+	if m.determinism.Enabled {
+		var detEnv []string
+		var mounts []mount.Mount
+		stateDir, detEnv, mounts, err = m.determinismSetup(containerName)
+		if err != nil {
+			metrics.ContainerOperationsTotal.WithLabelValues(agentURL, "start", "error").Inc()
+			return nil, err
+		}
+		containerConfig.Env = append(containerConfig.Env, detEnv...)
+		hostConfig.Mounts = mounts
+	}
+
+	// Trust the sandbox proxy's MITM CA
+	if m.sandboxNetwork != nil && m.sandboxNetwork.CABundle != "" {
+		containerConfig.Env = append(containerConfig.Env, caEnv()...)
+		hostConfig.Mounts = append(hostConfig.Mounts, mount.Mount{
+			Type:     mount.TypeBind,
+			Source:   m.sandboxNetwork.CABundle,
+			Target:   containerCABundle,
+			ReadOnly: true,
+		})
 	}
 
 	// Configure network - use sandbox network if configured
 	var networkConfig *network.NetworkingConfig
 	if m.sandboxNetwork != nil {
+		if m.sandboxNetwork.DNS {
+			hostConfig.DNS = []string{m.sandboxNetwork.Gateway}
+		}
 		networkConfig = &network.NetworkingConfig{
 			EndpointsConfig: map[string]*network.EndpointSettings{
 				m.sandboxNetwork.Name: {},
@@ -714,49 +997,180 @@ func (m *Manager) EnsureRunning(agentURL string) (int, bool, error) {
 		)
 	}
 
-	resp, err := m.client.ContainerCreate(ctx, containerConfig, hostConfig, networkConfig, nil, containerName)
-	if err != nil {
-		return 0, false, fmt.Errorf("failed to create container: %w", err)
-	}
+	// Bind a host port, retrying with another one if it is taken between probe and bind
+	var containerID string
+	var hostPort int
+	for attempt := 1; ; attempt++ {
+		if !m.useContainerIP {
+			hostPort, err = m.ports.Allocate()
+			if err != nil {
+				metrics.ContainerOperationsTotal.WithLabelValues(agentURL, "start", "error").Inc()
+				if stateDir != "" {
+					os.RemoveAll(stateDir)
+				}
+				return nil, err
+			}
+			hostConfig.PortBindings = nat.PortMap{
+				"80/tcp": []nat.PortBinding{
+					{HostIP: m.bindIP, HostPort: strconv.Itoa(hostPort)},
+				},
+			}
+		}
 
-	if err := m.client.ContainerStart(ctx, resp.ID, container.StartOptions{}); err != nil {
-		return 0, false, fmt.Errorf("failed to start container: %w", err)
+		containerID, err = m.createAndStart(ctx, containerName, containerConfig, hostConfig, networkConfig, &limits)
+		if err == nil {
+			break
+		}
+		if hostPort > 0 {
+			if isPortConflict(err) {
+				// Held by something the probe cannot see; leave it out of the free list
+				m.ports.Discard(hostPort)
+			} else {
+				m.ports.Release(hostPort)
+			}
+		}
+		if m.useContainerIP || !isPortConflict(err) || attempt >= maxPortAttempts {
+			metrics.ContainerOperationsTotal.WithLabelValues(agentURL, "start", "error").Inc()
+			if stateDir != "" {
+				os.RemoveAll(stateDir)
+			}
+			return nil, err
+		}
+		slog.Warn("Host port conflict, retrying with another port",
+			"agent_url", agentURL,
+			"port", hostPort,
+			"attempt", attempt,
+			"error", err,
+		)
 	}
 
 	// Start streaming container logs to structured logging
-	m.streamContainerLogs(resp.ID, versionHash, agentURL)
+	m.streamContainerLogs(containerID, containerName, versionHash, agentURL, time.Time{})
 
-	m.containersMutex.Lock()
-	m.runningContainers[versionHash] = &ContainerInfo{
-		ContainerID: resp.ID,
+	sandboxIP, sandboxIP6 := m.sandboxIP(ctx, containerID)
+
+	info := &ContainerInfo{
+		ContainerID: containerID,
+		Name:        containerName,
 		Port:        hostPort,
 		URL:         agentURL,
+		VersionHash: versionHash,
+		Limits:      limits,
+		Health:      health,
+		stateDir:    stateDir,
+		sandboxIP:   sandboxIP,
+		sandboxIP6:  sandboxIP6,
+		egress:      m.declaredEgress(agent, metadata),
+		proxyToken:  proxyToken,
 	}
-	metrics.ContainersActive.WithLabelValues(agentURL).Inc()
-	m.containersMutex.Unlock()
+	info.touch()
+
+	addr, err := m.containerAddr(ctx, info)
+	if err != nil {
+		metrics.ContainerOperationsTotal.WithLabelValues(agentURL, "start", "error").Inc()
+		m.stopReplica(info)
+		return nil, err
+	}
+	info.Addr = addr
 
 	slog.Info("Container started",
-		"container_id", resp.ID[:12],
+		"container_id", containerID[:12],
 		"agent_url", agentURL,
 		"version", versionHash,
-		"host_port", hostPort,
+		"replica", replica,
+		"addr", addr,
 		"image", imageName,
 	)
 
-	if err := m.waitForContainerReady(hostPort, 30, 1000); err != nil {
+	if err := m.waitForContainerReady(ctx, addr, health); err != nil {
 		metrics.ContainerOperationsTotal.WithLabelValues(agentURL, "start", "error").Inc()
-		return 0, false, err
+		metrics.ContainerHealthCheckFailuresTotal.WithLabelValues(agentURL, "readiness").Inc()
+		metrics.AgentHealthy.WithLabelValues(agentURL).Set(0)
+		m.containersMutex.Lock()
+		if set, exists := m.runningContainers[versionHash]; exists {
+			m.recordCrash(set)
+		}
+		m.containersMutex.Unlock()
+		m.stopReplica(info)
+		return nil, err
+	}
+	metrics.AgentHealthy.WithLabelValues(agentURL).Set(1)
+
+	info.Protocol = m.negotiateProtocol(ctx, addr, labels)
+	slog.Info("Agent protocol negotiated", "agent_url", agentURL, "name", containerName, "protocol", info.Protocol)
+
+	if m.determinism.Enabled {
+		if probe := determinismProbe(labels, metadata); probe != nil {
+			go m.checkDeterminism(info, agent, probe)
+		}
+	}
+
+	m.containersMutex.Lock()
+	set, exists = m.runningContainers[versionHash]
+	if !exists {
+		// The version was stopped while this replica was starting
+		m.containersMutex.Unlock()
+		m.stopReplica(info)
+		return nil, fmt.Errorf("agent version %s was stopped during startup", versionHash)
 	}
+	set.replicas = append(set.replicas, info)
+	m.pendingStarts--
+	registered = true
+	metrics.ContainersActive.WithLabelValues(agentURL).Inc()
+	m.containersMutex.Unlock()
 
 	metrics.ContainerOperationsTotal.WithLabelValues(agentURL, "start", "success").Inc()
 	metrics.ContainerStartDuration.WithLabelValues(agentURL).Observe(time.Since(start).Seconds())
 
-	return hostPort, true, nil
+	return info, nil
+}
+
+// createAndStart creates and starts a container, falling back to no disk
+// quota if the storage driver does not support one. A container that fails
+// to start is removed.
+func (m *Manager) createAndStart(ctx context.Context, name string, containerConfig *container.Config, hostConfig *container.HostConfig, networkConfig *network.NetworkingConfig, limits *ResourceLimits) (string, error) {
+	resp, err := m.client.ContainerCreate(ctx, containerConfig, hostConfig, networkConfig, nil, name)
+	if err != nil && hostConfig.StorageOpt != nil && isStorageOptUnsupported(err) {
+		// Disk quotas need overlay2 on xfs with pquota; run without one rather than not at all
+		slog.Warn("Storage driver does not support disk limits, starting container without one",
+			"name", name,
+			"disk_mb", limits.DiskMB,
+			"error", err,
+		)
+		hostConfig.StorageOpt = nil
+		limits.DiskMB = 0
+		resp, err = m.client.ContainerCreate(ctx, containerConfig, hostConfig, networkConfig, nil, name)
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to create container: %w", err)
+	}
+
+	if err := m.client.ContainerStart(ctx, resp.ID, container.StartOptions{}); err != nil {
+		m.client.ContainerRemove(ctx, resp.ID, container.RemoveOptions{Force: true})
+		return "", fmt.Errorf("failed to start container: %w", err)
+	}
+	return resp.ID, nil
 }
 
 // Forward forwards a request to an agent container using JSON-in-JSON-out protocol.
-func (m *Manager) Forward(agentURL string, body []byte, headers map[string]string) (*Response, error) {
+// The cold start and the agent call are bound to ctx. Failures are reported as
+// ErrAgentTimeout, ErrContainerCrashed (possibly ErrContainerOOMKilled) or, for
+// non-2xx answers, an *AgentError carrying the agent's response. execCtx is
+// passed to the agent in the request envelope and may be nil.
+func (m *Manager) Forward(ctx context.Context, agent Agent, body []byte, execCtx *ExecutionContext, headers map[string]string) (*Response, error) {
+	return m.forward(ctx, agent, body, execCtx, headers, "")
+}
+
+// ForwardExcluding is like Forward but runs the request on a replica other
+// than the named one, starting a new replica if needed. It is used to check
+// that two independent containers agree on a result.
+func (m *Manager) ForwardExcluding(ctx context.Context, agent Agent, body []byte, execCtx *ExecutionContext, headers map[string]string, replica string) (*Response, error) {
+	return m.forward(ctx, agent, body, execCtx, headers, replica)
+}
+
+func (m *Manager) forward(ctx context.Context, agent Agent, body []byte, execCtx *ExecutionContext, headers map[string]string, exclude string) (*Response, error) {
 	requestID := headers["X-Request-Id"]
+	agentURL := agent.URL
 
 	slog.Info("Forwarding request to container",
 		"request_id", requestID,
@@ -764,7 +1178,7 @@ func (m *Manager) Forward(agentURL string, body []byte, headers map[string]strin
 		"payload_size", len(body),
 	)
 
-	port, newlyStarted, err := m.EnsureRunning(agentURL)
+	info, newlyStarted, err := m.acquireReplica(ctx, agent, exclude)
 	if err != nil {
 		metrics.AgentRequestsTotal.WithLabelValues(agentURL, "error").Inc()
 		slog.Error("Forward failed: container not running",
@@ -772,26 +1186,63 @@ func (m *Manager) Forward(agentURL string, body []byte, headers map[string]strin
 			"agent_url", agentURL,
 			"error", err,
 		)
+		if isTimeout(ctx, err) {
+			metrics.AgentRequestFailuresTotal.WithLabelValues(agentURL, "timeout").Inc()
+			return nil, fmt.Errorf("%w: container not ready before deadline: %v", ErrAgentTimeout, err)
+		}
 		return nil, err
 	}
 
+	// Bound the agent call even if the caller set no deadline
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, defaultRequestTimeout)
+		defer cancel()
+	}
+
 	start := time.Now()
-	url := fmt.Sprintf("http://localhost:%d/", port)
+	defer func() { m.releaseReplica(info, time.Since(start)) }()
+	info.beginRequest(requestID)
+	defer info.endRequest(requestID)
+
+	url := fmt.Sprintf("http://%s/", info.Addr)
 
 	slog.Debug("Container ready for request",
 		"request_id", requestID,
-		"port", port,
+		"addr", info.Addr,
+		"replica", info.Name,
 		"newly_started", newlyStarted,
+		"protocol", info.Protocol,
 	)
 
 	requestHex := "0x" + hex.EncodeToString(body)
 
-	jsonRequest := map[string]string{
-		"requestId": requestID,
-		"request":   requestHex,
+	// Freeze the replica's clock at the block timestamp and seed it from the request
+	if m.determinism.Enabled {
+		info.execMu.Lock()
+		defer info.execMu.Unlock()
+		execCtx, err = deterministicContext(requestID, execCtx)
+		if err != nil {
+			metrics.AgentRequestsTotal.WithLabelValues(agentURL, "error").Inc()
+			slog.Error("Forward failed: cannot fake the clock",
+				"request_id", requestID,
+				"agent_url", agentURL,
+				"error", err,
+			)
+			return nil, err
+		}
+		if err := writeRequestState(info.stateDir, requestID, execCtx); err != nil {
+			metrics.AgentRequestsTotal.WithLabelValues(agentURL, "error").Inc()
+			slog.Error("Forward failed: cannot write determinism state",
+				"request_id", requestID,
+				"agent_url", agentURL,
+				"error", err,
+			)
+			return nil, err
+		}
 	}
 
-	jsonBody, err := json.Marshal(jsonRequest)
+	jsonBody, err := EncodeRequest(info.Protocol, requestID, body, execCtx)
 	if err != nil {
 		metrics.AgentRequestsTotal.WithLabelValues(agentURL, "error").Inc()
 		slog.Error("Forward failed: cannot marshal request",
@@ -802,7 +1253,11 @@ func (m *Manager) Forward(agentURL string, body []byte, headers map[string]strin
 		return nil, fmt.Errorf("failed to marshal request: %w", err)
 	}
 
-	req, err := http.NewRequest("POST", url, bytes.NewReader(jsonBody))
+	// Capture the container output produced while handling the request
+	finishLogs := m.logs.begin(info.ContainerID, requestID)
+	defer finishLogs()
+
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(jsonBody))
 	if err != nil {
 		metrics.AgentRequestsTotal.WithLabelValues(agentURL, "error").Inc()
 		slog.Error("Forward failed: cannot create HTTP request",
@@ -814,10 +1269,23 @@ func (m *Manager) Forward(agentURL string, body []byte, headers map[string]strin
 	}
 	req.Header.Set("Content-Type", "application/json")
 
-	resp, err := m.httpClient.Do(req)
+	resp, err := m.agentClient.Do(req)
 	if err != nil {
 		metrics.AgentRequestsTotal.WithLabelValues(agentURL, "error").Inc()
 
+		if errors.Is(err, context.Canceled) {
+			return nil, fmt.Errorf("agent request cancelled: %w", err)
+		}
+		if isTimeout(ctx, err) {
+			metrics.AgentRequestFailuresTotal.WithLabelValues(agentURL, "timeout").Inc()
+			slog.Error("Forward failed: agent did not respond before deadline",
+				"request_id", requestID,
+				"agent_url", agentURL,
+				"duration_ms", time.Since(start).Milliseconds(),
+			)
+			return nil, fmt.Errorf("%w after %s", ErrAgentTimeout, time.Since(start).Round(time.Millisecond))
+		}
+
 		// Provide detailed diagnostics for connection errors
 		errMsg := err.Error()
 		var diagnosis string
@@ -831,19 +1299,26 @@ func (m *Manager) Forward(agentURL string, body []byte, headers map[string]strin
 			diagnosis = "Container closed connection before sending response"
 		}
 
+		// A container killed for exceeding its memory limit is reported distinctly
+		if oomErr := m.diagnoseContainerFailure(info); oomErr != nil {
+			metrics.AgentRequestFailuresTotal.WithLabelValues(agentURL, "oom_killed").Inc()
+			return nil, fmt.Errorf("%w: %w (memory limit %d MiB): %v", ErrContainerCrashed, oomErr, info.Limits.MemoryMB, err)
+		}
+		metrics.AgentRequestFailuresTotal.WithLabelValues(agentURL, "container_error").Inc()
+
 		slog.Error("Forward failed: HTTP request to container failed",
 			"request_id", requestID,
 			"agent_url", agentURL,
-			"port", port,
+			"addr", info.Addr,
 			"error", errMsg,
 			"diagnosis", diagnosis,
 		)
 
-		return nil, fmt.Errorf("failed to forward request to agent: %w", err)
+		return nil, fmt.Errorf("%w: %v", ErrContainerCrashed, err)
 	}
 	defer resp.Body.Close()
 
-	responseText, err := io.ReadAll(resp.Body)
+	responseText, err := io.ReadAll(io.LimitReader(resp.Body, maxResponseBodySize+1))
 	if err != nil {
 		metrics.AgentRequestsTotal.WithLabelValues(agentURL, "error").Inc()
 		slog.Error("Forward failed: cannot read response body",
@@ -852,28 +1327,47 @@ func (m *Manager) Forward(agentURL string, body []byte, headers map[string]strin
 			"status_code", resp.StatusCode,
 			"error", err,
 		)
-		return nil, fmt.Errorf("failed to read response: %w", err)
-	}
-
-	var responseBody []byte
-	var receipt map[string]interface{}
-
-	var jsonResponse map[string]interface{}
-	if err := json.Unmarshal(responseText, &jsonResponse); err == nil {
-		if result, ok := jsonResponse["result"].(string); ok {
-			resultHex := strings.TrimPrefix(result, "0x")
-			responseBody, _ = hex.DecodeString(resultHex)
-		} else {
-			responseBody = responseText
+		if isTimeout(ctx, err) {
+			metrics.AgentRequestFailuresTotal.WithLabelValues(agentURL, "timeout").Inc()
+			return nil, fmt.Errorf("%w while reading response: %v", ErrAgentTimeout, err)
 		}
+		return nil, fmt.Errorf("%w: failed to read response: %v", ErrContainerCrashed, err)
+	}
 
-		if _, hasSteps := jsonResponse["steps"]; hasSteps {
-			// Include the request hex in the receipt
-			jsonResponse["request"] = requestHex
-			receipt = jsonResponse
+	var response *Response
+	if len(responseText) > maxResponseBodySize {
+		err = fmt.Errorf("response body exceeds %d bytes", maxResponseBodySize)
+		response = &Response{
+			Status:   resp.StatusCode,
+			Protocol: info.Protocol,
+			Error:    &ProtocolError{Code: ErrorCodeResultTooLarge, Message: err.Error()},
 		}
 	} else {
-		responseBody = responseText
+		response, err = DecodeResponse(info.Protocol, resp.StatusCode, responseText, m.maxResultSize)
+	}
+	response.Replica = info.Name
+	if err != nil {
+		metrics.AgentRequestsTotal.WithLabelValues(agentURL, "error").Inc()
+		metrics.AgentRequestFailuresTotal.WithLabelValues(agentURL, string(response.Error.Code)).Inc()
+		slog.Error("Forward failed: unusable agent response",
+			"request_id", requestID,
+			"agent_url", agentURL,
+			"status_code", resp.StatusCode,
+			"protocol", info.Protocol,
+			"response_size", len(responseText),
+			"error", err,
+		)
+		return nil, &AgentError{Response: response}
+	}
+
+	// Include the request hex in the receipt
+	if response.Receipt != nil {
+		response.Receipt["request"] = requestHex
+	}
+
+	// Sample CPU throttling for containers with a CPU quota
+	if info.Limits.CPUs > 0 {
+		go m.recordThrottling(info)
 	}
 
 	duration := time.Since(start)
@@ -885,41 +1379,59 @@ func (m *Manager) Forward(agentURL string, body []byte, headers map[string]strin
 		"request_id", requestID,
 		"agent_url", agentURL,
 		"status_code", resp.StatusCode,
-		"response_size", len(responseBody),
+		"success", response.Success,
+		"response_size", len(response.Body),
 		"duration_ms", duration.Milliseconds(),
-		"has_receipt", receipt != nil,
+		"has_receipt", response.Receipt != nil,
 	)
 
-	return &Response{
-		Status:  resp.StatusCode,
-		Body:    responseBody,
-		Receipt: receipt,
-	}, nil
+	if !response.Success {
+		reason := "agent_error"
+		if response.Error != nil {
+			reason = string(response.Error.Code)
+		}
+		metrics.AgentRequestFailuresTotal.WithLabelValues(agentURL, reason).Inc()
+		return nil, &AgentError{Response: response}
+	}
+	return response, nil
 }
 
-
-// Cleanup removes all running containers.
+// Cleanup stops background loops and removes all running containers.
 func (m *Manager) Cleanup() {
 	slog.Info("Cleaning up containers")
 
+	select {
+	case <-m.stopCh:
+	default:
+		close(m.stopCh)
+	}
+
 	m.containersMutex.Lock()
 	defer m.containersMutex.Unlock()
 
 	ctx := context.Background()
-	for versionHash, info := range m.runningContainers {
-		timeout := 10
-		if err := m.client.ContainerStop(ctx, info.ContainerID, container.StopOptions{Timeout: &timeout}); err != nil {
-			slog.Warn("Failed to stop container", "version", versionHash, "error", err)
-		}
-		if err := m.client.ContainerRemove(ctx, info.ContainerID, container.RemoveOptions{Force: true}); err != nil {
-			slog.Error("Failed to remove container", "version", versionHash, "error", err)
-			metrics.ContainerOperationsTotal.WithLabelValues(info.URL, "stop", "error").Inc()
-		} else {
-			slog.Info("Removed container", "version", versionHash)
-			metrics.ContainerOperationsTotal.WithLabelValues(info.URL, "stop", "success").Inc()
+	for versionHash, set := range m.runningContainers {
+		for _, info := range set.replicas {
+			timeout := 10
+			if err := m.client.ContainerStop(ctx, info.ContainerID, container.StopOptions{Timeout: &timeout}); err != nil {
+				slog.Warn("Failed to stop container", "version", versionHash, "name", info.Name, "error", err)
+			}
+			if err := m.client.ContainerRemove(ctx, info.ContainerID, container.RemoveOptions{Force: true}); err != nil {
+				slog.Error("Failed to remove container", "version", versionHash, "name", info.Name, "error", err)
+				metrics.ContainerOperationsTotal.WithLabelValues(info.URL, "stop", "error").Inc()
+			} else {
+				slog.Info("Removed container", "version", versionHash, "name", info.Name)
+				metrics.ContainerOperationsTotal.WithLabelValues(info.URL, "stop", "success").Inc()
+			}
+			if info.Port > 0 {
+				m.ports.Release(info.Port)
+			}
+			if info.stateDir != "" {
+				os.RemoveAll(info.stateDir)
+			}
+			metrics.ContainersActive.WithLabelValues(info.URL).Dec()
 		}
-		metrics.ContainersActive.WithLabelValues(info.URL).Dec()
 	}
 
-	m.runningContainers = make(map[string]*ContainerInfo)
+	m.runningContainers = make(map[string]*replicaSet)
 }
@@ -0,0 +1,458 @@
+package agents
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/errdefs"
+	"github.com/somnia-chain/agent-runner/internal/engine"
+)
+
+// testStartPort is the first host port test managers bind containers to.
+const testStartPort = 47000
+
+// agentHandler serves a legacy agent that echoes its request as the result.
+func agentHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodGet && r.URL.Path == "/":
+			w.WriteHeader(http.StatusOK)
+		case r.Method == http.MethodPost && r.URL.Path == "/":
+			var req ProtocolRequest
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			json.NewEncoder(w).Encode(map[string]string{"result": req.Request})
+		default:
+			http.NotFound(w, r)
+		}
+	})
+}
+
+// imageServer serves agent images; every path is a distinct image version.
+func imageServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"`+r.URL.Path+`"`)
+		if r.Method == http.MethodGet {
+			w.Write([]byte("image " + r.URL.Path))
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// newTestManager returns a manager on a fake engine whose containers run agentHandler.
+func newTestManager(t *testing.T, fake *engine.Fake) *Manager {
+	t.Helper()
+	m := NewManager(fake, t.TempDir(), testStartPort, "")
+	t.Cleanup(m.Cleanup)
+	return m
+}
+
+func newFake(t *testing.T) *engine.Fake {
+	t.Helper()
+	fake := engine.NewFake()
+	fake.Handler = agentHandler()
+	t.Cleanup(func() { fake.Close() })
+	return fake
+}
+
+// replicas returns the running replicas of an agent.
+func replicas(m *Manager, agent Agent) []*ContainerInfo {
+	m.containersMutex.RLock()
+	defer m.containersMutex.RUnlock()
+
+	for _, set := range m.runningContainers {
+		if set.agent.URL == agent.URL {
+			return append([]*ContainerInfo(nil), set.replicas...)
+		}
+	}
+	return nil
+}
+
+// running reports whether the fake engine still runs a container.
+func running(t *testing.T, fake *engine.Fake, containerID string) bool {
+	t.Helper()
+	containerJSON, err := fake.ContainerInspect(context.Background(), containerID)
+	if errdefs.IsNotFound(err) {
+		return false
+	}
+	if err != nil {
+		t.Fatalf("ContainerInspect(%s): %v", containerID, err)
+	}
+	return containerJSON.State.Running
+}
+
+// waitFor polls cond until it holds or the timeout expires.
+func waitFor(t *testing.T, timeout time.Duration, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met before timeout")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestEnsureRunningStartsOnce(t *testing.T) {
+	fake := newFake(t)
+	m := newTestManager(t, fake)
+	agent := Agent{URL: imageServer(t).URL + "/echo"}
+	ctx := context.Background()
+
+	port, started, err := m.EnsureRunning(ctx, agent)
+	if err != nil {
+		t.Fatalf("EnsureRunning: %v", err)
+	}
+	if !started || port < testStartPort {
+		t.Errorf("EnsureRunning = %d, %v, want a new container on a port from %d", port, started, testStartPort)
+	}
+
+	again, started, err := m.EnsureRunning(ctx, agent)
+	if err != nil {
+		t.Fatalf("EnsureRunning again: %v", err)
+	}
+	if started || again != port {
+		t.Errorf("EnsureRunning again = %d, %v, want the running container on %d", again, started, port)
+	}
+	if got := len(replicas(m, agent)); got != 1 {
+		t.Errorf("replicas = %d, want 1", got)
+	}
+}
+
+func TestEnsureRunningKeepsReplicaOnInspectError(t *testing.T) {
+	fake := newFake(t)
+	m := newTestManager(t, fake)
+	agent := Agent{URL: imageServer(t).URL + "/echo"}
+	ctx := context.Background()
+
+	port, _, err := m.EnsureRunning(ctx, agent)
+	if err != nil {
+		t.Fatalf("EnsureRunning: %v", err)
+	}
+	info := replicas(m, agent)[0]
+
+	fake.SetInspectError(errors.New("engine busy"))
+	again, started, err := m.EnsureRunning(ctx, agent)
+	fake.SetInspectError(nil)
+	if err != nil || started || again != port {
+		t.Errorf("EnsureRunning with a failing inspect = %d, %v, %v, want the running container on %d", again, started, err, port)
+	}
+	if !running(t, fake, info.ContainerID) {
+		t.Errorf("container %s was removed on an inspect error", info.Name)
+	}
+
+	// A container the engine no longer knows is replaced
+	if err := fake.ContainerRemove(ctx, info.ContainerID, container.RemoveOptions{Force: true}); err != nil {
+		t.Fatalf("ContainerRemove: %v", err)
+	}
+	if _, started, err := m.EnsureRunning(ctx, agent); err != nil || !started {
+		t.Errorf("EnsureRunning after removal = %v, %v, want a new container", started, err)
+	}
+}
+
+func TestForward(t *testing.T) {
+	fake := newFake(t)
+	m := newTestManager(t, fake)
+	agent := Agent{URL: imageServer(t).URL + "/echo"}
+
+	resp, err := m.Forward(context.Background(), agent, []byte("hello"), nil, map[string]string{"X-Request-Id": "req-1"})
+	if err != nil {
+		t.Fatalf("Forward: %v", err)
+	}
+	if !resp.Success || string(resp.Body) != "hello" || resp.Protocol != ProtocolLegacy {
+		t.Errorf("Forward = %+v, want a successful legacy echo of %q", resp, "hello")
+	}
+	if want := replicas(m, agent)[0].Name; resp.Replica != want {
+		t.Errorf("Replica = %q, want %q", resp.Replica, want)
+	}
+}
+
+func TestEvictionAtCapacity(t *testing.T) {
+	fake := newFake(t)
+	m := newTestManager(t, fake)
+	m.SetEvictionConfig(EvictionConfig{MaxContainers: 1})
+	images := imageServer(t)
+	first := Agent{URL: images.URL + "/first"}
+	second := Agent{URL: images.URL + "/second"}
+	ctx := context.Background()
+
+	if _, _, err := m.EnsureRunning(ctx, first); err != nil {
+		t.Fatalf("EnsureRunning(first): %v", err)
+	}
+	evicted := replicas(m, first)[0]
+
+	if _, _, err := m.EnsureRunning(ctx, second); err != nil {
+		t.Fatalf("EnsureRunning(second): %v", err)
+	}
+	if got := replicas(m, first); len(got) != 0 {
+		t.Errorf("first agent replicas = %d, want 0 after eviction", len(got))
+	}
+	if running(t, fake, evicted.ContainerID) {
+		t.Errorf("evicted container %s is still running", evicted.Name)
+	}
+	if got := len(replicas(m, second)); got != 1 {
+		t.Errorf("second agent replicas = %d, want 1", got)
+	}
+}
+
+func TestEvictionSkipsBusyReplicas(t *testing.T) {
+	fake := newFake(t)
+	m := newTestManager(t, fake)
+	m.SetEvictionConfig(EvictionConfig{MaxContainers: 1})
+	images := imageServer(t)
+	busy := Agent{URL: images.URL + "/busy"}
+	ctx := context.Background()
+
+	if _, _, err := m.EnsureRunning(ctx, busy); err != nil {
+		t.Fatalf("EnsureRunning(busy): %v", err)
+	}
+	info := replicas(m, busy)[0]
+	info.inFlight.Add(1)
+	defer info.inFlight.Add(-1)
+
+	_, _, err := m.EnsureRunning(ctx, Agent{URL: images.URL + "/other"})
+	if !errors.Is(err, ErrContainerCapacity) {
+		t.Errorf("EnsureRunning at capacity = %v, want ErrContainerCapacity", err)
+	}
+	if !running(t, fake, info.ContainerID) {
+		t.Errorf("busy container %s was evicted", info.Name)
+	}
+	m.containersMutex.RLock()
+	sets := len(m.runningContainers)
+	m.containersMutex.RUnlock()
+	if sets != 1 {
+		t.Errorf("replica sets = %d, want 1 after a start refused at capacity", sets)
+	}
+}
+
+func TestEvictionCountsPendingStarts(t *testing.T) {
+	fake := newFake(t)
+	m := newTestManager(t, fake)
+	m.SetEvictionConfig(EvictionConfig{MaxContainers: 2})
+	images := imageServer(t)
+	ctx := context.Background()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 6; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			m.EnsureRunning(ctx, Agent{URL: images.URL + "/agent-" + strconv.Itoa(i)})
+		}()
+	}
+	wg.Wait()
+
+	list, err := fake.ContainerList(ctx, container.ListOptions{})
+	if err != nil {
+		t.Fatalf("ContainerList: %v", err)
+	}
+	if len(list) > 2 {
+		t.Errorf("running containers = %d, want at most 2", len(list))
+	}
+	if m.pendingStarts != 0 {
+		t.Errorf("pendingStarts = %d after all starts finished, want 0", m.pendingStarts)
+	}
+}
+
+func TestCrashRestart(t *testing.T) {
+	fake := newFake(t)
+	m := newTestManager(t, fake)
+	m.StartEventWatcher()
+	agent := Agent{URL: imageServer(t).URL + "/crashy"}
+
+	if _, _, err := m.EnsureRunning(context.Background(), agent); err != nil {
+		t.Fatalf("EnsureRunning: %v", err)
+	}
+	crashed := replicas(m, agent)[0]
+	if err := fake.Exit(crashed.ContainerID, 3, true); err != nil {
+		t.Fatalf("Exit: %v", err)
+	}
+
+	// The first crash is restarted immediately
+	waitFor(t, 10*time.Second, func() bool {
+		current := replicas(m, agent)
+		return len(current) == 1 && current[0].ContainerID != crashed.ContainerID
+	})
+	exit, ok := m.lastExit(crashed.VersionHash)
+	if !ok || exit.ExitCode != 3 || !exit.OOMKilled || exit.ContainerID != crashed.ContainerID {
+		t.Errorf("lastExit = %+v, %v, want exit code 3 with OOM kill of %s", exit, ok, crashed.Name)
+	}
+	if _, err := fake.ContainerInspect(context.Background(), crashed.ContainerID); !errdefs.IsNotFound(err) {
+		t.Errorf("crashed container was not removed: %v", err)
+	}
+}
+
+func TestCrashRestartStopsWhenIdle(t *testing.T) {
+	fake := newFake(t)
+	m := newTestManager(t, fake)
+	m.SetEvictionConfig(EvictionConfig{IdleTimeout: 100 * time.Millisecond})
+	m.StartEventWatcher()
+	agent := Agent{URL: imageServer(t).URL + "/abandoned"}
+	ctx := context.Background()
+
+	if _, _, err := m.EnsureRunning(ctx, agent); err != nil {
+		t.Fatalf("EnsureRunning: %v", err)
+	}
+	crashed := replicas(m, agent)[0]
+	time.Sleep(200 * time.Millisecond)
+	if err := fake.Exit(crashed.ContainerID, 1, false); err != nil {
+		t.Fatalf("Exit: %v", err)
+	}
+
+	// An idle agent is not restarted and holds no replica set
+	waitFor(t, 10*time.Second, func() bool {
+		m.containersMutex.RLock()
+		defer m.containersMutex.RUnlock()
+		_, exists := m.runningContainers[crashed.VersionHash]
+		return !exists
+	})
+	if got := replicas(m, agent); len(got) != 0 {
+		t.Errorf("replicas = %d, want 0 for an idle crashed agent", len(got))
+	}
+
+	// The next request starts it again
+	if _, started, err := m.EnsureRunning(ctx, agent); err != nil || !started {
+		t.Errorf("EnsureRunning after abandoned restart = %v, %v, want a new container", started, err)
+	}
+}
+
+func TestReconcileRechecksUnlistedReplicas(t *testing.T) {
+	fake := newFake(t)
+	m := newTestManager(t, fake)
+	agent := Agent{URL: imageServer(t).URL + "/reconciled"}
+	ctx := context.Background()
+
+	if _, _, err := m.EnsureRunning(ctx, agent); err != nil {
+		t.Fatalf("EnsureRunning: %v", err)
+	}
+	info := replicas(m, agent)[0]
+
+	// A replica started after the listing runs in a container it does not show
+	unlisted, err := fake.ContainerCreate(ctx, &container.Config{Image: fakeImage(t, fake, info.ContainerID)}, nil, nil, nil, "unlisted")
+	if err != nil {
+		t.Fatalf("ContainerCreate: %v", err)
+	}
+	if err := fake.ContainerStart(ctx, unlisted.ID, container.StartOptions{}); err != nil {
+		t.Fatalf("ContainerStart: %v", err)
+	}
+	listed := info.ContainerID
+	m.containersMutex.Lock()
+	info.ContainerID = unlisted.ID
+	m.containersMutex.Unlock()
+
+	m.reconcileContainers(ctx)
+	if got := replicas(m, agent); len(got) != 1 || got[0] != info {
+		t.Fatalf("replicas after reconcile = %d, want the unlisted running replica kept", len(got))
+	}
+
+	// A replica whose container is gone is dropped
+	if err := fake.ContainerRemove(ctx, unlisted.ID, container.RemoveOptions{Force: true}); err != nil {
+		t.Fatalf("ContainerRemove: %v", err)
+	}
+	m.reconcileContainers(ctx)
+	for _, got := range replicas(m, agent) {
+		if got == info {
+			t.Errorf("replica %s was kept after its container was removed", info.Name)
+		}
+	}
+	fake.ContainerRemove(ctx, listed, container.RemoveOptions{Force: true})
+}
+
+func TestAdoptContainers(t *testing.T) {
+	fake := newFake(t)
+	agent := Agent{URL: imageServer(t).URL + "/adopted"}
+	ctx := context.Background()
+
+	// A previous runner left a replica running
+	previous := NewManager(fake, t.TempDir(), testStartPort, "")
+	port, _, err := previous.EnsureRunning(ctx, agent)
+	if err != nil {
+		t.Fatalf("EnsureRunning: %v", err)
+	}
+	left := replicas(previous, agent)[0]
+
+	// Alongside a container whose name does not match its labels
+	stray, err := fake.ContainerCreate(ctx, &container.Config{
+		Image:  fakeImage(t, fake, left.ContainerID),
+		Labels: map[string]string{labelVersionHash: left.VersionHash, labelAgentURL: agent.URL},
+	}, nil, nil, nil, "stray")
+	if err != nil {
+		t.Fatalf("ContainerCreate: %v", err)
+	}
+	if err := fake.ContainerStart(ctx, stray.ID, container.StartOptions{}); err != nil {
+		t.Fatalf("ContainerStart: %v", err)
+	}
+
+	m := newTestManager(t, fake)
+	adopted, err := m.AdoptContainers(ctx)
+	if err != nil {
+		t.Fatalf("AdoptContainers: %v", err)
+	}
+	if adopted != 1 {
+		t.Errorf("adopted = %d, want 1", adopted)
+	}
+	if running(t, fake, stray.ID) {
+		t.Error("stray container was not removed")
+	}
+
+	again, started, err := m.EnsureRunning(ctx, agent)
+	if err != nil {
+		t.Fatalf("EnsureRunning after adoption: %v", err)
+	}
+	if started || again != port {
+		t.Errorf("EnsureRunning after adoption = %d, %v, want the adopted container on %d", again, started, port)
+	}
+	if got := replicas(m, agent); len(got) != 1 || got[0].ContainerID != left.ContainerID {
+		t.Errorf("replicas = %v, want the adopted container %s", got, left.Name)
+	}
+}
+
+// fakeImage returns the image a fake container was created from.
+func fakeImage(t *testing.T, fake *engine.Fake, containerID string) string {
+	t.Helper()
+	containerJSON, err := fake.ContainerInspect(context.Background(), containerID)
+	if err != nil {
+		t.Fatalf("ContainerInspect(%s): %v", containerID, err)
+	}
+	return containerJSON.Config.Image
+}
+
+func TestForwardExcludingStopsSurplusReplica(t *testing.T) {
+	fake := newFake(t)
+	m := newTestManager(t, fake)
+	agent := Agent{URL: imageServer(t).URL + "/checked"}
+	ctx := context.Background()
+
+	first, err := m.Forward(ctx, agent, []byte("run"), nil, map[string]string{"X-Request-Id": "req-1"})
+	if err != nil {
+		t.Fatalf("Forward: %v", err)
+	}
+	second, err := m.ForwardExcluding(ctx, agent, []byte("run"), nil, map[string]string{"X-Request-Id": "req-1"}, first.Replica)
+	if err != nil {
+		t.Fatalf("ForwardExcluding: %v", err)
+	}
+	if second.Replica == first.Replica {
+		t.Errorf("ForwardExcluding ran on the excluded replica %s", first.Replica)
+	}
+
+	// The extra replica exceeded MaxReplicas and is gone once the run is done
+	got := replicas(m, agent)
+	if len(got) != 1 || got[0].Name != first.Replica {
+		t.Errorf("replicas = %v, want only %s", got, first.Replica)
+	}
+	if _, err := fake.ContainerInspect(ctx, second.Replica); !errdefs.IsNotFound(err) {
+		t.Errorf("surplus container %s was not removed: %v", second.Replica, err)
+	}
+}
@@ -0,0 +1,276 @@
+package agents
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types/mount"
+	"github.com/somnia-chain/agent-runner/internal/metrics"
+)
+
+// ErrNoBlockTimestamp is returned in determinism mode for a chain request whose
+// block timestamp is unknown; faking the clock to the wall clock instead would
+// give each validator a different time.
+var ErrNoBlockTimestamp = errors.New("request has no block timestamp")
+
+// DeterminismConfig holds the determinism mode configuration.
+type DeterminismConfig struct {
+	Enabled     bool   // Fake the clock and provide a random seed per request
+	StateDir    string // Host directory for per-container clock and seed files
+	FaketimeLib string // Host path of libfaketime to preload (empty = the image provides it)
+}
+
+const (
+	// containerStateDir is where the per-container state directory is mounted.
+	containerStateDir = "/run/agent-host"
+	// containerFaketimeLib is where the host's libfaketime is mounted.
+	containerFaketimeLib = "/usr/lib/agent-host/libfaketime.so.1"
+	// labelDeterminismProbe is the image label holding a request payload used
+	// to check an agent for determinism at startup.
+	labelDeterminismProbe = "agent-host.determinism-probe"
+	// probeBlockTimestamp is the fixed block timestamp used by startup probes.
+	probeBlockTimestamp = 1700000000
+)
+
+// SetDeterminismConfig configures determinism mode.
+func (m *Manager) SetDeterminismConfig(cfg DeterminismConfig) error {
+	if cfg.Enabled {
+		if cfg.StateDir == "" {
+			cfg.StateDir = "./agent-state"
+		}
+		// Bind mounts need an absolute path
+		stateDir, err := filepath.Abs(cfg.StateDir)
+		if err != nil {
+			return fmt.Errorf("invalid determinism state directory: %w", err)
+		}
+		if err := os.MkdirAll(stateDir, 0755); err != nil {
+			return fmt.Errorf("failed to create determinism state directory: %w", err)
+		}
+		cfg.StateDir = stateDir
+
+		if cfg.FaketimeLib != "" {
+			if _, err := os.Stat(cfg.FaketimeLib); err != nil {
+				return fmt.Errorf("libfaketime not found: %w", err)
+			}
+		} else {
+			slog.Warn("Determinism mode without --faketime-lib: agents whose images do not preload libfaketime keep the host clock")
+		}
+		// Nothing replaces the kernel's randomness; the seed is only offered
+		slog.Warn("Determinism mode does not seed agent randomness: agents must read the request seed themselves")
+	}
+	m.determinism = cfg
+
+	slog.Info("Determinism mode configured",
+		"enabled", cfg.Enabled,
+		"state_dir", cfg.StateDir,
+		"faketime_lib", cfg.FaketimeLib,
+	)
+	return nil
+}
+
+// determinismSetup creates the state directory for a new container and
+// returns the environment variables and mounts that point the container at it.
+func (m *Manager) determinismSetup(containerName string) (string, []string, []mount.Mount, error) {
+	stateDir := filepath.Join(m.determinism.StateDir, containerName)
+	if err := os.MkdirAll(stateDir, 0755); err != nil {
+		return "", nil, nil, fmt.Errorf("failed to create container state directory: %w", err)
+	}
+
+	// libfaketime needs a valid timestamp file from the first exec
+	if err := writeRequestState(stateDir, "", &ExecutionContext{BlockTimestamp: uint64(time.Now().Unix())}); err != nil {
+		os.RemoveAll(stateDir)
+		return "", nil, nil, err
+	}
+
+	env := []string{
+		"AGENT_DETERMINISTIC=1",
+		"TZ=UTC",
+		"FAKETIME_TIMESTAMP_FILE=" + containerStateDir + "/faketime",
+		"FAKETIME_NO_CACHE=1",
+		// Keep timeouts and sleeps working on a frozen wall clock
+		"DONT_FAKE_MONOTONIC=1",
+		"AGENT_RANDOM_SEED_FILE=" + containerStateDir + "/seed",
+		"AGENT_CONTEXT_FILE=" + containerStateDir + "/context.env",
+	}
+	mounts := []mount.Mount{{
+		Type:     mount.TypeBind,
+		Source:   stateDir,
+		Target:   containerStateDir,
+		ReadOnly: true,
+	}}
+	if m.determinism.FaketimeLib != "" {
+		env = append(env, "LD_PRELOAD="+containerFaketimeLib)
+		mounts = append(mounts, mount.Mount{
+			Type:     mount.TypeBind,
+			Source:   m.determinism.FaketimeLib,
+			Target:   containerFaketimeLib,
+			ReadOnly: true,
+		})
+	}
+	return stateDir, env, mounts, nil
+}
+
+// requestSeed derives the random seed for a request from its ID, so every
+// validator seeds the agent identically.
+func requestSeed(requestID string, execCtx *ExecutionContext) string {
+	var chainID, agentID string
+	if execCtx != nil {
+		chainID, agentID = execCtx.ChainID, execCtx.AgentID
+	}
+	sum := sha256.Sum256([]byte(chainID + "/" + agentID + "/" + requestID))
+	return "0x" + hex.EncodeToString(sum[:])
+}
+
+// writeRequestState writes the frozen clock, seed and context files a
+// container reads while handling one request. Files are replaced atomically.
+func writeRequestState(stateDir, requestID string, execCtx *ExecutionContext) error {
+	timestamp := time.Unix(int64(execCtx.BlockTimestamp), 0).UTC()
+	files := map[string]string{
+		// libfaketime freezes the clock at an absolute timestamp without '@'
+		"faketime": timestamp.Format("2006-01-02 15:04:05") + "\n",
+		"seed":     execCtx.Seed + "\n",
+		"context.env": strings.Join([]string{
+			"AGENT_REQUEST_ID=" + requestID,
+			"AGENT_ID=" + execCtx.AgentID,
+			fmt.Sprintf("AGENT_BLOCK_NUMBER=%d", execCtx.BlockNumber),
+			fmt.Sprintf("AGENT_BLOCK_TIMESTAMP=%d", execCtx.BlockTimestamp),
+			"AGENT_RANDOM_SEED=" + execCtx.Seed,
+		}, "\n") + "\n",
+	}
+
+	for name, content := range files {
+		tmp := filepath.Join(stateDir, "."+name+".tmp")
+		if err := os.WriteFile(tmp, []byte(content), 0644); err != nil {
+			return fmt.Errorf("failed to write %s: %w", name, err)
+		}
+		if err := os.Rename(tmp, filepath.Join(stateDir, name)); err != nil {
+			return fmt.Errorf("failed to write %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// deterministicContext returns a copy of execCtx with the request seed set.
+// Ad-hoc requests without chain context get the current time as their
+// timestamp; a chain request without its block timestamp is refused with
+// ErrNoBlockTimestamp.
+func deterministicContext(requestID string, execCtx *ExecutionContext) (*ExecutionContext, error) {
+	var detCtx ExecutionContext
+	if execCtx == nil {
+		detCtx.BlockTimestamp = uint64(time.Now().Unix())
+	} else {
+		if execCtx.BlockTimestamp == 0 {
+			return nil, ErrNoBlockTimestamp
+		}
+		detCtx = *execCtx
+	}
+	detCtx.Seed = requestSeed(requestID, execCtx)
+	return &detCtx, nil
+}
+
+// determinismProbe returns the startup probe payload an agent declares in its
+// metadata or image labels, or nil if it declares none.
+func determinismProbe(labels map[string]string, meta *AgentMetadata) []byte {
+	probe := labels[labelDeterminismProbe]
+	if meta != nil && meta.DeterminismProbe != "" {
+		probe = meta.DeterminismProbe
+	}
+	if probe == "" {
+		return nil
+	}
+	payload, err := hex.DecodeString(strings.TrimPrefix(probe, "0x"))
+	if err != nil {
+		slog.Warn("Invalid determinism probe payload", "error", err)
+		return nil
+	}
+	return payload
+}
+
+// checkDeterminism runs the probe payload twice on a fresh replica with the
+// same context and flags the agent if the results differ.
+func (m *Manager) checkDeterminism(info *ContainerInfo, agent Agent, payload []byte) {
+	execCtx := &ExecutionContext{
+		AgentID:        agent.ID,
+		BlockNumber:    1,
+		BlockTimestamp: probeBlockTimestamp,
+	}
+
+	var results [2]*Response
+	for i := range results {
+		response, err := m.probeOnce(info, "determinism-probe", payload, execCtx)
+		if err != nil {
+			slog.Warn("Determinism probe failed", "agent_url", info.URL, "name", info.Name, "run", i+1, "error", err)
+			return
+		}
+		results[i] = response
+	}
+
+	if results[0].Success == results[1].Success && bytes.Equal(results[0].Body, results[1].Body) {
+		metrics.AgentNondeterministic.WithLabelValues(info.URL).Set(0)
+		metrics.AgentDeterminismChecksTotal.WithLabelValues(info.URL, "match").Inc()
+		slog.Info("Agent passed determinism check", "agent_url", info.URL, "name", info.Name)
+		return
+	}
+
+	metrics.AgentNondeterministic.WithLabelValues(info.URL).Set(1)
+	metrics.AgentDeterminismChecksTotal.WithLabelValues(info.URL, "mismatch").Inc()
+	slog.Warn("Agent output diverged across two identical runs",
+		"agent_id", agent.ID,
+		"agent_url", info.URL,
+		"name", info.Name,
+		"first_result", hex.EncodeToString(results[0].Body),
+		"second_result", hex.EncodeToString(results[1].Body),
+		"first_success", results[0].Success,
+		"second_success", results[1].Success,
+	)
+}
+
+// probeOnce sends one request to a replica outside the request path.
+func (m *Manager) probeOnce(info *ContainerInfo, requestID string, payload []byte, execCtx *ExecutionContext) (*Response, error) {
+	info.execMu.Lock()
+	defer info.execMu.Unlock()
+
+	detCtx, err := deterministicContext(requestID, execCtx)
+	if err != nil {
+		return nil, err
+	}
+	if err := writeRequestState(info.stateDir, requestID, detCtx); err != nil {
+		return nil, err
+	}
+
+	body, err := EncodeRequest(info.Protocol, requestID, payload, detCtx)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), defaultRequestTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "POST", fmt.Sprintf("http://%s/", info.Addr), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := m.agentClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxResponseBodySize))
+	if err != nil {
+		return nil, err
+	}
+	return DecodeResponse(info.Protocol, resp.StatusCode, data, 0)
+}
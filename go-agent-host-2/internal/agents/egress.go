@@ -0,0 +1,111 @@
+package agents
+
+import (
+	"context"
+	"log/slog"
+	"slices"
+
+	"github.com/docker/docker/api/types"
+	"github.com/somnia-chain/agent-runner/internal/sandbox"
+)
+
+// containerCABundle is where the trust store with the sandbox proxy's MITM
+// CA is mounted, over the Debian and Alpine system bundle.
+const containerCABundle = "/etc/ssl/certs/ca-certificates.crt"
+
+// caEnv returns the environment variables pointing TLS clients that do not
+// read the system bundle at the mounted trust store.
+func caEnv() []string {
+	return []string{
+		"SSL_CERT_FILE=" + containerCABundle,      // OpenSSL, Go
+		"REQUESTS_CA_BUNDLE=" + containerCABundle, // Python requests
+		"CURL_CA_BUNDLE=" + containerCABundle,     // curl
+		"NODE_EXTRA_CA_CERTS=" + containerCABundle,
+	}
+}
+
+// trustsSandboxCA reports whether a container was started with the MITM CA
+// trust store.
+func trustsSandboxCA(env []string) bool {
+	return slices.Contains(env, "SSL_CERT_FILE="+containerCABundle)
+}
+
+// SetEgressPolicy configures the sandbox proxy egress policy, used to report
+// agents whose declared egress destinations are not approved.
+func (m *Manager) SetEgressPolicy(policy *sandbox.EgressPolicy) {
+	m.egressPolicy = policy
+}
+
+// SetEgressCache configures the sandbox proxy egress cache, whose recorded
+// responses are summarized in request receipts.
+func (m *Manager) SetEgressCache(cache *sandbox.EgressCache) {
+	m.egressCache = cache
+}
+
+// EgressRecords returns summaries of the proxy responses recorded for a
+// request, in fetch order, or nil if the egress cache is disabled.
+func (m *Manager) EgressRecords(requestID string) []sandbox.EgressRecord {
+	if m.egressCache == nil {
+		return nil
+	}
+	return m.egressCache.Summaries(requestID)
+}
+
+// declaredEgress returns the egress destinations an agent declares in its
+// metadata, logging them if the operator has not approved them.
+func (m *Manager) declaredEgress(agent Agent, meta *AgentMetadata) []string {
+	if meta == nil || len(meta.Egress) == 0 {
+		return nil
+	}
+	if m.egressPolicy != nil && !m.egressPolicy.DeclaredApproved(agent.ID, agent.URL) {
+		slog.Warn("Agent declares egress destinations that are not approved",
+			"agent_id", agent.ID,
+			"agent_url", agent.URL,
+			"egress", meta.Egress,
+		)
+	}
+	return meta.Egress
+}
+
+// sandboxIP returns a container's IPv4 and IPv6 addresses on the sandbox
+// network, "" for those it has none of.
+func (m *Manager) sandboxIP(ctx context.Context, containerID string) (ip, ip6 string) {
+	if m.sandboxNetwork == nil {
+		return "", ""
+	}
+	containerJSON, err := m.client.ContainerInspect(ctx, containerID)
+	if err != nil {
+		slog.Warn("Failed to inspect container for its sandbox address", "container_id", containerID[:12], "error", err)
+		return "", ""
+	}
+	return m.endpointIP(containerJSON), m.endpointIP6(containerJSON)
+}
+
+// endpointIP returns a container's IP on the sandbox network, or on any
+// network when no sandbox network is configured.
+func (m *Manager) endpointIP(containerJSON types.ContainerJSON) string {
+	if containerJSON.NetworkSettings == nil {
+		return ""
+	}
+	for name, endpoint := range containerJSON.NetworkSettings.Networks {
+		if m.sandboxNetwork != nil && name != m.sandboxNetwork.Name {
+			continue
+		}
+		if endpoint != nil && endpoint.IPAddress != "" {
+			return endpoint.IPAddress
+		}
+	}
+	return ""
+}
+
+// endpointIP6 returns a container's global IPv6 address on a dual-stack
+// sandbox network, or "" if it has none.
+func (m *Manager) endpointIP6(containerJSON types.ContainerJSON) string {
+	if m.sandboxNetwork == nil || containerJSON.NetworkSettings == nil {
+		return ""
+	}
+	if endpoint := containerJSON.NetworkSettings.Networks[m.sandboxNetwork.Name]; endpoint != nil {
+		return endpoint.GlobalIPv6Address
+	}
+	return ""
+}
@@ -0,0 +1,45 @@
+package agents
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+// defaultRequestTimeout bounds the agent HTTP call when the caller's context
+// has no deadline.
+const defaultRequestTimeout = 60 * time.Second
+
+// ErrAgentTimeout is returned when the agent did not respond before the
+// request deadline.
+var ErrAgentTimeout = errors.New("agent request timed out")
+
+// ErrContainerCrashed is returned when the agent container died or dropped
+// the connection while handling a request.
+var ErrContainerCrashed = errors.New("agent container crashed")
+
+// AgentError is returned when the agent handled the request but reported a
+// failure, or returned a response the runner could not use. Response holds
+// what the agent returned, with Error set when the failure is typed.
+type AgentError struct {
+	Response *Response
+}
+
+func (e *AgentError) Error() string {
+	if e.Response.Error != nil {
+		return fmt.Sprintf("agent failed with status %d: %v", e.Response.Status, e.Response.Error)
+	}
+	return fmt.Sprintf("agent returned status %d", e.Response.Status)
+}
+
+// isTimeout reports whether a failed agent call ran out of time rather than
+// failing on its own.
+func isTimeout(ctx context.Context, err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
@@ -0,0 +1,266 @@
+package agents
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/events"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/errdefs"
+	"github.com/somnia-chain/agent-runner/internal/metrics"
+)
+
+// labelVersionHash marks containers managed by the runner.
+const labelVersionHash = "agent-host.version-hash"
+
+// eventReconnectDelay is the wait before resubscribing to Docker events.
+const eventReconnectDelay = 5 * time.Second
+
+// ContainerExit describes why a replica's container stopped.
+type ContainerExit struct {
+	ContainerID string
+	Name        string
+	ExitCode    int
+	OOMKilled   bool
+	Signal      string // Last signal sent to the container, if any
+	Error       string // Error reported by the runtime, if any
+	At          time.Time
+}
+
+// StartEventWatcher starts the background loop that follows Docker events for
+// runner containers and drops replicas as soon as their container dies,
+// instead of on the next request.
+func (m *Manager) StartEventWatcher() {
+	go func() {
+		for {
+			m.watchEvents()
+			select {
+			case <-m.stopCh:
+				return
+			case <-time.After(eventReconnectDelay):
+			}
+		}
+	}()
+	slog.Info("Container event watcher started", "engine", m.client.Name())
+}
+
+// watchEvents follows container events until the stream fails or the manager
+// is stopped.
+func (m *Manager) watchEvents() {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-m.stopCh:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	messages, errs := m.client.Events(ctx, events.ListOptions{
+		Filters: filters.NewArgs(
+			filters.Arg("type", string(events.ContainerEventType)),
+			filters.Arg("label", labelVersionHash),
+			filters.Arg("event", string(events.ActionDie)),
+			filters.Arg("event", string(events.ActionOOM)),
+			filters.Arg("event", string(events.ActionKill)),
+		),
+	})
+
+	// Catch up on containers that died while we were not subscribed
+	m.reconcileContainers(ctx)
+
+	for {
+		select {
+		case msg := <-messages:
+			m.handleContainerEvent(msg)
+		case err := <-errs:
+			if ctx.Err() == nil {
+				slog.Warn("Docker event stream ended, resubscribing", "error", err, "retry_in", eventReconnectDelay)
+			}
+			return
+		}
+	}
+}
+
+// handleContainerEvent reacts to a single container event.
+func (m *Manager) handleContainerEvent(msg events.Message) {
+	info := m.replicaByContainerID(msg.Actor.ID)
+	if info == nil {
+		// Not a tracked replica, e.g. one we are stopping ourselves
+		return
+	}
+
+	switch msg.Action {
+	case events.ActionKill:
+		signal := msg.Actor.Attributes["signal"]
+		m.containersMutex.Lock()
+		info.killSignal = signal
+		m.containersMutex.Unlock()
+		slog.Debug("Container received signal", "agent_url", info.URL, "name", info.Name, "signal", signal)
+	case events.ActionOOM:
+		slog.Warn("Container ran out of memory", "agent_url", info.URL, "name", info.Name, "memory_limit_mb", info.Limits.MemoryMB)
+	case events.ActionDie:
+		exitCode, _ := strconv.Atoi(msg.Actor.Attributes["exitCode"])
+		m.handleContainerExit(info, exitCode, true)
+	}
+}
+
+// reconcileContainers drops every tracked replica whose container is no
+// longer running. Replicas missing from the listing are inspected again, since
+// they may have been started after it.
+func (m *Manager) reconcileContainers(ctx context.Context) {
+	running, err := m.client.ContainerList(ctx, container.ListOptions{
+		Filters: filters.NewArgs(filters.Arg("label", labelVersionHash)),
+	})
+	if err != nil {
+		slog.Warn("Failed to list containers for reconciliation", "error", err)
+		return
+	}
+	alive := make(map[string]bool, len(running))
+	for _, c := range running {
+		alive[c.ID] = true
+	}
+
+	var dead []*ContainerInfo
+	m.containersMutex.RLock()
+	for _, set := range m.runningContainers {
+		for _, info := range set.replicas {
+			if !alive[info.ContainerID] {
+				dead = append(dead, info)
+			}
+		}
+	}
+	m.containersMutex.RUnlock()
+
+	for _, info := range dead {
+		containerJSON, err := m.client.ContainerInspect(ctx, info.ContainerID)
+		if err != nil && !errdefs.IsNotFound(err) {
+			slog.Warn("Failed to inspect container for reconciliation", "name", info.Name, "error", err)
+			continue
+		}
+		if err == nil && containerJSON.State != nil && containerJSON.State.Running {
+			continue
+		}
+		m.handleContainerExit(info, -1, true)
+	}
+}
+
+// replicaByContainerID returns the tracked replica running in a container.
+func (m *Manager) replicaByContainerID(containerID string) *ContainerInfo {
+	m.containersMutex.RLock()
+	defer m.containersMutex.RUnlock()
+
+	for _, set := range m.runningContainers {
+		for _, info := range set.replicas {
+			if info.ContainerID == containerID {
+				return info
+			}
+		}
+	}
+	return nil
+}
+
+// containerExit inspects a stopped container for its exit code and OOM flag.
+// exitCode is used if the container can no longer be inspected (-1 = unknown).
+func (m *Manager) containerExit(info *ContainerInfo, exitCode int) ContainerExit {
+	m.containersMutex.RLock()
+	exit := ContainerExit{
+		ContainerID: info.ContainerID,
+		Name:        info.Name,
+		ExitCode:    exitCode,
+		Signal:      info.killSignal,
+		At:          time.Now(),
+	}
+	m.containersMutex.RUnlock()
+
+	containerJSON, err := m.client.ContainerInspect(context.Background(), info.ContainerID)
+	if err == nil && containerJSON.State != nil {
+		exit.ExitCode = containerJSON.State.ExitCode
+		exit.OOMKilled = containerJSON.State.OOMKilled
+		exit.Error = containerJSON.State.Error
+	}
+	return exit
+}
+
+// handleContainerExit drops a replica whose container stopped, records why
+// and frees its resources. With restart set, a replacement is scheduled if
+// the pool is short.
+func (m *Manager) handleContainerExit(info *ContainerInfo, exitCode int, restart bool) {
+	exit := m.containerExit(info, exitCode)
+
+	m.containersMutex.Lock()
+	set, exists := m.runningContainers[info.VersionHash]
+	if !exists || !set.remove(info) {
+		// Already stopped, evicted or replaced
+		m.containersMutex.Unlock()
+		return
+	}
+	metrics.ContainersActive.WithLabelValues(info.URL).Dec()
+	delay := m.recordCrash(set)
+	set.lastExit = &exit
+	m.containersMutex.Unlock()
+
+	metrics.ContainerExitsTotal.WithLabelValues(info.URL, strconv.Itoa(exit.ExitCode)).Inc()
+	if exit.OOMKilled {
+		m.recordOOMKill(info, exit.ExitCode)
+	}
+	slog.Error("Agent container exited",
+		"agent_url", info.URL,
+		"name", info.Name,
+		"container_id", info.ContainerID[:12],
+		"exit_code", exit.ExitCode,
+		"oom_killed", exit.OOMKilled,
+		"signal", exit.Signal,
+		"error", exit.Error,
+		"restart_delay", delay,
+	)
+
+	m.discardReplica(info)
+	if restart {
+		m.scheduleRestart(set, delay)
+	}
+}
+
+// discardReplica removes a dead replica's container and frees its host port
+// and state directory. The caller must have already removed it from its set.
+func (m *Manager) discardReplica(info *ContainerInfo) {
+	err := m.client.ContainerRemove(context.Background(), info.ContainerID, container.RemoveOptions{Force: true})
+	if err != nil && !errdefs.IsNotFound(err) {
+		slog.Warn("Failed to remove exited container", "name", info.Name, "error", err)
+	}
+	if info.Port > 0 {
+		m.ports.Release(info.Port)
+	}
+	if info.stateDir != "" {
+		os.RemoveAll(info.stateDir)
+	}
+}
+
+// lastExit returns how the most recent replica of an agent version exited.
+func (m *Manager) lastExit(versionHash string) (ContainerExit, bool) {
+	m.containersMutex.RLock()
+	defer m.containersMutex.RUnlock()
+
+	set, exists := m.runningContainers[versionHash]
+	if !exists || set.lastExit == nil {
+		return ContainerExit{}, false
+	}
+	return *set.lastExit, true
+}
+
+// String describes the exit for error messages.
+func (e ContainerExit) String() string {
+	s := "exit code " + strconv.Itoa(e.ExitCode)
+	if e.OOMKilled {
+		s += ", OOM killed"
+	}
+	if e.Signal != "" {
+		s += ", signal " + e.Signal
+	}
+	return s
+}
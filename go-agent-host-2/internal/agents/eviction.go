@@ -0,0 +1,233 @@
+package agents
+
+import (
+	"bufio"
+	"errors"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/somnia-chain/agent-runner/internal/metrics"
+)
+
+// ErrContainerCapacity is returned when a container cannot be started because
+// the running container cap is reached and no idle container can be evicted.
+var ErrContainerCapacity = errors.New("container capacity reached and no idle container to evict")
+
+// EvictionConfig holds the idle reaping and eviction configuration.
+type EvictionConfig struct {
+	IdleTimeout     time.Duration // Stop replicas unused for this long (0 = never)
+	MaxContainers   int           // Global cap on running containers (0 = unlimited)
+	MinFreeMemoryMB int64         // Evict idle containers while host MemAvailable is below this (0 = disabled)
+	ReapInterval    time.Duration // How often idle and memory checks run
+}
+
+// SetEvictionConfig configures idle reaping and eviction.
+func (m *Manager) SetEvictionConfig(cfg EvictionConfig) {
+	if cfg.ReapInterval <= 0 {
+		cfg.ReapInterval = 30 * time.Second
+	}
+	m.eviction = cfg
+
+	slog.Info("Container eviction configured",
+		"idle_timeout", cfg.IdleTimeout,
+		"max_containers", cfg.MaxContainers,
+		"min_free_memory_mb", cfg.MinFreeMemoryMB,
+	)
+}
+
+// touch records that a replica was just used.
+func (info *ContainerInfo) touch() {
+	info.lastUsed.Store(time.Now().UnixNano())
+}
+
+// idleFor returns how long a replica has been unused.
+func (info *ContainerInfo) idleFor() time.Duration {
+	return time.Since(time.Unix(0, info.lastUsed.Load()))
+}
+
+// StartReaper starts the background loop that stops idle containers and
+// evicts least-recently-used containers under host memory pressure.
+func (m *Manager) StartReaper() {
+	if m.eviction.IdleTimeout <= 0 && m.eviction.MinFreeMemoryMB <= 0 {
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(m.eviction.ReapInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-m.stopCh:
+				return
+			case <-ticker.C:
+				m.reapIdle()
+				m.relieveMemoryPressure()
+			}
+		}
+	}()
+	slog.Info("Container reaper started", "interval", m.eviction.ReapInterval)
+}
+
+// reapIdle stops every replica that has been idle longer than the idle timeout.
+func (m *Manager) reapIdle() {
+	if m.eviction.IdleTimeout <= 0 {
+		return
+	}
+
+	var idle []*ContainerInfo
+	m.containersMutex.Lock()
+	for _, set := range m.runningContainers {
+		for _, info := range append([]*ContainerInfo(nil), set.replicas...) {
+			if info.inFlight.Load() == 0 && info.idleFor() >= m.eviction.IdleTimeout {
+				set.remove(info)
+				metrics.ContainersActive.WithLabelValues(info.URL).Dec()
+				idle = append(idle, info)
+			}
+		}
+	}
+	m.containersMutex.Unlock()
+
+	for _, info := range idle {
+		slog.Info("Stopping idle container",
+			"agent_url", info.URL,
+			"name", info.Name,
+			"idle", info.idleFor().Round(time.Second),
+		)
+		m.stopReplica(info)
+		metrics.ContainerEvictionsTotal.WithLabelValues(info.URL, "idle").Inc()
+	}
+}
+
+// relieveMemoryPressure evicts least-recently-used idle replicas until host
+// available memory is back above the configured minimum.
+func (m *Manager) relieveMemoryPressure() {
+	if m.eviction.MinFreeMemoryMB <= 0 {
+		return
+	}
+
+	for {
+		availableMB, ok := hostAvailableMemoryMB()
+		if !ok || availableMB >= m.eviction.MinFreeMemoryMB {
+			return
+		}
+
+		info := m.evictLRU()
+		if info == nil {
+			slog.Warn("Host memory pressure but no idle container to evict",
+				"available_mb", availableMB,
+				"min_free_mb", m.eviction.MinFreeMemoryMB,
+			)
+			return
+		}
+
+		slog.Warn("Evicting container under host memory pressure",
+			"agent_url", info.URL,
+			"name", info.Name,
+			"available_mb", availableMB,
+			"min_free_mb", m.eviction.MinFreeMemoryMB,
+		)
+		m.stopReplica(info)
+		metrics.ContainerEvictionsTotal.WithLabelValues(info.URL, "memory_pressure").Inc()
+	}
+}
+
+// reserveCapacity reserves room for one more container under the global cap,
+// evicting the least-recently-used idle replica if necessary. The reservation
+// counts as a running container until the caller registers the replica or
+// calls releaseCapacity, so concurrent starts cannot overshoot the cap.
+func (m *Manager) reserveCapacity() error {
+	m.containersMutex.Lock()
+	m.pendingStarts++
+	running := m.pendingStarts
+	for _, set := range m.runningContainers {
+		running += len(set.replicas)
+	}
+	if m.eviction.MaxContainers <= 0 || running <= m.eviction.MaxContainers {
+		m.containersMutex.Unlock()
+		return nil
+	}
+
+	info := m.evictLRULocked()
+	if info == nil {
+		m.pendingStarts--
+		m.containersMutex.Unlock()
+		return ErrContainerCapacity
+	}
+	m.containersMutex.Unlock()
+
+	slog.Info("Evicting least recently used container",
+		"agent_url", info.URL,
+		"name", info.Name,
+		"idle", info.idleFor().Round(time.Second),
+		"max_containers", m.eviction.MaxContainers,
+	)
+	m.stopReplica(info)
+	metrics.ContainerEvictionsTotal.WithLabelValues(info.URL, "lru").Inc()
+	return nil
+}
+
+// releaseCapacity gives back a reservation of a start that failed.
+func (m *Manager) releaseCapacity() {
+	m.containersMutex.Lock()
+	m.pendingStarts--
+	m.containersMutex.Unlock()
+}
+
+// evictLRU removes the least-recently-used idle replica from its set and
+// returns it for stopping, or nil if every replica is busy.
+func (m *Manager) evictLRU() *ContainerInfo {
+	m.containersMutex.Lock()
+	defer m.containersMutex.Unlock()
+
+	return m.evictLRULocked()
+}
+
+// evictLRULocked is evictLRU with containersMutex held.
+func (m *Manager) evictLRULocked() *ContainerInfo {
+	var lru *ContainerInfo
+	var lruSet *replicaSet
+	for _, set := range m.runningContainers {
+		for _, info := range set.replicas {
+			if info.inFlight.Load() > 0 {
+				continue
+			}
+			if lru == nil || info.lastUsed.Load() < lru.lastUsed.Load() {
+				lru = info
+				lruSet = set
+			}
+		}
+	}
+
+	if lru == nil {
+		return nil
+	}
+	lruSet.remove(lru)
+	metrics.ContainersActive.WithLabelValues(lru.URL).Dec()
+	return lru
+}
+
+// hostAvailableMemoryMB reads MemAvailable from /proc/meminfo.
+// Returns false on systems without /proc/meminfo.
+func hostAvailableMemoryMB() (int64, bool) {
+	file, err := os.Open("/proc/meminfo")
+	if err != nil {
+		return 0, false
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 2 && fields[0] == "MemAvailable:" {
+			kb, err := strconv.ParseInt(fields[1], 10, 64)
+			if err != nil {
+				return 0, false
+			}
+			return kb / 1024, true
+		}
+	}
+	return 0, false
+}
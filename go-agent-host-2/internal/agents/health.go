@@ -0,0 +1,370 @@
+package agents
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/somnia-chain/agent-runner/internal/metrics"
+)
+
+// ErrCrashLoopBackoff is returned when an agent keeps failing its health
+// checks and its next restart is being delayed.
+var ErrCrashLoopBackoff = errors.New("agent container is crash looping, restart delayed")
+
+// HealthCheck describes how an agent container is probed.
+// Zero values mean "use the runner default" for that field.
+type HealthCheck struct {
+	ReadinessPath     string `json:"readinessPath,omitempty"`     // Path that returns 2xx once the agent can serve requests
+	LivenessPath      string `json:"livenessPath,omitempty"`      // Path probed while running (defaults to the readiness path)
+	StartupTimeoutSec int    `json:"startupTimeoutSec,omitempty"` // How long a new container may take to become ready
+	IntervalSec       int    `json:"intervalSec,omitempty"`       // Time between liveness probes
+	TimeoutSec        int    `json:"timeoutSec,omitempty"`        // Timeout of a single probe
+	FailureThreshold  int    `json:"failureThreshold,omitempty"`  // Consecutive liveness failures before a restart
+}
+
+// Image labels agents may use to declare their health check.
+const (
+	labelReadinessPath    = "agent-host.health.readiness-path"
+	labelLivenessPath     = "agent-host.health.liveness-path"
+	labelStartupTimeout   = "agent-host.health.startup-timeout"
+	labelInterval         = "agent-host.health.interval"
+	labelTimeout          = "agent-host.health.timeout"
+	labelFailureThreshold = "agent-host.health.failure-threshold"
+)
+
+const (
+	// restartBackoffBase is the delay before the first restart of a crashed agent.
+	restartBackoffBase = time.Second
+	// restartBackoffMax caps the crash-loop restart delay.
+	restartBackoffMax = 5 * time.Minute
+	// restartBackoffReset is how long an agent must stay up for its backoff to reset.
+	restartBackoffReset = 10 * time.Minute
+	// maxRestartFailures is how many replacement replicas in a row may fail to
+	// start before restarts are left to the next request.
+	maxRestartFailures = 5
+)
+
+// DefaultHealthCheck returns the health check used for agents that declare none.
+// Without a readiness path, any non-5xx response on "/" counts as healthy.
+func DefaultHealthCheck() HealthCheck {
+	return HealthCheck{
+		StartupTimeoutSec: 30,
+		IntervalSec:       15,
+		TimeoutSec:        2,
+		FailureThreshold:  3,
+	}
+}
+
+// Merge returns a copy of h with every non-zero field of o applied on top.
+func (h HealthCheck) Merge(o HealthCheck) HealthCheck {
+	if o.ReadinessPath != "" {
+		h.ReadinessPath = o.ReadinessPath
+	}
+	if o.LivenessPath != "" {
+		h.LivenessPath = o.LivenessPath
+	}
+	if o.StartupTimeoutSec > 0 {
+		h.StartupTimeoutSec = o.StartupTimeoutSec
+	}
+	if o.IntervalSec > 0 {
+		h.IntervalSec = o.IntervalSec
+	}
+	if o.TimeoutSec > 0 {
+		h.TimeoutSec = o.TimeoutSec
+	}
+	if o.FailureThreshold > 0 {
+		h.FailureThreshold = o.FailureThreshold
+	}
+	return h
+}
+
+// livenessPath returns the path probed while the container is running.
+func (h HealthCheck) livenessPath() string {
+	if h.LivenessPath != "" {
+		return h.LivenessPath
+	}
+	return h.ReadinessPath
+}
+
+// healthCheckFromLabels reads a health check declared in image labels.
+// Malformed numeric labels are ignored.
+func healthCheckFromLabels(labels map[string]string) HealthCheck {
+	atoi := func(key string) int {
+		n, err := strconv.Atoi(labels[key])
+		if err != nil || n < 0 {
+			return 0
+		}
+		return n
+	}
+	return HealthCheck{
+		ReadinessPath:     labels[labelReadinessPath],
+		LivenessPath:      labels[labelLivenessPath],
+		StartupTimeoutSec: atoi(labelStartupTimeout),
+		IntervalSec:       atoi(labelInterval),
+		TimeoutSec:        atoi(labelTimeout),
+		FailureThreshold:  atoi(labelFailureThreshold),
+	}
+}
+
+// SetHealthCheckDefaults configures the health check applied to agents that
+// do not declare their own.
+func (m *Manager) SetHealthCheckDefaults(hc HealthCheck) {
+	m.healthDefaults = DefaultHealthCheck().Merge(hc)
+
+	slog.Info("Container health checks configured",
+		"startup_timeout_sec", m.healthDefaults.StartupTimeoutSec,
+		"interval_sec", m.healthDefaults.IntervalSec,
+		"timeout_sec", m.healthDefaults.TimeoutSec,
+		"failure_threshold", m.healthDefaults.FailureThreshold,
+	)
+}
+
+// imageLabels returns the labels of a loaded image, or nil if it cannot be inspected.
+func (m *Manager) imageLabels(ctx context.Context, imageName string) map[string]string {
+	inspect, _, err := m.client.ImageInspectWithRaw(ctx, imageName)
+	if err != nil {
+		slog.Warn("Failed to inspect image labels", "image", imageName, "error", err)
+		return nil
+	}
+	if inspect.Config == nil {
+		return nil
+	}
+	return inspect.Config.Labels
+}
+
+// resolveHealthCheck combines runner defaults, image labels and agent
+// metadata, in increasing order of precedence.
+func (m *Manager) resolveHealthCheck(labels map[string]string, meta *AgentMetadata) HealthCheck {
+	hc := m.healthDefaults.Merge(healthCheckFromLabels(labels))
+
+	if meta != nil && meta.HealthCheck != nil {
+		hc = hc.Merge(*meta.HealthCheck)
+	}
+	return hc
+}
+
+// probeContainer sends a single health probe. With an empty path, "/" is
+// probed and any non-5xx response is accepted, since agents only have to
+// implement POST /. A declared path must return 2xx.
+func probeContainer(ctx context.Context, client *http.Client, addr, path string) (int, error) {
+	strict := path != ""
+	if path == "" {
+		path = "/"
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", fmt.Sprintf("http://%s%s", addr, path), nil)
+	if err != nil {
+		return 0, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode >= 500 || (strict && (resp.StatusCode < 200 || resp.StatusCode > 299)) {
+		return resp.StatusCode, fmt.Errorf("health check %s returned %d", path, resp.StatusCode)
+	}
+	return resp.StatusCode, nil
+}
+
+// StartHealthMonitor starts the background loop that probes running replicas
+// and restarts those failing their liveness check.
+func (m *Manager) StartHealthMonitor() {
+	go func() {
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-m.stopCh:
+				return
+			case <-ticker.C:
+				m.probeReplicas()
+			}
+		}
+	}()
+	slog.Info("Container health monitor started")
+}
+
+// probeReplicas starts a liveness probe for every replica that is due.
+func (m *Manager) probeReplicas() {
+	var due []*ContainerInfo
+	m.containersMutex.RLock()
+	for _, set := range m.runningContainers {
+		for _, info := range set.replicas {
+			interval := time.Duration(info.Health.IntervalSec) * time.Second
+			if interval > 0 && time.Since(info.lastProbe) >= interval && !info.probing.Load() {
+				due = append(due, info)
+			}
+		}
+	}
+	m.containersMutex.RUnlock()
+
+	for _, info := range due {
+		info.probing.Store(true)
+		info.lastProbe = time.Now()
+		go func() {
+			defer info.probing.Store(false)
+			m.checkLiveness(info)
+		}()
+	}
+}
+
+// checkLiveness probes one replica and restarts it once it has failed
+// FailureThreshold probes in a row.
+func (m *Manager) checkLiveness(info *ContainerInfo) {
+	client := &http.Client{Timeout: time.Duration(info.Health.TimeoutSec) * time.Second}
+	_, err := probeContainer(context.Background(), client, info.Addr, info.Health.livenessPath())
+	if err == nil {
+		info.probeFailures = 0
+		metrics.AgentHealthy.WithLabelValues(info.URL).Set(1)
+		return
+	}
+
+	info.probeFailures++
+	metrics.ContainerHealthCheckFailuresTotal.WithLabelValues(info.URL, "liveness").Inc()
+	slog.Warn("Container liveness check failed",
+		"agent_url", info.URL,
+		"name", info.Name,
+		"failures", info.probeFailures,
+		"threshold", info.Health.FailureThreshold,
+		"error", err,
+	)
+	if info.probeFailures < info.Health.FailureThreshold {
+		return
+	}
+	metrics.AgentHealthy.WithLabelValues(info.URL).Set(0)
+
+	m.containersMutex.Lock()
+	set, exists := m.runningContainers[info.VersionHash]
+	if !exists || !set.remove(info) {
+		// Already stopped, evicted or replaced
+		m.containersMutex.Unlock()
+		return
+	}
+	metrics.ContainersActive.WithLabelValues(info.URL).Dec()
+	delay := m.recordCrash(set)
+	m.containersMutex.Unlock()
+
+	slog.Error("Restarting unhealthy container",
+		"agent_url", info.URL,
+		"name", info.Name,
+		"restart_delay", delay,
+	)
+	m.stopReplica(info)
+	m.scheduleRestart(set, delay)
+}
+
+// recordCrash notes a failed replica and returns how long to wait before
+// starting a replacement. Must be called with containersMutex held.
+func (m *Manager) recordCrash(set *replicaSet) time.Duration {
+	if time.Since(set.lastCrash) > restartBackoffReset {
+		set.crashes = 0
+	}
+	set.crashes++
+	set.lastCrash = time.Now()
+
+	// The first crash is restarted immediately, repeated ones back off exponentially
+	var delay time.Duration
+	if set.crashes > 1 {
+		delay = min(restartBackoffBase<<min(set.crashes-2, 16), restartBackoffMax)
+	}
+	set.restartAt = time.Now().Add(delay)
+	return delay
+}
+
+// scheduleRestart starts a replacement replica after the crash-loop delay if
+// the set has dropped below its minimum size. Restarts stop once the set has
+// been idle for IdleTimeout or maxRestartFailures replacements in a row have
+// failed; the next request then starts the agent again.
+func (m *Manager) scheduleRestart(set *replicaSet, delay time.Duration) {
+	go func() {
+		select {
+		case <-m.stopCh:
+			return
+		case <-time.After(delay):
+		}
+
+		m.containersMutex.RLock()
+		current := m.runningContainers[set.versionHash]
+		needed := current == set && len(set.replicas) < m.minReplicas(set)
+		idle := m.eviction.IdleTimeout > 0 && time.Since(set.lastRequest) >= m.eviction.IdleTimeout
+		m.containersMutex.RUnlock()
+		if !needed {
+			return
+		}
+		if idle {
+			m.abandonRestart(set, "idle")
+			return
+		}
+
+		metrics.ContainerRestartsTotal.WithLabelValues(set.agent.URL).Inc()
+		if _, err := m.startReplica(context.Background(), set.agent, set.versionHash); err != nil {
+			slog.Warn("Failed to restart agent container",
+				"agent_url", set.agent.URL,
+				"version", set.versionHash,
+				"error", err,
+			)
+			// A failed readiness check already recorded the crash
+			m.containersMutex.Lock()
+			set.restartFailures++
+			failures := set.restartFailures
+			delay := time.Until(set.restartAt)
+			if delay <= 0 {
+				delay = m.recordCrash(set)
+			}
+			m.containersMutex.Unlock()
+			if failures >= maxRestartFailures {
+				m.abandonRestart(set, "failures")
+				return
+			}
+			m.scheduleRestart(set, delay)
+			return
+		}
+
+		m.containersMutex.Lock()
+		set.restartFailures = 0
+		m.containersMutex.Unlock()
+	}()
+}
+
+// abandonRestart stops restarting a set and forgets it if it has no replicas
+// left, so it holds no container slot and the next request cold-starts it.
+func (m *Manager) abandonRestart(set *replicaSet, reason string) {
+	m.containersMutex.Lock()
+	removed := m.runningContainers[set.versionHash] == set && len(set.replicas) == 0
+	if removed {
+		delete(m.runningContainers, set.versionHash)
+	}
+	failures := set.restartFailures
+	m.containersMutex.Unlock()
+
+	slog.Warn("Stopped restarting agent container",
+		"agent_url", set.agent.URL,
+		"version", set.versionHash,
+		"reason", reason,
+		"failed_restarts", failures,
+		"removed", removed,
+	)
+}
+
+// crashLoopDelay returns the remaining restart delay of a crash-looping
+// version with no running replicas, or zero.
+func (m *Manager) crashLoopDelay(versionHash string) time.Duration {
+	m.containersMutex.RLock()
+	defer m.containersMutex.RUnlock()
+
+	set, exists := m.runningContainers[versionHash]
+	if !exists || len(set.replicas) > 0 {
+		return 0
+	}
+	if remaining := time.Until(set.restartAt); remaining > 0 {
+		return remaining
+	}
+	return 0
+}
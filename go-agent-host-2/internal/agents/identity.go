@@ -0,0 +1,184 @@
+package agents
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/somnia-chain/agent-runner/internal/sandbox"
+)
+
+// ErrProxyAuth is returned for sandbox proxy requests with missing or
+// invalid per-container credentials.
+var ErrProxyAuth = errors.New("invalid sandbox proxy credentials")
+
+// SetProxyAuthRequired makes the sandbox proxy reject requests without valid
+// per-container credentials. Otherwise they are identified by source address.
+func (m *Manager) SetProxyAuthRequired(required bool) {
+	m.proxyAuthRequired = required
+}
+
+// newProxyToken mints a random per-container proxy password.
+func newProxyToken() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// proxyEnv returns the environment variables routing a container's HTTP
+// traffic through the sandbox proxy with its credentials.
+func (m *Manager) proxyEnv(containerName, token string) []string {
+	proxyURL := (&url.URL{
+		Scheme: "http",
+		User:   url.UserPassword(containerName, token),
+		Host:   net.JoinHostPort(m.sandboxNetwork.Gateway, fmt.Sprint(m.sandboxNetwork.ProxyPort)),
+	}).String()
+	noProxy := "localhost,127.0.0.1," + m.sandboxNetwork.Gateway
+	return []string{
+		"HTTP_PROXY=" + proxyURL,
+		"HTTPS_PROXY=" + proxyURL,
+		"http_proxy=" + proxyURL,
+		"https_proxy=" + proxyURL,
+		"NO_PROXY=" + noProxy,
+		"no_proxy=" + noProxy,
+	}
+}
+
+// proxyTokenFromEnv recovers the proxy password from a container's environment.
+func proxyTokenFromEnv(env []string) string {
+	for _, kv := range env {
+		if value, ok := strings.CutPrefix(kv, "HTTP_PROXY="); ok {
+			if u, err := url.Parse(value); err == nil && u.User != nil {
+				token, _ := u.User.Password()
+				return token
+			}
+		}
+	}
+	return ""
+}
+
+// AuthenticateProxy checks the per-container credentials of a sandbox proxy
+// request. Requests without credentials pass unless they are required.
+func (m *Manager) AuthenticateProxy(r *http.Request) error {
+	name, _, ok := proxyCredentials(r)
+	if !ok {
+		if m.proxyAuthRequired {
+			return ErrProxyAuth
+		}
+		return nil
+	}
+	if m.proxyClientByName(r, name) == nil {
+		return ErrProxyAuth
+	}
+	return nil
+}
+
+// ProxyClient identifies the agent and request behind a sandbox proxy
+// request, by its credentials or else its source address on the sandbox
+// network. It returns nil for unknown clients.
+func (m *Manager) ProxyClient(r *http.Request) *sandbox.ProxyClient {
+	if name, _, ok := proxyCredentials(r); ok {
+		return m.proxyClientByName(r, name)
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return nil
+	}
+	return m.sandboxClient(host, r.Header.Get("X-Request-Id"))
+}
+
+// SandboxClient identifies the agent and request behind traffic from an
+// address on the sandbox network, such as a DNS query. It returns nil for
+// unknown addresses.
+func (m *Manager) SandboxClient(ip string) *sandbox.ProxyClient {
+	return m.sandboxClient(ip, "")
+}
+
+func (m *Manager) sandboxClient(ip, tagged string) *sandbox.ProxyClient {
+	return m.findProxyClient(tagged, func(info *ContainerInfo) bool {
+		return ip != "" && (info.sandboxIP == ip || info.sandboxIP6 == ip)
+	})
+}
+
+// proxyClientByName identifies a client by its credentials.
+func (m *Manager) proxyClientByName(r *http.Request, name string) *sandbox.ProxyClient {
+	_, token, _ := proxyCredentials(r)
+	return m.findProxyClient(r.Header.Get("X-Request-Id"), func(info *ContainerInfo) bool {
+		return info.Name == name && info.proxyToken != "" &&
+			subtle.ConstantTimeCompare([]byte(info.proxyToken), []byte(token)) == 1
+	})
+}
+
+func (m *Manager) findProxyClient(tagged string, match func(*ContainerInfo) bool) *sandbox.ProxyClient {
+	m.containersMutex.RLock()
+	defer m.containersMutex.RUnlock()
+
+	for _, set := range m.runningContainers {
+		for _, info := range set.replicas {
+			if match(info) {
+				return &sandbox.ProxyClient{
+					AgentID:   set.agent.ID,
+					AgentURL:  set.agent.URL,
+					Container: info.Name,
+					RequestID: info.proxyRequestID(tagged),
+					Egress:    info.egress,
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// proxyCredentials returns the Basic credentials of a proxy request.
+func proxyCredentials(r *http.Request) (name, token string, ok bool) {
+	auth := r.Header.Get("Proxy-Authorization")
+	if auth == "" {
+		return "", "", false
+	}
+	return (&http.Request{Header: http.Header{"Authorization": {auth}}}).BasicAuth()
+}
+
+// beginRequest records a request as in flight on the replica.
+func (info *ContainerInfo) beginRequest(requestID string) {
+	info.requestsMu.Lock()
+	defer info.requestsMu.Unlock()
+
+	info.requests = append(info.requests, requestID)
+}
+
+// endRequest removes a request recorded by beginRequest.
+func (info *ContainerInfo) endRequest(requestID string) {
+	info.requestsMu.Lock()
+	defer info.requestsMu.Unlock()
+
+	for i, id := range info.requests {
+		if id == requestID {
+			info.requests = append(info.requests[:i], info.requests[i+1:]...)
+			return
+		}
+	}
+}
+
+// proxyRequestID attributes a proxy request to an in-flight request: the one
+// the agent tagged it with, or the only one running on the replica.
+func (info *ContainerInfo) proxyRequestID(tagged string) string {
+	info.requestsMu.Lock()
+	defer info.requestsMu.Unlock()
+
+	for _, id := range info.requests {
+		if tagged != "" && id == tagged {
+			return id
+		}
+	}
+	if len(info.requests) == 1 {
+		return info.requests[0]
+	}
+	return ""
+}
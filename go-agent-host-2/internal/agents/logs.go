@@ -0,0 +1,265 @@
+package agents
+
+import (
+	"context"
+	"log/slog"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LogSettleTime is how long after a request finishes its captured logs keep
+// accepting lines, since the container log stream lags behind the response.
+const LogSettleTime = time.Second
+
+// LogCaptureConfig holds the per-request log capture configuration.
+type LogCaptureConfig struct {
+	MaxBytes int // Captured bytes per request (0 = capture disabled)
+	Retain   int // Finished requests whose logs are kept for the admin API
+}
+
+// DefaultLogCaptureConfig returns the default log capture configuration.
+func DefaultLogCaptureConfig() LogCaptureConfig {
+	return LogCaptureConfig{
+		MaxBytes: 64 << 10,
+		Retain:   1000,
+	}
+}
+
+// LogLine is one line an agent container wrote while handling a request.
+type LogLine struct {
+	Time      time.Time `json:"time"`
+	Container string    `json:"container"`
+	Stream    string    `json:"stream"` // stdout or stderr
+	Message   string    `json:"message"`
+}
+
+// RequestLog holds the lines captured for one request.
+type RequestLog struct {
+	RequestID string    `json:"requestId"`
+	Lines     []LogLine `json:"lines"`
+	Truncated bool      `json:"truncated"` // Lines were dropped after MaxBytes
+}
+
+// requestIDPattern finds a request ID an agent tagged a log line with, as
+// requestId=ID, request_id=ID or a JSON "requestId" field.
+var requestIDPattern = regexp.MustCompile(`(?i)"?request_?id"?\s*[:=]\s*"?([0-9A-Za-z_-]+)`)
+
+// logLevelPattern finds a log level at the start of a line or in a JSON
+// "level" field.
+var logLevelPattern = regexp.MustCompile(`(?i)^\[?(debug|info|warn|warning|error|fatal|critical)\b|"(?:level|severity)"\s*:\s*"(debug|info|warn|warning|error|fatal|critical)"`)
+
+// logCapture collects the lines of one request.
+type logCapture struct {
+	log   RequestLog
+	bytes int
+}
+
+// activeCapture is a request running on a container, or finished less than
+// LogSettleTime ago.
+type activeCapture struct {
+	capture *logCapture
+	start   time.Time
+	end     time.Time // Zero while the request is in flight
+}
+
+// logCaptures routes container log lines to the requests that produced them.
+type logCaptures struct {
+	mu        sync.Mutex
+	cfg       LogCaptureConfig
+	active    map[string][]*activeCapture // Container ID -> requests on it
+	byRequest map[string]*logCapture
+	order     []string // Request IDs, oldest first
+}
+
+func newLogCaptures(cfg LogCaptureConfig) *logCaptures {
+	return &logCaptures{
+		cfg:       cfg,
+		active:    make(map[string][]*activeCapture),
+		byRequest: make(map[string]*logCapture),
+	}
+}
+
+// SetLogCaptureConfig configures per-request log capture.
+func (m *Manager) SetLogCaptureConfig(cfg LogCaptureConfig) {
+	if cfg.MaxBytes < 0 {
+		cfg.MaxBytes = 0
+	}
+	if cfg.Retain < 1 {
+		cfg.Retain = DefaultLogCaptureConfig().Retain
+	}
+	m.logs.mu.Lock()
+	m.logs.cfg = cfg
+	m.logs.mu.Unlock()
+
+	slog.Info("Request log capture configured",
+		"max_bytes", cfg.MaxBytes,
+		"retain", cfg.Retain,
+	)
+}
+
+// RequestLogs returns the container logs captured for a request.
+func (m *Manager) RequestLogs(requestID string) (RequestLog, bool) {
+	m.logs.mu.Lock()
+	defer m.logs.mu.Unlock()
+
+	capture, exists := m.logs.byRequest[requestID]
+	if !exists {
+		return RequestLog{}, false
+	}
+	log := capture.log
+	log.Lines = append([]LogLine(nil), capture.log.Lines...)
+	return log, true
+}
+
+// begin starts capturing a request's logs on a container and returns a
+// function that marks the request finished.
+func (c *logCaptures) begin(containerID, requestID string) func() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.cfg.MaxBytes == 0 || requestID == "" {
+		return func() {}
+	}
+
+	// A request run on a second container (self-check) shares its capture
+	capture, exists := c.byRequest[requestID]
+	if !exists {
+		capture = &logCapture{log: RequestLog{RequestID: requestID}}
+		c.byRequest[requestID] = capture
+		c.order = append(c.order, requestID)
+		for len(c.order) > c.cfg.Retain {
+			delete(c.byRequest, c.order[0])
+			c.order = c.order[1:]
+		}
+	}
+
+	active := &activeCapture{capture: capture, start: time.Now()}
+	c.active[containerID] = append(c.pruned(containerID), active)
+
+	return func() {
+		c.mu.Lock()
+		active.end = time.Now()
+		c.mu.Unlock()
+	}
+}
+
+// pruned drops captures that finished more than LogSettleTime ago from a
+// container's active list and returns what is left.
+// Must be called with mu held.
+func (c *logCaptures) pruned(containerID string) []*activeCapture {
+	kept := c.active[containerID][:0]
+	for _, active := range c.active[containerID] {
+		if active.end.IsZero() || time.Since(active.end) < LogSettleTime {
+			kept = append(kept, active)
+		}
+	}
+	if len(kept) == 0 {
+		delete(c.active, containerID)
+		return nil
+	}
+	c.active[containerID] = kept
+	return kept
+}
+
+// route attributes a log line to a request and returns its ID, or "" if the
+// line cannot be attributed. A line tagged with a request ID goes to that
+// request; an untagged line goes to the only request running on the container
+// when it was written.
+func (c *logCaptures) route(containerID string, line LogLine) string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	actives := c.pruned(containerID)
+	if len(actives) == 0 {
+		return ""
+	}
+
+	var target *logCapture
+	if match := requestIDPattern.FindStringSubmatch(line.Message); match != nil {
+		for _, active := range actives {
+			if active.capture.log.RequestID == match[1] {
+				target = active.capture
+				break
+			}
+		}
+	}
+	if target == nil {
+		var candidates []*activeCapture
+		for _, active := range actives {
+			if !line.Time.Before(active.start) && (active.end.IsZero() || !line.Time.After(active.end)) {
+				candidates = append(candidates, active)
+			}
+		}
+		if len(candidates) != 1 {
+			return ""
+		}
+		target = candidates[0].capture
+	}
+
+	if target.bytes+len(line.Message) > c.cfg.MaxBytes {
+		target.log.Truncated = true
+	} else {
+		target.bytes += len(line.Message)
+		target.log.Lines = append(target.log.Lines, line)
+	}
+	return target.log.RequestID
+}
+
+// parseLogLine splits a Docker log line with a timestamp prefix.
+func parseLogLine(raw string) (time.Time, string) {
+	if i := strings.IndexByte(raw, ' '); i > 0 {
+		if t, err := time.Parse(time.RFC3339Nano, raw[:i]); err == nil {
+			return t, strings.TrimSpace(raw[i+1:])
+		}
+	}
+	return time.Now(), strings.TrimSpace(raw)
+}
+
+// logLevel picks the slog level for a container log line from the level the
+// agent wrote, falling back to INFO for stdout and WARN for stderr.
+func logLevel(stream, message string) slog.Level {
+	if match := logLevelPattern.FindStringSubmatch(message); match != nil {
+		level := match[1]
+		if level == "" {
+			level = match[2]
+		}
+		switch strings.ToLower(level) {
+		case "debug":
+			return slog.LevelDebug
+		case "info":
+			return slog.LevelInfo
+		case "warn", "warning":
+			return slog.LevelWarn
+		default:
+			return slog.LevelError
+		}
+	}
+	if stream == "stderr" {
+		return slog.LevelWarn
+	}
+	return slog.LevelInfo
+}
+
+// logContainerLine captures a container log line for its request and writes
+// it to the global log.
+func (m *Manager) logContainerLine(containerID, containerName, versionHash, agentURL, stream, raw string) {
+	t, message := parseLogLine(raw)
+	if message == "" {
+		return
+	}
+
+	requestID := m.logs.route(containerID, LogLine{
+		Time:      t,
+		Container: containerName,
+		Stream:    stream,
+		Message:   message,
+	})
+
+	attrs := []any{"version", versionHash, "agent_url", agentURL, "stream", stream, "message", message}
+	if requestID != "" {
+		attrs = append(attrs, "request_id", requestID)
+	}
+	slog.Log(context.Background(), logLevel(stream, message), "Container output", attrs...)
+}
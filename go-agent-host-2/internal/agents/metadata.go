@@ -0,0 +1,92 @@
+package agents
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Agent identifies an on-chain agent whose container the manager runs.
+type Agent struct {
+	ID          string // On-chain agent ID (may be empty for ad-hoc runs)
+	URL         string // Container image URL
+	MetadataURI string // URI of the agent's metadata JSON (may be empty)
+}
+
+// AgentMetadata holds the runner-relevant fields of an agent's metadata JSON.
+// Unknown fields are ignored.
+type AgentMetadata struct {
+	Resources   *ResourceLimits `json:"resources,omitempty"`
+	HealthCheck *HealthCheck    `json:"healthCheck,omitempty"`
+	// DeterminismProbe is a hex request payload run twice at startup in
+	// determinism mode to check that the agent's output is reproducible.
+	DeterminismProbe string `json:"determinismProbe,omitempty"`
+	// Egress lists the destinations the agent needs to reach through the
+	// sandbox proxy, in egress policy rule syntax. They are allowed only if
+	// the operator approves them.
+	Egress []string `json:"egress,omitempty"`
+}
+
+// metadataCacheEntry holds cached agent metadata with expiry time.
+type metadataCacheEntry struct {
+	metadata  *AgentMetadata
+	expiresAt time.Time
+}
+
+// maxMetadataSize bounds the size of a metadata document we are willing to parse.
+const maxMetadataSize = 1 << 20
+
+// getMetadata fetches and caches the agent's metadata JSON.
+// Returns nil (not an error) when the agent has no fetchable metadata URI.
+func (m *Manager) getMetadata(ctx context.Context, agent Agent) (*AgentMetadata, error) {
+	uri := agent.MetadataURI
+	if uri == "" || !(strings.HasPrefix(uri, "http://") || strings.HasPrefix(uri, "https://")) {
+		return nil, nil
+	}
+
+	m.metadataCacheMutex.RLock()
+	if entry, exists := m.metadataCache[uri]; exists && time.Now().Before(entry.expiresAt) {
+		m.metadataCacheMutex.RUnlock()
+		return entry.metadata, nil
+	}
+	m.metadataCacheMutex.RUnlock()
+
+	req, err := http.NewRequestWithContext(ctx, "GET", uri, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create metadata request: %w", err)
+	}
+	resp, err := m.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch agent metadata: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to fetch agent metadata: %d %s", resp.StatusCode, resp.Status)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxMetadataSize))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read agent metadata: %w", err)
+	}
+
+	var metadata AgentMetadata
+	if err := json.Unmarshal(data, &metadata); err != nil {
+		return nil, fmt.Errorf("failed to parse agent metadata: %w", err)
+	}
+
+	m.metadataCacheMutex.Lock()
+	m.metadataCache[uri] = &metadataCacheEntry{
+		metadata:  &metadata,
+		expiresAt: time.Now().Add(m.metadataCacheTTL),
+	}
+	m.metadataCacheMutex.Unlock()
+
+	slog.Debug("Agent metadata fetched", "agent_id", agent.ID, "uri", uri)
+	return &metadata, nil
+}
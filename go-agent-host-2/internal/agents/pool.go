@@ -0,0 +1,378 @@
+package agents
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/somnia-chain/agent-runner/internal/metrics"
+)
+
+// PoolConfig holds the replica pool and autoscaling configuration.
+type PoolConfig struct {
+	MaxReplicas       int           // Maximum replicas per agent version (1 = single container)
+	WarmReplicas      int           // Minimum replicas kept warm for popular agents
+	PopularThreshold  float64       // Requests per minute above which an agent is popular
+	TargetInFlight    int           // Target concurrent requests per replica
+	LatencyThreshold  time.Duration // Scale up when average latency exceeds this (0 = disabled)
+	ScaleInterval     time.Duration // How often the autoscaler evaluates replica sets
+	ScaleDownCooldown time.Duration // Minimum time between scale-downs of the same agent
+}
+
+const (
+	// latencyEWMAAlpha weights the latest request latency in the moving average.
+	latencyEWMAAlpha = 0.2
+	// requestRateEWMAAlpha weights the latest tick's request rate in the moving average.
+	requestRateEWMAAlpha = 0.5
+)
+
+// DefaultPoolConfig returns a pool configuration equivalent to one container per agent.
+func DefaultPoolConfig() PoolConfig {
+	return PoolConfig{
+		MaxReplicas:       1,
+		WarmReplicas:      1,
+		PopularThreshold:  30,
+		TargetInFlight:    4,
+		ScaleInterval:     10 * time.Second,
+		ScaleDownCooldown: 60 * time.Second,
+	}
+}
+
+// replicaSet holds the running replicas of a single agent version.
+// All fields are guarded by Manager.containersMutex.
+type replicaSet struct {
+	agent       Agent
+	versionHash string
+	imageName   string
+	replicas    []*ContainerInfo
+	nextReplica int
+
+	scalingUp     bool      // A background scale-up is in progress
+	lastScaleDown time.Time // Last time a replica was removed by the autoscaler
+	latencyEWMA   float64   // Exponentially weighted request latency in seconds
+	requests      int64     // Requests since the last autoscaler tick
+	requestRate   float64   // Smoothed requests per minute
+	lastRequest   time.Time // Last time a request was routed to the set
+
+	crashes         int            // Consecutive crashes within the backoff reset window
+	lastCrash       time.Time      // Last time a replica failed its health checks or died
+	restartAt       time.Time      // Earliest time a replacement replica may be started
+	restartFailures int            // Consecutive failed restarts of a replacement replica
+	lastExit        *ContainerExit // How the last dead replica exited
+}
+
+func newReplicaSet(agent Agent, versionHash string) *replicaSet {
+	return &replicaSet{
+		agent:       agent,
+		versionHash: versionHash,
+		lastRequest: time.Now(),
+	}
+}
+
+// leastLoaded returns the replica with the fewest in-flight requests.
+func (s *replicaSet) leastLoaded() *ContainerInfo {
+	return s.leastLoadedExcept("")
+}
+
+// leastLoadedExcept returns the least-loaded replica other than the named one.
+func (s *replicaSet) leastLoadedExcept(name string) *ContainerInfo {
+	var best *ContainerInfo
+	for _, info := range s.replicas {
+		if name != "" && info.Name == name {
+			continue
+		}
+		if best == nil || info.inFlight.Load() < best.inFlight.Load() {
+			best = info
+		}
+	}
+	return best
+}
+
+// inFlight returns the total number of in-flight requests across replicas.
+func (s *replicaSet) inFlight() int64 {
+	var total int64
+	for _, info := range s.replicas {
+		total += info.inFlight.Load()
+	}
+	return total
+}
+
+// remove drops a replica from the set, returning false if it was not present.
+func (s *replicaSet) remove(target *ContainerInfo) bool {
+	for i, info := range s.replicas {
+		if info == target {
+			s.replicas = append(s.replicas[:i], s.replicas[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// SetPoolConfig configures replica pooling and autoscaling.
+func (m *Manager) SetPoolConfig(cfg PoolConfig) {
+	if cfg.MaxReplicas < 1 {
+		cfg.MaxReplicas = 1
+	}
+	if cfg.WarmReplicas < 1 {
+		cfg.WarmReplicas = 1
+	}
+	if cfg.WarmReplicas > cfg.MaxReplicas {
+		cfg.WarmReplicas = cfg.MaxReplicas
+	}
+	if cfg.TargetInFlight < 1 {
+		cfg.TargetInFlight = 1
+	}
+	if cfg.ScaleInterval <= 0 {
+		cfg.ScaleInterval = 10 * time.Second
+	}
+	m.pool = cfg
+
+	slog.Info("Container pool configured",
+		"max_replicas", cfg.MaxReplicas,
+		"warm_replicas", cfg.WarmReplicas,
+		"popular_threshold_rpm", cfg.PopularThreshold,
+		"target_in_flight", cfg.TargetInFlight,
+		"latency_threshold", cfg.LatencyThreshold,
+	)
+}
+
+// acquireReplica picks the least-loaded replica for an agent and marks a
+// request in flight on it. If every replica is at its target load, a
+// background scale-up is triggered. A non-empty exclude names a replica that
+// must not be picked; if it is the only one, another replica is started even
+// beyond MaxReplicas, and releaseReplica stops it again once it is idle.
+func (m *Manager) acquireReplica(ctx context.Context, agent Agent, exclude string) (*ContainerInfo, bool, error) {
+	var info *ContainerInfo
+	var newlyStarted bool
+	var inFlight int64
+
+	// Retry if the replica is evicted between ensureReplica and marking it in flight
+	for attempt := 0; info == nil; attempt++ {
+		ensured, started, err := m.ensureReplica(ctx, agent)
+		if err != nil {
+			return nil, false, err
+		}
+		newlyStarted = newlyStarted || started
+
+		m.containersMutex.Lock()
+		set, exists := m.runningContainers[ensured.VersionHash]
+		if exists {
+			info = set.leastLoadedExcept(exclude)
+			if info != nil {
+				set.requests++
+				set.lastRequest = time.Now()
+				inFlight = info.inFlight.Add(1)
+				info.touch()
+				if m.shouldScaleUp(set) {
+					set.scalingUp = true
+					go m.scaleUp(set)
+				}
+			}
+		}
+		m.containersMutex.Unlock()
+
+		if info == nil && exists && exclude != "" && attempt < 2 {
+			// Only the excluded replica is running; start an independent one
+			started, err := m.startReplica(ctx, agent, ensured.VersionHash)
+			if err != nil {
+				return nil, false, err
+			}
+			m.containersMutex.Lock()
+			if set, exists := m.runningContainers[started.VersionHash]; exists && len(set.replicas) > m.pool.MaxReplicas {
+				started.surplus = true
+			}
+			m.containersMutex.Unlock()
+			newlyStarted = true
+			continue
+		}
+		if info == nil && attempt >= 2 {
+			return nil, false, fmt.Errorf("no replica available for %s", agent.URL)
+		}
+	}
+
+	metrics.AgentInFlightRequests.WithLabelValues(info.URL).Inc()
+	slog.Debug("Replica acquired",
+		"agent_url", info.URL,
+		"name", info.Name,
+		"in_flight", inFlight,
+	)
+	return info, newlyStarted, nil
+}
+
+// releaseReplica marks a request on a replica as finished and records its
+// latency. An idle surplus replica is stopped while the set exceeds MaxReplicas.
+func (m *Manager) releaseReplica(info *ContainerInfo, duration time.Duration) {
+	info.inFlight.Add(-1)
+	info.touch()
+	metrics.AgentInFlightRequests.WithLabelValues(info.URL).Dec()
+
+	stop := false
+	m.containersMutex.Lock()
+	if set, exists := m.runningContainers[info.VersionHash]; exists {
+		if set.latencyEWMA == 0 {
+			set.latencyEWMA = duration.Seconds()
+		} else {
+			set.latencyEWMA = latencyEWMAAlpha*duration.Seconds() + (1-latencyEWMAAlpha)*set.latencyEWMA
+		}
+		if info.surplus && info.inFlight.Load() == 0 && len(set.replicas) > m.pool.MaxReplicas && set.remove(info) {
+			stop = true
+			metrics.ContainersActive.WithLabelValues(info.URL).Dec()
+		}
+	}
+	m.containersMutex.Unlock()
+
+	if stop {
+		slog.Info("Stopping surplus replica",
+			"agent_url", info.URL,
+			"name", info.Name,
+			"max_replicas", m.pool.MaxReplicas,
+		)
+		if err := m.stopReplica(info); err == nil {
+			metrics.ContainerOperationsTotal.WithLabelValues(info.URL, "scale_down", "success").Inc()
+		}
+	}
+}
+
+// shouldScaleUp reports whether a replica set needs another replica.
+// Must be called with containersMutex held.
+func (m *Manager) shouldScaleUp(set *replicaSet) bool {
+	if set.scalingUp || len(set.replicas) == 0 || len(set.replicas) >= m.pool.MaxReplicas {
+		return false
+	}
+	if len(set.replicas) < m.minReplicas(set) {
+		return true
+	}
+
+	// All replicas at or above target load
+	if set.inFlight() >= int64(len(set.replicas)*m.pool.TargetInFlight) {
+		return true
+	}
+
+	// Requests are queueing up behind slow replicas
+	if m.pool.LatencyThreshold > 0 && set.inFlight() > 0 &&
+		set.latencyEWMA > m.pool.LatencyThreshold.Seconds() {
+		return true
+	}
+	return false
+}
+
+// minReplicas returns the warm pool size for a replica set.
+// Must be called with containersMutex held.
+func (m *Manager) minReplicas(set *replicaSet) int {
+	if m.pool.PopularThreshold > 0 && set.requestRate >= m.pool.PopularThreshold {
+		return m.pool.WarmReplicas
+	}
+	return 1
+}
+
+// scaleUp starts one additional replica for a set in the background.
+func (m *Manager) scaleUp(set *replicaSet) {
+	defer func() {
+		m.containersMutex.Lock()
+		set.scalingUp = false
+		m.containersMutex.Unlock()
+	}()
+
+	m.containersMutex.RLock()
+	current := m.runningContainers[set.versionHash]
+	replicas := len(set.replicas)
+	inFlight := set.inFlight()
+	m.containersMutex.RUnlock()
+
+	// The version was replaced or stopped since the scale-up was scheduled
+	if current != set {
+		return
+	}
+
+	slog.Info("Scaling up agent replicas",
+		"agent_url", set.agent.URL,
+		"version", set.versionHash,
+		"replicas", replicas,
+		"in_flight", inFlight,
+	)
+
+	if _, err := m.startReplica(context.Background(), set.agent, set.versionHash); err != nil {
+		slog.Warn("Failed to scale up agent replicas",
+			"agent_url", set.agent.URL,
+			"version", set.versionHash,
+			"error", err,
+		)
+		return
+	}
+	metrics.ContainerOperationsTotal.WithLabelValues(set.agent.URL, "scale_up", "success").Inc()
+}
+
+// StartAutoscaler starts the background loop that grows warm pools for
+// popular agents and shrinks idle replica sets back to their minimum.
+func (m *Manager) StartAutoscaler() {
+	if m.pool.MaxReplicas <= 1 {
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(m.pool.ScaleInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-m.stopCh:
+				return
+			case <-ticker.C:
+				m.autoscale()
+			}
+		}
+	}()
+	slog.Info("Autoscaler started", "interval", m.pool.ScaleInterval)
+}
+
+// autoscale evaluates every replica set once.
+func (m *Manager) autoscale() {
+	var toStop []*ContainerInfo
+
+	m.containersMutex.Lock()
+	for _, set := range m.runningContainers {
+		// Update the smoothed request rate from the requests seen this tick
+		perMinute := float64(set.requests) * float64(time.Minute) / float64(m.pool.ScaleInterval)
+		set.requestRate = requestRateEWMAAlpha*perMinute + (1-requestRateEWMAAlpha)*set.requestRate
+		set.requests = 0
+
+		if len(set.replicas) == 0 {
+			continue
+		}
+
+		if m.shouldScaleUp(set) {
+			set.scalingUp = true
+			go m.scaleUp(set)
+			continue
+		}
+
+		// Scale down one idle replica at a time when load is well below target
+		minReplicas := m.minReplicas(set)
+		lowLoad := set.inFlight()*2 <= int64((len(set.replicas)-1)*m.pool.TargetInFlight)
+		cooledDown := time.Since(set.lastScaleDown) >= m.pool.ScaleDownCooldown
+		if len(set.replicas) > minReplicas && lowLoad && cooledDown {
+			for i := len(set.replicas) - 1; i >= 0; i-- {
+				if info := set.replicas[i]; info.inFlight.Load() == 0 {
+					set.remove(info)
+					set.lastScaleDown = time.Now()
+					metrics.ContainersActive.WithLabelValues(info.URL).Dec()
+					toStop = append(toStop, info)
+					slog.Info("Scaling down agent replicas",
+						"agent_url", info.URL,
+						"version", set.versionHash,
+						"replicas", len(set.replicas),
+						"request_rate_rpm", set.requestRate,
+					)
+					break
+				}
+			}
+		}
+	}
+	m.containersMutex.Unlock()
+
+	for _, info := range toStop {
+		if err := m.stopReplica(info); err == nil {
+			metrics.ContainerOperationsTotal.WithLabelValues(info.URL, "scale_down", "success").Inc()
+		}
+	}
+}
@@ -0,0 +1,187 @@
+package agents
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ErrNoFreePorts is returned when every port in the configured range is in use.
+var ErrNoFreePorts = errors.New("no free host ports in configured range")
+
+// maxPortAttempts bounds how often a container start is retried on a host port conflict.
+const maxPortAttempts = 3
+
+// PortConfig holds the host port allocation configuration.
+type PortConfig struct {
+	Start          int    // First host port for container bindings
+	End            int    // Last host port for container bindings (inclusive)
+	BindIP         string // Host IP container ports are bound to (e.g. "127.0.0.1")
+	UseContainerIP bool   // Skip host ports and reach containers on their sandbox-network IP
+}
+
+// portAllocator hands out host ports from a fixed range, reusing released
+// ports and skipping ports that are already bound on the host.
+type portAllocator struct {
+	mu     sync.Mutex
+	bindIP string
+	start  int
+	end    int
+	next   int
+	free   []int
+	inUse  map[int]bool
+}
+
+func newPortAllocator(start, end int, bindIP string) *portAllocator {
+	if end < start {
+		end = start
+	}
+	return &portAllocator{
+		bindIP: bindIP,
+		start:  start,
+		end:    end,
+		next:   start,
+		inUse:  make(map[int]bool),
+	}
+}
+
+// Allocate returns a port that is free on the host.
+// Released ports are reused before new ones are handed out.
+func (a *portAllocator) Allocate() (int, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	// Reuse released ports first. A released port may since have been
+	// handed out again by the range walk; such stale entries are dropped.
+	for len(a.free) > 0 {
+		port := a.free[0]
+		a.free = a.free[1:]
+		if a.inUse[port] {
+			continue
+		}
+		if a.probe(port) {
+			a.inUse[port] = true
+			return port, nil
+		}
+	}
+
+	// Walk the range once, wrapping around
+	size := a.end - a.start + 1
+	for i := 0; i < size; i++ {
+		port := a.next
+		a.next++
+		if a.next > a.end {
+			a.next = a.start
+		}
+		if a.inUse[port] {
+			continue
+		}
+		if a.probe(port) {
+			a.inUse[port] = true
+			return port, nil
+		}
+	}
+
+	return 0, fmt.Errorf("%w (%d-%d)", ErrNoFreePorts, a.start, a.end)
+}
+
+// Release returns a port to the pool.
+func (a *portAllocator) Release(port int) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if !a.inUse[port] {
+		return
+	}
+	delete(a.inUse, port)
+	a.free = append(a.free, port)
+}
+
+// Reserve marks a port as in use by a container the allocator did not hand
+// out, such as one adopted from a previous run.
+func (a *portAllocator) Reserve(port int) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.inUse[port] = true
+	for i, p := range a.free {
+		if p == port {
+			a.free = append(a.free[:i], a.free[i+1:]...)
+			break
+		}
+	}
+}
+
+// Discard drops a port that turned out to be taken without returning it to
+// the free list. It is retried once the range wraps around.
+func (a *portAllocator) Discard(port int) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	delete(a.inUse, port)
+}
+
+// probe reports whether the port can be bound on the host right now.
+func (a *portAllocator) probe(port int) bool {
+	ln, err := net.Listen("tcp", net.JoinHostPort(a.bindIP, strconv.Itoa(port)))
+	if err != nil {
+		slog.Debug("Host port in use, skipping", "port", port, "error", err)
+		return false
+	}
+	ln.Close()
+	return true
+}
+
+// SetPortConfig configures host port allocation for container bindings.
+func (m *Manager) SetPortConfig(cfg PortConfig) {
+	if cfg.BindIP == "" {
+		cfg.BindIP = "127.0.0.1"
+	}
+	m.ports = newPortAllocator(cfg.Start, cfg.End, cfg.BindIP)
+	m.bindIP = cfg.BindIP
+	m.useContainerIP = cfg.UseContainerIP
+
+	slog.Info("Container port allocation configured",
+		"start", cfg.Start,
+		"end", cfg.End,
+		"bind_ip", cfg.BindIP,
+		"use_container_ip", cfg.UseContainerIP,
+	)
+}
+
+// dialHost returns the host address used to reach ports bound on bindIP.
+func (m *Manager) dialHost() string {
+	if m.bindIP == "0.0.0.0" || m.bindIP == "::" {
+		return "127.0.0.1"
+	}
+	return m.bindIP
+}
+
+// containerAddr returns the address used to reach a replica: its bound host
+// port, or port 80 on its sandbox-network IP when host ports are disabled.
+func (m *Manager) containerAddr(ctx context.Context, info *ContainerInfo) (string, error) {
+	if !m.useContainerIP {
+		return net.JoinHostPort(m.dialHost(), strconv.Itoa(info.Port)), nil
+	}
+
+	containerJSON, err := m.client.ContainerInspect(ctx, info.ContainerID)
+	if err != nil {
+		return "", fmt.Errorf("failed to inspect container: %w", err)
+	}
+	if ip := m.endpointIP(containerJSON); ip != "" {
+		return net.JoinHostPort(ip, "80"), nil
+	}
+	return "", fmt.Errorf("container %s has no IP address on the sandbox network", info.Name)
+}
+
+// isPortConflict reports whether a container create/start error was caused
+// by the host port already being taken.
+func isPortConflict(err error) bool {
+	msg := err.Error()
+	return strings.Contains(msg, "port is already allocated") || strings.Contains(msg, "address already in use")
+}
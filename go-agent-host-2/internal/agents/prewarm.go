@@ -0,0 +1,70 @@
+package agents
+
+import (
+	"context"
+	"log/slog"
+	"time"
+)
+
+// Prewarm downloads and loads the agent's current image so the first request
+// does not pay for it. If startContainer is set, a warm replica is started too.
+func (m *Manager) Prewarm(ctx context.Context, agent Agent, startContainer bool) error {
+	if startContainer {
+		_, _, err := m.ensureReplica(ctx, agent)
+		return err
+	}
+
+	start := time.Now()
+
+	versionHash, err := m.getVersionHash(ctx, agent.URL)
+	if err != nil {
+		return err
+	}
+
+	// Share the per-version start lock with cold starts so the image is only loaded once
+	startChan := make(chan struct{})
+	actual, loaded := m.startingMutex.LoadOrStore(versionHash, startChan)
+	if loaded {
+		select {
+		case <-actual.(chan struct{}):
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	defer func() {
+		close(startChan)
+		m.startingMutex.Delete(versionHash)
+	}()
+
+	imageName, err := m.imageFor(ctx, agent.URL, versionHash)
+	if err != nil {
+		return err
+	}
+
+	m.containersMutex.Lock()
+	set, exists := m.runningContainers[versionHash]
+	if !exists {
+		set = newReplicaSet(agent, versionHash)
+		m.runningContainers[versionHash] = set
+	}
+	set.imageName = imageName
+	m.containersMutex.Unlock()
+
+	slog.Info("Agent image prewarmed",
+		"agent_id", agent.ID,
+		"agent_url", agent.URL,
+		"version", versionHash,
+		"image", imageName,
+		"duration_ms", time.Since(start).Milliseconds(),
+	)
+	return nil
+}
+
+// InvalidateVersion drops the cached version hash for an agent URL so the
+// next request re-checks the image for updates.
+func (m *Manager) InvalidateVersion(agentURL string) {
+	m.versionCacheMutex.Lock()
+	delete(m.versionCache, agentURL)
+	m.versionCacheMutex.Unlock()
+}
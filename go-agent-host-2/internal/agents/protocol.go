@@ -0,0 +1,275 @@
+package agents
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Agent execution protocol versions. See PROTOCOL.md.
+const (
+	// ProtocolLegacy is the unversioned protocol: {requestId, request} in,
+	// {result, steps} or a raw body out, success taken from the HTTP status.
+	ProtocolLegacy = 0
+	// ProtocolV1 adds explicit success flags and typed errors.
+	ProtocolV1 = 1
+	// LatestProtocol is the newest version the runner speaks.
+	LatestProtocol = ProtocolV1
+)
+
+const (
+	// labelProtocol is the image label an agent uses to declare its protocol version.
+	labelProtocol = "agent-host.protocol"
+	// ProtocolPath is the endpoint an agent may serve to advertise its protocol versions.
+	ProtocolPath = "/protocol"
+	// maxResponseBodySize bounds how much of an agent response is read.
+	maxResponseBodySize = 8 << 20
+	// DefaultMaxResultSize is the default limit on the decoded result bytes.
+	DefaultMaxResultSize = 128 << 10
+)
+
+// ErrorCode classifies an agent failure.
+type ErrorCode string
+
+// Error codes agents may return.
+const (
+	ErrorCodeInvalidRequest ErrorCode = "invalid_request" // The request payload could not be handled
+	ErrorCodeUpstream       ErrorCode = "upstream_error"  // An external service the agent depends on failed
+	ErrorCodeTimeout        ErrorCode = "timeout"         // The agent gave up waiting on something
+	ErrorCodeUnsupported    ErrorCode = "unsupported"     // The requested function is not implemented
+	ErrorCodeInternal       ErrorCode = "internal_error"  // Any other agent-side failure
+)
+
+// Error codes set by the runner when an agent response is unusable.
+const (
+	ErrorCodeProtocolViolation ErrorCode = "protocol_violation"
+	ErrorCodeResultTooLarge    ErrorCode = "result_too_large"
+)
+
+// ProtocolError is the typed error object of a failed v1 response.
+type ProtocolError struct {
+	Code      ErrorCode `json:"code"`
+	Message   string    `json:"message,omitempty"`
+	Retryable bool      `json:"retryable,omitempty"`
+}
+
+func (e *ProtocolError) Error() string {
+	if e.Message == "" {
+		return string(e.Code)
+	}
+	return fmt.Sprintf("%s: %s", e.Code, e.Message)
+}
+
+// ExecutionContext is the on-chain context of a request. Agents should use it
+// instead of local state (e.g. the block timestamp instead of the wall clock)
+// so every validator computes the same result.
+type ExecutionContext struct {
+	ChainID         string `json:"chainId,omitempty"`         // Decimal chain ID
+	AgentID         string `json:"agentId"`                   // Decimal on-chain agent ID
+	Requester       string `json:"requester,omitempty"`       // Sender of the request transaction
+	BlockNumber     uint64 `json:"blockNumber"`               // Block the request was created in
+	BlockHash       string `json:"blockHash,omitempty"`       // Hash of that block
+	BlockTimestamp  uint64 `json:"blockTimestamp"`            // Unix seconds of that block
+	TxHash          string `json:"txHash,omitempty"`          // Request transaction hash
+	MaxCostPerAgent string `json:"maxCostPerAgent,omitempty"` // Decimal wei the agent may charge
+	Seed            string `json:"seed,omitempty"`            // Random seed derived from the request (determinism mode)
+}
+
+// ProtocolRequest is the body POSTed to an agent container.
+type ProtocolRequest struct {
+	Protocol  int               `json:"protocol,omitempty"` // Omitted for legacy agents
+	RequestID string            `json:"requestId"`
+	Request   string            `json:"request"`           // 0x-prefixed hex of the ABI-encoded call
+	Context   *ExecutionContext `json:"context,omitempty"` // Omitted for ad-hoc requests
+}
+
+// ProtocolResponse is the body a v1 agent returns.
+type ProtocolResponse struct {
+	Protocol int             `json:"protocol"`
+	Success  *bool           `json:"success"`
+	Result   string          `json:"result,omitempty"` // 0x-prefixed hex of the ABI-encoded result
+	Error    *ProtocolError  `json:"error,omitempty"`
+	Steps    json.RawMessage `json:"steps,omitempty"`
+}
+
+// ProtocolInfo is served by agents on ProtocolPath.
+type ProtocolInfo struct {
+	Versions []int `json:"versions"`
+}
+
+// SetMaxResultSize limits the size of agent results. Larger results are
+// reported as a result_too_large failure.
+func (m *Manager) SetMaxResultSize(n int) {
+	if n <= 0 {
+		n = DefaultMaxResultSize
+	}
+	m.maxResultSize = n
+	slog.Info("Agent result size limit configured", "max_result_bytes", n)
+}
+
+// negotiateProtocol picks the protocol version for a replica from its image
+// label, falling back to the agent's ProtocolPath endpoint and then to the
+// legacy protocol.
+func (m *Manager) negotiateProtocol(ctx context.Context, addr string, labels map[string]string) int {
+	if value, ok := labels[labelProtocol]; ok {
+		version, err := strconv.Atoi(value)
+		if err == nil && version >= ProtocolLegacy && version <= LatestProtocol {
+			return version
+		}
+		slog.Warn("Unsupported protocol version in image label", "label", value, "addr", addr)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "GET", fmt.Sprintf("http://%s%s", addr, ProtocolPath), nil)
+	if err != nil {
+		return ProtocolLegacy
+	}
+	resp, err := m.agentClient.Do(req)
+	if err != nil {
+		return ProtocolLegacy
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return ProtocolLegacy
+	}
+
+	var info ProtocolInfo
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 4096)).Decode(&info); err != nil {
+		return ProtocolLegacy
+	}
+	best := ProtocolLegacy
+	for _, version := range info.Versions {
+		if version > best && version <= LatestProtocol {
+			best = version
+		}
+	}
+	return best
+}
+
+// EncodeRequest builds the request body for an agent speaking the given protocol version.
+// execCtx may be nil for requests that do not come from the chain.
+func EncodeRequest(version int, requestID string, payload []byte, execCtx *ExecutionContext) ([]byte, error) {
+	req := ProtocolRequest{
+		RequestID: requestID,
+		Request:   "0x" + hex.EncodeToString(payload),
+		Context:   execCtx,
+	}
+	if version > ProtocolLegacy {
+		req.Protocol = version
+	}
+	return json.Marshal(req)
+}
+
+// DecodeResponse interprets an agent's HTTP response under the given protocol
+// version. A malformed v1 response or an oversized result is returned as a
+// failed Response with a runner-assigned error code, alongside a non-nil error.
+func DecodeResponse(version, status int, body []byte, maxResultSize int) (*Response, error) {
+	var response *Response
+	var err error
+	if version >= ProtocolV1 {
+		response, err = decodeV1Response(status, body)
+	} else {
+		response = decodeLegacyResponse(status, body)
+	}
+	if err != nil {
+		return &Response{
+			Status:   status,
+			Protocol: version,
+			Error:    &ProtocolError{Code: ErrorCodeProtocolViolation, Message: err.Error()},
+		}, err
+	}
+
+	if maxResultSize > 0 && len(response.Body) > maxResultSize {
+		err := fmt.Errorf("result is %d bytes, limit is %d", len(response.Body), maxResultSize)
+		return &Response{
+			Status:   status,
+			Protocol: version,
+			Receipt:  response.Receipt,
+			Error:    &ProtocolError{Code: ErrorCodeResultTooLarge, Message: err.Error()},
+		}, err
+	}
+	return response, nil
+}
+
+// decodeLegacyResponse accepts {result, steps} JSON or treats the body as the raw result.
+func decodeLegacyResponse(status int, body []byte) *Response {
+	response := &Response{
+		Status:   status,
+		Success:  status >= 200 && status < 300,
+		Protocol: ProtocolLegacy,
+	}
+
+	var jsonResponse map[string]interface{}
+	if err := json.Unmarshal(body, &jsonResponse); err != nil {
+		response.Body = body
+		return response
+	}
+
+	if result, ok := jsonResponse["result"].(string); ok {
+		response.Body, _ = hex.DecodeString(strings.TrimPrefix(result, "0x"))
+	} else {
+		response.Body = body
+	}
+	if _, hasSteps := jsonResponse["steps"]; hasSteps {
+		response.Receipt = jsonResponse
+	}
+	return response
+}
+
+// decodeV1Response validates and decodes a v1 response body.
+func decodeV1Response(status int, body []byte) (*Response, error) {
+	var pr ProtocolResponse
+	if err := json.Unmarshal(body, &pr); err != nil {
+		return nil, fmt.Errorf("response is not valid JSON (status %d): %w", status, err)
+	}
+	if pr.Protocol != ProtocolV1 {
+		return nil, fmt.Errorf("response protocol is %d, expected %d", pr.Protocol, ProtocolV1)
+	}
+	if pr.Success == nil {
+		return nil, fmt.Errorf("response has no success flag")
+	}
+
+	response := &Response{
+		Status:   status,
+		Success:  *pr.Success,
+		Protocol: ProtocolV1,
+	}
+
+	if pr.Result != "" {
+		if !strings.HasPrefix(pr.Result, "0x") {
+			return nil, fmt.Errorf("result is not 0x-prefixed hex")
+		}
+		result, err := hex.DecodeString(pr.Result[2:])
+		if err != nil {
+			return nil, fmt.Errorf("result is not valid hex: %w", err)
+		}
+		response.Body = result
+	}
+
+	if response.Success {
+		if pr.Error != nil {
+			return nil, fmt.Errorf("successful response carries an error")
+		}
+	} else {
+		if pr.Error == nil || pr.Error.Code == "" {
+			return nil, fmt.Errorf("failed response has no error code")
+		}
+		response.Error = pr.Error
+	}
+
+	if len(pr.Steps) > 0 {
+		var receipt map[string]interface{}
+		if err := json.Unmarshal(body, &receipt); err == nil {
+			response.Receipt = receipt
+		}
+	}
+	return response, nil
+}
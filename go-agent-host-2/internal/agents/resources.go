@@ -0,0 +1,260 @@
+package agents
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/somnia-chain/agent-runner/internal/metrics"
+)
+
+// ErrContainerOOMKilled is returned when an agent container was killed by the
+// kernel OOM killer while handling a request.
+var ErrContainerOOMKilled = errors.New("agent container was OOM killed")
+
+// ResourceLimits holds the cgroup limits applied to an agent container.
+// Zero values mean "no limit" for that resource.
+type ResourceLimits struct {
+	MemoryMB  int64   `json:"memoryMb,omitempty"`  // Memory limit in MiB (swap disabled)
+	CPUs      float64 `json:"cpus,omitempty"`      // CPU quota in cores (e.g. 0.5)
+	PidsLimit int64   `json:"pidsLimit,omitempty"` // Maximum number of processes
+	DiskMB    int64   `json:"diskMb,omitempty"`    // Writable layer size in MiB (requires overlay2 on xfs with pquota)
+}
+
+// Merge returns a copy of l with every non-zero field of o applied on top.
+func (l ResourceLimits) Merge(o ResourceLimits) ResourceLimits {
+	if o.MemoryMB > 0 {
+		l.MemoryMB = o.MemoryMB
+	}
+	if o.CPUs > 0 {
+		l.CPUs = o.CPUs
+	}
+	if o.PidsLimit > 0 {
+		l.PidsLimit = o.PidsLimit
+	}
+	if o.DiskMB > 0 {
+		l.DiskMB = o.DiskMB
+	}
+	return l
+}
+
+// Cap returns a copy of l with its set fields clamped to the non-zero fields
+// of max. Fields left at zero stay zero, so merging the result keeps the
+// defaults for resources l does not set.
+func (l ResourceLimits) Cap(max ResourceLimits) ResourceLimits {
+	if max.MemoryMB > 0 && l.MemoryMB > max.MemoryMB {
+		l.MemoryMB = max.MemoryMB
+	}
+	if max.CPUs > 0 && l.CPUs > max.CPUs {
+		l.CPUs = max.CPUs
+	}
+	if max.PidsLimit > 0 && l.PidsLimit > max.PidsLimit {
+		l.PidsLimit = max.PidsLimit
+	}
+	if max.DiskMB > 0 && l.DiskMB > max.DiskMB {
+		l.DiskMB = max.DiskMB
+	}
+	return l
+}
+
+// resources converts the limits into Docker host resources.
+func (l ResourceLimits) resources() container.Resources {
+	var res container.Resources
+	if l.MemoryMB > 0 {
+		res.Memory = l.MemoryMB * 1024 * 1024
+		res.MemorySwap = res.Memory // Disable swap so the limit is a hard limit
+	}
+	if l.CPUs > 0 {
+		res.NanoCPUs = int64(l.CPUs * 1e9)
+	}
+	if l.PidsLimit > 0 {
+		pids := l.PidsLimit
+		res.PidsLimit = &pids
+	}
+	return res
+}
+
+// storageOpt returns the Docker storage options for the disk limit, or nil if unlimited.
+func (l ResourceLimits) storageOpt() map[string]string {
+	if l.DiskMB <= 0 {
+		return nil
+	}
+	return map[string]string{"size": fmt.Sprintf("%dM", l.DiskMB)}
+}
+
+// ResourcePolicy is the operator-controlled resource policy loaded from a JSON file.
+//
+// Example:
+//
+//	{
+//	  "defaults": {"memoryMb": 512, "cpus": 1, "pidsLimit": 256},
+//	  "max":      {"memoryMb": 4096, "cpus": 4},
+//	  "agents": {
+//	    "42": {"memoryMb": 2048},
+//	    "https://storage.example.com/agent.tar": {"cpus": 2}
+//	  },
+//	  "runtimes": {
+//	    "42": "microvm"
+//	  }
+//	}
+//
+// Limits are resolved in order: flag defaults, policy defaults, agent metadata
+// (capped by max), then per-agent overrides keyed by agent ID or image URL.
+// Agent metadata may only lower limits unless max allows more; resources max
+// leaves unset are capped at the flag defaults. Per-agent overrides are set by
+// the operator and are not capped.
+//
+// Runtimes selects the OCI runtime per agent ID or image URL, overriding
+// --runtime; "microvm" runs the agent in a microVM.
+type ResourcePolicy struct {
+	Defaults ResourceLimits            `json:"defaults"`
+	Max      ResourceLimits            `json:"max"`
+	Agents   map[string]ResourceLimits `json:"agents"`
+	Runtimes map[string]string         `json:"runtimes"`
+}
+
+// UsesRuntime reports whether any agent is assigned the given runtime.
+func (p *ResourcePolicy) UsesRuntime(runtime string) bool {
+	for _, r := range p.Runtimes {
+		if r == runtime {
+			return true
+		}
+	}
+	return false
+}
+
+// LoadResourcePolicy reads a resource policy from a JSON file.
+func LoadResourcePolicy(path string) (*ResourcePolicy, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read resource policy: %w", err)
+	}
+
+	var policy ResourcePolicy
+	if err := json.Unmarshal(data, &policy); err != nil {
+		return nil, fmt.Errorf("failed to parse resource policy %s: %w", path, err)
+	}
+	return &policy, nil
+}
+
+// resolveLimits computes the effective resource limits for an agent.
+func (m *Manager) resolveLimits(agent Agent, meta *AgentMetadata) ResourceLimits {
+	limits := m.resourceDefaults
+
+	// Agent metadata is untrusted: without a policy maximum it may not exceed
+	// the flag defaults
+	max := m.resourceDefaults
+	if m.resourcePolicy != nil {
+		limits = limits.Merge(m.resourcePolicy.Defaults)
+		max = max.Merge(m.resourcePolicy.Max)
+	}
+
+	if meta != nil && meta.Resources != nil {
+		limits = limits.Merge(meta.Resources.Cap(max))
+	}
+
+	if m.resourcePolicy != nil {
+		if override, ok := m.resourcePolicy.Agents[agent.ID]; ok && agent.ID != "" {
+			limits = limits.Merge(override)
+		}
+		if override, ok := m.resourcePolicy.Agents[agent.URL]; ok {
+			limits = limits.Merge(override)
+		}
+	}
+
+	return limits
+}
+
+// resolveRuntime returns the OCI runtime for an agent: a policy entry for its
+// image URL, then for its ID, then the --runtime default.
+func (m *Manager) resolveRuntime(agent Agent) string {
+	if m.resourcePolicy != nil {
+		if runtime, ok := m.resourcePolicy.Runtimes[agent.URL]; ok {
+			return runtime
+		}
+		if runtime, ok := m.resourcePolicy.Runtimes[agent.ID]; ok && agent.ID != "" {
+			return runtime
+		}
+	}
+	return m.containerRuntime
+}
+
+// diagnoseContainerFailure inspects a container after a failed request to
+// distinguish resource-limit kills from other failures.
+func (m *Manager) diagnoseContainerFailure(info *ContainerInfo) error {
+	// The event watcher may have seen the OOM kill and removed the container already
+	if info.oomRecorded.Load() {
+		return ErrContainerOOMKilled
+	}
+
+	containerJSON, err := m.client.ContainerInspect(context.Background(), info.ContainerID)
+	if err != nil {
+		return nil
+	}
+
+	if containerJSON.State != nil && containerJSON.State.OOMKilled {
+		m.recordOOMKill(info, containerJSON.State.ExitCode)
+		return ErrContainerOOMKilled
+	}
+	return nil
+}
+
+// recordOOMKill counts and logs a replica's OOM kill once, whether it is
+// noticed by a failed request or by the Docker event watcher.
+func (m *Manager) recordOOMKill(info *ContainerInfo, exitCode int) {
+	if info.oomRecorded.Swap(true) {
+		return
+	}
+	metrics.ContainerOOMKillsTotal.WithLabelValues(info.URL).Inc()
+	slog.Error("Agent container was OOM killed",
+		"agent_url", info.URL,
+		"container_id", info.ContainerID[:12],
+		"exit_code", exitCode,
+	)
+}
+
+// recordThrottling samples CPU throttling for a container and records any
+// newly throttled periods since the last sample.
+func (m *Manager) recordThrottling(info *ContainerInfo) {
+	stats, err := m.client.ContainerStatsOneShot(context.Background(), info.ContainerID)
+	if err != nil {
+		return
+	}
+	defer stats.Body.Close()
+
+	var sample types.StatsJSON
+	if err := json.NewDecoder(stats.Body).Decode(&sample); err != nil {
+		return
+	}
+
+	throttled := sample.CPUStats.ThrottlingData.ThrottledPeriods
+
+	m.containersMutex.Lock()
+	delta := throttled - info.throttledPeriods
+	if throttled < info.throttledPeriods {
+		delta = 0
+	}
+	info.throttledPeriods = throttled
+	m.containersMutex.Unlock()
+
+	if delta > 0 {
+		metrics.ContainerCPUThrottledPeriodsTotal.WithLabelValues(info.URL).Add(float64(delta))
+		slog.Debug("Agent container CPU throttled",
+			"agent_url", info.URL,
+			"throttled_periods", delta,
+		)
+	}
+}
+
+// isStorageOptUnsupported reports whether a container create error was caused
+// by the storage driver not supporting the size option.
+func isStorageOptUnsupported(err error) bool {
+	msg := err.Error()
+	return strings.Contains(msg, "storage-opt") || strings.Contains(msg, "--storage-opt")
+}
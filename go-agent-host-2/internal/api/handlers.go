@@ -6,16 +6,24 @@ import (
 	"log/slog"
 	"net/http"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/somnia-chain/agent-runner/internal/agents"
 	"github.com/somnia-chain/agent-runner/internal/config"
 	"github.com/somnia-chain/agent-runner/internal/metrics"
 )
 
+// RequestLogSource returns the container logs captured for a request.
+type RequestLogSource interface {
+	RequestLogs(requestID string) (agents.RequestLog, bool)
+}
+
 // Server handles HTTP requests for the agent runner.
 type Server struct {
-	apiKey string
+	apiKey      string
+	requestLogs RequestLogSource // nil = request log endpoint disabled
 }
 
 // NewServer creates a new API Server.
@@ -95,6 +103,33 @@ func (s *Server) handleVersion(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
+// SetRequestLogSource enables the admin endpoint serving per-request container logs.
+func (s *Server) SetRequestLogSource(src RequestLogSource) {
+	s.requestLogs = src
+}
+
+// handleRequestLogs serves GET /admin/requests/{id}/logs.
+func (s *Server) handleRequestLogs(w http.ResponseWriter, r *http.Request, requestID string) {
+	if r.Method != http.MethodGet {
+		sendError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+	if s.requestLogs == nil {
+		sendError(w, http.StatusNotFound, "Request log capture is disabled")
+		return
+	}
+
+	logs, ok := s.requestLogs.RequestLogs(requestID)
+	if !ok {
+		sendError(w, http.StatusNotFound, "No logs captured for request")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(logs)
+}
+
 // HandleRequest is the main request handler.
 func (s *Server) HandleRequest(w http.ResponseWriter, r *http.Request) {
 	start := time.Now()
@@ -102,6 +137,10 @@ func (s *Server) HandleRequest(w http.ResponseWriter, r *http.Request) {
 	if path == "" {
 		path = "/"
 	}
+	// Keep request IDs out of metric labels
+	if strings.HasPrefix(path, "/admin/requests/") {
+		path = "/admin/requests/{id}/logs"
+	}
 
 	// Wrap response writer to capture status code
 	wrapped := &responseWriter{ResponseWriter: w, statusCode: http.StatusOK}
@@ -139,5 +178,24 @@ func (s *Server) handleRequestInternal(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Admin endpoints require authentication, and are disabled without an
+	// API key since they expose agent output
+	if strings.HasPrefix(r.URL.Path, "/admin/") {
+		if s.apiKey == "" {
+			sendError(w, http.StatusForbidden, "Admin endpoints require --api-key")
+			return
+		}
+		if !s.authenticate(r) {
+			sendError(w, http.StatusUnauthorized, "Unauthorized")
+			return
+		}
+		if requestID, ok := strings.CutPrefix(r.URL.Path, "/admin/requests/"); ok {
+			if requestID, ok = strings.CutSuffix(requestID, "/logs"); ok && requestID != "" && !strings.Contains(requestID, "/") {
+				s.handleRequestLogs(w, r, requestID)
+				return
+			}
+		}
+	}
+
 	sendError(w, http.StatusNotFound, "Not found")
 }
@@ -19,24 +19,97 @@ type Config struct {
 	ReceiptsServiceURL string
 	CacheDir           string
 	StartPort          int
+	EndPort            int
+	ContainerBindIP    string
+	ContainerIPAddress bool
 	Runtime            string
+	ContainerEngine    string
+	ContainerHost      string
+	MicroVMVMM         string
+	MicroVMBinary      string
+	MicroVMKernel      string
+	MicroVMStateDir    string
 	APIKey             string
 	LogFile            string
 	MaxLogFileSize     int
 
 	// Sandbox network configuration
-	SandboxNetworkName    string
-	SandboxNetworkSubnet  string
-	SandboxNetworkGateway string
-	SandboxProxyPort      int
-	EnableFirewall        bool
+	SandboxNetworkName     string
+	SandboxNetworkSubnet   string
+	SandboxNetworkGateway  string
+	SandboxNetworkSubnet6  string
+	SandboxNetworkGateway6 string
+	SandboxProxyPort       int
+	EnableFirewall         bool
+	EgressPolicyFile       string
+	SandboxProxyAuth       bool
+	TransparentProxyPort   int
+	SandboxMITM            bool
+	SandboxCADir           string
+	EgressAgentRequests    int64
+	EgressAgentBytes       int64
+	EgressQuotaWindow      time.Duration
+	EgressRequestRequests  int64
+	EgressRequestBytes     int64
+	EgressCacheMode        string
+	EgressCacheURL         string
+	EgressCacheToken       string
+	EgressCacheDir         string
+	EgressReplayFile       string
+	EgressCacheMaxBody     int64
+	SandboxDNS             bool
+	SandboxDNSPort         int
+	DNSMaxLabelLength      int
+	DNSMaxLabelEntropy     float64
 
 	// LLM Proxy configuration
-	LLMProxyEnabled bool
-	LLMProxyPort    int
-	LLMUpstreamURL  string
-	LLMAPIKey              string
-	DisableLLMValidation   bool
+	LLMProxyEnabled      bool
+	LLMProxyPort         int
+	LLMUpstreamURL       string
+	LLMAPIKey            string
+	DisableLLMValidation bool
+
+	// Container resource limits
+	ContainerMemoryMB  int64
+	ContainerCPUs      float64
+	ContainerPidsLimit int64
+	ContainerDiskMB    int64
+	AgentPolicyFile    string
+
+	// Container pool configuration
+	MaxReplicas        int
+	WarmReplicas       int
+	PopularAgentRPM    float64
+	TargetInFlight     int
+	ScaleLatencyTarget time.Duration
+	AutoscaleInterval  time.Duration
+
+	// Container eviction configuration
+	ContainerIdleTimeout time.Duration
+	MaxContainers        int
+	MinFreeMemoryMB      int64
+	AdoptContainers      bool
+
+	// Container health check configuration
+	ContainerStartupTimeout time.Duration
+	HealthCheckInterval     time.Duration
+	HealthCheckTimeout      time.Duration
+	HealthCheckFailures     int
+
+	// Request log capture configuration
+	RequestLogBytes  int
+	RequestLogRetain int
+
+	// Determinism mode configuration
+	Deterministic       bool
+	DeterminismStateDir string
+	FaketimeLib         string
+
+	// Prewarm configuration
+	PrewarmEnabled     bool
+	PrewarmAgents      string
+	PrewarmParallelism int
+	PrewarmContainers  bool
 
 	// Blockchain configuration
 	RPCURL               string
@@ -47,6 +120,16 @@ type Config struct {
 
 	// Worker pool configuration
 	MaxConcurrentRequests int
+	RequestTimeout        time.Duration
+	MaxResultBytes        int
+
+	// Divergence self-check configuration
+	SelfCheckRate           float64
+	SelfCheckAgents         string
+	SelfCheckFailOnMismatch bool
+
+	// Request journal configuration
+	JournalFile string
 }
 
 // Parse parses command-line flags and returns a Config.
@@ -57,7 +140,16 @@ func Parse() *Config {
 	flag.StringVar(&cfg.ReceiptsServiceURL, "receipts-url", "https://testnet-agent-receipts-ldxj422yua-ew.a.run.app", "URL for receipt uploads (empty to disable)")
 	flag.StringVar(&cfg.CacheDir, "cache-dir", "./image-cache", "Directory to cache downloaded container images")
 	flag.IntVar(&cfg.StartPort, "start-port", 10000, "Starting port for container allocation")
+	flag.IntVar(&cfg.EndPort, "end-port", 19999, "Last port for container allocation")
+	flag.StringVar(&cfg.ContainerBindIP, "container-bind-ip", "127.0.0.1", "Host IP container ports are bound to")
+	flag.BoolVar(&cfg.ContainerIPAddress, "container-ip-addressing", false, "Reach containers on their sandbox network IP instead of host ports")
 	flag.StringVar(&cfg.Runtime, "runtime", "", "Container runtime (e.g., runsc for gVisor)")
+	flag.StringVar(&cfg.ContainerEngine, "container-engine", "docker", "Container engine to run agents on (docker or podman)")
+	flag.StringVar(&cfg.ContainerHost, "container-host", "", "Container engine API address, e.g. unix:///run/podman/podman.sock (empty = engine default)")
+	flag.StringVar(&cfg.MicroVMVMM, "microvm-vmm", "firecracker", "VMM for agents on the microvm runtime (firecracker or cloud-hypervisor)")
+	flag.StringVar(&cfg.MicroVMBinary, "microvm-binary", "", "Path to the VMM binary (empty = the VMM name on PATH)")
+	flag.StringVar(&cfg.MicroVMKernel, "microvm-kernel", "", "Guest kernel (vmlinux) for microVMs (empty = microVM runtime disabled)")
+	flag.StringVar(&cfg.MicroVMStateDir, "microvm-state-dir", "./microvm-state", "Directory for microVM root filesystems and consoles")
 	flag.StringVar(&cfg.APIKey, "api-key", "", "API key for request authentication (optional, no auth if empty)")
 	flag.StringVar(&cfg.LogFile, "log-file", "", "Path to log file (default: stdout)")
 	flag.IntVar(&cfg.MaxLogFileSize, "max-log-file-size", 10*1024*1024, "Max log file size in bytes before rotation (default: 10MB)")
@@ -66,8 +158,30 @@ func Parse() *Config {
 	flag.StringVar(&cfg.SandboxNetworkName, "sandbox-network", "agent-sandbox", "Docker network name for sandbox containers")
 	flag.StringVar(&cfg.SandboxNetworkSubnet, "sandbox-subnet", "172.30.0.0/16", "Subnet for sandbox network")
 	flag.StringVar(&cfg.SandboxNetworkGateway, "sandbox-gateway", "172.30.0.1", "Gateway IP for sandbox network (host-side)")
+	flag.StringVar(&cfg.SandboxNetworkSubnet6, "sandbox-subnet6", "", "IPv6 subnet for a dual-stack sandbox network (empty = IPv6 disabled)")
+	flag.StringVar(&cfg.SandboxNetworkGateway6, "sandbox-gateway6", "", "IPv6 gateway IP for sandbox network (empty = first address of --sandbox-subnet6)")
 	flag.IntVar(&cfg.SandboxProxyPort, "sandbox-proxy-port", 3128, "Port for sandbox HTTP/HTTPS proxy")
 	flag.BoolVar(&cfg.EnableFirewall, "enable-firewall", false, "Enable iptables firewall rules for sandbox isolation")
+	flag.IntVar(&cfg.TransparentProxyPort, "transparent-proxy-port", 0, "Redirect sandbox TCP 80/443 to a transparent proxy on this gateway port (0 = disabled)")
+	flag.BoolVar(&cfg.SandboxMITM, "sandbox-mitm", false, "Intercept sandbox HTTPS with a runner CA that containers trust, for path rules, metering and caching")
+	flag.StringVar(&cfg.SandboxCADir, "sandbox-ca-dir", "./sandbox-ca", "Directory of the sandbox MITM CA certificate and key (generated if missing)")
+	flag.BoolVar(&cfg.SandboxProxyAuth, "sandbox-proxy-auth", false, "Reject sandbox proxy requests without valid per-container credentials")
+	flag.StringVar(&cfg.EgressPolicyFile, "egress-policy-file", "", "Path to JSON egress allow/deny policy for the sandbox proxy (empty = allow all)")
+	flag.Int64Var(&cfg.EgressAgentRequests, "egress-agent-max-requests", 0, "Max sandbox proxy requests per agent per quota window (0 = unlimited)")
+	flag.Int64Var(&cfg.EgressAgentBytes, "egress-agent-max-bytes", 0, "Max sandbox proxy bytes per agent per quota window (0 = unlimited)")
+	flag.DurationVar(&cfg.EgressQuotaWindow, "egress-quota-window", time.Hour, "Window of the per-agent sandbox proxy quotas")
+	flag.Int64Var(&cfg.EgressRequestRequests, "egress-request-max-requests", 0, "Max sandbox proxy requests per agent request (0 = unlimited)")
+	flag.Int64Var(&cfg.EgressRequestBytes, "egress-request-max-bytes", 0, "Max sandbox proxy bytes per agent request (0 = unlimited)")
+	flag.StringVar(&cfg.EgressCacheMode, "egress-cache", "", "Record/replay cache for sandbox proxy HTTP responses: shared, record or replay (empty = disabled)")
+	flag.StringVar(&cfg.EgressCacheURL, "egress-cache-url", "", "Shared egress cache service URL (shared mode; the service and its writers decide the responses every validator sees)")
+	flag.StringVar(&cfg.EgressCacheToken, "egress-cache-token", "", "Bearer token sent to the shared egress cache service (shared mode)")
+	flag.StringVar(&cfg.EgressCacheDir, "egress-cache-dir", "./egress-tapes", "Directory for recorded egress tapes (record mode)")
+	flag.StringVar(&cfg.EgressReplayFile, "egress-replay-file", "", "Egress tape or receipt to replay (replay mode)")
+	flag.Int64Var(&cfg.EgressCacheMaxBody, "egress-cache-max-body", 1024*1024, "Largest request or response body the egress cache records, in bytes")
+	flag.BoolVar(&cfg.SandboxDNS, "sandbox-dns", false, "Resolve sandbox DNS through a filtering DNS server on the gateway")
+	flag.IntVar(&cfg.SandboxDNSPort, "sandbox-dns-port", 53, "Gateway port of the sandbox DNS server (sandbox DNS traffic is redirected to it)")
+	flag.IntVar(&cfg.DNSMaxLabelLength, "sandbox-dns-max-label-length", 40, "Refuse sandbox DNS names with longer labels (0 = no limit)")
+	flag.Float64Var(&cfg.DNSMaxLabelEntropy, "sandbox-dns-max-label-entropy", 3.8, "Refuse sandbox DNS names with labels of 24+ characters above this entropy in bits per character (0 = no limit)")
 
 	// LLM Proxy configuration
 	flag.BoolVar(&cfg.LLMProxyEnabled, "llm-proxy-enabled", false, "Enable OpenAI-compatible LLM proxy")
@@ -76,6 +190,48 @@ func Parse() *Config {
 	flag.StringVar(&cfg.LLMAPIKey, "llm-api-key", "", "API key for upstream LLM service")
 	flag.BoolVar(&cfg.DisableLLMValidation, "disable-llm-validation", false, "Disable LLM determinism validation on startup")
 
+	// Container resource limits
+	flag.Int64Var(&cfg.ContainerMemoryMB, "container-memory-mb", 1024, "Default memory limit per agent container in MiB (0 = unlimited)")
+	flag.Float64Var(&cfg.ContainerCPUs, "container-cpus", 1.0, "Default CPU limit per agent container in cores (0 = unlimited)")
+	flag.Int64Var(&cfg.ContainerPidsLimit, "container-pids-limit", 256, "Default process limit per agent container (0 = unlimited)")
+	flag.Int64Var(&cfg.ContainerDiskMB, "container-disk-mb", 0, "Default writable layer size per agent container in MiB (0 = unlimited, requires overlay2 on xfs)")
+	flag.StringVar(&cfg.AgentPolicyFile, "agent-policy-file", "", "Path to JSON policy file with per-agent resource and runtime overrides")
+
+	// Container pool configuration
+	flag.IntVar(&cfg.MaxReplicas, "max-replicas", 1, "Maximum container replicas per agent (1 = single container per agent)")
+	flag.IntVar(&cfg.WarmReplicas, "warm-replicas", 2, "Minimum replicas kept warm for popular agents (capped by --max-replicas)")
+	flag.Float64Var(&cfg.PopularAgentRPM, "popular-agent-rpm", 30, "Requests per minute above which an agent keeps a warm pool")
+	flag.IntVar(&cfg.TargetInFlight, "target-in-flight", 4, "Target concurrent requests per replica before scaling up")
+	flag.DurationVar(&cfg.ScaleLatencyTarget, "scale-latency-target", 0, "Scale up when average agent latency exceeds this (0 = disabled)")
+	flag.DurationVar(&cfg.AutoscaleInterval, "autoscale-interval", 10*time.Second, "How often replica counts are re-evaluated")
+
+	// Container eviction configuration
+	flag.DurationVar(&cfg.ContainerIdleTimeout, "container-idle-timeout", 30*time.Minute, "Stop agent containers unused for this long (0 = never)")
+	flag.IntVar(&cfg.MaxContainers, "max-containers", 0, "Maximum running agent containers, least recently used are evicted (0 = unlimited)")
+	flag.Int64Var(&cfg.MinFreeMemoryMB, "min-free-memory-mb", 0, "Evict idle containers while host available memory is below this in MiB (0 = disabled)")
+	flag.BoolVar(&cfg.AdoptContainers, "adopt-containers", false, "Keep agent containers running across restarts and adopt them at startup instead of removing them")
+
+	// Container health check configuration
+	flag.DurationVar(&cfg.ContainerStartupTimeout, "container-startup-timeout", 30*time.Second, "Default time a new container may take to become ready")
+	flag.DurationVar(&cfg.HealthCheckInterval, "health-check-interval", 15*time.Second, "Default interval between container liveness probes")
+	flag.DurationVar(&cfg.HealthCheckTimeout, "health-check-timeout", 2*time.Second, "Default timeout of a single health probe")
+	flag.IntVar(&cfg.HealthCheckFailures, "health-check-failures", 3, "Consecutive liveness failures before a container is restarted")
+
+	// Request log capture configuration
+	flag.IntVar(&cfg.RequestLogBytes, "request-log-bytes", 64*1024, "Container log bytes captured per request for receipts and the admin API (0 = disabled)")
+	flag.IntVar(&cfg.RequestLogRetain, "request-log-retain", 1000, "Number of recent requests whose captured logs are kept")
+
+	// Determinism mode configuration
+	flag.BoolVar(&cfg.Deterministic, "deterministic", false, "Fake agent clocks to the block timestamp and give agents a random seed derived from the request ID")
+	flag.StringVar(&cfg.DeterminismStateDir, "determinism-state-dir", "./agent-state", "Directory for per-container clock and seed files in determinism mode")
+	flag.StringVar(&cfg.FaketimeLib, "faketime-lib", "", "Host path of libfaketime to preload into agent containers (empty = the image provides it)")
+
+	// Prewarm configuration
+	flag.BoolVar(&cfg.PrewarmEnabled, "prewarm", false, "Download and load agent images from the AgentRegistry at startup")
+	flag.StringVar(&cfg.PrewarmAgents, "prewarm-agents", "", "Comma-separated agent IDs to prewarm (empty = all registered agents)")
+	flag.IntVar(&cfg.PrewarmParallelism, "prewarm-parallelism", 4, "Maximum concurrent image downloads while prewarming")
+	flag.BoolVar(&cfg.PrewarmContainers, "prewarm-containers", false, "Also start a warm container for each prewarmed agent")
+
 	// Blockchain configuration
 	flag.StringVar(&cfg.RPCURL, "rpc-url", "https://dream-rpc.somnia.network/", "Blockchain RPC URL")
 	flag.StringVar(&cfg.SomniaAgentsContract, "somnia-agents-contract", "", "SomniaAgents contract address (required)")
@@ -85,6 +241,16 @@ func Parse() *Config {
 
 	// Worker pool configuration
 	flag.IntVar(&cfg.MaxConcurrentRequests, "max-concurrent-requests", 20, "Maximum concurrent request handlers")
+	flag.DurationVar(&cfg.RequestTimeout, "request-timeout", 60*time.Second, "Time to respond to a request, counted from its block, if the contract does not expose requestTimeout()")
+	flag.IntVar(&cfg.MaxResultBytes, "max-result-bytes", 128*1024, "Largest agent result accepted; larger results are reported as failures")
+
+	// Divergence self-check configuration
+	flag.Float64Var(&cfg.SelfCheckRate, "self-check-rate", 0, "Fraction of requests executed twice on independent containers to detect divergence (0 = disabled)")
+	flag.StringVar(&cfg.SelfCheckAgents, "self-check-agents", "", "Comma-separated agent IDs whose requests are always executed twice")
+	flag.BoolVar(&cfg.SelfCheckFailOnMismatch, "self-check-fail-on-mismatch", false, "Submit success=false when the two runs of a self-checked request disagree")
+
+	// Request journal configuration
+	flag.StringVar(&cfg.JournalFile, "journal-file", "./request-journal.jsonl", "Local journal of handled requests and their consensus outcomes (empty = in memory only)")
 
 	flag.Parse()
 
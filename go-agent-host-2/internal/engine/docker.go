@@ -0,0 +1,63 @@
+package engine
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/docker/docker/client"
+)
+
+// DockerEngine talks to an engine over the Docker Engine API. Podman serves
+// the same API, so both engines share this implementation.
+type DockerEngine struct {
+	*client.Client
+	name string
+}
+
+// NewDocker connects to dockerd at host, or at DOCKER_HOST (falling back to
+// the default socket) if host is empty.
+func NewDocker(host string) (*DockerEngine, error) {
+	opts := []client.Opt{client.FromEnv, client.WithAPIVersionNegotiation()}
+	if host != "" {
+		opts = append(opts, client.WithHost(host))
+	}
+	cli, err := client.NewClientWithOpts(opts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create Docker client: %w", err)
+	}
+	return &DockerEngine{Client: cli, name: Docker}, nil
+}
+
+// NewPodman connects to the Docker-compatible API of the Podman service
+// (podman system service) at host. If host is empty, CONTAINER_HOST is used,
+// then the rootless socket of the current user, then the rootful socket.
+func NewPodman(host string) (*DockerEngine, error) {
+	if host == "" {
+		host = defaultPodmanHost()
+	}
+	cli, err := client.NewClientWithOpts(client.WithHost(host), client.WithAPIVersionNegotiation())
+	if err != nil {
+		return nil, fmt.Errorf("failed to create Podman client: %w", err)
+	}
+	return &DockerEngine{Client: cli, name: Podman}, nil
+}
+
+// Name returns the engine name.
+func (e *DockerEngine) Name() string {
+	return e.name
+}
+
+// defaultPodmanHost returns the address of the local Podman API socket.
+func defaultPodmanHost() string {
+	if host := os.Getenv("CONTAINER_HOST"); host != "" {
+		return host
+	}
+	if dir := os.Getenv("XDG_RUNTIME_DIR"); dir != "" && os.Geteuid() != 0 {
+		socket := filepath.Join(dir, "podman", "podman.sock")
+		if _, err := os.Stat(socket); err == nil {
+			return "unix://" + socket
+		}
+	}
+	return "unix:///run/podman/podman.sock"
+}
@@ -0,0 +1,77 @@
+// Package engine abstracts the container engine the runner starts agent
+// containers on. Engines speak the Docker Engine API types, which Docker and
+// Podman both implement; a fake in-memory engine is provided for tests.
+package engine
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/events"
+	"github.com/docker/docker/api/types/image"
+	"github.com/docker/docker/api/types/network"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// Supported engines.
+const (
+	Docker = "docker"
+	Podman = "podman"
+)
+
+// Runtime is the set of container engine operations the runner uses.
+// Errors follow github.com/docker/docker/errdefs, so callers can test for
+// missing or conflicting objects the same way on every engine.
+type Runtime interface {
+	// Name returns the engine name, e.g. "docker".
+	Name() string
+	Ping(ctx context.Context) (types.Ping, error)
+	Close() error
+
+	ImageLoad(ctx context.Context, input io.Reader, quiet bool) (image.LoadResponse, error)
+	ImageInspectWithRaw(ctx context.Context, imageID string) (types.ImageInspect, []byte, error)
+	ImageSave(ctx context.Context, imageIDs []string) (io.ReadCloser, error)
+
+	ContainerCreate(ctx context.Context, config *container.Config, hostConfig *container.HostConfig, networkingConfig *network.NetworkingConfig, platform *ocispec.Platform, containerName string) (container.CreateResponse, error)
+	ContainerStart(ctx context.Context, containerID string, options container.StartOptions) error
+	ContainerStop(ctx context.Context, containerID string, options container.StopOptions) error
+	ContainerRemove(ctx context.Context, containerID string, options container.RemoveOptions) error
+	ContainerInspect(ctx context.Context, containerID string) (types.ContainerJSON, error)
+	ContainerList(ctx context.Context, options container.ListOptions) ([]types.Container, error)
+	ContainerLogs(ctx context.Context, containerID string, options container.LogsOptions) (io.ReadCloser, error)
+	ContainerStatsOneShot(ctx context.Context, containerID string) (container.StatsResponse, error)
+	Events(ctx context.Context, options events.ListOptions) (<-chan events.Message, <-chan error)
+
+	NetworkInspect(ctx context.Context, networkID string, options network.InspectOptions) (network.Inspect, error)
+	NetworkCreate(ctx context.Context, name string, options network.CreateOptions) (network.CreateResponse, error)
+	NetworkRemove(ctx context.Context, networkID string) error
+}
+
+var (
+	_ Runtime = (*DockerEngine)(nil)
+	_ Runtime = (*Fake)(nil)
+	_ Runtime = (*MicroVM)(nil)
+	_ Runtime = (*Router)(nil)
+)
+
+// New connects to the named engine. host is the engine API address, e.g.
+// unix:///run/podman/podman.sock; empty uses the engine's default.
+func New(name, host string) (Runtime, error) {
+	var e *DockerEngine
+	var err error
+	switch name {
+	case "", Docker:
+		e, err = NewDocker(host)
+	case Podman:
+		e, err = NewPodman(host)
+	default:
+		return nil, fmt.Errorf("unknown container engine %q (want %s or %s)", name, Docker, Podman)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return e, nil
+}
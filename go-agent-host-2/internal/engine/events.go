@@ -0,0 +1,73 @@
+package engine
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/api/types/events"
+	"github.com/docker/docker/api/types/filters"
+)
+
+// eventHub fans container events out to subscribers, for engines that
+// produce their own events.
+type eventHub struct {
+	mu          sync.Mutex
+	subscribers map[chan events.Message]filters.Args
+}
+
+func newEventHub() *eventHub {
+	return &eventHub{subscribers: make(map[chan events.Message]filters.Args)}
+}
+
+// subscribe streams events matching the type, event and label filters until
+// ctx is cancelled.
+func (h *eventHub) subscribe(ctx context.Context, options events.ListOptions) (<-chan events.Message, <-chan error) {
+	messages := make(chan events.Message, 64)
+	errs := make(chan error, 1)
+
+	h.mu.Lock()
+	h.subscribers[messages] = options.Filters
+	h.mu.Unlock()
+
+	go func() {
+		<-ctx.Done()
+		h.mu.Lock()
+		delete(h.subscribers, messages)
+		h.mu.Unlock()
+		errs <- ctx.Err()
+	}()
+	return messages, errs
+}
+
+// publish sends a container event to matching subscribers, dropping it for
+// subscribers that are not keeping up.
+func (h *eventHub) publish(id, name, image string, labels map[string]string, action events.Action, attrs map[string]string) {
+	attributes := map[string]string{"name": strings.TrimPrefix(name, "/"), "image": image}
+	for k, v := range labels {
+		attributes[k] = v
+	}
+	for k, v := range attrs {
+		attributes[k] = v
+	}
+	msg := events.Message{
+		Type:     events.ContainerEventType,
+		Action:   action,
+		Actor:    events.Actor{ID: id, Attributes: attributes},
+		Time:     time.Now().Unix(),
+		TimeNano: time.Now().UnixNano(),
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for ch, args := range h.subscribers {
+		if !args.ExactMatch("type", string(msg.Type)) || !args.ExactMatch("event", string(action)) || !args.MatchKVList("label", labels) {
+			continue
+		}
+		select {
+		case ch <- msg:
+		default:
+		}
+	}
+}
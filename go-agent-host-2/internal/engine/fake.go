@@ -0,0 +1,466 @@
+package engine
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/events"
+	"github.com/docker/docker/api/types/image"
+	"github.com/docker/docker/api/types/network"
+	"github.com/docker/docker/errdefs"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// Fake is an in-memory engine for tests. Containers do not run anything, but
+// if Handler is set, a started container serves it on its bound host port so
+// the runner can reach it like a real agent.
+type Fake struct {
+	Handler http.Handler
+
+	mu         sync.Mutex
+	images     map[string]*types.ImageInspect // By ID and by tag
+	saved      map[string][]byte              // Loaded image content by ID
+	containers map[string]*fakeContainer      // By ID
+	networks   map[string]network.Inspect     // By name
+	events     *eventHub
+	nextID     int
+	inspectErr error // Returned by ContainerInspect when set
+}
+
+type fakeContainer struct {
+	json   types.ContainerJSON
+	server *http.Server
+}
+
+// NewFake returns an empty fake engine.
+func NewFake() *Fake {
+	return &Fake{
+		images:     make(map[string]*types.ImageInspect),
+		saved:      make(map[string][]byte),
+		containers: make(map[string]*fakeContainer),
+		networks:   make(map[string]network.Inspect),
+		events:     newEventHub(),
+	}
+}
+
+// Name returns "fake".
+func (f *Fake) Name() string {
+	return "fake"
+}
+
+// Ping always succeeds.
+func (f *Fake) Ping(ctx context.Context) (types.Ping, error) {
+	return types.Ping{APIVersion: "fake"}, nil
+}
+
+// Close stops all container servers.
+func (f *Fake) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for _, c := range f.containers {
+		c.stopServer()
+	}
+	return nil
+}
+
+// AddImage registers an image with labels and returns its ID.
+func (f *Fake) AddImage(name string, labels map[string]string) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.addImage(name, []byte(name), labels)
+}
+
+func (f *Fake) addImage(name string, content []byte, labels map[string]string) string {
+	sum := sha256.Sum256(content)
+	id := "sha256:" + hex.EncodeToString(sum[:])
+	inspect := &types.ImageInspect{
+		ID:       id,
+		RepoTags: []string{name},
+		Created:  time.Now().Format(time.RFC3339Nano),
+		Config:   &container.Config{Labels: labels},
+	}
+	f.images[id] = inspect
+	f.images[name] = inspect
+	f.saved[id] = content
+	return id
+}
+
+// ImageLoad registers the input as an image named after its content hash.
+func (f *Fake) ImageLoad(ctx context.Context, input io.Reader, quiet bool) (image.LoadResponse, error) {
+	content, err := io.ReadAll(input)
+	if err != nil {
+		return image.LoadResponse{}, err
+	}
+	sum := sha256.Sum256(content)
+	name := "fake/agent-" + hex.EncodeToString(sum[:4]) + ":latest"
+
+	f.mu.Lock()
+	f.addImage(name, content, nil)
+	f.mu.Unlock()
+
+	line, _ := json.Marshal(map[string]string{"stream": "Loaded image: " + name + "\n"})
+	return image.LoadResponse{Body: io.NopCloser(bytes.NewReader(line)), JSON: true}, nil
+}
+
+// ImageInspectWithRaw returns a registered image.
+func (f *Fake) ImageInspectWithRaw(ctx context.Context, imageID string) (types.ImageInspect, []byte, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	inspect, exists := f.images[imageID]
+	if !exists {
+		return types.ImageInspect{}, nil, errdefs.NotFound(fmt.Errorf("no such image: %s", imageID))
+	}
+	raw, _ := json.Marshal(inspect)
+	return *inspect, raw, nil
+}
+
+// ImageSave returns the content an image was loaded from.
+func (f *Fake) ImageSave(ctx context.Context, imageIDs []string) (io.ReadCloser, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var buf bytes.Buffer
+	for _, name := range imageIDs {
+		inspect, exists := f.images[name]
+		if !exists {
+			return nil, errdefs.NotFound(fmt.Errorf("no such image: %s", name))
+		}
+		buf.Write(f.saved[inspect.ID])
+	}
+	return io.NopCloser(&buf), nil
+}
+
+// ContainerCreate registers a stopped container.
+func (f *Fake) ContainerCreate(ctx context.Context, config *container.Config, hostConfig *container.HostConfig, networkingConfig *network.NetworkingConfig, platform *ocispec.Platform, containerName string) (container.CreateResponse, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.lookup(containerName) != nil {
+		return container.CreateResponse{}, errdefs.Conflict(fmt.Errorf("container name %q is already in use", containerName))
+	}
+	img, exists := f.images[config.Image]
+	if !exists {
+		return container.CreateResponse{}, errdefs.NotFound(fmt.Errorf("no such image: %s", config.Image))
+	}
+	if hostConfig == nil {
+		hostConfig = &container.HostConfig{}
+	}
+
+	f.nextID++
+	sum := sha256.Sum256([]byte(strconv.Itoa(f.nextID)))
+	id := hex.EncodeToString(sum[:])
+
+	var mounts []types.MountPoint
+	for _, m := range hostConfig.Mounts {
+		mounts = append(mounts, types.MountPoint{Type: m.Type, Source: m.Source, Destination: m.Target, RW: !m.ReadOnly})
+	}
+	networks := make(map[string]*network.EndpointSettings)
+	if networkingConfig != nil {
+		for name := range networkingConfig.EndpointsConfig {
+			networks[name] = &network.EndpointSettings{
+				NetworkID: name,
+				IPAddress: fmt.Sprintf("10.88.%d.%d", f.nextID/250, f.nextID%250+2),
+			}
+		}
+	}
+
+	c := &fakeContainer{json: types.ContainerJSON{
+		ContainerJSONBase: &types.ContainerJSONBase{
+			ID:         id,
+			Created:    time.Now().Format(time.RFC3339Nano),
+			State:      &types.ContainerState{Status: "created"},
+			Image:      img.ID,
+			Name:       "/" + containerName,
+			HostConfig: hostConfig,
+		},
+		Mounts: mounts,
+		Config: config,
+		NetworkSettings: &types.NetworkSettings{
+			NetworkSettingsBase: types.NetworkSettingsBase{Ports: hostConfig.PortBindings},
+			Networks:            networks,
+		},
+	}}
+	f.containers[id] = c
+	f.emit(c, events.ActionCreate, nil)
+	return container.CreateResponse{ID: id}, nil
+}
+
+// ContainerStart marks a container running and serves Handler on its host port.
+func (f *Fake) ContainerStart(ctx context.Context, containerID string, options container.StartOptions) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	c := f.lookup(containerID)
+	if c == nil {
+		return errdefs.NotFound(fmt.Errorf("no such container: %s", containerID))
+	}
+	if c.json.State.Running {
+		return nil
+	}
+
+	if f.Handler != nil {
+		for _, binding := range c.json.HostConfig.PortBindings["80/tcp"] {
+			ln, err := net.Listen("tcp", net.JoinHostPort(binding.HostIP, binding.HostPort))
+			if err != nil {
+				return fmt.Errorf("driver failed programming external connectivity: %w", err)
+			}
+			c.server = &http.Server{Handler: f.Handler}
+			go c.server.Serve(ln)
+		}
+	}
+
+	c.json.State = &types.ContainerState{
+		Status:    "running",
+		Running:   true,
+		Pid:       1,
+		StartedAt: time.Now().Format(time.RFC3339Nano),
+	}
+	f.emit(c, events.ActionStart, nil)
+	return nil
+}
+
+// ContainerStop stops a running container with exit code 0.
+func (f *Fake) ContainerStop(ctx context.Context, containerID string, options container.StopOptions) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	c := f.lookup(containerID)
+	if c == nil {
+		return errdefs.NotFound(fmt.Errorf("no such container: %s", containerID))
+	}
+	f.exit(c, "SIGTERM", 0, false)
+	return nil
+}
+
+// ContainerRemove removes a container, stopping it first if forced.
+func (f *Fake) ContainerRemove(ctx context.Context, containerID string, options container.RemoveOptions) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	c := f.lookup(containerID)
+	if c == nil {
+		return errdefs.NotFound(fmt.Errorf("no such container: %s", containerID))
+	}
+	if c.json.State.Running {
+		if !options.Force {
+			return errdefs.Conflict(fmt.Errorf("cannot remove running container %s", containerID))
+		}
+		f.exit(c, "SIGKILL", 137, false)
+	}
+	delete(f.containers, c.json.ID)
+	f.emit(c, events.ActionDestroy, nil)
+	return nil
+}
+
+// Exit simulates a container dying on its own, e.g. after a crash or an OOM kill.
+func (f *Fake) Exit(containerID string, exitCode int, oomKilled bool) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	c := f.lookup(containerID)
+	if c == nil {
+		return errdefs.NotFound(fmt.Errorf("no such container: %s", containerID))
+	}
+	f.exit(c, "", exitCode, oomKilled)
+	return nil
+}
+
+// exit stops a running container and emits its events.
+// Must be called with mu held.
+func (f *Fake) exit(c *fakeContainer, signal string, exitCode int, oomKilled bool) {
+	if !c.json.State.Running {
+		return
+	}
+	c.stopServer()
+	if signal != "" {
+		f.emit(c, events.ActionKill, map[string]string{"signal": signal})
+	}
+	if oomKilled {
+		f.emit(c, events.ActionOOM, nil)
+	}
+	c.json.State = &types.ContainerState{
+		Status:     "exited",
+		ExitCode:   exitCode,
+		OOMKilled:  oomKilled,
+		StartedAt:  c.json.State.StartedAt,
+		FinishedAt: time.Now().Format(time.RFC3339Nano),
+	}
+	f.emit(c, events.ActionDie, map[string]string{"exitCode": strconv.Itoa(exitCode)})
+}
+
+// SetInspectError makes ContainerInspect fail with err, e.g. to simulate an
+// unresponsive engine. A nil err restores normal behavior.
+func (f *Fake) SetInspectError(err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.inspectErr = err
+}
+
+// ContainerInspect returns a container by ID or name.
+func (f *Fake) ContainerInspect(ctx context.Context, containerID string) (types.ContainerJSON, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.inspectErr != nil {
+		return types.ContainerJSON{}, f.inspectErr
+	}
+	c := f.lookup(containerID)
+	if c == nil {
+		return types.ContainerJSON{}, errdefs.NotFound(fmt.Errorf("no such container: %s", containerID))
+	}
+	// Copy the parts that change so callers don't race with later updates
+	base := *c.json.ContainerJSONBase
+	state := *base.State
+	base.State = &state
+	out := c.json
+	out.ContainerJSONBase = &base
+	return out, nil
+}
+
+// ContainerList lists containers matching the label and status filters.
+func (f *Fake) ContainerList(ctx context.Context, options container.ListOptions) ([]types.Container, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var list []types.Container
+	for _, c := range f.containers {
+		if !options.All && !c.json.State.Running {
+			continue
+		}
+		if !options.Filters.MatchKVList("label", c.json.Config.Labels) || !options.Filters.ExactMatch("status", c.json.State.Status) {
+			continue
+		}
+		list = append(list, types.Container{
+			ID:      c.json.ID,
+			Names:   []string{c.json.Name},
+			Image:   c.json.Config.Image,
+			ImageID: c.json.Image,
+			Labels:  c.json.Config.Labels,
+			State:   c.json.State.Status,
+		})
+	}
+	return list, nil
+}
+
+// ContainerLogs returns an empty log stream; fake containers write nothing.
+func (f *Fake) ContainerLogs(ctx context.Context, containerID string, options container.LogsOptions) (io.ReadCloser, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.lookup(containerID) == nil {
+		return nil, errdefs.NotFound(fmt.Errorf("no such container: %s", containerID))
+	}
+	return io.NopCloser(strings.NewReader("")), nil
+}
+
+// ContainerStatsOneShot returns zeroed stats.
+func (f *Fake) ContainerStatsOneShot(ctx context.Context, containerID string) (container.StatsResponse, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.lookup(containerID) == nil {
+		return container.StatsResponse{}, errdefs.NotFound(fmt.Errorf("no such container: %s", containerID))
+	}
+	body, _ := json.Marshal(types.StatsJSON{})
+	return container.StatsResponse{Body: io.NopCloser(bytes.NewReader(body)), OSType: "linux"}, nil
+}
+
+// Events streams container events matching the type, event and label
+// filters until ctx is cancelled.
+func (f *Fake) Events(ctx context.Context, options events.ListOptions) (<-chan events.Message, <-chan error) {
+	return f.events.subscribe(ctx, options)
+}
+
+// emit publishes a container event.
+func (f *Fake) emit(c *fakeContainer, action events.Action, attrs map[string]string) {
+	f.events.publish(c.json.ID, c.json.Name, c.json.Config.Image, c.json.Config.Labels, action, attrs)
+}
+
+// NetworkInspect returns a network created with NetworkCreate.
+func (f *Fake) NetworkInspect(ctx context.Context, networkID string, options network.InspectOptions) (network.Inspect, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	nw, exists := f.networks[networkID]
+	if !exists {
+		return network.Inspect{}, errdefs.NotFound(fmt.Errorf("network %s not found", networkID))
+	}
+	return nw, nil
+}
+
+// NetworkCreate registers a network.
+func (f *Fake) NetworkCreate(ctx context.Context, name string, options network.CreateOptions) (network.CreateResponse, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if _, exists := f.networks[name]; exists {
+		return network.CreateResponse{}, errdefs.Conflict(fmt.Errorf("network with name %s already exists", name))
+	}
+	f.networks[name] = network.Inspect{
+		Name:    name,
+		ID:      name,
+		Driver:  options.Driver,
+		IPAM:    ptrValue(options.IPAM),
+		Options: options.Options,
+		Labels:  options.Labels,
+	}
+	return network.CreateResponse{ID: name}, nil
+}
+
+// NetworkRemove removes a network.
+func (f *Fake) NetworkRemove(ctx context.Context, networkID string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if _, exists := f.networks[networkID]; !exists {
+		return errdefs.NotFound(fmt.Errorf("network %s not found", networkID))
+	}
+	delete(f.networks, networkID)
+	return nil
+}
+
+// lookup finds a container by ID, ID prefix or name.
+// Must be called with mu held.
+func (f *Fake) lookup(idOrName string) *fakeContainer {
+	if c, exists := f.containers[idOrName]; exists {
+		return c
+	}
+	for id, c := range f.containers {
+		if c.json.Name == "/"+idOrName || (len(idOrName) >= 12 && strings.HasPrefix(id, idOrName)) {
+			return c
+		}
+	}
+	return nil
+}
+
+func (c *fakeContainer) stopServer() {
+	if c.server != nil {
+		c.server.Close()
+		c.server = nil
+	}
+}
+
+func ptrValue[T any](p *T) T {
+	if p == nil {
+		var zero T
+		return zero
+	}
+	return *p
+}
@@ -0,0 +1,1059 @@
+package engine
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/events"
+	"github.com/docker/docker/api/types/image"
+	"github.com/docker/docker/api/types/mount"
+	"github.com/docker/docker/api/types/network"
+	"github.com/docker/docker/errdefs"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// MicroVMRuntime is the OCI runtime name that selects the microVM backend
+// for a container, e.g. in the agent policy file.
+const MicroVMRuntime = "microvm"
+
+// Supported virtual machine monitors.
+const (
+	Firecracker     = "firecracker"
+	CloudHypervisor = "cloud-hypervisor"
+)
+
+const (
+	// defaultVMMemoryMB is the guest memory when no memory limit is set.
+	defaultVMMemoryMB = 512
+	// rootfsHeadroomMB is the free space added to a rootfs without a disk limit.
+	rootfsHeadroomMB = 256
+	// logPollInterval is how often a followed console log is checked for output.
+	logPollInterval = 200 * time.Millisecond
+)
+
+// guestInit is installed as /.agent-host/init in every rootfs. It mounts the
+// per-VM config drive, installs the files copied onto it, applies the process
+// limit with a pids cgroup, runs the image command as root and reports its
+// exit code on the console before the guest halts.
+const guestInit = `#!/bin/sh
+mount -t proc proc /proc 2>/dev/null
+mount -t sysfs sysfs /sys 2>/dev/null
+mount -t devtmpfs devtmpfs /dev 2>/dev/null
+mkdir -p /dev/pts /dev/shm /tmp /run /.agent-host/config
+mount -t devpts devpts /dev/pts 2>/dev/null
+mount -t tmpfs tmpfs /dev/shm 2>/dev/null
+mount -o ro /dev/vdb /.agent-host/config
+[ -f /.agent-host/config/resolv.conf ] && cp /.agent-host/config/resolv.conf /etc/resolv.conf
+if [ -f /.agent-host/config/pids.max ]; then
+	mkdir -p /sys/fs/cgroup 2>/dev/null
+	mount -t cgroup2 cgroup2 /sys/fs/cgroup 2>/dev/null
+	if ! { mkdir -p /sys/fs/cgroup/agent &&
+		echo +pids > /sys/fs/cgroup/cgroup.subtree_control &&
+		cat /.agent-host/config/pids.max > /sys/fs/cgroup/agent/pids.max &&
+		echo $$ > /sys/fs/cgroup/agent/cgroup.procs; }; then
+		echo "agent-host: the guest kernel cannot limit processes"
+		echo "agent-host: exit 1"
+		sync
+		exit 1
+	fi
+fi
+[ -f /.agent-host/config/files ] && while read -r n target; do
+	mkdir -p "${target%/*}/" && cp "/.agent-host/config/files.d/$n" "$target"
+done < /.agent-host/config/files
+. /.agent-host/config/env
+. /.agent-host/config/run
+echo "agent-host: exit $?"
+sync
+`
+
+// exitPattern and oomPattern parse the guest console.
+var (
+	exitPattern = regexp.MustCompile(`^agent-host: exit (\d+)$`)
+	oomPattern  = regexp.MustCompile(`Out of memory: Killed process|Memory cgroup out of memory`)
+)
+
+// MicroVMConfig holds the microVM backend configuration.
+type MicroVMConfig struct {
+	VMM      string // firecracker or cloud-hypervisor
+	Binary   string // VMM binary (empty = the VMM name on PATH)
+	Kernel   string // Uncompressed guest kernel (vmlinux) with virtio and ip= autoconfiguration
+	StateDir string // Root filesystems, config drives and consoles
+	Network  string // Engine network whose bridge the VM taps are attached to
+}
+
+// MicroVM runs each container as a Firecracker or Cloud Hypervisor microVM
+// booted from the image's root filesystem. Images and networks stay on the
+// engine that loaded them; a VM gets a tap device on the network's bridge and
+// an address from the top of its subnet, away from the engine's own
+// allocations, so sandbox firewall rules apply to it unchanged. Published
+// ports are forwarded to the VM by the runner itself.
+type MicroVM struct {
+	cfg    MicroVMConfig
+	images Runtime
+
+	bridge  string
+	subnet  *net.IPNet
+	gateway net.IP
+
+	mu     sync.Mutex
+	vms    map[string]*microVM // By ID
+	usedIP map[string]bool
+	events *eventHub
+	builds map[string]*sync.Mutex // Serializes root filesystem builds, by key
+}
+
+type microVM struct {
+	json      types.ContainerJSON
+	dir       string
+	tap       string
+	ip        net.IP
+	cmd       *exec.Cmd
+	listeners []net.Listener
+	done      chan struct{} // Closed when the VMM exits
+	signal    string        // Signal sent by ContainerStop or ContainerRemove
+	exitCode  int           // Exit code reported by the guest, -1 if none
+	oom       bool
+}
+
+// NewMicroVM prepares the microVM backend. images is the engine that loads
+// images and owns cfg.Network.
+func NewMicroVM(ctx context.Context, images Runtime, cfg MicroVMConfig) (*MicroVM, error) {
+	if cfg.VMM != Firecracker && cfg.VMM != CloudHypervisor {
+		return nil, fmt.Errorf("unknown VMM %q (want %s or %s)", cfg.VMM, Firecracker, CloudHypervisor)
+	}
+	if cfg.Binary == "" {
+		cfg.Binary = cfg.VMM
+	}
+	binary, err := exec.LookPath(cfg.Binary)
+	if err != nil {
+		return nil, fmt.Errorf("VMM binary not found: %w", err)
+	}
+	cfg.Binary = binary
+	for _, tool := range []string{"mkfs.ext4", "ip", "cp"} {
+		if _, err := exec.LookPath(tool); err != nil {
+			return nil, fmt.Errorf("%s is required by the microVM backend: %w", tool, err)
+		}
+	}
+	if _, err := os.Stat(cfg.Kernel); err != nil {
+		return nil, fmt.Errorf("guest kernel not found: %w", err)
+	}
+	if cfg.StateDir, err = filepath.Abs(cfg.StateDir); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Join(cfg.StateDir, "images"), 0700); err != nil {
+		return nil, fmt.Errorf("failed to create microVM state directory: %w", err)
+	}
+
+	nw, err := images.NetworkInspect(ctx, cfg.Network, network.InspectOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to inspect network %s: %w", cfg.Network, err)
+	}
+	bridge := nw.Options["com.docker.network.bridge.name"]
+	if bridge == "" {
+		bridge = "br-" + nw.ID[:12]
+	}
+	var subnet *net.IPNet
+	var gateway net.IP
+	for _, c := range nw.IPAM.Config {
+		if _, ipnet, err := net.ParseCIDR(c.Subnet); err == nil && ipnet.IP.To4() != nil {
+			subnet, gateway = ipnet, net.ParseIP(c.Gateway).To4()
+			break
+		}
+	}
+	if subnet == nil || gateway == nil {
+		return nil, fmt.Errorf("network %s has no IPv4 subnet and gateway", cfg.Network)
+	}
+
+	slog.Info("MicroVM backend configured",
+		"vmm", cfg.VMM,
+		"binary", cfg.Binary,
+		"kernel", cfg.Kernel,
+		"bridge", bridge,
+		"subnet", subnet,
+	)
+	return &MicroVM{
+		cfg:     cfg,
+		images:  images,
+		bridge:  bridge,
+		subnet:  subnet,
+		gateway: gateway,
+		vms:     make(map[string]*microVM),
+		usedIP:  make(map[string]bool),
+		builds:  make(map[string]*sync.Mutex),
+		events:  newEventHub(),
+	}, nil
+}
+
+// Name returns the VMM name.
+func (v *MicroVM) Name() string {
+	return v.cfg.VMM
+}
+
+// Ping checks the image engine.
+func (v *MicroVM) Ping(ctx context.Context) (types.Ping, error) {
+	return v.images.Ping(ctx)
+}
+
+// Close kills all VMs. Their state is removed with ContainerRemove.
+func (v *MicroVM) Close() error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	for _, vm := range v.vms {
+		if vm.running() {
+			vm.cmd.Process.Kill()
+		}
+	}
+	return nil
+}
+
+// ImageLoad loads an image into the image engine.
+func (v *MicroVM) ImageLoad(ctx context.Context, input io.Reader, quiet bool) (image.LoadResponse, error) {
+	return v.images.ImageLoad(ctx, input, quiet)
+}
+
+// ImageInspectWithRaw inspects an image on the image engine.
+func (v *MicroVM) ImageInspectWithRaw(ctx context.Context, imageID string) (types.ImageInspect, []byte, error) {
+	return v.images.ImageInspectWithRaw(ctx, imageID)
+}
+
+// ImageSave exports images from the image engine.
+func (v *MicroVM) ImageSave(ctx context.Context, imageIDs []string) (io.ReadCloser, error) {
+	return v.images.ImageSave(ctx, imageIDs)
+}
+
+// ContainerCreate prepares a VM: its root filesystem, config drive and tap device.
+func (v *MicroVM) ContainerCreate(ctx context.Context, config *container.Config, hostConfig *container.HostConfig, networkingConfig *network.NetworkingConfig, platform *ocispec.Platform, containerName string) (container.CreateResponse, error) {
+	if hostConfig == nil {
+		hostConfig = &container.HostConfig{}
+	}
+	if err := checkSupported(config, hostConfig); err != nil {
+		return container.CreateResponse{}, errdefs.InvalidParameter(err)
+	}
+
+	img, _, err := v.images.ImageInspectWithRaw(ctx, config.Image)
+	if err != nil {
+		return container.CreateResponse{}, err
+	}
+
+	v.mu.Lock()
+	if v.lookup(containerName) != nil {
+		v.mu.Unlock()
+		return container.CreateResponse{}, errdefs.Conflict(fmt.Errorf("container name %q is already in use", containerName))
+	}
+	ip, err := v.allocateIP(ctx)
+	if err != nil {
+		v.mu.Unlock()
+		return container.CreateResponse{}, err
+	}
+	id := randomID()
+	v.mu.Unlock()
+
+	vm := &microVM{
+		dir:      filepath.Join(v.cfg.StateDir, id),
+		tap:      "fc" + id[:12],
+		ip:       ip,
+		exitCode: -1,
+	}
+	fail := func(err error) (container.CreateResponse, error) {
+		v.teardown(vm)
+		return container.CreateResponse{}, err
+	}
+
+	if err := os.MkdirAll(vm.dir, 0700); err != nil {
+		return fail(err)
+	}
+	base, err := v.baseRootfs(ctx, img, hostConfig.StorageOpt["size"])
+	if err != nil {
+		return fail(err)
+	}
+	if out, err := exec.CommandContext(ctx, "cp", "--sparse=always", "--reflink=auto", base, filepath.Join(vm.dir, "rootfs.ext4")).CombinedOutput(); err != nil {
+		return fail(fmt.Errorf("failed to copy rootfs: %w: %s", err, strings.TrimSpace(string(out))))
+	}
+	if err := v.writeConfigDrive(vm.dir, img.Config, config, hostConfig); err != nil {
+		return fail(err)
+	}
+	if err := v.createTap(vm.tap); err != nil {
+		return fail(err)
+	}
+
+	networks := map[string]*network.EndpointSettings{
+		v.cfg.Network: {
+			NetworkID:   v.cfg.Network,
+			IPAddress:   ip.String(),
+			Gateway:     v.gateway.String(),
+			IPPrefixLen: maskBits(v.subnet.Mask),
+			MacAddress:  guestMAC(ip),
+		},
+	}
+	vm.json = types.ContainerJSON{
+		ContainerJSONBase: &types.ContainerJSONBase{
+			ID:         id,
+			Created:    time.Now().Format(time.RFC3339Nano),
+			State:      &types.ContainerState{Status: "created"},
+			Image:      img.ID,
+			Name:       "/" + containerName,
+			HostConfig: hostConfig,
+			Driver:     v.cfg.VMM,
+		},
+		Config: config,
+		NetworkSettings: &types.NetworkSettings{
+			NetworkSettingsBase: types.NetworkSettingsBase{Ports: hostConfig.PortBindings},
+			Networks:            networks,
+		},
+	}
+
+	v.mu.Lock()
+	v.vms[id] = vm
+	v.mu.Unlock()
+	v.emit(vm, events.ActionCreate, nil)
+	return container.CreateResponse{ID: id}, nil
+}
+
+// ContainerStart forwards the published ports and boots the VM.
+func (v *MicroVM) ContainerStart(ctx context.Context, containerID string, options container.StartOptions) error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	vm := v.lookup(containerID)
+	if vm == nil {
+		return errdefs.NotFound(fmt.Errorf("no such container: %s", containerID))
+	}
+	if vm.running() {
+		return nil
+	}
+
+	for port, bindings := range vm.json.HostConfig.PortBindings {
+		for _, binding := range bindings {
+			ln, err := net.Listen("tcp", net.JoinHostPort(binding.HostIP, binding.HostPort))
+			if err != nil {
+				vm.closeListeners()
+				return fmt.Errorf("failed to bind host port: %w", err)
+			}
+			vm.listeners = append(vm.listeners, ln)
+			go forwardPort(ln, net.JoinHostPort(vm.ip.String(), port.Port()))
+		}
+	}
+
+	cmd, err := v.vmmCommand(vm)
+	if err != nil {
+		vm.closeListeners()
+		return err
+	}
+	console, err := os.OpenFile(filepath.Join(vm.dir, "console.log"), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		vm.closeListeners()
+		return err
+	}
+	output, err := cmd.StdoutPipe()
+	if err != nil {
+		console.Close()
+		vm.closeListeners()
+		return err
+	}
+	cmd.Stderr = cmd.Stdout
+	cmd.SysProcAttr = vmmProcAttr()
+	if err := cmd.Start(); err != nil {
+		console.Close()
+		vm.closeListeners()
+		return fmt.Errorf("failed to start %s: %w", v.cfg.VMM, err)
+	}
+
+	vm.cmd = cmd
+	vm.done = make(chan struct{})
+	vm.signal = ""
+	vm.exitCode = -1
+	vm.oom = false
+	vm.json.State = &types.ContainerState{
+		Status:    "running",
+		Running:   true,
+		Pid:       cmd.Process.Pid,
+		StartedAt: time.Now().Format(time.RFC3339Nano),
+	}
+	go v.watch(vm, output, console)
+	v.emit(vm, events.ActionStart, nil)
+	return nil
+}
+
+// watch timestamps the guest console into console.log and records the exit
+// of the VM.
+func (v *MicroVM) watch(vm *microVM, output io.Reader, console *os.File) {
+	scanner := bufio.NewScanner(output)
+	scanner.Buffer(make([]byte, 64*1024), 1<<20)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if match := exitPattern.FindStringSubmatch(line); match != nil {
+			code, _ := strconv.Atoi(match[1])
+			v.mu.Lock()
+			vm.exitCode = code
+			v.mu.Unlock()
+			continue
+		}
+		if oomPattern.MatchString(line) {
+			v.mu.Lock()
+			vm.oom = true
+			v.mu.Unlock()
+			v.emit(vm, events.ActionOOM, nil)
+		}
+		fmt.Fprintf(console, "%s %s\n", time.Now().UTC().Format(time.RFC3339Nano), line)
+	}
+	console.Close()
+
+	err := vm.cmd.Wait()
+
+	v.mu.Lock()
+	exitCode := vm.exitCode
+	if exitCode < 0 {
+		exitCode = vmmExitCode(vm.signal, err)
+	}
+	vm.closeListeners()
+	vm.json.State = &types.ContainerState{
+		Status:     "exited",
+		ExitCode:   exitCode,
+		OOMKilled:  vm.oom,
+		StartedAt:  vm.json.State.StartedAt,
+		FinishedAt: time.Now().Format(time.RFC3339Nano),
+	}
+	close(vm.done)
+	v.mu.Unlock()
+
+	v.emit(vm, events.ActionDie, map[string]string{"exitCode": strconv.Itoa(exitCode)})
+}
+
+// ContainerStop terminates the VMM, killing it after the stop timeout.
+func (v *MicroVM) ContainerStop(ctx context.Context, containerID string, options container.StopOptions) error {
+	timeout := 10 * time.Second
+	if options.Timeout != nil {
+		timeout = time.Duration(*options.Timeout) * time.Second
+	}
+	return v.stop(containerID, "SIGTERM", timeout)
+}
+
+func (v *MicroVM) stop(containerID, signal string, timeout time.Duration) error {
+	v.mu.Lock()
+	vm := v.lookup(containerID)
+	if vm == nil {
+		v.mu.Unlock()
+		return errdefs.NotFound(fmt.Errorf("no such container: %s", containerID))
+	}
+	if !vm.running() {
+		v.mu.Unlock()
+		return nil
+	}
+	vm.signal = signal
+	done := vm.done
+	v.mu.Unlock()
+
+	v.emit(vm, events.ActionKill, map[string]string{"signal": signal})
+	if signal == "SIGKILL" {
+		vm.cmd.Process.Kill()
+	} else {
+		vm.cmd.Process.Signal(terminateSignal)
+	}
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		vm.cmd.Process.Kill()
+		<-done
+	}
+	return nil
+}
+
+// ContainerRemove removes a VM and its state, killing it first if forced.
+func (v *MicroVM) ContainerRemove(ctx context.Context, containerID string, options container.RemoveOptions) error {
+	v.mu.Lock()
+	vm := v.lookup(containerID)
+	if vm == nil {
+		v.mu.Unlock()
+		return errdefs.NotFound(fmt.Errorf("no such container: %s", containerID))
+	}
+	running := vm.running()
+	v.mu.Unlock()
+
+	if running {
+		if !options.Force {
+			return errdefs.Conflict(fmt.Errorf("cannot remove running container %s", containerID))
+		}
+		v.stop(containerID, "SIGKILL", 0)
+	}
+
+	v.mu.Lock()
+	delete(v.vms, vm.json.ID)
+	v.mu.Unlock()
+	v.teardown(vm)
+	v.emit(vm, events.ActionDestroy, nil)
+	return nil
+}
+
+// ContainerInspect returns a VM by ID or name.
+func (v *MicroVM) ContainerInspect(ctx context.Context, containerID string) (types.ContainerJSON, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	vm := v.lookup(containerID)
+	if vm == nil {
+		return types.ContainerJSON{}, errdefs.NotFound(fmt.Errorf("no such container: %s", containerID))
+	}
+	base := *vm.json.ContainerJSONBase
+	state := *base.State
+	base.State = &state
+	out := vm.json
+	out.ContainerJSONBase = &base
+	return out, nil
+}
+
+// ContainerList lists VMs matching the label and status filters.
+func (v *MicroVM) ContainerList(ctx context.Context, options container.ListOptions) ([]types.Container, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	var list []types.Container
+	for _, vm := range v.vms {
+		if !options.All && !vm.running() {
+			continue
+		}
+		if !options.Filters.MatchKVList("label", vm.json.Config.Labels) || !options.Filters.ExactMatch("status", vm.json.State.Status) {
+			continue
+		}
+		list = append(list, types.Container{
+			ID:      vm.json.ID,
+			Names:   []string{vm.json.Name},
+			Image:   vm.json.Config.Image,
+			ImageID: vm.json.Image,
+			Labels:  vm.json.Config.Labels,
+			State:   vm.json.State.Status,
+		})
+	}
+	return list, nil
+}
+
+// ContainerLogs returns the guest console in the Docker multiplexed stream
+// format, on stdout.
+func (v *MicroVM) ContainerLogs(ctx context.Context, containerID string, options container.LogsOptions) (io.ReadCloser, error) {
+	v.mu.Lock()
+	vm := v.lookup(containerID)
+	if vm == nil {
+		v.mu.Unlock()
+		return nil, errdefs.NotFound(fmt.Errorf("no such container: %s", containerID))
+	}
+	done := vm.done
+	v.mu.Unlock()
+
+	f, err := os.Open(filepath.Join(vm.dir, "console.log"))
+	if err != nil {
+		return nil, err
+	}
+	var since time.Time
+	if options.Since != "" {
+		since, _ = time.Parse(time.RFC3339Nano, options.Since)
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		defer f.Close()
+		reader := bufio.NewReader(f)
+		var partial string
+		for {
+			chunk, err := reader.ReadString('\n')
+			partial += chunk
+			if err == nil {
+				if !writeLogFrame(pw, partial, since, options.Timestamps) {
+					return
+				}
+				partial = ""
+				continue
+			}
+			if !options.Follow || done == nil {
+				pw.Close()
+				return
+			}
+			select {
+			case <-done:
+				// Drain what the VM wrote before it exited
+				if _, err := reader.Peek(1); err != nil {
+					pw.Close()
+					return
+				}
+			case <-ctx.Done():
+				pw.CloseWithError(ctx.Err())
+				return
+			case <-time.After(logPollInterval):
+			}
+		}
+	}()
+	return pr, nil
+}
+
+// writeLogFrame writes one timestamped console line as a stdout frame.
+func writeLogFrame(w io.Writer, line string, since time.Time, timestamps bool) bool {
+	ts, message, ok := strings.Cut(strings.TrimSuffix(line, "\n"), " ")
+	if !ok {
+		return true
+	}
+	if t, err := time.Parse(time.RFC3339Nano, ts); err == nil && !since.IsZero() && t.Before(since) {
+		return true
+	}
+	payload := message + "\n"
+	if timestamps {
+		payload = ts + " " + payload
+	}
+	header := make([]byte, 8)
+	header[0] = 1
+	binary.BigEndian.PutUint32(header[4:], uint32(len(payload)))
+	if _, err := w.Write(append(header, payload...)); err != nil {
+		return false
+	}
+	return true
+}
+
+// ContainerStatsOneShot returns zeroed stats; guest usage is not sampled.
+func (v *MicroVM) ContainerStatsOneShot(ctx context.Context, containerID string) (container.StatsResponse, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if v.lookup(containerID) == nil {
+		return container.StatsResponse{}, errdefs.NotFound(fmt.Errorf("no such container: %s", containerID))
+	}
+	body, _ := json.Marshal(types.StatsJSON{})
+	return container.StatsResponse{Body: io.NopCloser(strings.NewReader(string(body))), OSType: "linux"}, nil
+}
+
+// Events streams VM events matching the type, event and label filters.
+func (v *MicroVM) Events(ctx context.Context, options events.ListOptions) (<-chan events.Message, <-chan error) {
+	return v.events.subscribe(ctx, options)
+}
+
+// NetworkInspect inspects a network on the image engine.
+func (v *MicroVM) NetworkInspect(ctx context.Context, networkID string, options network.InspectOptions) (network.Inspect, error) {
+	return v.images.NetworkInspect(ctx, networkID, options)
+}
+
+// NetworkCreate creates a network on the image engine.
+func (v *MicroVM) NetworkCreate(ctx context.Context, name string, options network.CreateOptions) (network.CreateResponse, error) {
+	return v.images.NetworkCreate(ctx, name, options)
+}
+
+// NetworkRemove removes a network from the image engine.
+func (v *MicroVM) NetworkRemove(ctx context.Context, networkID string) error {
+	return v.images.NetworkRemove(ctx, networkID)
+}
+
+// Owns reports whether a container ID or name belongs to a VM.
+func (v *MicroVM) Owns(idOrName string) bool {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	return v.lookup(idOrName) != nil
+}
+
+// baseRootfs returns the shared ext4 root filesystem of an image, building
+// it on first use. size is a Docker storage size such as "2048M".
+func (v *MicroVM) baseRootfs(ctx context.Context, img types.ImageInspect, size string) (string, error) {
+	key := strings.TrimPrefix(img.ID, "sha256:")
+	if size != "" {
+		key += "-" + size
+	}
+	// Root filesystems built with another guest init are rebuilt
+	key += fmt.Sprintf("-%08x", crc32.ChecksumIEEE([]byte(guestInit)))
+	path := filepath.Join(v.cfg.StateDir, "images", key+".ext4")
+	if _, err := os.Stat(path); err == nil {
+		return path, nil
+	}
+
+	// Concurrent creates of the same image wait for one build
+	v.mu.Lock()
+	build, ok := v.builds[key]
+	if !ok {
+		build = &sync.Mutex{}
+		v.builds[key] = build
+	}
+	v.mu.Unlock()
+	build.Lock()
+	defer build.Unlock()
+	if _, err := os.Stat(path); err == nil {
+		return path, nil
+	}
+
+	start := time.Now()
+	dir, err := os.MkdirTemp(filepath.Join(v.cfg.StateDir, "images"), "rootfs-")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(dir)
+
+	archive, err := v.images.ImageSave(ctx, []string{img.ID})
+	if err != nil {
+		return "", fmt.Errorf("failed to export image: %w", err)
+	}
+	used, err := unpackImage(archive, dir)
+	archive.Close()
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(filepath.Join(dir, ".agent-host"), 0755); err != nil {
+		return "", err
+	}
+	if err := os.WriteFile(filepath.Join(dir, ".agent-host", "init"), []byte(guestInit), 0755); err != nil {
+		return "", err
+	}
+
+	sizeMB := used/(1024*1024) + used/(1024*1024)/4 + rootfsHeadroomMB
+	if size != "" {
+		if limit, err := strconv.ParseInt(strings.TrimSuffix(size, "M"), 10, 64); err == nil && limit > sizeMB {
+			sizeMB = limit
+		}
+	}
+	tmpFile, err := os.CreateTemp(filepath.Dir(path), key+"-*.tmp")
+	if err != nil {
+		return "", err
+	}
+	tmpFile.Close()
+	tmp := tmpFile.Name()
+	if err := makeExt4(dir, tmp, sizeMB); err != nil {
+		os.Remove(tmp)
+		return "", err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return "", err
+	}
+	if img.Config != nil && img.Config.User != "" {
+		slog.Warn("MicroVMs run the image command as root; the image user is not applied",
+			"image", img.ID,
+			"user", img.Config.User,
+		)
+	}
+	slog.Info("Built microVM root filesystem",
+		"image", img.ID,
+		"size_mb", sizeMB,
+		"duration_ms", time.Since(start).Milliseconds(),
+	)
+	return path, nil
+}
+
+// checkSupported rejects settings the VM cannot apply: a user to run as or a
+// read-only root filesystem, and mounts other than read-only bind mounts of
+// regular files, which are copied into the VM when it is created.
+func checkSupported(config *container.Config, hostConfig *container.HostConfig) error {
+	if config.User != "" {
+		return errors.New("running as a user is not supported by the microVM backend")
+	}
+	if hostConfig.ReadonlyRootfs {
+		return errors.New("read-only root filesystems are not supported by the microVM backend")
+	}
+	if len(hostConfig.Binds) > 0 {
+		return errors.New("bind mounts are not supported by the microVM backend")
+	}
+	for _, mnt := range hostConfig.Mounts {
+		if mnt.Type != mount.TypeBind || !mnt.ReadOnly {
+			return errors.New("only read-only file mounts are supported by the microVM backend")
+		}
+		if info, err := os.Stat(mnt.Source); err != nil || !info.Mode().IsRegular() {
+			return fmt.Errorf("mount source %s is not a regular file; the microVM backend copies only files", mnt.Source)
+		}
+	}
+	return nil
+}
+
+// writeConfigDrive builds the read-only drive with the VM's environment and
+// command, merged from the image and container configuration, its process
+// limit, its resolv.conf if DNS servers are set and copies of the mounted files.
+func (v *MicroVM) writeConfigDrive(vmDir string, imageConfig *container.Config, config *container.Config, hostConfig *container.HostConfig) error {
+	if imageConfig == nil {
+		imageConfig = &container.Config{}
+	}
+	dir := filepath.Join(vmDir, "config")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	var env strings.Builder
+	for _, kv := range append(append([]string(nil), imageConfig.Env...), config.Env...) {
+		env.WriteString("export " + shellQuote(kv) + "\n")
+	}
+
+	entrypoint, cmd := imageConfig.Entrypoint, imageConfig.Cmd
+	if len(config.Entrypoint) > 0 {
+		entrypoint, cmd = config.Entrypoint, nil
+	}
+	if len(config.Cmd) > 0 {
+		cmd = config.Cmd
+	}
+	argv := append(append([]string(nil), entrypoint...), cmd...)
+	if len(argv) == 0 {
+		return errors.New("image has no entrypoint or command")
+	}
+	workdir := config.WorkingDir
+	if workdir == "" {
+		workdir = imageConfig.WorkingDir
+	}
+	if workdir == "" {
+		workdir = "/"
+	}
+	quoted := make([]string, len(argv))
+	for i, arg := range argv {
+		quoted[i] = shellQuote(arg)
+	}
+	run := "cd " + shellQuote(workdir) + "\n" + strings.Join(quoted, " ") + "\n"
+
+	if err := os.WriteFile(filepath.Join(dir, "env"), []byte(env.String()), 0644); err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(dir, "run"), []byte(run), 0644); err != nil {
+		return err
+	}
+	if pids := hostConfig.PidsLimit; pids != nil && *pids > 0 {
+		if err := os.WriteFile(filepath.Join(dir, "pids.max"), []byte(strconv.FormatInt(*pids, 10)+"\n"), 0644); err != nil {
+			return err
+		}
+	}
+	if len(hostConfig.DNS) > 0 {
+		var resolv strings.Builder
+		for _, server := range hostConfig.DNS {
+			resolv.WriteString("nameserver " + server + "\n")
+		}
+		if err := os.WriteFile(filepath.Join(dir, "resolv.conf"), []byte(resolv.String()), 0644); err != nil {
+			return err
+		}
+	}
+	if len(hostConfig.Mounts) > 0 {
+		if err := os.MkdirAll(filepath.Join(dir, "files.d"), 0755); err != nil {
+			return err
+		}
+		var manifest strings.Builder
+		for i, mnt := range hostConfig.Mounts {
+			data, err := os.ReadFile(mnt.Source)
+			if err != nil {
+				return err
+			}
+			if err := os.WriteFile(filepath.Join(dir, "files.d", strconv.Itoa(i)), data, 0644); err != nil {
+				return err
+			}
+			fmt.Fprintf(&manifest, "%d %s\n", i, mnt.Target)
+		}
+		if err := os.WriteFile(filepath.Join(dir, "files"), []byte(manifest.String()), 0644); err != nil {
+			return err
+		}
+	}
+	return makeExt4(dir, filepath.Join(vmDir, "config.ext4"), 4)
+}
+
+// vmmCommand builds the VMM command line for a VM.
+func (v *MicroVM) vmmCommand(vm *microVM) (*exec.Cmd, error) {
+	resources := vm.json.HostConfig.Resources
+	vcpus := int((resources.NanoCPUs + 1e9 - 1) / 1e9)
+	if vcpus < 1 {
+		vcpus = 1
+	}
+	memoryMB := resources.Memory / (1024 * 1024)
+	if memoryMB <= 0 {
+		memoryMB = defaultVMMemoryMB
+	}
+	hostname := strings.TrimPrefix(vm.json.Name, "/")
+	ipConfig := fmt.Sprintf("ip=%s::%s:%s:%s:eth0:off", vm.ip, v.gateway, net.IP(v.subnet.Mask), hostname)
+	rootfs := filepath.Join(vm.dir, "rootfs.ext4")
+	configDrive := filepath.Join(vm.dir, "config.ext4")
+	mac := guestMAC(vm.ip)
+
+	switch v.cfg.VMM {
+	case Firecracker:
+		config := map[string]any{
+			"boot-source": map[string]any{
+				"kernel_image_path": v.cfg.Kernel,
+				"boot_args":         "console=ttyS0 quiet reboot=k panic=1 pci=off root=/dev/vda rw init=/.agent-host/init " + ipConfig,
+			},
+			"drives": []map[string]any{
+				{"drive_id": "rootfs", "path_on_host": rootfs, "is_root_device": true, "is_read_only": false},
+				{"drive_id": "config", "path_on_host": configDrive, "is_root_device": false, "is_read_only": true},
+			},
+			"machine-config": map[string]any{
+				"vcpu_count":   vcpus,
+				"mem_size_mib": memoryMB,
+			},
+			"network-interfaces": []map[string]any{
+				{"iface_id": "eth0", "guest_mac": mac, "host_dev_name": vm.tap},
+			},
+		}
+		data, _ := json.MarshalIndent(config, "", "  ")
+		path := filepath.Join(vm.dir, "firecracker.json")
+		if err := os.WriteFile(path, data, 0600); err != nil {
+			return nil, err
+		}
+		return exec.Command(v.cfg.Binary, "--no-api", "--config-file", path), nil
+	default:
+		return exec.Command(v.cfg.Binary,
+			"--kernel", v.cfg.Kernel,
+			"--cmdline", "console=ttyS0 quiet reboot=k panic=1 root=/dev/vda rw init=/.agent-host/init "+ipConfig,
+			"--cpus", fmt.Sprintf("boot=%d", vcpus),
+			"--memory", fmt.Sprintf("size=%dM", memoryMB),
+			"--disk", "path="+rootfs, "path="+configDrive+",readonly=on",
+			"--net", fmt.Sprintf("tap=%s,mac=%s", vm.tap, mac),
+			"--serial", "tty",
+			"--console", "off",
+		), nil
+	}
+}
+
+// allocateIP picks the highest free address of the subnet that neither the
+// engine nor another VM uses. Must be called with mu held.
+func (v *MicroVM) allocateIP(ctx context.Context) (net.IP, error) {
+	nw, err := v.images.NetworkInspect(ctx, v.cfg.Network, network.InspectOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to inspect network %s: %w", v.cfg.Network, err)
+	}
+	used := make(map[string]bool)
+	for _, endpoint := range nw.Containers {
+		if ip, _, err := net.ParseCIDR(endpoint.IPv4Address); err == nil {
+			used[ip.String()] = true
+		}
+	}
+
+	base := binary.BigEndian.Uint32(v.subnet.IP.To4())
+	ones, bits := v.subnet.Mask.Size()
+	broadcast := base | (1<<(bits-ones) - 1)
+	for n := broadcast - 1; n > base; n-- {
+		ip := make(net.IP, 4)
+		binary.BigEndian.PutUint32(ip, n)
+		key := ip.String()
+		if ip.Equal(v.gateway) || used[key] || v.usedIP[key] {
+			continue
+		}
+		v.usedIP[key] = true
+		return ip, nil
+	}
+	return nil, fmt.Errorf("no free address in %s", v.subnet)
+}
+
+// createTap creates a tap device attached to the network bridge.
+func (v *MicroVM) createTap(name string) error {
+	for _, args := range [][]string{
+		{"tuntap", "add", "dev", name, "mode", "tap"},
+		{"link", "set", name, "master", v.bridge},
+		{"link", "set", name, "up"},
+	} {
+		if out, err := exec.Command("ip", args...).CombinedOutput(); err != nil {
+			return fmt.Errorf("ip %s failed: %w: %s", strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+		}
+	}
+	return nil
+}
+
+// teardown releases a VM's tap device, address and state directory.
+func (v *MicroVM) teardown(vm *microVM) {
+	exec.Command("ip", "link", "del", vm.tap).Run()
+	v.mu.Lock()
+	delete(v.usedIP, vm.ip.String())
+	v.mu.Unlock()
+	os.RemoveAll(vm.dir)
+}
+
+// emit publishes a VM event.
+func (v *MicroVM) emit(vm *microVM, action events.Action, attrs map[string]string) {
+	v.events.publish(vm.json.ID, vm.json.Name, vm.json.Config.Image, vm.json.Config.Labels, action, attrs)
+}
+
+// lookup finds a VM by ID, ID prefix or name. Must be called with mu held.
+func (v *MicroVM) lookup(idOrName string) *microVM {
+	if vm, exists := v.vms[idOrName]; exists {
+		return vm
+	}
+	for id, vm := range v.vms {
+		if vm.json.Name == "/"+idOrName || (len(idOrName) >= 12 && strings.HasPrefix(id, idOrName)) {
+			return vm
+		}
+	}
+	return nil
+}
+
+func (vm *microVM) running() bool {
+	return vm.json.State != nil && vm.json.State.Running
+}
+
+func (vm *microVM) closeListeners() {
+	for _, ln := range vm.listeners {
+		ln.Close()
+	}
+	vm.listeners = nil
+}
+
+// forwardPort proxies connections accepted on ln to addr until ln is closed.
+func forwardPort(ln net.Listener, addr string) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			upstream, err := net.DialTimeout("tcp", addr, 5*time.Second)
+			if err != nil {
+				return
+			}
+			defer upstream.Close()
+			go func() {
+				io.Copy(upstream, conn)
+				if tcp, ok := upstream.(*net.TCPConn); ok {
+					tcp.CloseWrite()
+				}
+			}()
+			io.Copy(conn, upstream)
+		}()
+	}
+}
+
+// vmmExitCode derives an exit code for a VM whose guest did not report one.
+func vmmExitCode(signal string, err error) int {
+	switch signal {
+	case "SIGKILL":
+		return 137
+	case "SIGTERM":
+		return 143
+	}
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.ExitCode()
+	}
+	return 0
+}
+
+// guestMAC derives a locally administered MAC address from a guest IP.
+func guestMAC(ip net.IP) string {
+	ip4 := ip.To4()
+	return fmt.Sprintf("06:00:%02x:%02x:%02x:%02x", ip4[0], ip4[1], ip4[2], ip4[3])
+}
+
+func maskBits(mask net.IPMask) int {
+	ones, _ := mask.Size()
+	return ones
+}
+
+// shellQuote quotes s for /bin/sh.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+func randomID() string {
+	b := make([]byte, 32)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,12 @@
+package engine
+
+import "syscall"
+
+// terminateSignal asks a VMM to exit.
+var terminateSignal = syscall.SIGTERM
+
+// vmmProcAttr kills a VMM when the runner exits, so no VM outlives the
+// runner that tracks it.
+func vmmProcAttr() *syscall.SysProcAttr {
+	return &syscall.SysProcAttr{Pdeathsig: syscall.SIGKILL}
+}
@@ -0,0 +1,16 @@
+//go:build !linux
+
+package engine
+
+import (
+	"os"
+	"syscall"
+)
+
+// terminateSignal asks a VMM to exit.
+var terminateSignal = os.Interrupt
+
+// vmmProcAttr returns no process attributes; microVMs only run on Linux.
+func vmmProcAttr() *syscall.SysProcAttr {
+	return nil
+}
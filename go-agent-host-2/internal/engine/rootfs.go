@@ -0,0 +1,219 @@
+package engine
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// imageManifest is an entry of the manifest.json of a `docker save` archive.
+type imageManifest struct {
+	Config   string
+	RepoTags []string
+	Layers   []string
+}
+
+// unpackImage flattens the layers of a `docker save` archive into dir,
+// applying whiteouts, and returns the total size of the unpacked files.
+func unpackImage(archive io.Reader, dir string) (int64, error) {
+	// Layers are applied in manifest order, so spool the archive to disk first
+	spool, err := os.MkdirTemp(filepath.Dir(dir), "image-")
+	if err != nil {
+		return 0, err
+	}
+	defer os.RemoveAll(spool)
+
+	if _, err := extractTar(archive, spool, false); err != nil {
+		return 0, fmt.Errorf("failed to read image archive: %w", err)
+	}
+
+	data, err := os.ReadFile(filepath.Join(spool, "manifest.json"))
+	if err != nil {
+		return 0, fmt.Errorf("image archive has no manifest: %w", err)
+	}
+	var manifests []imageManifest
+	if err := json.Unmarshal(data, &manifests); err != nil || len(manifests) == 0 {
+		return 0, fmt.Errorf("invalid image manifest: %v", err)
+	}
+
+	var size int64
+	for _, layer := range manifests[0].Layers {
+		n, err := applyLayer(filepath.Join(spool, filepath.Clean("/"+layer)), dir)
+		if err != nil {
+			return 0, fmt.Errorf("failed to apply layer %s: %w", layer, err)
+		}
+		size += n
+	}
+	return size, nil
+}
+
+// applyLayer extracts a layer tarball, compressed or not, on top of dir.
+func applyLayer(path, dir string) (int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	var layer io.Reader = r
+	if magic, err := r.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(r)
+		if err != nil {
+			return 0, err
+		}
+		defer gz.Close()
+		layer = gz
+	}
+	return extractTar(layer, dir, true)
+}
+
+// extractTar extracts a tar stream into dir. With whiteouts set, overlay
+// whiteout entries remove files of lower layers instead of being written.
+// Entries that would resolve outside dir are rejected.
+func extractTar(r io.Reader, dir string, whiteouts bool) (int64, error) {
+	var size int64
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return size, nil
+		}
+		if err != nil {
+			return size, err
+		}
+
+		name := filepath.Clean("/" + hdr.Name)
+		if name == "/" {
+			continue
+		}
+		target, err := secureJoin(dir, name)
+		if err != nil {
+			return size, err
+		}
+
+		base := filepath.Base(name)
+		if whiteouts && strings.HasPrefix(base, ".wh.") {
+			parent := filepath.Dir(target)
+			if base == ".wh..wh..opq" {
+				// Opaque directory: hide everything from lower layers
+				entries, _ := os.ReadDir(parent)
+				for _, entry := range entries {
+					os.RemoveAll(filepath.Join(parent, entry.Name()))
+				}
+				continue
+			}
+			hidden := strings.TrimPrefix(base, ".wh.")
+			if hidden == "" || hidden == "." || hidden == ".." {
+				return size, fmt.Errorf("invalid whiteout %s", hdr.Name)
+			}
+			os.RemoveAll(filepath.Join(parent, hidden))
+			continue
+		}
+
+		mode := os.FileMode(hdr.Mode).Perm() | os.FileMode(hdr.Mode)&(os.ModeSetuid|os.ModeSetgid|os.ModeSticky)
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if info, err := os.Lstat(target); err == nil && !info.IsDir() {
+				os.RemoveAll(target)
+			}
+			if err := os.MkdirAll(target, 0755); err != nil {
+				return size, err
+			}
+			os.Chmod(target, mode)
+		case tar.TypeReg:
+			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return size, err
+			}
+			os.RemoveAll(target)
+			f, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, mode)
+			if err != nil {
+				return size, err
+			}
+			n, err := io.Copy(f, tr)
+			f.Close()
+			if err != nil {
+				return size, err
+			}
+			os.Chmod(target, mode)
+			size += n
+		case tar.TypeSymlink:
+			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return size, err
+			}
+			os.RemoveAll(target)
+			if err := os.Symlink(hdr.Linkname, target); err != nil {
+				return size, err
+			}
+		case tar.TypeLink:
+			source, err := secureJoin(dir, hdr.Linkname)
+			if err != nil {
+				return size, err
+			}
+			os.RemoveAll(target)
+			if err := os.Link(source, target); err != nil {
+				return size, err
+			}
+		default:
+			// Device nodes and FIFOs are created by devtmpfs in the guest
+			continue
+		}
+		os.Lchown(target, hdr.Uid, hdr.Gid)
+	}
+}
+
+// secureJoin joins path onto root, resolving symlinks in path as if root
+// were the filesystem root, so the result never leaves root. The last
+// component is not resolved.
+func secureJoin(root, path string) (string, error) {
+	parts := strings.Split(strings.TrimPrefix(filepath.Clean("/"+path), "/"), "/")
+	if len(parts) == 1 && parts[0] == "" {
+		return root, nil
+	}
+
+	resolved := "/"
+	for hops := 0; len(parts) > 1; {
+		part := parts[0]
+		parts = parts[1:]
+		next := filepath.Join(resolved, part)
+
+		info, err := os.Lstat(filepath.Join(root, next))
+		if err != nil || info.Mode()&os.ModeSymlink == 0 {
+			resolved = next
+			continue
+		}
+		if hops++; hops > 255 {
+			return "", fmt.Errorf("too many symlinks in %s", path)
+		}
+		link, err := os.Readlink(filepath.Join(root, next))
+		if err != nil {
+			return "", err
+		}
+		if !filepath.IsAbs(link) {
+			link = filepath.Join(resolved, link)
+		}
+		// Continue from the link target with the remaining components
+		rest := strings.TrimPrefix(filepath.Clean("/"+link), "/")
+		resolved = "/"
+		if rest != "" {
+			parts = append(strings.Split(rest, "/"), parts...)
+		}
+	}
+	return filepath.Join(root, resolved, parts[0]), nil
+}
+
+// makeExt4 builds an ext4 filesystem image of sizeMB from the contents of dir.
+func makeExt4(dir, image string, sizeMB int64) error {
+	out, err := exec.Command("mkfs.ext4", "-q", "-F", "-L", "rootfs", "-d", dir, image, fmt.Sprintf("%dM", sizeMB)).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("mkfs.ext4 failed: %w: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
@@ -0,0 +1,266 @@
+package engine
+
+import (
+	"archive/tar"
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// tarEntry is a tar archive entry for tests.
+type tarEntry struct {
+	name string
+	kind byte   // tar.TypeReg if zero
+	link string // Symlink or hardlink target
+	body string
+}
+
+// tarball builds a tar archive of entries.
+func tarball(t *testing.T, entries ...tarEntry) *bytes.Reader {
+	t.Helper()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, e := range entries {
+		hdr := &tar.Header{Name: e.name, Typeflag: e.kind, Linkname: e.link, Mode: 0644, Size: int64(len(e.body))}
+		switch e.kind {
+		case 0:
+			hdr.Typeflag = tar.TypeReg
+		case tar.TypeDir:
+			hdr.Mode = 0755
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatalf("WriteHeader(%s): %v", e.name, err)
+		}
+		if _, err := tw.Write([]byte(e.body)); err != nil {
+			t.Fatalf("Write(%s): %v", e.name, err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	return bytes.NewReader(buf.Bytes())
+}
+
+// testRoot returns an empty root directory next to a file outside it that
+// entries must not reach.
+func testRoot(t *testing.T) (root, outside string) {
+	t.Helper()
+	base := t.TempDir()
+	root = filepath.Join(base, "root")
+	if err := os.Mkdir(root, 0755); err != nil {
+		t.Fatal(err)
+	}
+	outside = filepath.Join(base, "secret")
+	if err := os.WriteFile(outside, []byte("secret"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return root, outside
+}
+
+// readFile returns the content of a file, or "" if it does not exist.
+func readFile(t *testing.T, path string) string {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return ""
+	}
+	if err != nil {
+		t.Fatalf("ReadFile(%s): %v", path, err)
+	}
+	return string(data)
+}
+
+func TestExtractTarConfinement(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		entries func(outside string) []tarEntry
+		inside  string // File expected inside the root with content "x"
+		wantErr bool
+	}{
+		{"dot dot", func(string) []tarEntry {
+			return []tarEntry{{name: "../../secret", body: "x"}}
+		}, "secret", false},
+		{"absolute", func(string) []tarEntry {
+			return []tarEntry{{name: "/etc/file", body: "x"}}
+		}, "etc/file", false},
+		{"symlink parent to root", func(string) []tarEntry {
+			return []tarEntry{
+				{name: "link", kind: tar.TypeSymlink, link: "/"},
+				{name: "link/secret", body: "x"},
+			}
+		}, "secret", false},
+		{"symlink parent upwards", func(string) []tarEntry {
+			return []tarEntry{
+				{name: "dir", kind: tar.TypeDir},
+				{name: "dir/up", kind: tar.TypeSymlink, link: "../../../.."},
+				{name: "dir/up/secret", body: "x"},
+			}
+		}, "secret", false},
+		{"symlink parent to host path", func(outside string) []tarEntry {
+			return []tarEntry{
+				{name: "host", kind: tar.TypeSymlink, link: filepath.Dir(outside)},
+				{name: "host/secret", body: "x"},
+			}
+		}, "", false},
+		{"chained symlinks", func(string) []tarEntry {
+			return []tarEntry{
+				{name: "a", kind: tar.TypeSymlink, link: "b/.."},
+				{name: "b", kind: tar.TypeSymlink, link: "../.."},
+				{name: "a/secret", body: "x"},
+			}
+		}, "secret", false},
+		{"file over symlink", func(outside string) []tarEntry {
+			return []tarEntry{
+				{name: "file", kind: tar.TypeSymlink, link: outside},
+				{name: "file", body: "x"},
+			}
+		}, "file", false},
+		{"directory over symlink", func(outside string) []tarEntry {
+			return []tarEntry{
+				{name: "dir", kind: tar.TypeSymlink, link: filepath.Dir(outside)},
+				{name: "dir", kind: tar.TypeDir},
+				{name: "dir/secret", body: "x"},
+			}
+		}, "dir/secret", false},
+		{"hardlink outside", func(outside string) []tarEntry {
+			return []tarEntry{{name: "hard", kind: tar.TypeLink, link: "../../" + filepath.Base(outside)}}
+		}, "", true},
+		{"hardlink to host path", func(outside string) []tarEntry {
+			return []tarEntry{{name: "hard", kind: tar.TypeLink, link: outside}}
+		}, "", true},
+		{"hardlink through symlink parent", func(outside string) []tarEntry {
+			return []tarEntry{
+				{name: "host", kind: tar.TypeSymlink, link: filepath.Dir(outside)},
+				{name: "hard", kind: tar.TypeLink, link: "host/" + filepath.Base(outside)},
+			}
+		}, "", true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			root, outside := testRoot(t)
+			_, err := extractTar(tarball(t, tc.entries(outside)...), root, true)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("extractTar error = %v, want error %v", err, tc.wantErr)
+			}
+			if got := readFile(t, outside); got != "secret" {
+				t.Errorf("file outside the root = %q, want it untouched", got)
+			}
+			if tc.inside != "" {
+				if got := readFile(t, filepath.Join(root, tc.inside)); got != "x" {
+					t.Errorf("%s inside the root = %q, want %q", tc.inside, got, "x")
+				}
+			}
+		})
+	}
+}
+
+func TestExtractTarHardlinkToSymlink(t *testing.T) {
+	root, outside := testRoot(t)
+	_, err := extractTar(tarball(t,
+		tarEntry{name: "link", kind: tar.TypeSymlink, link: outside},
+		tarEntry{name: "hard", kind: tar.TypeLink, link: "link"},
+	), root, true)
+	if err != nil {
+		t.Fatalf("extractTar: %v", err)
+	}
+
+	// The hardlink shares the symlink's inode, not the file it points to
+	info, err := os.Lstat(filepath.Join(root, "hard"))
+	if err != nil {
+		t.Fatalf("Lstat: %v", err)
+	}
+	if info.Mode()&os.ModeSymlink == 0 {
+		t.Errorf("hard mode = %v, want a symlink", info.Mode())
+	}
+	secret, _ := os.Stat(outside)
+	if os.SameFile(info, secret) {
+		t.Error("hardlink points at the file outside the root")
+	}
+}
+
+func TestExtractTarWhiteouts(t *testing.T) {
+	root, outside := testRoot(t)
+	lower := tarball(t,
+		tarEntry{name: "etc/keep", body: "keep"},
+		tarEntry{name: "etc/gone", body: "gone"},
+		tarEntry{name: "opaque/old", body: "old"},
+		tarEntry{name: "opaque/sub/old", body: "old"},
+	)
+	if _, err := extractTar(lower, root, true); err != nil {
+		t.Fatalf("extractTar(lower): %v", err)
+	}
+
+	upper := tarball(t,
+		tarEntry{name: "etc/.wh.gone"},
+		tarEntry{name: "opaque/.wh..wh..opq"},
+		tarEntry{name: "opaque/new", body: "new"},
+		tarEntry{name: ".wh.missing"},
+	)
+	if _, err := extractTar(upper, root, true); err != nil {
+		t.Fatalf("extractTar(upper): %v", err)
+	}
+	for path, want := range map[string]string{
+		"etc/keep":       "keep",
+		"etc/gone":       "",
+		"etc/.wh.gone":   "",
+		"opaque/old":     "",
+		"opaque/sub/old": "",
+		"opaque/new":     "new",
+	} {
+		if got := readFile(t, filepath.Join(root, path)); got != want {
+			t.Errorf("%s = %q, want %q", path, got, want)
+		}
+	}
+
+	// Without whiteouts, as for the outer image archive, entries are plain files
+	if _, err := extractTar(tarball(t, tarEntry{name: "etc/.wh.keep", body: "x"}), root, false); err != nil {
+		t.Fatalf("extractTar without whiteouts: %v", err)
+	}
+	if readFile(t, filepath.Join(root, "etc/keep")) != "keep" || readFile(t, filepath.Join(root, "etc/.wh.keep")) != "x" {
+		t.Error("whiteout entry was applied with whiteouts off")
+	}
+
+	// Whiteouts of the root, its parent or outside it are rejected
+	for _, name := range []string{".wh..", ".wh...", "etc/.wh...", ".wh."} {
+		if _, err := extractTar(tarball(t, tarEntry{name: name}), root, true); err == nil {
+			t.Errorf("extractTar(%s) succeeded, want error", name)
+		}
+	}
+	if readFile(t, filepath.Join(root, "etc/keep")) != "keep" || readFile(t, outside) != "secret" {
+		t.Error("an invalid whiteout removed files")
+	}
+}
+
+func TestSecureJoin(t *testing.T) {
+	root := t.TempDir()
+	for name, link := range map[string]string{"abs": "/usr", "rel": "../../usr", "loop": "loop/x"} {
+		if err := os.Symlink(link, filepath.Join(root, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, tc := range []struct {
+		path string
+		want string // Relative to root
+	}{
+		{"a/b", "a/b"},
+		{"/a/../../b", "b"},
+		{"abs/bin", "usr/bin"},
+		{"rel/bin", "usr/bin"},
+		{"abs", "abs"}, // The last component is not resolved
+		{"/", ""},
+	} {
+		got, err := secureJoin(root, tc.path)
+		if err != nil {
+			t.Errorf("secureJoin(%q): %v", tc.path, err)
+			continue
+		}
+		if want := filepath.Join(root, tc.want); got != want {
+			t.Errorf("secureJoin(%q) = %s, want %s", tc.path, got, want)
+		}
+	}
+
+	if _, err := secureJoin(root, "loop/file"); err == nil {
+		t.Error("secureJoin through a symlink loop succeeded, want error")
+	}
+}
@@ -0,0 +1,166 @@
+package engine
+
+import (
+	"context"
+	"io"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/events"
+	"github.com/docker/docker/api/types/image"
+	"github.com/docker/docker/api/types/network"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// Router sends containers created with the microvm runtime to a MicroVM
+// backend and everything else to the base engine. Images and networks always
+// live on the base engine.
+type Router struct {
+	base Runtime
+	vm   *MicroVM
+}
+
+// NewRouter combines a base engine with a microVM backend built on it.
+func NewRouter(base Runtime, vm *MicroVM) *Router {
+	return &Router{base: base, vm: vm}
+}
+
+// pick returns the engine that owns a container.
+func (r *Router) pick(containerID string) Runtime {
+	if r.vm.Owns(containerID) {
+		return r.vm
+	}
+	return r.base
+}
+
+// Name returns the base engine name.
+func (r *Router) Name() string {
+	return r.base.Name()
+}
+
+// Ping checks the base engine.
+func (r *Router) Ping(ctx context.Context) (types.Ping, error) {
+	return r.base.Ping(ctx)
+}
+
+// Close stops all VMs and closes the base engine.
+func (r *Router) Close() error {
+	r.vm.Close()
+	return r.base.Close()
+}
+
+// ImageLoad loads an image into the base engine.
+func (r *Router) ImageLoad(ctx context.Context, input io.Reader, quiet bool) (image.LoadResponse, error) {
+	return r.base.ImageLoad(ctx, input, quiet)
+}
+
+// ImageInspectWithRaw inspects an image on the base engine.
+func (r *Router) ImageInspectWithRaw(ctx context.Context, imageID string) (types.ImageInspect, []byte, error) {
+	return r.base.ImageInspectWithRaw(ctx, imageID)
+}
+
+// ImageSave exports images from the base engine.
+func (r *Router) ImageSave(ctx context.Context, imageIDs []string) (io.ReadCloser, error) {
+	return r.base.ImageSave(ctx, imageIDs)
+}
+
+// ContainerCreate creates a VM if hostConfig.Runtime is MicroVMRuntime and a
+// container on the base engine otherwise.
+func (r *Router) ContainerCreate(ctx context.Context, config *container.Config, hostConfig *container.HostConfig, networkingConfig *network.NetworkingConfig, platform *ocispec.Platform, containerName string) (container.CreateResponse, error) {
+	if hostConfig != nil && hostConfig.Runtime == MicroVMRuntime {
+		return r.vm.ContainerCreate(ctx, config, hostConfig, networkingConfig, platform, containerName)
+	}
+	return r.base.ContainerCreate(ctx, config, hostConfig, networkingConfig, platform, containerName)
+}
+
+// ContainerStart starts a container or VM.
+func (r *Router) ContainerStart(ctx context.Context, containerID string, options container.StartOptions) error {
+	return r.pick(containerID).ContainerStart(ctx, containerID, options)
+}
+
+// ContainerStop stops a container or VM.
+func (r *Router) ContainerStop(ctx context.Context, containerID string, options container.StopOptions) error {
+	return r.pick(containerID).ContainerStop(ctx, containerID, options)
+}
+
+// ContainerRemove removes a container or VM.
+func (r *Router) ContainerRemove(ctx context.Context, containerID string, options container.RemoveOptions) error {
+	return r.pick(containerID).ContainerRemove(ctx, containerID, options)
+}
+
+// ContainerInspect inspects a container or VM.
+func (r *Router) ContainerInspect(ctx context.Context, containerID string) (types.ContainerJSON, error) {
+	return r.pick(containerID).ContainerInspect(ctx, containerID)
+}
+
+// ContainerList lists containers of both backends.
+func (r *Router) ContainerList(ctx context.Context, options container.ListOptions) ([]types.Container, error) {
+	list, err := r.base.ContainerList(ctx, options)
+	if err != nil {
+		return nil, err
+	}
+	vms, err := r.vm.ContainerList(ctx, options)
+	if err != nil {
+		return nil, err
+	}
+	return append(list, vms...), nil
+}
+
+// ContainerLogs returns the logs of a container or VM.
+func (r *Router) ContainerLogs(ctx context.Context, containerID string, options container.LogsOptions) (io.ReadCloser, error) {
+	return r.pick(containerID).ContainerLogs(ctx, containerID, options)
+}
+
+// ContainerStatsOneShot returns the stats of a container or VM.
+func (r *Router) ContainerStatsOneShot(ctx context.Context, containerID string) (container.StatsResponse, error) {
+	return r.pick(containerID).ContainerStatsOneShot(ctx, containerID)
+}
+
+// Events merges the event streams of both backends. An error from either
+// ends the merged stream.
+func (r *Router) Events(ctx context.Context, options events.ListOptions) (<-chan events.Message, <-chan error) {
+	ctx, cancel := context.WithCancel(ctx)
+	baseMsgs, baseErrs := r.base.Events(ctx, options)
+	vmMsgs, vmErrs := r.vm.Events(ctx, options)
+
+	messages := make(chan events.Message)
+	errs := make(chan error, 1)
+	go func() {
+		defer cancel()
+		for {
+			var msg events.Message
+			select {
+			case msg = <-baseMsgs:
+			case msg = <-vmMsgs:
+			case err := <-baseErrs:
+				errs <- err
+				return
+			case err := <-vmErrs:
+				errs <- err
+				return
+			}
+			select {
+			case messages <- msg:
+			case <-ctx.Done():
+				errs <- ctx.Err()
+				return
+			}
+		}
+	}()
+	return messages, errs
+}
+
+// NetworkInspect inspects a network on the base engine.
+func (r *Router) NetworkInspect(ctx context.Context, networkID string, options network.InspectOptions) (network.Inspect, error) {
+	return r.base.NetworkInspect(ctx, networkID, options)
+}
+
+// NetworkCreate creates a network on the base engine.
+func (r *Router) NetworkCreate(ctx context.Context, name string, options network.CreateOptions) (network.CreateResponse, error) {
+	return r.base.NetworkCreate(ctx, name, options)
+}
+
+// NetworkRemove removes a network from the base engine.
+func (r *Router) NetworkRemove(ctx context.Context, networkID string) error {
+	return r.base.NetworkRemove(ctx, networkID)
+}
@@ -0,0 +1,238 @@
+// Package journal keeps a local record of the requests this validator handled:
+// what it answered, whether the answer landed on-chain and how it compared
+// with the rest of the subcommittee once the request was finalized.
+package journal
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+// DefaultMaxEntries is the number of requests kept when no limit is given.
+const DefaultMaxEntries = 10000
+
+// compactFactor bounds the journal file to this many lines per kept entry
+// before it is rewritten.
+const compactFactor = 2
+
+// Consensus outcomes of a finalized request.
+const (
+	OutcomeMatch    = "match"    // Our response agreed with the majority
+	OutcomeMismatch = "mismatch" // Our response differed from the majority
+	OutcomeMissing  = "missing"  // We have no response on-chain
+)
+
+// Entry is the journal record of one request.
+type Entry struct {
+	RequestID string `json:"requestId"`
+	AgentID   string `json:"agentId"`
+	AgentURL  string `json:"agentUrl"`
+
+	// Execution and submission
+	ReceivedAt  time.Time `json:"receivedAt,omitzero"`
+	Success     bool      `json:"success"`
+	Result      string    `json:"result,omitempty"` // 0x-prefixed hex
+	Cost        string    `json:"cost,omitempty"`   // Decimal wei
+	SubmittedAt time.Time `json:"submittedAt,omitzero"`
+	SubmitTx    string    `json:"submitTx,omitempty"`
+	SubmitError string    `json:"submitError,omitempty"` // Why nothing was submitted, or why it reverted
+
+	// Consensus, filled in when the request is finalized
+	FinalizedAt time.Time `json:"finalizedAt,omitzero"`
+	FinalStatus string    `json:"finalStatus,omitempty"`
+	Outcome     string    `json:"outcome,omitempty"`
+	StatusMatch bool      `json:"statusMatch,omitempty"`
+	ResultMatch bool      `json:"resultMatch,omitempty"`
+	Responses   int       `json:"responses,omitempty"`
+	Agreeing    int       `json:"agreeing,omitempty"`   // Other validators with our status and result
+	MedianCost  string    `json:"medianCost,omitempty"` // Decimal wei
+	CostMatch   bool      `json:"costMatch,omitempty"`  // Our quoted cost equals the median
+}
+
+// Journal holds the most recent entries in memory and appends every update to
+// a JSON Lines file, one full entry per line, so the latest line for a request
+// wins when the file is read back. The file is compacted once it holds
+// compactFactor times as many lines as there are kept entries.
+type Journal struct {
+	mu         sync.Mutex
+	path       string
+	file       *os.File
+	lines      int // Lines in the file
+	entries    map[string]*Entry
+	order      []string // Request IDs, oldest first
+	maxEntries int
+}
+
+// Open loads the journal at path, creating it if needed, and compacts it to
+// the latest state of the last maxEntries requests. An empty path keeps the
+// journal in memory only.
+func Open(path string, maxEntries int) (*Journal, error) {
+	if maxEntries <= 0 {
+		maxEntries = DefaultMaxEntries
+	}
+	j := &Journal{
+		entries:    make(map[string]*Entry),
+		maxEntries: maxEntries,
+	}
+	if path == "" {
+		return j, nil
+	}
+
+	if err := j.load(path); err != nil {
+		return nil, err
+	}
+	j.path = path
+	if err := j.compact(); err != nil {
+		return nil, err
+	}
+	slog.Info("Request journal opened", "path", path, "entries", len(j.order))
+	return j, nil
+}
+
+// compact rewrites the journal file with one line per kept entry and reopens
+// it for appending. Must be called with mu held (or before the journal is shared).
+func (j *Journal) compact() error {
+	tmp := j.path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return fmt.Errorf("failed to compact journal: %w", err)
+	}
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	for _, id := range j.order {
+		if err := enc.Encode(j.entries[id]); err != nil {
+			f.Close()
+			os.Remove(tmp)
+			return fmt.Errorf("failed to compact journal: %w", err)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return fmt.Errorf("failed to compact journal: %w", err)
+	}
+	f.Close()
+	if err := os.Rename(tmp, j.path); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to compact journal: %w", err)
+	}
+
+	f, err = os.OpenFile(j.path, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open journal: %w", err)
+	}
+	if j.file != nil {
+		j.file.Close()
+	}
+	j.file = f
+	j.lines = len(j.order)
+	return nil
+}
+
+// load reads an existing journal file. Malformed lines are skipped.
+func (j *Journal) load(path string) error {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read journal: %w", err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16<<20)
+	for scanner.Scan() {
+		var entry Entry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil || entry.RequestID == "" {
+			continue
+		}
+		j.put(&entry)
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read journal: %w", err)
+	}
+	return nil
+}
+
+// put stores an entry, evicting the oldest once the journal is full.
+// Must be called with mu held (or before the journal is shared).
+func (j *Journal) put(entry *Entry) {
+	if _, exists := j.entries[entry.RequestID]; !exists {
+		j.order = append(j.order, entry.RequestID)
+	}
+	j.entries[entry.RequestID] = entry
+	for len(j.order) > j.maxEntries {
+		delete(j.entries, j.order[0])
+		j.order = j.order[1:]
+	}
+}
+
+// Update applies fn to the entry for a request, creating it if needed, and
+// appends the updated entry to the journal file, compacting the file once it
+// has grown past compactFactor lines per kept entry.
+func (j *Journal) Update(requestID string, fn func(*Entry)) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	entry, exists := j.entries[requestID]
+	if !exists {
+		entry = &Entry{RequestID: requestID}
+	}
+	fn(entry)
+	j.put(entry)
+
+	if j.file == nil {
+		return
+	}
+	line, err := json.Marshal(entry)
+	if err != nil {
+		slog.Error("Failed to encode journal entry", "requestId", requestID, "error", err)
+		return
+	}
+	if _, err := j.file.Write(append(line, '\n')); err != nil {
+		slog.Error("Failed to write journal entry", "requestId", requestID, "error", err)
+		return
+	}
+	j.lines++
+
+	if j.lines > compactFactor*j.maxEntries {
+		if err := j.compact(); err != nil {
+			slog.Error("Failed to compact journal", "path", j.path, "error", err)
+			// Retry once as many lines have been appended again
+			j.lines = len(j.order)
+			return
+		}
+		slog.Debug("Request journal compacted", "path", j.path, "entries", len(j.order))
+	}
+}
+
+// Get returns a copy of the entry for a request.
+func (j *Journal) Get(requestID string) (Entry, bool) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	entry, exists := j.entries[requestID]
+	if !exists {
+		return Entry{}, false
+	}
+	return *entry, true
+}
+
+// Close closes the journal file.
+func (j *Journal) Close() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if j.file == nil {
+		return nil
+	}
+	err := j.file.Close()
+	j.file = nil
+	return err
+}
@@ -0,0 +1,210 @@
+package listener
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"log/slog"
+	"math/big"
+	"sort"
+	"time"
+
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+
+	"github.com/somnia-chain/agent-runner/internal/journal"
+	"github.com/somnia-chain/agent-runner/internal/metrics"
+	"github.com/somnia-chain/agent-runner/internal/somniaagents"
+)
+
+// consensusLookupTimeout bounds reading the responses of a finalized request.
+const consensusLookupTimeout = 30 * time.Second
+
+// consensusComparison is how our response compares with the subcommittee's.
+type consensusComparison struct {
+	outcome     string
+	statusMatch bool
+	resultMatch bool
+	costMatch   bool // Our quoted cost equals the median
+	agreeing    int  // Other validators with our status and result
+	ours        *somniaagents.Response
+	majority    *somniaagents.Response
+	medianCost  *big.Int
+}
+
+// handleFinalized records the consensus outcome of a finalized request that
+// this validator handled.
+func (l *Listener) handleFinalized(vLog types.Log) {
+	event, err := l.somniaAgents.ParseRequestFinalized(vLog)
+	if err != nil {
+		slog.Warn("Failed to parse RequestFinalized event", "error", err, "txHash", vLog.TxHash.Hex())
+		return
+	}
+	if event == nil {
+		return
+	}
+
+	// Only requests we were in the subcommittee for are journaled
+	if _, ok := l.journal.Get(event.RequestId.String()); !ok {
+		return
+	}
+	go l.recordConsensus(event, vLog.BlockNumber, time.Now())
+}
+
+// recordConsensus reads all responses to a finalized request, compares ours
+// with the majority and records the outcome in metrics and the journal.
+func (l *Listener) recordConsensus(event *somniaagents.RequestFinalizedEvent, blockNumber uint64, finalizedAt time.Time) {
+	requestId := event.RequestId
+	entry, _ := l.journal.Get(requestId.String())
+
+	ctx, cancel := context.WithTimeout(l.ctx, consensusLookupTimeout)
+	defer cancel()
+
+	// Read at the finalization block, before the request slot can be reused
+	responses, err := l.somniaAgents.GetResponses(&bind.CallOpts{
+		Context:     ctx,
+		BlockNumber: new(big.Int).SetUint64(blockNumber),
+	}, requestId)
+	if err != nil {
+		slog.Warn("Failed to read responses for finalized request", "requestId", requestId, "error", err)
+		return
+	}
+
+	agentURL := entry.AgentURL
+	if agentURL == "" {
+		if agentId, ok := new(big.Int).SetString(entry.AgentID, 10); ok {
+			if agent, err := l.getCachedAgent(agentId); err == nil {
+				agentURL = agent.ContainerImageUri
+			}
+		}
+	}
+
+	comparison := compareResponses(l.address, responses)
+	metrics.ConsensusOutcomesTotal.WithLabelValues(agentURL, comparison.outcome).Inc()
+	if !entry.ReceivedAt.IsZero() {
+		metrics.RequestFinalizationDuration.WithLabelValues(agentURL).Observe(finalizedAt.Sub(entry.ReceivedAt).Seconds())
+	}
+	medianCost, _ := new(big.Float).SetInt(comparison.medianCost).Float64()
+	metrics.AgentMedianCost.WithLabelValues(agentURL).Set(medianCost)
+	if comparison.ours != nil && !comparison.costMatch {
+		metrics.ConsensusCostMismatchesTotal.WithLabelValues(agentURL).Inc()
+	}
+
+	l.journal.Update(requestId.String(), func(e *journal.Entry) {
+		e.FinalizedAt = finalizedAt
+		e.FinalStatus = somniaagents.StatusName(event.Status)
+		e.Outcome = comparison.outcome
+		e.StatusMatch = comparison.statusMatch
+		e.ResultMatch = comparison.resultMatch
+		e.Responses = len(responses)
+		e.Agreeing = comparison.agreeing
+		e.MedianCost = comparison.medianCost.String()
+		e.CostMatch = comparison.costMatch
+	})
+
+	attrs := []any{
+		"requestId", requestId,
+		"agentId", entry.AgentID,
+		"finalStatus", somniaagents.StatusName(event.Status),
+		"outcome", comparison.outcome,
+		"responses", len(responses),
+		"agreeing", comparison.agreeing,
+		"medianCost", comparison.medianCost,
+	}
+	if comparison.ours != nil {
+		attrs = append(attrs, "ourCost", comparison.ours.Cost, "costMatch", comparison.costMatch)
+	}
+
+	switch comparison.outcome {
+	case journal.OutcomeMatch:
+		if !comparison.costMatch {
+			slog.Warn("Our response matched consensus but our cost differed from the median", attrs...)
+			break
+		}
+		slog.Info("Our response matched consensus", attrs...)
+	case journal.OutcomeMissing:
+		slog.Warn("Request finalized without our response", attrs...)
+	default:
+		attrs = append(attrs,
+			"statusMatch", comparison.statusMatch,
+			"resultMatch", comparison.resultMatch,
+			"ourStatus", somniaagents.StatusName(comparison.ours.Status),
+			"majorityStatus", somniaagents.StatusName(comparison.majority.Status),
+			"ourResult", "0x"+hex.EncodeToString(comparison.ours.Result),
+			"majorityResult", "0x"+hex.EncodeToString(comparison.majority.Result),
+		)
+		slog.Warn("Our response differed from consensus", attrs...)
+	}
+}
+
+// compareResponses finds the majority response (the most common status and
+// result) and compares ours against it.
+func compareResponses(self common.Address, responses []somniaagents.Response) consensusComparison {
+	c := consensusComparison{
+		outcome:    journal.OutcomeMissing,
+		medianCost: medianCost(responses),
+	}
+
+	counts := make(map[string]int)
+	best := 0
+	for i := range responses {
+		r := &responses[i]
+		key := string([]byte{r.Status}) + string(r.Result)
+		counts[key]++
+		if counts[key] > best {
+			best = counts[key]
+			c.majority = r
+		}
+		if r.Validator == self {
+			c.ours = r
+		}
+	}
+	if c.ours == nil {
+		return c
+	}
+
+	for i := range responses {
+		r := &responses[i]
+		if r != c.ours && r.Status == c.ours.Status && bytes.Equal(r.Result, c.ours.Result) {
+			c.agreeing++
+		}
+	}
+	ourCost := c.ours.Cost
+	if ourCost == nil {
+		ourCost = new(big.Int)
+	}
+	c.costMatch = ourCost.Cmp(c.medianCost) == 0
+	c.statusMatch = c.ours.Status == c.majority.Status
+	c.resultMatch = bytes.Equal(c.ours.Result, c.majority.Result)
+	if c.statusMatch && c.resultMatch {
+		c.outcome = journal.OutcomeMatch
+	} else {
+		c.outcome = journal.OutcomeMismatch
+	}
+	return c
+}
+
+// medianCost returns the median quoted cost, averaging the middle two for an
+// even count as the contract does.
+func medianCost(responses []somniaagents.Response) *big.Int {
+	if len(responses) == 0 {
+		return new(big.Int)
+	}
+	costs := make([]*big.Int, 0, len(responses))
+	for _, r := range responses {
+		if r.Cost == nil {
+			costs = append(costs, new(big.Int))
+		} else {
+			costs = append(costs, r.Cost)
+		}
+	}
+	sort.Slice(costs, func(i, j int) bool { return costs[i].Cmp(costs[j]) < 0 })
+
+	mid := len(costs) / 2
+	if len(costs)%2 == 1 {
+		return new(big.Int).Set(costs[mid])
+	}
+	sum := new(big.Int).Add(costs[mid-1], costs[mid])
+	return sum.Div(sum, big.NewInt(2))
+}
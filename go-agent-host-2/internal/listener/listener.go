@@ -14,6 +14,7 @@ import (
 	"net/url"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/ethereum/go-ethereum"
@@ -25,6 +26,7 @@ import (
 
 	"github.com/somnia-chain/agent-runner/internal/agentregistry"
 	"github.com/somnia-chain/agent-runner/internal/agents"
+	"github.com/somnia-chain/agent-runner/internal/journal"
 	"github.com/somnia-chain/agent-runner/internal/sessionrpc"
 	"github.com/somnia-chain/agent-runner/internal/somniaagents"
 )
@@ -37,6 +39,25 @@ type agentCacheEntry struct {
 
 const agentCacheTTL = 60 * time.Second
 
+// headerLookupAttempts bounds how often the block header of a request is
+// fetched before its deadline and timestamp fall back to local knowledge.
+const headerLookupAttempts = 3
+
+// responseSubmitMargin is the part of the request timeout reserved for
+// submitting the response on-chain. Short timeouts reserve at most a quarter.
+const responseSubmitMargin = 5 * time.Second
+
+// requestTimeoutRefreshInterval is how often requestTimeout() is re-read, so a
+// timeout changed on-chain applies without a restart.
+const requestTimeoutRefreshInterval = 5 * time.Minute
+
+// pendingRequest is a request queued for a worker with when we saw it.
+type pendingRequest struct {
+	event      *somniaagents.RequestCreatedEvent
+	log        types.Log
+	receivedAt time.Time
+}
+
 // decodeRevertReason extracts a human-readable revert reason from an error.
 // It handles both rpc.DataError (which contains revert data) and standard errors.
 func decodeRevertReason(err error) string {
@@ -118,6 +139,14 @@ type Config struct {
 	RPCURL                string
 	ReceiptsServiceURL    string
 	MaxConcurrentRequests int
+	RequestTimeout        time.Duration // Used when the contract does not expose requestTimeout()
+
+	// Divergence self-check: run requests twice on independent containers
+	SelfCheckRate           float64  // Fraction of requests checked (0 = disabled)
+	SelfCheckAgents         []string // Agent IDs whose requests are always checked
+	SelfCheckFailOnMismatch bool     // Submit success=false when the runs disagree
+
+	JournalFile string // Local request journal (empty = in memory only)
 }
 
 // Listener listens for RequestCreated events and executes agents.
@@ -140,9 +169,23 @@ type Listener struct {
 	receiptsServiceURL string
 
 	// Worker pool
-	requestCh  chan *somniaagents.RequestCreatedEvent
+	requestCh  chan pendingRequest
 	maxWorkers int
 
+	// Time validators have to respond to a request, counted from its block
+	requestTimeout atomic.Int64 // time.Duration
+
+	// Chain ID passed to agents in the execution context (nil if unknown)
+	chainID *big.Int
+
+	// Divergence self-check configuration
+	selfCheckRate           float64
+	selfCheckAgents         map[string]bool
+	selfCheckFailOnMismatch bool
+
+	// Local record of handled requests and their consensus outcomes
+	journal *journal.Journal
+
 	ctx    context.Context
 	cancel context.CancelFunc
 	wg     sync.WaitGroup
@@ -154,6 +197,10 @@ type Listener struct {
 	// Agent info cache
 	agentCache     map[string]*agentCacheEntry
 	agentCacheLock sync.RWMutex
+
+	// Optional hook called when an agent is updated in the AgentRegistry.
+	// Set it before Start.
+	OnAgentSet func(event *agentregistry.AgentSetEvent)
 }
 
 // New creates a new Listener instance.
@@ -200,6 +247,18 @@ func New(cfg Config, agentManager *agents.Manager, session *sessionrpc.Client) (
 	}
 	slog.Info("Resolved Committee address from SomniaAgents", "address", committeeAddr.Hex())
 
+	// Resolve the response deadline, falling back to the configured timeout
+	requestTimeout := cfg.RequestTimeout
+	if timeout, err := readRequestTimeout(context.Background(), somniaAgentsContract); err == nil {
+		requestTimeout = timeout
+		slog.Info("Resolved request timeout from SomniaAgents", "timeout", requestTimeout)
+	} else {
+		slog.Info("Using configured request timeout", "timeout", requestTimeout)
+	}
+	if requestTimeout <= 0 {
+		requestTimeout = 60 * time.Second
+	}
+
 	// Create AgentRegistry contract instance
 	agentRegistryContract, err := agentregistry.NewAgentRegistry(agentRegistryAddr, client)
 	if err != nil {
@@ -207,6 +266,29 @@ func New(cfg Config, agentManager *agents.Manager, session *sessionrpc.Client) (
 		return nil, fmt.Errorf("failed to create AgentRegistry contract instance: %w", err)
 	}
 
+	chainID, err := client.ChainID(context.Background())
+	if err != nil {
+		slog.Warn("Failed to get chain ID, agents will not see it", "error", err)
+	}
+
+	selfCheckAgents := make(map[string]bool)
+	for _, id := range cfg.SelfCheckAgents {
+		selfCheckAgents[id] = true
+	}
+	if cfg.SelfCheckRate > 0 || len(selfCheckAgents) > 0 {
+		slog.Info("Divergence self-check enabled",
+			"rate", cfg.SelfCheckRate,
+			"agents", cfg.SelfCheckAgents,
+			"failOnMismatch", cfg.SelfCheckFailOnMismatch,
+		)
+	}
+
+	requestJournal, err := journal.Open(cfg.JournalFile, journal.DefaultMaxEntries)
+	if err != nil {
+		client.Close()
+		return nil, fmt.Errorf("failed to open request journal: %w", err)
+	}
+
 	maxWorkers := cfg.MaxConcurrentRequests
 	if maxWorkers <= 0 {
 		maxWorkers = 20
@@ -214,26 +296,87 @@ func New(cfg Config, agentManager *agents.Manager, session *sessionrpc.Client) (
 
 	ctx, cancel := context.WithCancel(context.Background())
 
-	return &Listener{
-		client:             client,
-		somniaAgents:       somniaAgentsContract,
-		agentRegistry:      agentRegistryContract,
-		agentManager:       agentManager,
-		session:            session,
-		address:            address,
-		rpcURL:             cfg.RPCURL,
-		wsURL:              httpToWsURL(cfg.RPCURL),
-		somniaAgentsAddr:   somniaAgentsAddr,
-		agentRegistryAddr:  agentRegistryAddr,
-		committeeAddr:      committeeAddr,
-		receiptsServiceURL: cfg.ReceiptsServiceURL,
-		requestCh:          make(chan *somniaagents.RequestCreatedEvent, 10000),
-		maxWorkers:         maxWorkers,
-		ctx:                ctx,
-		cancel:             cancel,
-		processed:          make(map[string]bool),
-		agentCache:         make(map[string]*agentCacheEntry),
-	}, nil
+	l := &Listener{
+		client:                  client,
+		somniaAgents:            somniaAgentsContract,
+		agentRegistry:           agentRegistryContract,
+		agentManager:            agentManager,
+		session:                 session,
+		address:                 address,
+		rpcURL:                  cfg.RPCURL,
+		wsURL:                   httpToWsURL(cfg.RPCURL),
+		somniaAgentsAddr:        somniaAgentsAddr,
+		agentRegistryAddr:       agentRegistryAddr,
+		committeeAddr:           committeeAddr,
+		receiptsServiceURL:      cfg.ReceiptsServiceURL,
+		requestCh:               make(chan pendingRequest, 10000),
+		maxWorkers:              maxWorkers,
+		chainID:                 chainID,
+		selfCheckRate:           cfg.SelfCheckRate,
+		selfCheckAgents:         selfCheckAgents,
+		selfCheckFailOnMismatch: cfg.SelfCheckFailOnMismatch,
+		journal:                 requestJournal,
+		ctx:                     ctx,
+		cancel:                  cancel,
+		processed:               make(map[string]bool),
+		agentCache:              make(map[string]*agentCacheEntry),
+	}
+	l.requestTimeout.Store(int64(requestTimeout))
+	return l, nil
+}
+
+// readRequestTimeout reads how long validators have to respond to a request.
+func readRequestTimeout(ctx context.Context, contract *somniaagents.SomniaAgents) (time.Duration, error) {
+	timeout, err := contract.RequestTimeout(&bind.CallOpts{Context: ctx})
+	if err != nil {
+		return 0, err
+	}
+	if timeout.Sign() <= 0 || !timeout.IsInt64() {
+		return 0, fmt.Errorf("invalid request timeout %s", timeout)
+	}
+	return time.Duration(timeout.Int64()) * time.Second, nil
+}
+
+// refreshRequestTimeoutLoop re-reads requestTimeout() periodically. A failed
+// read keeps the current timeout.
+func (l *Listener) refreshRequestTimeoutLoop() {
+	defer l.wg.Done()
+
+	ticker := time.NewTicker(requestTimeoutRefreshInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-l.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		ctx, cancel := context.WithTimeout(l.ctx, 30*time.Second)
+		timeout, err := readRequestTimeout(ctx, l.somniaAgents)
+		cancel()
+		if err != nil {
+			slog.Debug("Failed to refresh request timeout", "error", err)
+			continue
+		}
+		if previous := time.Duration(l.requestTimeout.Swap(int64(timeout))); previous != timeout {
+			slog.Info("Request timeout changed on-chain", "previous", previous, "timeout", timeout)
+		}
+	}
+}
+
+// responseDeadline returns when a response must be ready to leave time to
+// submit it. The contract's timeout runs from the request's block; without its
+// header, or if the block time is ahead of our clock, it runs from receivedAt.
+func (l *Listener) responseDeadline(header *types.Header, receivedAt time.Time) time.Time {
+	timeout := time.Duration(l.requestTimeout.Load())
+	budget := timeout - min(responseSubmitMargin, timeout/4)
+	deadline := receivedAt.Add(budget)
+	if header != nil {
+		if blockDeadline := time.Unix(int64(header.Time), 0).Add(budget); blockDeadline.Before(deadline) {
+			deadline = blockDeadline
+		}
+	}
+	return deadline
 }
 
 // AgentRegistryAddress returns the resolved AgentRegistry contract address.
@@ -261,6 +404,10 @@ func (l *Listener) Start() {
 		go l.worker()
 	}
 
+	// Follow requestTimeout() changes
+	l.wg.Add(1)
+	go l.refreshRequestTimeoutLoop()
+
 	// Start event subscription loop
 	l.wg.Add(1)
 	go l.listenLoop()
@@ -272,6 +419,9 @@ func (l *Listener) Stop() {
 	l.cancel()
 	l.wg.Wait()
 	l.client.Close()
+	if err := l.journal.Close(); err != nil {
+		slog.Warn("Failed to close request journal", "error", err)
+	}
 	slog.Info("Event listener stopped")
 }
 
@@ -279,8 +429,8 @@ func (l *Listener) worker() {
 	defer l.wg.Done()
 	for {
 		select {
-		case event := <-l.requestCh:
-			l.handleRequest(event)
+		case req := <-l.requestCh:
+			l.handleRequest(req.event, req.log, req.receivedAt)
 		case <-l.ctx.Done():
 			return
 		}
@@ -319,13 +469,15 @@ func (l *Listener) subscribeAndListen() {
 
 	slog.Info("Connected to WebSocket RPC", "url", l.wsURL)
 
-	// Get the RequestCreated event signature
+	// Get the RequestCreated, RequestFinalized and AgentSet event signatures
 	eventSignature := l.somniaAgents.ABI().Events["RequestCreated"].ID
+	finalizedSignature := l.somniaAgents.ABI().Events["RequestFinalized"].ID
+	agentSetSignature := l.agentRegistry.ABI().Events["AgentSet"].ID
 
 	// Create filter query
 	query := ethereum.FilterQuery{
-		Addresses: []common.Address{l.somniaAgents.Address()},
-		Topics:    [][]common.Hash{{eventSignature}},
+		Addresses: []common.Address{l.somniaAgents.Address(), l.agentRegistry.Address()},
+		Topics:    [][]common.Hash{{eventSignature, finalizedSignature, agentSetSignature}},
 	}
 
 	// Create a channel to receive logs
@@ -339,8 +491,9 @@ func (l *Listener) subscribeAndListen() {
 	}
 	defer sub.Unsubscribe()
 
-	slog.Info("Subscribed to RequestCreated events via WebSocket",
+	slog.Info("Subscribed to RequestCreated, RequestFinalized and AgentSet events via WebSocket",
 		"contract", l.somniaAgents.Address().Hex(),
+		"agentRegistry", l.agentRegistry.Address().Hex(),
 	)
 
 	for {
@@ -351,7 +504,14 @@ func (l *Listener) subscribeAndListen() {
 			slog.Error("Subscription error", "error", err)
 			return
 		case vLog := <-logs:
-			l.handleLog(vLog)
+			switch {
+			case vLog.Address == l.agentRegistry.Address():
+				l.handleAgentSet(vLog)
+			case len(vLog.Topics) > 0 && vLog.Topics[0] == finalizedSignature:
+				l.handleFinalized(vLog)
+			default:
+				l.handleLog(vLog)
+			}
 		}
 	}
 }
@@ -403,14 +563,45 @@ func (l *Listener) handleLog(vLog types.Log) {
 
 	slog.Info("We are in the subcommittee for request", "requestId", event.RequestId)
 
+	receivedAt := time.Now()
+	l.journal.Update(event.RequestId.String(), func(e *journal.Entry) {
+		e.AgentID = event.AgentId.String()
+		e.ReceivedAt = receivedAt
+	})
+
 	// Send to worker pool (drop if full to avoid blocking the event loop)
 	select {
-	case l.requestCh <- event:
+	case l.requestCh <- pendingRequest{event: event, log: vLog, receivedAt: receivedAt}:
 	default:
 		slog.Warn("Worker pool full, dropping request", "requestId", event.RequestId)
 	}
 }
 
+// handleAgentSet drops the cached info of an updated agent and passes the
+// event to the OnAgentSet hook.
+func (l *Listener) handleAgentSet(vLog types.Log) {
+	event, err := l.agentRegistry.ParseAgentSet(vLog)
+	if err != nil {
+		slog.Warn("Failed to parse AgentSet event", "error", err, "txHash", vLog.TxHash.Hex())
+		return
+	}
+	if event == nil {
+		return
+	}
+
+	l.InvalidateAgent(event.AgentId)
+	if l.OnAgentSet != nil {
+		l.OnAgentSet(event)
+	}
+}
+
+// InvalidateAgent drops cached agent info so the next request re-reads it from chain.
+func (l *Listener) InvalidateAgent(agentId *big.Int) {
+	l.agentCacheLock.Lock()
+	delete(l.agentCache, agentId.String())
+	l.agentCacheLock.Unlock()
+}
+
 // getCachedAgent returns agent info from cache or fetches from chain.
 func (l *Listener) getCachedAgent(agentId *big.Int) (*agentregistry.Agent, error) {
 	key := agentId.String()
@@ -436,10 +627,30 @@ func (l *Listener) getCachedAgent(agentId *big.Int) (*agentregistry.Agent, error
 	return agent, nil
 }
 
-func (l *Listener) handleRequest(event *somniaagents.RequestCreatedEvent) {
+func (l *Listener) handleRequest(event *somniaagents.RequestCreatedEvent, vLog types.Log, receivedAt time.Time) {
 	requestId := event.RequestId
 	agentId := event.AgentId
 
+	// The deadline runs from the request's block, leaving time to submit
+	deadline := l.responseDeadline(nil, receivedAt)
+	if time.Until(deadline) <= 0 {
+		slog.Warn("Request deadline passed while queued, skipping", "requestId", requestId, "agentId", agentId)
+		return
+	}
+	headerCtx, cancelHeader := context.WithDeadline(l.ctx, deadline)
+	header, err := l.blockHeader(headerCtx, vLog.BlockHash)
+	cancelHeader()
+	if err != nil {
+		slog.Warn("Failed to get block header for request", "requestId", requestId, "block", vLog.BlockNumber, "error", err)
+	}
+	deadline = l.responseDeadline(header, receivedAt)
+	if time.Until(deadline) <= 0 {
+		slog.Warn("Request deadline passed since its block, skipping", "requestId", requestId, "agentId", agentId, "block", vLog.BlockNumber)
+		return
+	}
+	ctx, cancel := context.WithDeadline(l.ctx, deadline)
+	defer cancel()
+
 	// Get agent info from cache (or fetch once)
 	agent, err := l.getCachedAgent(agentId)
 	if err != nil {
@@ -451,6 +662,9 @@ func (l *Listener) handleRequest(event *somniaagents.RequestCreatedEvent) {
 		slog.Error("Agent has no container image URI", "agentId", agentId)
 		return
 	}
+	l.journal.Update(requestId.String(), func(e *journal.Entry) {
+		e.AgentURL = agent.ContainerImageUri
+	})
 
 	// Generate a request ID string for the agent
 	requestIdStr := fmt.Sprintf("%d", requestId.Uint64())
@@ -460,12 +674,40 @@ func (l *Listener) handleRequest(event *somniaagents.RequestCreatedEvent) {
 		"requestId", requestId,
 		"agentUrl", agent.ContainerImageUri,
 		"payloadSize", len(event.Payload),
+		"timeout", time.Until(deadline).Round(time.Second),
 	)
 
-	response, err := l.agentManager.Forward(agent.ContainerImageUri, event.Payload, map[string]string{
+	target := agents.Agent{
+		ID:          agentId.String(),
+		URL:         agent.ContainerImageUri,
+		MetadataURI: agent.MetadataUri,
+	}
+	execCtx := l.executionContext(ctx, event, vLog, header)
+	headers := map[string]string{
 		"X-Request-Id": requestIdStr,
-	})
-	if err != nil {
+	}
+	response, err := l.agentManager.Forward(ctx, target, event.Payload, execCtx, headers)
+	var agentErr *agents.AgentError
+	if err != nil && !errors.As(err, &agentErr) {
+		l.journal.Update(requestId.String(), func(e *journal.Entry) {
+			e.SubmitError = err.Error()
+		})
+	}
+	switch {
+	case errors.As(err, &agentErr):
+		// The agent ran and failed; report the failure on-chain
+		slog.Warn("Agent reported failure", "requestId", requestId, "agentId", agentId, "error", err)
+		response = agentErr.Response
+	case errors.Is(err, agents.ErrContainerOOMKilled):
+		slog.Error("Agent exceeded its memory limit", "requestId", requestId, "agentId", agentId, "error", err)
+		return
+	case errors.Is(err, agents.ErrContainerCrashed):
+		slog.Error("Agent container crashed", "requestId", requestId, "agentId", agentId, "error", err)
+		return
+	case errors.Is(err, agents.ErrAgentTimeout):
+		slog.Error("Agent did not respond before the request deadline", "requestId", requestId, "agentId", agentId, "error", err)
+		return
+	case err != nil:
 		slog.Error("Failed to forward request to agent", "requestId", requestId, "error", err)
 		return
 	}
@@ -476,16 +718,98 @@ func (l *Listener) handleRequest(event *somniaagents.RequestCreatedEvent) {
 		"responseSize", len(response.Body),
 	)
 
+	// Run the request again on another container to catch non-determinism
+	success := response.Success
+	result := response.Body
+	if l.shouldSelfCheck(agentId) && !l.selfCheck(ctx, requestId, target, event.Payload, execCtx, headers, response) && l.selfCheckFailOnMismatch {
+		slog.Warn("Submitting failure for a diverging agent result", "requestId", requestId, "agentId", agentId)
+		success = false
+		result = nil
+	}
+
 	// Upload receipt asynchronously
 	if response.Receipt != nil {
 		response.Receipt["agentId"] = agentId.String()
 		response.Receipt["request"] = "0x" + hex.EncodeToString(event.Payload)
-		go l.uploadReceipt(requestIdStr, response.Receipt)
+		go func(receipt map[string]interface{}) {
+			// Let the container log stream catch up before attaching the request's logs
+			select {
+			case <-time.After(agents.LogSettleTime):
+			case <-l.ctx.Done():
+			}
+			if logs, ok := l.agentManager.RequestLogs(requestIdStr); ok && len(logs.Lines) > 0 {
+				receipt["logs"] = logs.Lines
+				receipt["logsTruncated"] = logs.Truncated
+			}
+			if records := l.agentManager.EgressRecords(requestIdStr); len(records) > 0 {
+				receipt["egress"] = records
+			}
+			l.uploadReceipt(requestIdStr, receipt)
+		}(response.Receipt)
 	}
 
+	l.journal.Update(requestId.String(), func(e *journal.Entry) {
+		e.Success = success
+		e.Result = "0x" + hex.EncodeToString(result)
+		if event.MaxCostPerAgent != nil {
+			e.Cost = event.MaxCostPerAgent.String()
+		}
+	})
+
 	// Submit the response to the blockchain (fire and forget)
-	success := response.Status >= 200 && response.Status < 300
-	go l.submitResponse(requestId, response.Body, event.MaxCostPerAgent, success)
+	go l.submitResponse(requestId, result, event.MaxCostPerAgent, success)
+}
+
+// executionContext builds the chain context passed to the agent from the
+// event, its block header and the request transaction. header is nil if it
+// could not be fetched; determinism mode then refuses the request. A failed
+// sender lookup is logged and left empty rather than failing the request.
+func (l *Listener) executionContext(ctx context.Context, event *somniaagents.RequestCreatedEvent, vLog types.Log, header *types.Header) *agents.ExecutionContext {
+	execCtx := &agents.ExecutionContext{
+		AgentID:     event.AgentId.String(),
+		BlockNumber: vLog.BlockNumber,
+		BlockHash:   vLog.BlockHash.Hex(),
+		TxHash:      vLog.TxHash.Hex(),
+	}
+	if l.chainID != nil {
+		execCtx.ChainID = l.chainID.String()
+	}
+	if event.MaxCostPerAgent != nil {
+		execCtx.MaxCostPerAgent = event.MaxCostPerAgent.String()
+	}
+
+	if header != nil {
+		execCtx.BlockTimestamp = header.Time
+	}
+
+	tx, _, err := l.client.TransactionByHash(ctx, vLog.TxHash)
+	if err == nil {
+		var sender common.Address
+		sender, err = l.client.TransactionSender(ctx, tx, vLog.BlockHash, vLog.TxIndex)
+		if err == nil {
+			execCtx.Requester = sender.Hex()
+		}
+	}
+	if err != nil {
+		slog.Warn("Failed to get requester for request", "requestId", event.RequestId, "txHash", vLog.TxHash.Hex(), "error", err)
+	}
+
+	return execCtx
+}
+
+// blockHeader fetches a block header, retrying failed lookups.
+func (l *Listener) blockHeader(ctx context.Context, hash common.Hash) (*types.Header, error) {
+	for attempt := 1; ; attempt++ {
+		header, err := l.client.HeaderByHash(ctx, hash)
+		if err == nil || attempt >= headerLookupAttempts {
+			return header, err
+		}
+		select {
+		case <-time.After(time.Duration(attempt) * 500 * time.Millisecond):
+		case <-ctx.Done():
+			return nil, err
+		}
+	}
 }
 
 // uploadReceipt uploads a receipt to the receipts service asynchronously.
@@ -541,6 +865,9 @@ func (l *Listener) submitResponse(requestId *big.Int, result []byte, cost *big.I
 
 	receipt, err := l.session.Send(ctx, l.somniaAgentsAddr.Hex(), calldata, "0x0", sessionrpc.SubmitResponseGas)
 	if err != nil {
+		l.journal.Update(requestId.String(), func(e *journal.Entry) {
+			e.SubmitError = err.Error()
+		})
 		slog.Error("Failed to submit response",
 			"requestId", requestId,
 			"validator", l.address.Hex(),
@@ -550,6 +877,11 @@ func (l *Listener) submitResponse(requestId *big.Int, result []byte, cost *big.I
 		return
 	}
 
+	l.journal.Update(requestId.String(), func(e *journal.Entry) {
+		e.SubmittedAt = time.Now()
+		e.SubmitTx = receipt.TransactionHash
+	})
+
 	if receipt.Success() {
 		slog.Info("Response submitted successfully",
 			"requestId", requestId,
@@ -582,6 +914,9 @@ func (l *Listener) submitResponse(requestId *big.Int, result []byte, cost *big.I
 			rawError = callErr.Error()
 			revertReason = decodeRevertReason(callErr)
 		}
+		l.journal.Update(requestId.String(), func(e *journal.Entry) {
+			e.SubmitError = "reverted: " + revertReason
+		})
 
 		slog.Error("Response transaction reverted",
 			"requestId", requestId,
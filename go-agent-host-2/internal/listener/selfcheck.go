@@ -0,0 +1,77 @@
+package listener
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"errors"
+	"log/slog"
+	"math/big"
+	"math/rand"
+
+	"github.com/somnia-chain/agent-runner/internal/agents"
+	"github.com/somnia-chain/agent-runner/internal/metrics"
+)
+
+// shouldSelfCheck reports whether a request to the agent is executed twice.
+func (l *Listener) shouldSelfCheck(agentId *big.Int) bool {
+	if l.selfCheckAgents[agentId.String()] {
+		return true
+	}
+	return l.selfCheckRate > 0 && rand.Float64() < l.selfCheckRate
+}
+
+// selfCheck runs a request a second time on another replica and compares the
+// result with the first run. It reports whether the runs agreed. A second run
+// that produces no response counts as agreement since there is nothing to
+// compare.
+func (l *Listener) selfCheck(ctx context.Context, requestId *big.Int, agent agents.Agent, payload []byte, execCtx *agents.ExecutionContext, headers map[string]string, first *agents.Response) bool {
+	second, err := l.agentManager.ForwardExcluding(ctx, agent, payload, execCtx, headers, first.Replica)
+	var agentErr *agents.AgentError
+	if errors.As(err, &agentErr) {
+		second = agentErr.Response
+	} else if err != nil {
+		metrics.AgentSelfChecksTotal.WithLabelValues(agent.URL, "error").Inc()
+		slog.Warn("Self-check run failed, using the first result", "requestId", requestId, "agentId", agent.ID, "error", err)
+		return true
+	}
+
+	if first.Success == second.Success && bytes.Equal(first.Body, second.Body) {
+		metrics.AgentSelfChecksTotal.WithLabelValues(agent.URL, "match").Inc()
+		metrics.AgentNondeterministic.WithLabelValues(agent.URL).Set(0)
+		slog.Debug("Self-check results match", "requestId", requestId, "agentId", agent.ID)
+		return true
+	}
+
+	metrics.AgentSelfChecksTotal.WithLabelValues(agent.URL, "mismatch").Inc()
+	metrics.AgentNondeterministic.WithLabelValues(agent.URL).Set(1)
+	slog.Warn("Agent results diverged between two local runs",
+		"requestId", requestId,
+		"agentId", agent.ID,
+		"agentUrl", agent.URL,
+		"firstReplica", first.Replica,
+		"secondReplica", second.Replica,
+		"firstSuccess", first.Success,
+		"secondSuccess", second.Success,
+		"firstError", first.Error,
+		"secondError", second.Error,
+		"firstDiffByte", firstDifference(first.Body, second.Body),
+		"firstResult", "0x"+hex.EncodeToString(first.Body),
+		"secondResult", "0x"+hex.EncodeToString(second.Body),
+	)
+	return false
+}
+
+// firstDifference returns the offset of the first byte where a and b differ,
+// or -1 if they are equal.
+func firstDifference(a, b []byte) int {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if a[i] != b[i] {
+			return i
+		}
+	}
+	if len(a) != len(b) {
+		return min(len(a), len(b))
+	}
+	return -1
+}
@@ -51,6 +51,71 @@ var (
 		[]string{"agent"},
 	)
 
+	ContainerEvictionsTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "agent_runner_container_evictions_total",
+			Help: "Total number of containers stopped by the runner to free resources",
+		},
+		[]string{"agent", "reason"},
+	)
+
+	// Container health metrics (per-agent)
+	AgentHealthy = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "agent_runner_agent_healthy",
+			Help: "Whether the agent's last health check passed (1) or failed (0)",
+		},
+		[]string{"agent"},
+	)
+
+	ContainerHealthCheckFailuresTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "agent_runner_container_health_check_failures_total",
+			Help: "Total number of failed container health probes",
+		},
+		[]string{"agent", "probe"},
+	)
+
+	ContainerExitsTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "agent_runner_container_exits_total",
+			Help: "Total number of agent containers that exited unexpectedly by exit code (-1 = unknown)",
+		},
+		[]string{"agent", "exit_code"},
+	)
+
+	ContainerRestartsTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "agent_runner_container_restarts_total",
+			Help: "Total number of agent containers restarted after failing health checks",
+		},
+		[]string{"agent"},
+	)
+
+	AgentNondeterministic = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "agent_runner_agent_nondeterministic",
+			Help: "Whether the agent's last determinism check or self-check found diverging outputs (1) or not (0)",
+		},
+		[]string{"agent"},
+	)
+
+	AgentDeterminismChecksTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "agent_runner_agent_determinism_checks_total",
+			Help: "Total number of startup determinism checks by result (match, mismatch)",
+		},
+		[]string{"agent", "result"},
+	)
+
+	AgentSelfChecksTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "agent_runner_agent_self_checks_total",
+			Help: "Total number of requests executed twice to detect divergence by result (match, mismatch, error)",
+		},
+		[]string{"agent", "result"},
+	)
+
 	// Image metrics (per-agent)
 	ImageDownloadsTotal = promauto.NewCounterVec(
 		prometheus.CounterOpts{
@@ -86,4 +151,120 @@ var (
 		},
 		[]string{"agent"},
 	)
+
+	AgentInFlightRequests = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "agent_runner_agent_in_flight_requests",
+			Help: "Number of requests currently being handled by agent containers",
+		},
+		[]string{"agent"},
+	)
+
+	AgentRequestFailuresTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "agent_runner_agent_request_failures_total",
+			Help: "Total number of failed agent requests by failure reason",
+		},
+		[]string{"agent", "reason"},
+	)
+
+	// Container resource metrics (per-agent)
+	ContainerOOMKillsTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "agent_runner_container_oom_kills_total",
+			Help: "Total number of agent containers killed for exceeding their memory limit",
+		},
+		[]string{"agent"},
+	)
+
+	ContainerCPUThrottledPeriodsTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "agent_runner_container_cpu_throttled_periods_total",
+			Help: "Total number of CFS periods in which agent containers were CPU throttled",
+		},
+		[]string{"agent"},
+	)
+
+	// Sandbox proxy metrics (per-agent)
+	EgressBlockedTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "agent_runner_egress_blocked_total",
+			Help: "Total number of sandbox proxy requests blocked by the egress policy (denied, not_allowed)",
+		},
+		[]string{"agent", "reason"},
+	)
+
+	EgressRequestsTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "agent_runner_egress_requests_total",
+			Help: "Total number of completed sandbox proxy requests and tunnels",
+		},
+		[]string{"agent"},
+	)
+
+	EgressBytesTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "agent_runner_egress_bytes_total",
+			Help: "Total bytes of sandbox proxy bodies and tunnels by direction (sent, received)",
+		},
+		[]string{"agent", "direction"},
+	)
+
+	EgressThrottledTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "agent_runner_egress_throttled_total",
+			Help: "Total number of sandbox proxy requests refused or cut by a quota (requests, bytes)",
+		},
+		[]string{"agent", "quota"},
+	)
+
+	EgressCacheTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "agent_runner_egress_cache_total",
+			Help: "Total number of sandbox proxy requests through the egress cache by result (hit, pinned, miss, bypass, replay_miss)",
+		},
+		[]string{"agent", "result"},
+	)
+
+	DNSQueriesTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "agent_runner_dns_queries_total",
+			Help: "Total number of sandbox DNS queries by result (allowed, denied, not_allowed, suspicious_name)",
+		},
+		[]string{"agent", "result"},
+	)
+
+	// Consensus metrics (per-agent)
+	ConsensusOutcomesTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "agent_runner_consensus_outcomes_total",
+			Help: "Total number of finalized requests by how our response compared with the majority (match, mismatch, missing)",
+		},
+		[]string{"agent", "outcome"},
+	)
+
+	RequestFinalizationDuration = promauto.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "agent_runner_request_finalization_duration_seconds",
+			Help:    "Time from receiving a request to its on-chain finalization",
+			Buckets: []float64{1, 2, 5, 10, 20, 30, 60, 120, 300},
+		},
+		[]string{"agent"},
+	)
+
+	AgentMedianCost = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "agent_runner_agent_median_cost_wei",
+			Help: "Median cost per agent quoted by the subcommittee for the agent's last finalized request",
+		},
+		[]string{"agent"},
+	)
+
+	ConsensusCostMismatchesTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "agent_runner_consensus_cost_mismatches_total",
+			Help: "Total number of finalized requests where our quoted cost differed from the subcommittee median",
+		},
+		[]string{"agent"},
+	)
 )
@@ -0,0 +1,201 @@
+// Package prewarmer loads agent images ahead of their first request and keeps
+// them fresh as owners update agents in the AgentRegistry.
+package prewarmer
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/ethclient"
+
+	"github.com/somnia-chain/agent-runner/internal/agentregistry"
+	"github.com/somnia-chain/agent-runner/internal/agents"
+)
+
+// Config holds the configuration for the prewarmer.
+type Config struct {
+	AgentRegistryAddress string
+	RPCURL               string
+	Allowlist            []string // Agent IDs to prewarm (empty = all registered agents)
+	Parallelism          int      // Maximum concurrent image downloads
+	StartContainers      bool     // Also start a warm container per agent
+}
+
+// Prewarmer downloads and loads agent images in the background.
+type Prewarmer struct {
+	client          *ethclient.Client
+	registry        *agentregistry.AgentRegistry
+	agentManager    *agents.Manager
+	allowlist       map[string]bool
+	startContainers bool
+	sem             chan struct{}
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// New creates a new Prewarmer instance.
+func New(cfg Config, agentManager *agents.Manager) (*Prewarmer, error) {
+	client, err := ethclient.Dial(cfg.RPCURL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to RPC %s: %w", cfg.RPCURL, err)
+	}
+
+	if !common.IsHexAddress(cfg.AgentRegistryAddress) {
+		client.Close()
+		return nil, fmt.Errorf("invalid AgentRegistry address: %s", cfg.AgentRegistryAddress)
+	}
+
+	registry, err := agentregistry.NewAgentRegistry(common.HexToAddress(cfg.AgentRegistryAddress), client)
+	if err != nil {
+		client.Close()
+		return nil, fmt.Errorf("failed to create AgentRegistry contract instance: %w", err)
+	}
+
+	var allowlist map[string]bool
+	if len(cfg.Allowlist) > 0 {
+		allowlist = make(map[string]bool, len(cfg.Allowlist))
+		for _, id := range cfg.Allowlist {
+			allowlist[id] = true
+		}
+	}
+
+	parallelism := cfg.Parallelism
+	if parallelism <= 0 {
+		parallelism = 4
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	return &Prewarmer{
+		client:          client,
+		registry:        registry,
+		agentManager:    agentManager,
+		allowlist:       allowlist,
+		startContainers: cfg.StartContainers,
+		sem:             make(chan struct{}, parallelism),
+		ctx:             ctx,
+		cancel:          cancel,
+	}, nil
+}
+
+// Start prewarms all selected agents in the background. Updated agents are
+// passed in with HandleAgentSet.
+func (p *Prewarmer) Start() {
+	slog.Info("Starting prewarmer",
+		"agent_registry", p.registry.Address().Hex(),
+		"allowlist", len(p.allowlist),
+		"parallelism", cap(p.sem),
+		"start_containers", p.startContainers,
+	)
+
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		p.prewarmAll()
+	}()
+}
+
+// Stop cancels in-flight work and waits for background goroutines to finish.
+func (p *Prewarmer) Stop() {
+	slog.Info("Stopping prewarmer...")
+	p.cancel()
+	p.wg.Wait()
+	p.client.Close()
+}
+
+// prewarmAll enumerates registered agents and prewarms each selected one.
+func (p *Prewarmer) prewarmAll() {
+	start := time.Now()
+
+	var agentIds []*big.Int
+	if p.allowlist != nil {
+		for id := range p.allowlist {
+			agentId, ok := new(big.Int).SetString(id, 10)
+			if !ok {
+				slog.Warn("Invalid agent ID in prewarm allowlist", "agentId", id)
+				continue
+			}
+			agentIds = append(agentIds, agentId)
+		}
+	} else {
+		ids, err := p.registry.GetAllAgents(&bind.CallOpts{Context: p.ctx})
+		if err != nil {
+			slog.Error("Prewarmer failed to list agents", "error", err)
+			return
+		}
+		agentIds = ids
+	}
+
+	slog.Info("Prewarming agents", "count", len(agentIds))
+
+	var wg sync.WaitGroup
+	for _, agentId := range agentIds {
+		agent, err := p.registry.GetAgent(&bind.CallOpts{Context: p.ctx}, agentId)
+		if err != nil {
+			slog.Warn("Prewarmer failed to get agent", "agentId", agentId, "error", err)
+			continue
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			p.prewarm(agentId, agent.MetadataUri, agent.ContainerImageUri)
+		}()
+	}
+	wg.Wait()
+
+	slog.Info("Prewarming complete", "count", len(agentIds), "duration_ms", time.Since(start).Milliseconds())
+}
+
+// prewarm loads a single agent's image, bounded by the parallelism semaphore.
+func (p *Prewarmer) prewarm(agentId *big.Int, metadataUri, imageUri string) {
+	if imageUri == "" {
+		return
+	}
+
+	select {
+	case p.sem <- struct{}{}:
+	case <-p.ctx.Done():
+		return
+	}
+	defer func() { <-p.sem }()
+
+	err := p.agentManager.Prewarm(p.ctx, agents.Agent{
+		ID:          agentId.String(),
+		URL:         imageUri,
+		MetadataURI: metadataUri,
+	}, p.startContainers)
+	if err != nil {
+		slog.Warn("Failed to prewarm agent", "agentId", agentId, "agentUrl", imageUri, "error", err)
+	}
+}
+
+// HandleAgentSet refreshes the image of an agent its owner updated.
+func (p *Prewarmer) HandleAgentSet(event *agentregistry.AgentSetEvent) {
+	if p.allowlist != nil && !p.allowlist[event.AgentId.String()] {
+		return
+	}
+
+	slog.Info("Agent updated, refreshing image",
+		"agentId", event.AgentId,
+		"owner", event.Owner.Hex(),
+		"agentUrl", event.ContainerImageUri,
+	)
+
+	// The URL may be unchanged with new content behind it
+	p.agentManager.InvalidateVersion(event.ContainerImageUri)
+
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		p.prewarm(event.AgentId, event.MetadataUri, event.ContainerImageUri)
+	}()
+}
@@ -0,0 +1,226 @@
+package sandbox
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	// caValidity is the lifetime of a generated CA certificate.
+	caValidity = 10 * 365 * 24 * time.Hour
+	// leafValidity is the lifetime of the host certificates the CA signs.
+	leafValidity = 7 * 24 * time.Hour
+	// maxLeafCerts bounds the cache of signed host certificates.
+	maxLeafCerts = 1024
+)
+
+// systemBundles are the usual locations of the host's trusted roots.
+var systemBundles = []string{
+	"/etc/ssl/certs/ca-certificates.crt", // Debian, Ubuntu, Alpine
+	"/etc/pki/tls/certs/ca-bundle.crt",   // Fedora, RHEL
+	"/etc/ssl/ca-bundle.pem",             // openSUSE
+	"/etc/ssl/cert.pem",                  // macOS, Arch
+}
+
+// CA is the runner's certificate authority for intercepting sandbox HTTPS.
+// It signs a certificate for each intercepted host; containers trust it
+// through the bundle written by WriteBundle.
+type CA struct {
+	cert    tls.Certificate
+	certPEM []byte
+
+	mu     sync.Mutex
+	leaves map[string]*tls.Certificate // Keyed by hostname
+}
+
+// LoadOrCreateCA loads the CA certificate and key from dir (ca.pem and
+// ca-key.pem), generating and saving a new CA if there is none.
+func LoadOrCreateCA(dir string) (*CA, error) {
+	certPath, keyPath := filepath.Join(dir, "ca.pem"), filepath.Join(dir, "ca-key.pem")
+	certPEM, certErr := os.ReadFile(certPath)
+	keyPEM, keyErr := os.ReadFile(keyPath)
+	switch {
+	case certErr == nil && keyErr == nil:
+	case errors.Is(certErr, os.ErrNotExist) && errors.Is(keyErr, os.ErrNotExist):
+		var err error
+		if certPEM, keyPEM, err = generateCA(); err != nil {
+			return nil, fmt.Errorf("failed to generate CA: %w", err)
+		}
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return nil, fmt.Errorf("failed to create CA directory: %w", err)
+		}
+		if err := os.WriteFile(keyPath, keyPEM, 0600); err != nil {
+			return nil, fmt.Errorf("failed to write CA key: %w", err)
+		}
+		if err := os.WriteFile(certPath, certPEM, 0644); err != nil {
+			return nil, fmt.Errorf("failed to write CA certificate: %w", err)
+		}
+	case certErr != nil:
+		return nil, fmt.Errorf("failed to read CA certificate: %w", certErr)
+	default:
+		return nil, fmt.Errorf("failed to read CA key: %w", keyErr)
+	}
+
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, fmt.Errorf("invalid CA in %s: %w", dir, err)
+	}
+	if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+		return nil, fmt.Errorf("invalid CA certificate in %s: %w", dir, err)
+	}
+	if !cert.Leaf.IsCA {
+		return nil, fmt.Errorf("certificate in %s is not a CA", certPath)
+	}
+	return &CA{cert: cert, certPEM: certPEM, leaves: make(map[string]*tls.Certificate)}, nil
+}
+
+// generateCA creates a self-signed CA certificate and key.
+func generateCA() (certPEM, keyPEM []byte, err error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          randomSerial(),
+		Subject:               pkix.Name{CommonName: "agent-runner sandbox CA"},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(caValidity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), nil
+}
+
+// CertPEM returns the PEM-encoded CA certificate.
+func (ca *CA) CertPEM() []byte {
+	return ca.certPEM
+}
+
+// Fingerprint returns the SHA-256 fingerprint of the CA certificate.
+func (ca *CA) Fingerprint() string {
+	sum := sha256.Sum256(ca.cert.Certificate[0])
+	return hex.EncodeToString(sum[:])
+}
+
+// WriteBundle writes the host's trusted roots followed by the CA certificate
+// to path, for containers to use as their trust store.
+func (ca *CA) WriteBundle(path string) error {
+	var bundle bytes.Buffer
+	for _, system := range systemBundles {
+		if data, err := os.ReadFile(system); err == nil {
+			bundle.Write(data)
+			if !bytes.HasSuffix(data, []byte("\n")) {
+				bundle.WriteByte('\n')
+			}
+			break
+		}
+	}
+	bundle.Write(ca.certPEM)
+	if err := os.WriteFile(path, bundle.Bytes(), 0644); err != nil {
+		return fmt.Errorf("failed to write CA bundle: %w", err)
+	}
+	return nil
+}
+
+// serverConfig returns the TLS configuration presenting a certificate for
+// the client's server name, or for host if the client sends none.
+func (ca *CA) serverConfig(host string) *tls.Config {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			name := hello.ServerName
+			if name == "" {
+				name = host
+			}
+			return ca.leaf(name)
+		},
+	}
+}
+
+// leaf returns a certificate for host signed by the CA, reusing a cached
+// one until it nears expiry.
+func (ca *CA) leaf(host string) (*tls.Certificate, error) {
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+
+	now := time.Now()
+	if cert, ok := ca.leaves[host]; ok && now.Add(leafValidity/2).Before(cert.Leaf.NotAfter) {
+		return cert, nil
+	}
+
+	// Keys come from crypto/rand; goproxy's signer derives them from the CA
+	// key and hostname, which makes them guessable
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	notAfter := now.Add(leafValidity)
+	if notAfter.After(ca.cert.Leaf.NotAfter) {
+		notAfter = ca.cert.Leaf.NotAfter
+	}
+	template := &x509.Certificate{
+		SerialNumber: randomSerial(),
+		Subject:      pkix.Name{CommonName: host},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     notAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		template.IPAddresses = []net.IP{ip}
+	} else {
+		template.DNSNames = []string{host}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert.Leaf, key.Public(), ca.cert.PrivateKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign certificate for %s: %w", host, err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(ca.leaves) >= maxLeafCerts {
+		clear(ca.leaves)
+	}
+	cert := &tls.Certificate{Certificate: [][]byte{der, ca.cert.Certificate[0]}, PrivateKey: key, Leaf: leaf}
+	ca.leaves[host] = cert
+	return cert, nil
+}
+
+// randomSerial returns a random 128-bit certificate serial number.
+func randomSerial() *big.Int {
+	serial, _ := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	return serial
+}
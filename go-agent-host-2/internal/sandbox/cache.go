@@ -0,0 +1,494 @@
+package sandbox
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Egress cache modes.
+const (
+	CacheShared = "shared" // Pin the first response fetched by any validator via a cache service
+	CacheRecord = "record" // Record responses locally to tapes
+	CacheReplay = "replay" // Serve recorded responses only, never the network
+)
+
+// Egress cache outcomes reported to OnCache.
+const (
+	CacheHit        = "hit"         // Served a response recorded for the request
+	CachePinned     = "pinned"      // Served a response another validator fetched first
+	CacheMiss       = "miss"        // Fetched and recorded the response
+	CacheBypass     = "bypass"      // Body too large to record, served uncached
+	CacheReplayMiss = "replay_miss" // Not on the replayed tape
+)
+
+// DefaultCacheMaxBody is the largest request or response body recorded.
+const DefaultCacheMaxBody = 1024 * 1024
+
+// cacheTTL is how long the responses of a request are kept after last use.
+const cacheTTL = 10 * time.Minute
+
+// unkeyedHeaders are request headers left out of cache keys: they belong to
+// the connection or the proxy, not to the resource requested.
+var unkeyedHeaders = []string{
+	"Connection", "Content-Length", "Keep-Alive", "Proxy-Authenticate", "Proxy-Authorization",
+	"Proxy-Connection", "Te", "Trailer", "Transfer-Encoding", "Upgrade",
+}
+
+// privateHeaders are response headers never shared through the cache
+// service, since they hand credentials or sessions to the fetching validator.
+var privateHeaders = []string{"Authentication-Info", "Proxy-Authentication-Info", "Set-Cookie", "Set-Cookie2"}
+
+// CachedResponse is a recorded upstream response.
+type CachedResponse struct {
+	Key       string      `json:"key"`
+	Method    string      `json:"method"`
+	URL       string      `json:"url"`
+	Status    int         `json:"status"`
+	Header    http.Header `json:"header,omitempty"`
+	Body      []byte      `json:"body,omitempty"`
+	FetchedAt time.Time   `json:"fetchedAt"`
+}
+
+// Tape is the responses recorded for one agent request. Tapes hold full
+// URLs, headers and bodies, which may carry secrets, and are kept local.
+type Tape struct {
+	RequestID string            `json:"requestId,omitempty"`
+	Egress    []*CachedResponse `json:"egress"`
+}
+
+// EgressRecord summarizes a recorded response for a request receipt, without
+// the query string, headers or body that may carry secrets.
+type EgressRecord struct {
+	Key        string    `json:"key"`
+	Method     string    `json:"method"`
+	URL        string    `json:"url"` // Without userinfo, query or fragment
+	Status     int       `json:"status"`
+	BodySHA256 string    `json:"bodySha256"`
+	FetchedAt  time.Time `json:"fetchedAt"`
+}
+
+// EgressCacheConfig holds configuration for the egress cache.
+type EgressCacheConfig struct {
+	Mode         string // CacheShared, CacheRecord or CacheReplay
+	ServiceURL   string // Shared cache service (shared mode)
+	ServiceToken string // Bearer token for the cache service (shared mode)
+	TapeDir      string // Where tapes are written (record mode, "" = not written)
+	ReplayFile   string // Tape or receipt to replay (replay mode)
+	MaxBody      int64  // Largest body recorded (0 = DefaultCacheMaxBody)
+}
+
+// EgressCache records proxied HTTP responses per agent request and URL, so
+// every fetch of a URL while executing a request sees the same response.
+// In shared mode the first response any validator fetched is pinned by a
+// cache service and served to the others, so a subcommittee agrees on the
+// data; in replay mode an execution is reproduced offline from its tape.
+//
+// The cache service is trusted: entries are not signed, so whoever writes
+// first to the service, or controls it, decides what every validator sees.
+// Only the key hash, the URL without its query and the response without
+// cookies are sent to it.
+type EgressCache struct {
+	cfg    EgressCacheConfig
+	client *http.Client
+
+	mu        sync.Mutex
+	tapes     map[string]*requestTape // Keyed by request ID
+	replay    map[string]*CachedResponse
+	lastSweep time.Time
+}
+
+// requestTape is the local record of a request's responses.
+type requestTape struct {
+	byKey map[string]*CachedResponse
+	order []*CachedResponse
+	seen  time.Time
+}
+
+// NewEgressCache creates an egress cache, loading the replayed tape in
+// replay mode.
+func NewEgressCache(cfg EgressCacheConfig) (*EgressCache, error) {
+	if cfg.MaxBody <= 0 {
+		cfg.MaxBody = DefaultCacheMaxBody
+	}
+	c := &EgressCache{
+		cfg:    cfg,
+		client: &http.Client{Timeout: 10 * time.Second},
+		tapes:  make(map[string]*requestTape),
+	}
+
+	switch cfg.Mode {
+	case CacheShared:
+		if cfg.ServiceURL == "" {
+			return nil, fmt.Errorf("shared egress cache requires a cache service URL")
+		}
+	case CacheRecord:
+		if cfg.TapeDir != "" {
+			if err := os.MkdirAll(cfg.TapeDir, 0755); err != nil {
+				return nil, fmt.Errorf("failed to create tape directory: %w", err)
+			}
+		}
+	case CacheReplay:
+		data, err := os.ReadFile(cfg.ReplayFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read replay file: %w", err)
+		}
+		var tape Tape
+		if err := json.Unmarshal(data, &tape); err != nil {
+			return nil, fmt.Errorf("failed to parse replay file %s: %w", cfg.ReplayFile, err)
+		}
+		var summary struct {
+			Egress []EgressRecord `json:"egress"`
+		}
+		if json.Unmarshal(data, &summary) == nil && len(summary.Egress) > 0 && summary.Egress[0].BodySHA256 != "" {
+			return nil, fmt.Errorf("replay file %s holds receipt summaries, not a tape recorded in %s mode", cfg.ReplayFile, CacheRecord)
+		}
+		c.replay = make(map[string]*CachedResponse, len(tape.Egress))
+		for _, entry := range tape.Egress {
+			c.replay[entry.Key] = entry
+		}
+	default:
+		return nil, fmt.Errorf("unknown egress cache mode %q", cfg.Mode)
+	}
+	return c, nil
+}
+
+// Mode returns the cache mode.
+func (c *EgressCache) Mode() string {
+	return c.cfg.Mode
+}
+
+// Records returns the responses recorded for a request, in fetch order.
+func (c *EgressCache) Records(requestID string) []*CachedResponse {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	tape, ok := c.tapes[requestID]
+	if !ok {
+		return nil
+	}
+	return append([]*CachedResponse(nil), tape.order...)
+}
+
+// Summaries returns the receipt summaries of the responses recorded for a
+// request, in fetch order.
+func (c *EgressCache) Summaries(requestID string) []EgressRecord {
+	records := c.Records(requestID)
+	if len(records) == 0 {
+		return nil
+	}
+	summaries := make([]EgressRecord, 0, len(records))
+	for _, e := range records {
+		summaries = append(summaries, e.summary())
+	}
+	return summaries
+}
+
+// fetch serves a proxied request from the cache, or fetches it with
+// roundTrip and records the response. It returns the cache outcome.
+func (c *EgressCache) fetch(req *http.Request, requestID string, roundTrip func(*http.Request) (*http.Response, error)) (*http.Response, string, error) {
+	body, ok, err := c.readBody(req)
+	if err != nil {
+		return nil, "", err
+	}
+	if !ok {
+		resp, err := roundTrip(req)
+		return resp, CacheBypass, err
+	}
+	key := cacheKey(req.Method, req.URL.String(), req.Header, body)
+
+	// Responses already recorded for the request
+	if c.cfg.Mode == CacheReplay {
+		c.mu.Lock()
+		entry, ok := c.replay[key]
+		c.mu.Unlock()
+		if !ok {
+			return replayMiss(req), CacheReplayMiss, nil
+		}
+		return entry.response(req), CacheHit, nil
+	}
+	if entry := c.lookup(requestID, key); entry != nil {
+		return entry.response(req), CacheHit, nil
+	}
+	if c.cfg.Mode == CacheShared {
+		if entry := c.get(req.Context(), requestID, key); entry != nil {
+			entry.Method, entry.URL = req.Method, req.URL.String()
+			c.store(requestID, entry)
+			return entry.response(req), CachePinned, nil
+		}
+	}
+
+	// Fetch and record the response
+	resp, err := roundTrip(req)
+	if err != nil {
+		return nil, "", err
+	}
+	respBody, err := io.ReadAll(io.LimitReader(resp.Body, c.cfg.MaxBody+1))
+	if err != nil {
+		resp.Body.Close()
+		return nil, "", err
+	}
+	if int64(len(respBody)) > c.cfg.MaxBody {
+		resp.Body = readCloser{io.MultiReader(bytes.NewReader(respBody), resp.Body), resp.Body}
+		return resp, CacheBypass, nil
+	}
+	resp.Body.Close()
+
+	entry := &CachedResponse{
+		Key:       key,
+		Method:    req.Method,
+		URL:       req.URL.String(),
+		Status:    resp.StatusCode,
+		Header:    resp.Header,
+		Body:      respBody,
+		FetchedAt: time.Now().UTC(),
+	}
+	outcome := CacheMiss
+	if c.cfg.Mode == CacheShared {
+		// Serve what the other validators get, not this validator's cookies
+		entry.Header = entry.Header.Clone()
+		for _, name := range privateHeaders {
+			entry.Header.Del(name)
+		}
+		if pinned := c.put(req.Context(), requestID, entry); pinned != nil && !pinned.FetchedAt.Equal(entry.FetchedAt) {
+			pinned.Method, pinned.URL = req.Method, req.URL.String()
+			entry, outcome = pinned, CachePinned
+		}
+	}
+	c.store(requestID, entry)
+	return entry.response(req), outcome, nil
+}
+
+// readBody reads a request body for its cache key and restores it. It
+// reports false if the body is too large to record.
+func (c *EgressCache) readBody(req *http.Request) ([]byte, bool, error) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return nil, true, nil
+	}
+	body, err := io.ReadAll(io.LimitReader(req.Body, c.cfg.MaxBody+1))
+	if err != nil {
+		return nil, false, err
+	}
+	if int64(len(body)) > c.cfg.MaxBody {
+		req.Body = readCloser{io.MultiReader(bytes.NewReader(body), req.Body), req.Body}
+		return nil, false, nil
+	}
+	req.Body.Close()
+	req.Body = io.NopCloser(bytes.NewReader(body))
+	return body, true, nil
+}
+
+// lookup returns the response recorded locally for a request and key.
+func (c *EgressCache) lookup(requestID, key string) *CachedResponse {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	tape, ok := c.tapes[requestID]
+	if !ok {
+		return nil
+	}
+	tape.seen = time.Now()
+	return tape.byKey[key]
+}
+
+// store records a response for a request, keeping the first one per key,
+// and writes the request's tape in record mode.
+func (c *EgressCache) store(requestID string, entry *CachedResponse) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(c.lastSweep) > time.Minute {
+		c.lastSweep = now
+		for id, tape := range c.tapes {
+			if now.Sub(tape.seen) > cacheTTL {
+				delete(c.tapes, id)
+			}
+		}
+	}
+
+	tape, ok := c.tapes[requestID]
+	if !ok {
+		tape = &requestTape{byKey: make(map[string]*CachedResponse)}
+		c.tapes[requestID] = tape
+	}
+	tape.seen = now
+	if _, exists := tape.byKey[entry.Key]; exists {
+		return
+	}
+	tape.byKey[entry.Key] = entry
+	tape.order = append(tape.order, entry)
+
+	if c.cfg.Mode == CacheRecord && c.cfg.TapeDir != "" {
+		data, err := json.MarshalIndent(Tape{RequestID: requestID, Egress: tape.order}, "", "  ")
+		if err == nil {
+			err = os.WriteFile(filepath.Join(c.cfg.TapeDir, filepath.Base(requestID)+".json"), data, 0600)
+		}
+		if err != nil {
+			slog.Warn("Failed to write egress tape", "request_id", requestID, "error", err)
+		}
+	}
+}
+
+// get asks the cache service for the response pinned for a request and key.
+func (c *EgressCache) get(ctx context.Context, requestID, key string) *CachedResponse {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.serviceURL(requestID, key), nil)
+	if err != nil {
+		return nil
+	}
+	return c.call(req, requestID)
+}
+
+// put offers a response to the cache service, which pins the first response
+// stored for a request and key and returns it. The URL is sent without its
+// query, which may carry credentials.
+func (c *EgressCache) put(ctx context.Context, requestID string, entry *CachedResponse) *CachedResponse {
+	shared := *entry
+	shared.URL = redactURL(entry.URL)
+	data, err := json.Marshal(&shared)
+	if err != nil {
+		return nil
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.serviceURL(requestID, entry.Key), bytes.NewReader(data))
+	if err != nil {
+		return nil
+	}
+	req.Header.Set("Content-Type", "application/json")
+	return c.call(req, requestID)
+}
+
+// call sends a cache service request. Failures are logged and treated as a
+// miss, so the proxy keeps working without the service.
+func (c *EgressCache) call(req *http.Request, requestID string) *CachedResponse {
+	if c.cfg.ServiceToken != "" {
+		req.Header.Set("Authorization", "Bearer "+c.cfg.ServiceToken)
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		slog.Warn("Egress cache service request failed", "request_id", requestID, "error", err)
+		return nil
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil
+	}
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+		slog.Warn("Egress cache service request failed", "request_id", requestID, "status", resp.StatusCode)
+		return nil
+	}
+	var entry CachedResponse
+	if err := json.NewDecoder(resp.Body).Decode(&entry); err != nil || entry.Key != req.URL.Query().Get("key") {
+		slog.Warn("Invalid egress cache service response", "request_id", requestID, "error", err)
+		return nil
+	}
+	return &entry
+}
+
+func (c *EgressCache) serviceURL(requestID, key string) string {
+	return fmt.Sprintf("%s/egress-cache?requestId=%s&key=%s", c.cfg.ServiceURL, url.QueryEscape(requestID), url.QueryEscape(key))
+}
+
+// cacheKey identifies a request by method, URL, headers and body, so requests
+// with different credentials do not share responses.
+func cacheKey(method, rawURL string, header http.Header, body []byte) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s %s\n", method, rawURL)
+	names := make([]string, 0, len(header))
+	for name := range header {
+		if name = http.CanonicalHeaderKey(name); !slices.Contains(unkeyedHeaders, name) {
+			names = append(names, name)
+		}
+	}
+	slices.Sort(names)
+	for _, name := range names {
+		for _, value := range header.Values(name) {
+			fmt.Fprintf(h, "%s: %s\n", name, value)
+		}
+	}
+	h.Write([]byte("\n"))
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// redactURL strips the userinfo, query and fragment of a URL.
+func redactURL(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return ""
+	}
+	u.User, u.RawQuery, u.ForceQuery, u.Fragment, u.RawFragment = nil, "", false, "", ""
+	return u.String()
+}
+
+// summary returns the receipt summary of a recorded response.
+func (e *CachedResponse) summary() EgressRecord {
+	sum := sha256.Sum256(e.Body)
+	return EgressRecord{
+		Key:        e.Key,
+		Method:     e.Method,
+		URL:        redactURL(e.URL),
+		Status:     e.Status,
+		BodySHA256: hex.EncodeToString(sum[:]),
+		FetchedAt:  e.FetchedAt,
+	}
+}
+
+// response builds an HTTP response from a recorded one.
+func (e *CachedResponse) response(req *http.Request) *http.Response {
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", e.Status, http.StatusText(e.Status)),
+		StatusCode:    e.Status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        e.Header.Clone(),
+		Body:          io.NopCloser(bytes.NewReader(e.Body)),
+		ContentLength: int64(len(e.Body)),
+		Request:       req,
+	}
+}
+
+// replayMiss answers a request that is not on the replayed tape.
+func replayMiss(req *http.Request) *http.Response {
+	body := fmt.Sprintf("%s %s was not recorded\n", req.Method, req.URL)
+	resp := (&CachedResponse{Status: http.StatusGatewayTimeout, Body: []byte(body)}).response(req)
+	resp.Header = http.Header{"Content-Type": {"text/plain"}}
+	return resp
+}
+
+// fetch sends a proxied request upstream, through the egress cache for
+// requests attributed to an agent request. In replay mode every request is
+// answered from the tape.
+func (p *Proxy) fetch(req *http.Request, client *ProxyClient) (*http.Response, error) {
+	requestID := ""
+	if client != nil {
+		requestID = client.RequestID
+	}
+	if p.Cache == nil || (requestID == "" && p.Cache.Mode() != CacheReplay) {
+		return p.proxy.Tr.RoundTrip(req)
+	}
+	resp, outcome, err := p.Cache.fetch(req, requestID, p.proxy.Tr.RoundTrip)
+	if err == nil && p.OnCache != nil {
+		p.OnCache(req, client, outcome)
+	}
+	return resp, err
+}
+
+// readCloser reads from a reader and closes a closer.
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
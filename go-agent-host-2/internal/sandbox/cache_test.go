@@ -0,0 +1,86 @@
+package sandbox
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestCacheKey(t *testing.T) {
+	base := cacheKey(http.MethodGet, "https://api.com/v1", http.Header{"Authorization": {"Bearer a"}}, nil)
+
+	for _, tc := range []struct {
+		name   string
+		header http.Header
+		same   bool
+	}{
+		{"same credentials", http.Header{"Authorization": {"Bearer a"}}, true},
+		{"proxy credentials", http.Header{"Authorization": {"Bearer a"}, "Proxy-Authorization": {"Basic x"}}, true},
+		{"other credentials", http.Header{"Authorization": {"Bearer b"}}, false},
+		{"no credentials", nil, false},
+		{"cookie", http.Header{"Authorization": {"Bearer a"}, "Cookie": {"session=1"}}, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := cacheKey(http.MethodGet, "https://api.com/v1", tc.header, nil) == base; got != tc.same {
+				t.Errorf("key equal = %v, want %v", got, tc.same)
+			}
+		})
+	}
+}
+
+func TestEgressCacheSharedPrivateData(t *testing.T) {
+	var mu sync.Mutex
+	var posted CachedResponse
+	var auth string
+	service := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		auth = r.Header.Get("Authorization")
+		if r.Method == http.MethodGet {
+			http.NotFound(w, r)
+			return
+		}
+		data, _ := io.ReadAll(r.Body)
+		json.Unmarshal(data, &posted)
+		w.Write(data)
+	}))
+	defer service.Close()
+
+	cache, err := NewEgressCache(EgressCacheConfig{Mode: CacheShared, ServiceURL: service.URL, ServiceToken: "token"})
+	if err != nil {
+		t.Fatalf("NewEgressCache: %v", err)
+	}
+	req := httptest.NewRequest(http.MethodGet, "https://api.com/v1/price?apikey=secret", nil)
+	resp, outcome, err := cache.fetch(req, "req-1", func(*http.Request) (*http.Response, error) {
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Header:     http.Header{"Set-Cookie": {"session=1"}, "Content-Type": {"application/json"}},
+			Body:       io.NopCloser(strings.NewReader(`{"price":1}`)),
+		}, nil
+	})
+	if err != nil {
+		t.Fatalf("fetch: %v", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if outcome != CacheMiss {
+		t.Errorf("outcome = %q, want %q", outcome, CacheMiss)
+	}
+	if auth != "Bearer token" {
+		t.Errorf("service Authorization = %q, want the bearer token", auth)
+	}
+	if posted.URL != "https://api.com/v1/price" {
+		t.Errorf("posted URL = %q, want it without the query", posted.URL)
+	}
+	if posted.Header.Get("Set-Cookie") != "" || resp.Header.Get("Set-Cookie") != "" {
+		t.Errorf("Set-Cookie was shared or served: posted %v, served %v", posted.Header, resp.Header)
+	}
+	if records := cache.Records("req-1"); len(records) != 1 || records[0].URL != req.URL.String() {
+		t.Errorf("local records = %+v, want the full URL", records)
+	}
+}
@@ -0,0 +1,483 @@
+package sandbox
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DNSSuspiciousName is the reason a DNS query is blocked for a label that
+// looks like encoded data.
+const DNSSuspiciousName = "suspicious_name"
+
+// Default limits on the labels of names the sandbox DNS server resolves.
+const (
+	DefaultDNSMaxLabelLength  = 40
+	DefaultDNSMaxLabelEntropy = 3.8
+)
+
+const (
+	dnsTTL             = 30  // TTL of answers, in seconds
+	dnsMaxUDPSize      = 512 // Largest UDP response without EDNS
+	dnsEntropyMinLabel = 24  // Shorter labels are not checked for entropy
+	dnsLabelAlphabet   = 37  // Letters, digits and hyphen
+	dnsTimeout         = 5 * time.Second
+)
+
+// DNS header flags, record types and response codes.
+const (
+	dnsFlagResponse  = 0x8000
+	dnsFlagOpcode    = 0x7800
+	dnsFlagRecursion = 0x0100
+	dnsFlagAvailable = 0x0080
+
+	dnsTypeA    = 1
+	dnsTypeAAAA = 28
+	dnsClassIN  = 1
+
+	dnsRcodeFormErr  = 1
+	dnsRcodeServFail = 2
+	dnsRcodeNXDomain = 3
+	dnsRcodeNotImp   = 4
+)
+
+// DNSMetrics holds metrics for sandbox DNS queries.
+type DNSMetrics struct {
+	QueryCount   atomic.Int64
+	BlockedCount atomic.Int64
+	ErrorCount   atomic.Int64
+}
+
+// DNSServer is the resolver sandbox containers use. It answers address
+// queries for the names the egress policy allows, with addresses from the
+// host resolver, and nothing else: other record types get empty answers and
+// names with long or high-entropy labels are refused, so DNS cannot be used
+// to tunnel data out of the sandbox.
+type DNSServer struct {
+	listenAddr string
+	resolver   *net.Resolver
+	metrics    *DNSMetrics
+	udp        []net.PacketConn
+	tcp        []net.Listener
+	wg         sync.WaitGroup
+
+	// ListenAddr6 is an additional address on the IPv6 gateway of a
+	// dual-stack sandbox network ("" = IPv4 only).
+	ListenAddr6 string
+
+	// Labels longer than MaxLabelLength, or of at least 24 characters with a
+	// Shannon entropy above MaxLabelEntropy bits per character (scaled to the
+	// DNS alphabet for hex and base32 labels, see labelEntropy), are refused
+	// (0 = no limit).
+	MaxLabelLength  int
+	MaxLabelEntropy float64
+
+	// Egress policy the names are checked against, by the same rules as
+	// proxy destinations on any port. Without one every name is refused.
+	Egress *EgressPolicy
+
+	// Optional hooks. ClientFunc identifies the agent behind a source IP on
+	// the sandbox network; OnQuery is called for each well-formed query, with
+	// a nil client when unknown.
+	ClientFunc func(ip string) *ProxyClient
+	OnQuery    func(client *ProxyClient, name, qtype string, decision EgressDecision)
+}
+
+// NewDNSServer creates a sandbox DNS server.
+// listenAddr should be the sandbox network gateway IP and port, e.g., "172.30.0.1:53"
+func NewDNSServer(listenAddr string) *DNSServer {
+	return &DNSServer{
+		listenAddr:      listenAddr,
+		resolver:        net.DefaultResolver,
+		metrics:         &DNSMetrics{},
+		MaxLabelLength:  DefaultDNSMaxLabelLength,
+		MaxLabelEntropy: DefaultDNSMaxLabelEntropy,
+	}
+}
+
+// Metrics returns the current DNS metrics.
+func (s *DNSServer) Metrics() *DNSMetrics {
+	return s.metrics
+}
+
+// Start starts serving DNS over UDP and TCP.
+func (s *DNSServer) Start() error {
+	slog.Info("Starting sandbox DNS server", "addr", s.listenAddr, "addr6", s.ListenAddr6)
+
+	for _, addr := range []string{s.listenAddr, s.ListenAddr6} {
+		if addr == "" {
+			continue
+		}
+		udp, err := net.ListenPacket("udp", addr)
+		if err != nil {
+			s.close()
+			return fmt.Errorf("failed to listen on udp %s: %w", addr, err)
+		}
+		s.udp = append(s.udp, udp)
+		tcp, err := net.Listen("tcp", addr)
+		if err != nil {
+			s.close()
+			return fmt.Errorf("failed to listen on tcp %s: %w", addr, err)
+		}
+		s.tcp = append(s.tcp, tcp)
+	}
+
+	s.wg.Add(len(s.udp) + len(s.tcp))
+	for _, udp := range s.udp {
+		go s.serveUDP(udp)
+	}
+	for _, tcp := range s.tcp {
+		go s.serveTCP(tcp)
+	}
+	return nil
+}
+
+// close closes the UDP and TCP listeners.
+func (s *DNSServer) close() {
+	for _, udp := range s.udp {
+		udp.Close()
+	}
+	for _, tcp := range s.tcp {
+		tcp.Close()
+	}
+}
+
+// Stop stops the DNS server and waits for in-flight queries.
+func (s *DNSServer) Stop(ctx context.Context) error {
+	if s.udp == nil {
+		return nil
+	}
+	slog.Info("Stopping sandbox DNS server")
+	s.close()
+
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (s *DNSServer) serveUDP(udp net.PacketConn) {
+	defer s.wg.Done()
+	buf := make([]byte, 4096)
+	for {
+		n, addr, err := udp.ReadFrom(buf)
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				slog.Error("Sandbox DNS read error", "error", err)
+			}
+			return
+		}
+		query := append([]byte(nil), buf[:n]...)
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			if resp := s.answer(query, addr, dnsMaxUDPSize); resp != nil {
+				udp.WriteTo(resp, addr)
+			}
+		}()
+	}
+}
+
+func (s *DNSServer) serveTCP(tcp net.Listener) {
+	defer s.wg.Done()
+	for {
+		conn, err := tcp.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				slog.Error("Sandbox DNS accept error", "error", err)
+			}
+			return
+		}
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.handleTCP(conn)
+		}()
+	}
+}
+
+// handleTCP answers length-prefixed queries until the client is done.
+func (s *DNSServer) handleTCP(conn net.Conn) {
+	defer conn.Close()
+	for {
+		conn.SetDeadline(time.Now().Add(dnsTimeout))
+		var size [2]byte
+		if _, err := io.ReadFull(conn, size[:]); err != nil {
+			return
+		}
+		query := make([]byte, binary.BigEndian.Uint16(size[:]))
+		if _, err := io.ReadFull(conn, query); err != nil {
+			return
+		}
+		resp := s.answer(query, conn.RemoteAddr(), math.MaxUint16)
+		if resp == nil {
+			return
+		}
+		if _, err := conn.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(resp))), resp...)); err != nil {
+			return
+		}
+	}
+}
+
+// answer builds the response to a query from addr, or returns nil if the
+// query is too malformed to answer.
+func (s *DNSServer) answer(query []byte, addr net.Addr, maxSize int) []byte {
+	s.metrics.QueryCount.Add(1)
+	q, err := parseDNSQuery(query)
+	if err != nil {
+		s.metrics.ErrorCount.Add(1)
+		if len(query) < 12 {
+			return nil
+		}
+		return dnsResponse(query, nil, dnsRcodeFormErr, nil, maxSize)
+	}
+	if q.flags&dnsFlagOpcode != 0 {
+		return q.reply(dnsRcodeNotImp, nil, maxSize)
+	}
+
+	var client *ProxyClient
+	if s.ClientFunc != nil {
+		if host, _, err := net.SplitHostPort(addr.String()); err == nil {
+			client = s.ClientFunc(host)
+		}
+	}
+
+	address := q.qclass == dnsClassIN && (q.qtype == dnsTypeA || q.qtype == dnsTypeAAAA)
+	decision, undecided := s.check(client, q.name, nil)
+	if !decision.Allowed && !(undecided && address) {
+		return s.refuse(q, client, decision, maxSize)
+	}
+	if !address {
+		// Only addresses are served; other records could carry data
+		s.report(client, q, decision)
+		return q.reply(0, nil, maxSize)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), dnsTimeout)
+	defer cancel()
+	ips, err := s.resolver.LookupIP(ctx, "ip", q.name)
+	if err != nil {
+		var dnsErr *net.DNSError
+		s.report(client, q, decision)
+		if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+			return q.reply(dnsRcodeNXDomain, nil, maxSize)
+		}
+		s.metrics.ErrorCount.Add(1)
+		slog.Debug("Sandbox DNS lookup failed", "name", q.name, "error", err)
+		return q.reply(dnsRcodeServFail, nil, maxSize)
+	}
+
+	// Check the addresses too, so a name cannot resolve into a denied range
+	if decision, _ = s.check(client, q.name, ips); !decision.Allowed {
+		return s.refuse(q, client, decision, maxSize)
+	}
+	s.report(client, q, decision)
+
+	// Answer with the addresses of the queried family only
+	var answers []net.IP
+	for _, ip := range ips {
+		if (ip.To4() != nil) == (q.qtype == dnsTypeA) {
+			answers = append(answers, ip)
+		}
+	}
+	return q.reply(0, answers, maxSize)
+}
+
+// check applies the label limits and the egress policy to a name, before it
+// is resolved if ips is nil. Address rules cannot decide a name before then:
+// undecided reports a name they may still allow once its addresses are known.
+func (s *DNSServer) check(client *ProxyClient, name string, ips []net.IP) (decision EgressDecision, undecided bool) {
+	for _, label := range strings.Split(name, ".") {
+		if s.MaxLabelLength > 0 && len(label) > s.MaxLabelLength {
+			return EgressDecision{Reason: DNSSuspiciousName}, false
+		}
+		if s.MaxLabelEntropy > 0 && len(label) >= dnsEntropyMinLabel && labelEntropy(label) > s.MaxLabelEntropy {
+			return EgressDecision{Reason: DNSSuspiciousName}, false
+		}
+	}
+	if s.Egress == nil {
+		// Resolving arbitrary names would reach any nameserver
+		return EgressDecision{Reason: EgressNotAllowed}, false
+	}
+	decision = s.Egress.Check(client, name, 0, ips)
+	undecided = ips == nil && decision.Reason == EgressNotAllowed && s.Egress.AllowsAddresses(client)
+	return decision, undecided
+}
+
+// refuse answers a blocked query with NXDOMAIN.
+func (s *DNSServer) refuse(q *dnsQuery, client *ProxyClient, decision EgressDecision, maxSize int) []byte {
+	s.metrics.BlockedCount.Add(1)
+	s.report(client, q, decision)
+	return q.reply(dnsRcodeNXDomain, nil, maxSize)
+}
+
+// report calls the OnQuery hook.
+func (s *DNSServer) report(client *ProxyClient, q *dnsQuery, decision EgressDecision) {
+	if s.OnQuery != nil {
+		s.OnQuery(client, q.name, dnsTypeName(q.qtype), decision)
+	}
+}
+
+// labelEntropy returns the Shannon entropy of a label in bits per character.
+// Encoded data in a narrow alphabet cannot reach the entropy of the DNS
+// alphabet (random hex stays below log2(16) = 4 bits), so the entropy of
+// labels that are all hex or all base32 is scaled up to the DNS alphabet.
+func labelEntropy(label string) float64 {
+	var counts [256]int
+	for i := 0; i < len(label); i++ {
+		counts[label[i]]++
+	}
+	var entropy float64
+	for _, n := range counts {
+		if n > 0 {
+			p := float64(n) / float64(len(label))
+			entropy -= p * math.Log2(p)
+		}
+	}
+	switch {
+	case strings.Trim(label, "0123456789abcdef") == "":
+		entropy *= math.Log2(dnsLabelAlphabet) / 4
+	case strings.Trim(label, "abcdefghijklmnopqrstuvwxyz234567") == "":
+		entropy *= math.Log2(dnsLabelAlphabet) / 5
+	}
+	return entropy
+}
+
+// dnsQuery is the parsed header and question of a DNS query.
+type dnsQuery struct {
+	raw      []byte // Header and question, echoed in the response
+	flags    uint16
+	name     string // Lowercase, without the trailing dot
+	qtype    uint16
+	qclass   uint16
+	question int // End of the question in raw
+}
+
+// parseDNSQuery parses a query with exactly one question.
+func parseDNSQuery(msg []byte) (*dnsQuery, error) {
+	if len(msg) < 12 {
+		return nil, errors.New("short DNS message")
+	}
+	flags := binary.BigEndian.Uint16(msg[2:4])
+	if flags&dnsFlagResponse != 0 || binary.BigEndian.Uint16(msg[4:6]) != 1 {
+		return nil, errors.New("not a single-question DNS query")
+	}
+
+	var labels []string
+	off := 12
+	for {
+		if off >= len(msg) {
+			return nil, errors.New("truncated DNS name")
+		}
+		n := int(msg[off])
+		off++
+		if n == 0 {
+			break
+		}
+		if n > 63 || off+n > len(msg) {
+			return nil, errors.New("invalid DNS label")
+		}
+		labels = append(labels, strings.ToLower(string(msg[off:off+n])))
+		off += n
+	}
+	if off+4 > len(msg) || len(labels) == 0 {
+		return nil, errors.New("invalid DNS question")
+	}
+
+	return &dnsQuery{
+		raw:      msg,
+		flags:    flags,
+		name:     strings.Join(labels, "."),
+		qtype:    binary.BigEndian.Uint16(msg[off : off+2]),
+		qclass:   binary.BigEndian.Uint16(msg[off+2 : off+4]),
+		question: off + 4,
+	}, nil
+}
+
+// reply builds a response to the query with the given addresses as answers.
+func (q *dnsQuery) reply(rcode uint16, ips []net.IP, maxSize int) []byte {
+	return dnsResponse(q.raw[:12], q.raw[12:q.question], rcode, ips, maxSize)
+}
+
+// dnsResponse builds a response echoing the query header and question. As
+// many answers are included as fit in maxSize.
+func dnsResponse(header, question []byte, rcode uint16, ips []net.IP, maxSize int) []byte {
+	flags := binary.BigEndian.Uint16(header[2:4])
+	flags = dnsFlagResponse | flags&(dnsFlagOpcode|dnsFlagRecursion) | dnsFlagAvailable | rcode
+
+	var answers [][]byte
+	size := 12 + len(question)
+	for _, ip := range ips {
+		rtype, data := uint16(dnsTypeA), ip.To4()
+		if data == nil {
+			rtype, data = dnsTypeAAAA, ip.To16()
+		}
+		// Name as a pointer to the question, type, class, TTL, length, data
+		rr := []byte{0xc0, 12}
+		rr = binary.BigEndian.AppendUint16(rr, rtype)
+		rr = binary.BigEndian.AppendUint16(rr, dnsClassIN)
+		rr = binary.BigEndian.AppendUint32(rr, dnsTTL)
+		rr = binary.BigEndian.AppendUint16(rr, uint16(len(data)))
+		rr = append(rr, data...)
+		if size+len(rr) > maxSize {
+			break
+		}
+		size += len(rr)
+		answers = append(answers, rr)
+	}
+
+	qdcount := uint16(0)
+	if len(question) > 0 {
+		qdcount = 1
+	}
+	resp := make([]byte, 0, size)
+	resp = append(resp, header[0:2]...)
+	resp = binary.BigEndian.AppendUint16(resp, flags)
+	resp = binary.BigEndian.AppendUint16(resp, qdcount)
+	resp = binary.BigEndian.AppendUint16(resp, uint16(len(answers)))
+	resp = append(resp, 0, 0, 0, 0) // No authority or additional records
+	resp = append(resp, question...)
+	for _, rr := range answers {
+		resp = append(resp, rr...)
+	}
+	return resp
+}
+
+// dnsTypeName returns a readable name for a record type.
+func dnsTypeName(qtype uint16) string {
+	switch qtype {
+	case dnsTypeA:
+		return "A"
+	case dnsTypeAAAA:
+		return "AAAA"
+	case 5:
+		return "CNAME"
+	case 12:
+		return "PTR"
+	case 15:
+		return "MX"
+	case 16:
+		return "TXT"
+	case 33:
+		return "SRV"
+	case 65:
+		return "HTTPS"
+	}
+	return fmt.Sprintf("TYPE%d", qtype)
+}
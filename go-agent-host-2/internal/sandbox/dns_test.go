@@ -0,0 +1,126 @@
+package sandbox
+
+import (
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/hex"
+	"net"
+	"strings"
+	"testing"
+)
+
+// payload returns n bytes of deterministic pseudo-random data.
+func payload(seed string, n int) []byte {
+	var data []byte
+	for i := 0; len(data) < n; i++ {
+		sum := sha256.Sum256([]byte(seed + strings.Repeat(".", i)))
+		data = append(data, sum[:]...)
+	}
+	return data[:n]
+}
+
+func TestLabelEntropy(t *testing.T) {
+	max := DefaultDNSMaxLabelEntropy
+	b32 := base32.StdEncoding.WithPadding(base32.NoPadding)
+
+	for _, tc := range []struct {
+		name       string
+		label      string
+		suspicious bool
+	}{
+		{"hex 24", hex.EncodeToString(payload("a", 12)), true},
+		{"hex 32", hex.EncodeToString(payload("b", 16)), true},
+		{"hex 40", hex.EncodeToString(payload("c", 20)), true},
+		{"base32 32", strings.ToLower(b32.EncodeToString(payload("d", 20))), true},
+		{"base32 40", strings.ToLower(b32.EncodeToString(payload("e", 25))), true},
+		{"hostname", "ec2-54-210-167-204-compute", false},
+		{"region", "storage-googleapis-europe-west", false},
+		{"words", "internationalization-test", false},
+		{"repetitive hex", "abcdefabcdefabcdefabcdef", false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := labelEntropy(tc.label) > max; got != tc.suspicious {
+				t.Errorf("labelEntropy(%q) = %.2f, suspicious = %v, want %v", tc.label, labelEntropy(tc.label), got, tc.suspicious)
+			}
+		})
+	}
+}
+
+func TestLabelEntropyHexBelowAlphabetLimit(t *testing.T) {
+	// Unscaled, random hex can never exceed log2(16) = 4 bits per character
+	for i := 0; i < 100; i++ {
+		label := hex.EncodeToString(payload(strings.Repeat("x", i), 20))
+		if got := labelEntropy(label); got <= DefaultDNSMaxLabelEntropy {
+			t.Errorf("labelEntropy(%q) = %.2f, want above %.1f", label, got, DefaultDNSMaxLabelEntropy)
+		}
+	}
+}
+
+func TestDNSCheck(t *testing.T) {
+	s := NewDNSServer("127.0.0.1:0")
+	s.Egress = testPolicy(t, EgressRules{Allow: []string{"*.example.com:443", "api.allowed.com"}}, nil)
+	hexLabel := hex.EncodeToString(payload("secret", 16))
+	b32Label := strings.ToLower(base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(payload("secret", 20)))
+
+	for _, tc := range []struct {
+		name   string
+		query  string
+		reason string // "" = allowed
+	}{
+		{"allowed name", "api.allowed.com", ""},
+		{"allowed on some port", "www.example.com", ""},
+		{"long natural label", "storage-googleapis-europe-west.example.com", ""},
+		{"not allowed", "attacker.tld", EgressNotAllowed},
+		{"hex payload", hexLabel + ".example.com", DNSSuspiciousName},
+		{"hex payload elsewhere", hexLabel + ".attacker.tld", DNSSuspiciousName},
+		{"base32 payload", b32Label + ".example.com", DNSSuspiciousName},
+		{"long label", strings.Repeat("a", DefaultDNSMaxLabelLength+1) + ".example.com", DNSSuspiciousName},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			decision, undecided := s.check(nil, tc.query, nil)
+			if decision.Allowed != (tc.reason == "") || decision.Reason != tc.reason || undecided {
+				t.Errorf("check(%q) = %+v, %v, want reason %q", tc.query, decision, undecided, tc.reason)
+			}
+		})
+	}
+}
+
+func TestDNSCheckAddressRules(t *testing.T) {
+	s := NewDNSServer("127.0.0.1:0")
+	s.Egress = testPolicy(t, EgressRules{Allow: []string{"10.1.0.0/16"}, Deny: []string{"10.1.99.0/24"}}, nil)
+	hexLabel := hex.EncodeToString(payload("secret", 16))
+
+	for _, tc := range []struct {
+		name      string
+		query     string
+		ips       []net.IP
+		reason    string // "" = allowed
+		undecided bool
+	}{
+		{"before resolution", "internal.corp", nil, EgressNotAllowed, true},
+		{"allowed address", "internal.corp", ips("10.1.2.3"), "", false},
+		{"address not allowed", "internal.corp", ips("192.0.2.1"), EgressNotAllowed, false},
+		{"denied address", "internal.corp", ips("10.1.99.7"), EgressDenied, false},
+		{"payload before resolution", hexLabel + ".internal.corp", nil, DNSSuspiciousName, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			decision, undecided := s.check(nil, tc.query, tc.ips)
+			if decision.Allowed != (tc.reason == "") || decision.Reason != tc.reason || undecided != tc.undecided {
+				t.Errorf("check(%q, %v) = %+v, %v, want reason %q, undecided %v", tc.query, tc.ips, decision, undecided, tc.reason, tc.undecided)
+			}
+			// The proxy decides the resolved name the same way
+			if tc.ips != nil {
+				if proxy := s.Egress.Check(nil, tc.query, 443, tc.ips); proxy.Allowed != decision.Allowed {
+					t.Errorf("Egress.Check(%q, %v) = %+v, DNS check = %+v", tc.query, tc.ips, proxy, decision)
+				}
+			}
+		})
+	}
+}
+
+func TestDNSCheckWithoutPolicy(t *testing.T) {
+	s := NewDNSServer("127.0.0.1:0")
+	if decision, undecided := s.check(nil, "data.attacker.tld", nil); decision.Allowed || undecided {
+		t.Errorf("check without a policy = %+v, %v, want refused", decision, undecided)
+	}
+}
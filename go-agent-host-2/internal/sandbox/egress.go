@@ -0,0 +1,382 @@
+package sandbox
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// Reasons an egress destination is blocked.
+const (
+	EgressDenied     = "denied"      // A deny rule matched
+	EgressNotAllowed = "not_allowed" // No allow rule matched
+)
+
+// AnyPath asks CheckRequest whether some path of a destination may be
+// reachable, before its requests are seen: rules for specific paths then
+// allow it but do not deny it.
+const AnyPath = "*"
+
+// EgressRules is a list of allowed and denied destinations. Each entry is a
+// host with an optional port or port range:
+//
+//	api.example.com        exact hostname, any port
+//	*.example.com:443      subdomains of example.com, port 443
+//	10.0.0.0/8             addresses in a CIDR
+//	[2001:db8::1]:8000-8100 an address and port range
+//	*:443                  any host on port 443
+//	https://api.example.com/v1/*  paths under /v1/ of a host (port 443)
+//
+// CIDRs and addresses also match hostnames that resolve into them. URL rules
+// scope a host to a path, or a path prefix ending in "*"; the proxy can only
+// check paths of HTTP requests and intercepted HTTPS requests.
+type EgressRules struct {
+	Allow []string `json:"allow,omitempty"`
+	Deny  []string `json:"deny,omitempty"`
+	// ApproveDeclared allows the destinations agents declare in the
+	// "egress" field of their metadata.
+	ApproveDeclared bool `json:"approveDeclared,omitempty"`
+}
+
+// EgressPolicy is the operator-controlled egress policy of the sandbox proxy,
+// loaded from a JSON file.
+//
+// Example:
+//
+//	{
+//	  "allow": ["*.openai.com:443"],
+//	  "deny":  ["169.254.0.0/16", "10.0.0.0/8"],
+//	  "agents": {
+//	    "42": {"allow": ["api.coingecko.com:443"]},
+//	    "https://storage.example.com/agent.tar": {"approveDeclared": true}
+//	  }
+//	}
+//
+// Deny rules win over allow rules, global rules apply to every agent, and
+// per-agent rules are keyed by agent ID or image URL. A destination no allow
+// rule matches is blocked.
+type EgressPolicy struct {
+	EgressRules
+	Agents map[string]EgressRules `json:"agents"`
+
+	global compiledRules
+	agents map[string]compiledRules
+}
+
+// ProxyClient identifies the agent behind a proxied request.
+type ProxyClient struct {
+	AgentID   string
+	AgentURL  string
+	Container string   // Container name
+	RequestID string   // Request being executed, "" if unknown
+	Egress    []string // Destinations declared in the agent's metadata
+}
+
+// EgressDecision is the outcome of an egress policy check.
+type EgressDecision struct {
+	Allowed bool
+	Reason  string // EgressDenied or EgressNotAllowed when blocked
+	Rule    string // The rule that decided, if any
+}
+
+// LoadEgressPolicy reads an egress policy from a JSON file.
+func LoadEgressPolicy(path string) (*EgressPolicy, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read egress policy: %w", err)
+	}
+
+	var policy EgressPolicy
+	if err := json.Unmarshal(data, &policy); err != nil {
+		return nil, fmt.Errorf("failed to parse egress policy %s: %w", path, err)
+	}
+	if policy.global, err = compileRules(policy.EgressRules); err != nil {
+		return nil, fmt.Errorf("invalid egress policy %s: %w", path, err)
+	}
+	policy.agents = make(map[string]compiledRules, len(policy.Agents))
+	for key, rules := range policy.Agents {
+		if policy.agents[key], err = compileRules(rules); err != nil {
+			return nil, fmt.Errorf("invalid egress policy %s for agent %s: %w", path, key, err)
+		}
+	}
+	return &policy, nil
+}
+
+// Check decides whether client may reach host:port. ips are the addresses
+// host resolves to. client may be nil for unidentified requests, which only
+// the global rules apply to. Port 0 asks whether host is reachable on some
+// port: rules for specific ports then allow it but do not deny it.
+func (p *EgressPolicy) Check(client *ProxyClient, host string, port int, ips []net.IP) EgressDecision {
+	return p.CheckRequest(client, host, port, "", ips)
+}
+
+// CheckRequest decides whether client may request path on host:port, like
+// Check. An empty path stands for an opaque tunnel, whose requests cannot be
+// checked: rules for specific paths then deny it but do not allow it.
+func (p *EgressPolicy) CheckRequest(client *ProxyClient, host string, port int, reqPath string, ips []net.IP) EgressDecision {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if port == 0 {
+		reqPath = AnyPath
+	} else if reqPath != "" && reqPath != AnyPath {
+		reqPath = path.Clean("/" + reqPath)
+	}
+	sets, approveDeclared := p.ruleSets(client)
+	for _, rules := range sets {
+		if rule := matchAny(rules.deny, host, port, reqPath, ips, false); rule != "" {
+			return EgressDecision{Reason: EgressDenied, Rule: rule}
+		}
+	}
+	for _, rules := range sets {
+		if rule := matchAny(rules.allow, host, port, reqPath, ips, true); rule != "" {
+			return EgressDecision{Allowed: true, Rule: rule}
+		}
+	}
+	if approveDeclared && client != nil {
+		declared, _ := parseRules(client.Egress)
+		if rule := matchAny(declared, host, port, reqPath, ips, true); rule != "" {
+			return EgressDecision{Allowed: true, Rule: rule}
+		}
+	}
+	return EgressDecision{Reason: EgressNotAllowed}
+}
+
+// AllowsAddresses reports whether any allow rule for client is an address
+// or CIDR rule. Such rules decide a hostname only once it is resolved.
+func (p *EgressPolicy) AllowsAddresses(client *ProxyClient) bool {
+	sets, approveDeclared := p.ruleSets(client)
+	if approveDeclared && client != nil {
+		declared, _ := parseRules(client.Egress)
+		sets = append(sets, compiledRules{allow: declared})
+	}
+	for _, rules := range sets {
+		for _, rule := range rules.allow {
+			if rule.cidr != nil {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// ruleSets returns the global rules and those of client, and whether the
+// destinations client declares are approved.
+func (p *EgressPolicy) ruleSets(client *ProxyClient) ([]compiledRules, bool) {
+	sets := []compiledRules{p.global}
+	approveDeclared := p.ApproveDeclared
+	if client != nil {
+		for _, key := range []string{client.AgentID, client.AgentURL} {
+			if rules, ok := p.agents[key]; ok && key != "" {
+				sets = append(sets, rules)
+				approveDeclared = approveDeclared || rules.approveDeclared
+			}
+		}
+	}
+	return sets, approveDeclared
+}
+
+// DeclaredApproved reports whether the destinations an agent declares in its
+// metadata are allowed.
+func (p *EgressPolicy) DeclaredApproved(agentID, agentURL string) bool {
+	if p.ApproveDeclared {
+		return true
+	}
+	for _, key := range []string{agentID, agentURL} {
+		if rules, ok := p.agents[key]; ok && key != "" && rules.approveDeclared {
+			return true
+		}
+	}
+	return false
+}
+
+type compiledRules struct {
+	allow           []egressRule
+	deny            []egressRule
+	approveDeclared bool
+}
+
+// egressRule is a parsed EgressRules entry.
+type egressRule struct {
+	raw    string
+	any    bool       // "*"
+	name   string     // Exact hostname
+	suffix string     // ".example.com" for "*.example.com"
+	cidr   *net.IPNet // Address or CIDR
+	portLo int        // 0 = any port
+	portHi int
+	path   string // Path or "/prefix*" of URL rules, "" = any path
+}
+
+func compileRules(rules EgressRules) (compiledRules, error) {
+	allow, err := parseRules(rules.Allow)
+	if err != nil {
+		return compiledRules{}, err
+	}
+	deny, err := parseRules(rules.Deny)
+	if err != nil {
+		return compiledRules{}, err
+	}
+	return compiledRules{allow: allow, deny: deny, approveDeclared: rules.ApproveDeclared}, nil
+}
+
+// parseRules parses rule entries, returning the valid ones and the first error.
+func parseRules(entries []string) ([]egressRule, error) {
+	var rules []egressRule
+	var firstErr error
+	for _, entry := range entries {
+		rule, err := parseEgressRule(entry)
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		rules = append(rules, rule)
+	}
+	return rules, firstErr
+}
+
+func parseEgressRule(entry string) (egressRule, error) {
+	if strings.Contains(entry, "://") {
+		return parseURLRule(entry)
+	}
+	rule := egressRule{raw: entry}
+	host, ports := strings.ToLower(strings.TrimSpace(entry)), ""
+	if strings.HasPrefix(host, "[") {
+		end := strings.Index(host, "]")
+		if end < 0 {
+			return rule, fmt.Errorf("invalid egress rule %q", entry)
+		}
+		host, ports = host[1:end], strings.TrimPrefix(host[end+1:], ":")
+	} else if strings.Count(host, ":") == 1 {
+		host, ports, _ = strings.Cut(host, ":")
+	}
+
+	switch {
+	case host == "*":
+		rule.any = true
+	case strings.HasPrefix(host, "*."):
+		rule.suffix = host[1:]
+	case strings.Contains(host, "/"):
+		_, cidr, err := net.ParseCIDR(host)
+		if err != nil {
+			return rule, fmt.Errorf("invalid egress rule %q: %w", entry, err)
+		}
+		rule.cidr = cidr
+	case net.ParseIP(host) != nil:
+		ip := net.ParseIP(host)
+		bits := 128
+		if ip.To4() != nil {
+			ip, bits = ip.To4(), 32
+		}
+		rule.cidr = &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+	case host != "" && !strings.ContainsAny(host, "*/ "):
+		rule.name = strings.TrimSuffix(host, ".")
+	default:
+		return rule, fmt.Errorf("invalid egress rule %q", entry)
+	}
+
+	if ports != "" {
+		lo, hi, isRange := strings.Cut(ports, "-")
+		var err1, err2 error
+		rule.portLo, err1 = strconv.Atoi(lo)
+		rule.portHi, err2 = rule.portLo, nil
+		if isRange {
+			rule.portHi, err2 = strconv.Atoi(hi)
+		}
+		if err1 != nil || err2 != nil || rule.portLo < 1 || rule.portHi > 65535 || rule.portLo > rule.portHi {
+			return rule, fmt.Errorf("invalid port in egress rule %q", entry)
+		}
+	}
+	return rule, nil
+}
+
+// parseURLRule parses a rule written as an http or https URL, whose scheme
+// gives its default port and whose path scopes it.
+func parseURLRule(entry string) (egressRule, error) {
+	u, err := url.Parse(strings.TrimSpace(entry))
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || u.User != nil || u.RawQuery != "" || u.Fragment != "" {
+		return egressRule{raw: entry}, fmt.Errorf("invalid egress rule %q", entry)
+	}
+	hostport := u.Host
+	if u.Port() == "" {
+		hostport = net.JoinHostPort(u.Hostname(), defaultPort(u.Scheme))
+	}
+	rule, err := parseEgressRule(hostport)
+	rule.raw = entry
+	if err != nil {
+		return rule, fmt.Errorf("invalid egress rule %q", entry)
+	}
+	if u.Path != "" && u.Path != "/*" {
+		prefix, wildcard := strings.CutSuffix(u.Path, "*")
+		if strings.Contains(prefix, "*") {
+			return rule, fmt.Errorf("invalid path in egress rule %q", entry)
+		}
+		rule.path = path.Clean(prefix)
+		if wildcard {
+			if strings.HasSuffix(prefix, "/") && rule.path != "/" {
+				rule.path += "/"
+			}
+			rule.path += "*"
+		}
+	}
+	return rule, nil
+}
+
+// matchAny returns the first rule matching the destination, or "". Address
+// rules match a hostname if all its addresses match (allow) or any does (deny).
+func matchAny(rules []egressRule, host string, port int, reqPath string, ips []net.IP, allow bool) string {
+	for _, rule := range rules {
+		if rule.portLo != 0 && (port == 0 && !allow || port != 0 && (port < rule.portLo || port > rule.portHi)) {
+			continue
+		}
+		if !rule.matchPath(reqPath, allow) {
+			continue
+		}
+		if rule.matchHost(host, ips, allow) {
+			return rule.raw
+		}
+	}
+	return ""
+}
+
+// matchPath reports whether a rule applies to a request path, AnyPath or ""
+// for an opaque tunnel.
+func (r egressRule) matchPath(reqPath string, allow bool) bool {
+	switch {
+	case r.path == "":
+		return true
+	case reqPath == AnyPath:
+		return allow
+	case reqPath == "":
+		return !allow
+	}
+	if prefix, ok := strings.CutSuffix(r.path, "*"); ok {
+		return strings.HasPrefix(reqPath, prefix) || reqPath+"/" == prefix
+	}
+	return reqPath == r.path
+}
+
+func (r egressRule) matchHost(host string, ips []net.IP, allow bool) bool {
+	switch {
+	case r.any:
+		return true
+	case r.name != "":
+		return host == r.name
+	case r.suffix != "":
+		return strings.HasSuffix(host, r.suffix)
+	}
+	if len(ips) == 0 {
+		return false
+	}
+	for _, ip := range ips {
+		if r.cidr.Contains(ip) != allow {
+			return !allow
+		}
+	}
+	return allow
+}
@@ -0,0 +1,221 @@
+package sandbox
+
+import (
+	"net"
+	"testing"
+)
+
+// testPolicy compiles an egress policy from global and per-agent rules.
+func testPolicy(t *testing.T, global EgressRules, agents map[string]EgressRules) *EgressPolicy {
+	t.Helper()
+	policy := &EgressPolicy{EgressRules: global, Agents: agents, agents: make(map[string]compiledRules)}
+	var err error
+	if policy.global, err = compileRules(global); err != nil {
+		t.Fatalf("compileRules(%v): %v", global, err)
+	}
+	for key, rules := range agents {
+		if policy.agents[key], err = compileRules(rules); err != nil {
+			t.Fatalf("compileRules(%v): %v", rules, err)
+		}
+	}
+	return policy
+}
+
+// ips parses addresses for tests.
+func ips(addrs ...string) []net.IP {
+	var out []net.IP
+	for _, addr := range addrs {
+		out = append(out, net.ParseIP(addr))
+	}
+	return out
+}
+
+func TestEgressCheck(t *testing.T) {
+	policy := testPolicy(t, EgressRules{
+		Allow: []string{
+			"*.example.com:443",
+			"api.exact.com",
+			"ports.com:8000-8100",
+			"[2001:db8::1]:8443",
+			"10.1.0.0/16",
+			"https://files.com/v1/*",
+			"http://plain.com/health",
+			"tunnel.com:443",
+		},
+		Deny: []string{
+			"secret.example.com",
+			"2001:db8:bad::/48",
+			"10.1.99.0/24",
+			"https://tunnel.com/admin/*",
+			"blocked.com:25",
+		},
+	}, nil)
+
+	for _, tc := range []struct {
+		name   string
+		host   string
+		port   int
+		path   string
+		ips    []net.IP
+		reason string // "" = allowed
+	}{
+		{"wildcard subdomain", "api.example.com", 443, "", nil, ""},
+		{"wildcard nested subdomain", "a.b.example.com", 443, "", nil, ""},
+		{"wildcard needs a dot", "badexample.com", 443, "", nil, EgressNotAllowed},
+		{"wildcard excludes apex", "example.com", 443, "", nil, EgressNotAllowed},
+		{"wildcard wrong port", "api.example.com", 80, "", nil, EgressNotAllowed},
+		{"exact any port", "api.exact.com", 9999, "", nil, ""},
+		{"exact case and trailing dot", "API.Exact.com.", 443, "", nil, ""},
+		{"exact not subdomain", "v2.api.exact.com", 443, "", nil, EgressNotAllowed},
+		{"port range low", "ports.com", 8000, "", nil, ""},
+		{"port range high", "ports.com", 8100, "", nil, ""},
+		{"port range above", "ports.com", 8101, "", nil, EgressNotAllowed},
+		{"port range below", "ports.com", 7999, "", nil, EgressNotAllowed},
+		{"ipv6 literal", "2001:db8::1", 8443, "", ips("2001:db8::1"), ""},
+		{"ipv6 literal wrong port", "2001:db8::1", 443, "", ips("2001:db8::1"), EgressNotAllowed},
+		{"ipv6 deny cidr", "v6.host", 443, "", ips("2001:db8:bad::5"), EgressDenied},
+		{"deny over allow", "secret.example.com", 443, "", nil, EgressDenied},
+		{"cidr allow all addresses", "internal.host", 80, "", ips("10.1.2.3", "10.1.4.5"), ""},
+		{"cidr allow needs every address", "mixed.host", 80, "", ips("10.1.2.3", "192.0.2.1"), EgressNotAllowed},
+		{"cidr deny any address", "sneaky.host", 80, "", ips("10.1.2.3", "10.1.99.7"), EgressDenied},
+		{"cidr without addresses", "unresolved.host", 80, "", nil, EgressNotAllowed},
+		{"url prefix", "files.com", 443, "/v1/objects/a", nil, ""},
+		{"url prefix root", "files.com", 443, "/v1", nil, ""},
+		{"url prefix sibling", "files.com", 443, "/v10/objects", nil, EgressNotAllowed},
+		{"url prefix traversal", "files.com", 443, "/v1/../admin", nil, EgressNotAllowed},
+		{"url prefix scheme port", "files.com", 80, "/v1/objects", nil, EgressNotAllowed},
+		{"url exact path", "plain.com", 80, "/health", nil, ""},
+		{"url exact path other", "plain.com", 80, "/health/deep", nil, EgressNotAllowed},
+		{"url path deny", "tunnel.com", 443, "/admin/users", nil, EgressDenied},
+		{"url path deny elsewhere", "tunnel.com", 443, "/public", nil, ""},
+		{"unlisted", "attacker.tld", 443, "", nil, EgressNotAllowed},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			decision := policy.CheckRequest(nil, tc.host, tc.port, tc.path, tc.ips)
+			if decision.Allowed != (tc.reason == "") || decision.Reason != tc.reason {
+				t.Errorf("CheckRequest(%s, %d, %q) = %+v, want reason %q", tc.host, tc.port, tc.path, decision, tc.reason)
+			}
+		})
+	}
+}
+
+func TestEgressCheckAsymmetry(t *testing.T) {
+	policy := testPolicy(t, EgressRules{
+		Allow: []string{"api.com:443", "mail.com", "https://files.com/v1/*"},
+		Deny:  []string{"mail.com:25", "https://tunnel.com/admin/*"},
+	}, map[string]EgressRules{
+		"7": {Allow: []string{"tunnel.com:443"}},
+	})
+	client := &ProxyClient{AgentID: "7"}
+
+	for _, tc := range []struct {
+		name    string
+		host    string
+		port    int
+		path    string
+		allowed bool
+	}{
+		// Port 0 asks whether a host is reachable on some port
+		{"port 0 allowed by port rule", "api.com", 0, "", true},
+		{"port 0 not denied by port rule", "mail.com", 0, "", true},
+		{"port rule denies its port", "mail.com", 25, "", false},
+		{"port 0 unlisted", "other.com", 0, "", false},
+		// AnyPath asks whether some path is reachable
+		{"any path allowed by path rule", "files.com", 443, AnyPath, true},
+		{"any path not denied by path rule", "tunnel.com", 443, AnyPath, true},
+		// An opaque tunnel cannot be checked against path rules
+		{"tunnel not allowed by path rule", "files.com", 443, "", false},
+		{"tunnel denied by path rule", "tunnel.com", 443, "", false},
+		{"request allowed outside denied path", "tunnel.com", 443, "/public", true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			decision := policy.CheckRequest(client, tc.host, tc.port, tc.path, nil)
+			if decision.Allowed != tc.allowed {
+				t.Errorf("CheckRequest(%s, %d, %q) = %+v, want allowed %v", tc.host, tc.port, tc.path, decision, tc.allowed)
+			}
+		})
+	}
+
+	// A deny rule without a port still denies port 0
+	denyAll := testPolicy(t, EgressRules{Allow: []string{"*"}, Deny: []string{"blocked.com"}}, nil)
+	if decision := denyAll.Check(nil, "blocked.com", 0, nil); decision.Reason != EgressDenied {
+		t.Errorf("Check(blocked.com, 0) = %+v, want denied", decision)
+	}
+}
+
+func TestEgressCheckAgents(t *testing.T) {
+	policy := testPolicy(t, EgressRules{
+		Allow: []string{"shared.com"},
+		Deny:  []string{"evil.com"},
+	}, map[string]EgressRules{
+		"42":                         {Allow: []string{"api.coingecko.com:443"}},
+		"https://images.com/a.tar":   {ApproveDeclared: true},
+		"https://images.com/bad.tar": {Deny: []string{"shared.com"}},
+	})
+	declared := []string{"declared.com:443", "evil.com"}
+
+	for _, tc := range []struct {
+		name   string
+		client *ProxyClient
+		host   string
+		reason string // "" = allowed
+	}{
+		{"global rules without client", nil, "shared.com", ""},
+		{"agent rules need the agent", nil, "api.coingecko.com", EgressNotAllowed},
+		{"agent by ID", &ProxyClient{AgentID: "42"}, "api.coingecko.com", ""},
+		{"other agent", &ProxyClient{AgentID: "43"}, "api.coingecko.com", EgressNotAllowed},
+		{"agent deny over global allow", &ProxyClient{AgentURL: "https://images.com/bad.tar"}, "shared.com", EgressDenied},
+		{"declared approved", &ProxyClient{AgentURL: "https://images.com/a.tar", Egress: declared}, "declared.com", ""},
+		{"declared not approved", &ProxyClient{AgentID: "42", Egress: declared}, "declared.com", EgressNotAllowed},
+		{"declared cannot override deny", &ProxyClient{AgentURL: "https://images.com/a.tar", Egress: declared}, "evil.com", EgressDenied},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			decision := policy.Check(tc.client, tc.host, 443, nil)
+			if decision.Allowed != (tc.reason == "") || decision.Reason != tc.reason {
+				t.Errorf("Check(%s) = %+v, want reason %q", tc.host, decision, tc.reason)
+			}
+		})
+	}
+
+	if !policy.DeclaredApproved("", "https://images.com/a.tar") {
+		t.Error("DeclaredApproved for an approving agent = false, want true")
+	}
+	if policy.DeclaredApproved("42", "https://images.com/b.tar") {
+		t.Error("DeclaredApproved for a non-approving agent = true, want false")
+	}
+}
+
+func TestParseEgressRule(t *testing.T) {
+	for _, entry := range []string{
+		"*.example.com:443",
+		"[2001:db8::1]:8000-8100",
+		"2001:db8::/32",
+		"10.0.0.0/8",
+		"*:443",
+		"https://api.example.com/v1/*",
+		"http://[::1]:8080/health",
+	} {
+		if _, err := parseEgressRule(entry); err != nil {
+			t.Errorf("parseEgressRule(%q): %v", entry, err)
+		}
+	}
+
+	for _, entry := range []string{
+		"",
+		"api.*.com",
+		"host:0",
+		"host:70000",
+		"host:90-80",
+		"host:abc",
+		"[2001:db8::1",
+		"10.0.0.0/33",
+		"ftp://files.com/",
+		"https://user@api.com/",
+		"https://api.com/v1?x=1",
+		"https://api.com/v*/x",
+	} {
+		if _, err := parseEgressRule(entry); err == nil {
+			t.Errorf("parseEgressRule(%q) succeeded, want error", entry)
+		}
+	}
+}
@@ -16,13 +16,24 @@ import (
 // Note: Rules are not cleaned up on shutdown - they reference the sandbox subnet,
 // so if the network is deleted the rules become no-ops. This avoids complexity
 // and the rules don't affect anything outside the sandbox network.
+//
+// On a dual-stack network every rule is mirrored with ip6tables for the IPv6
+// subnet. On an IPv4-only network, IPv6 traffic from its bridge is dropped.
 type FirewallRules struct {
-	ipt          *iptables.IPTables
-	subnet       string
-	gateway      string
+	families     []*firewallFamily
+	ipt6         *iptables.IPTables // Drops IPv6 of an IPv4-only bridge, nil if unavailable
+	bridge       string
 	allowedPorts []int
 }
 
+// firewallFamily is the sandbox subnet and gateway of one IP family.
+type firewallFamily struct {
+	ipt     *iptables.IPTables
+	subnet  string
+	gateway string
+	chain   string // Filter chain for forwarded sandbox traffic
+}
+
 // NewFirewallRules creates a new FirewallRules instance.
 // This does NOT apply any rules - call Apply() to enforce them.
 func NewFirewallRules(net *NetworkInfo, allowedPorts []int) (*FirewallRules, error) {
@@ -30,28 +41,52 @@ func NewFirewallRules(net *NetworkInfo, allowedPorts []int) (*FirewallRules, err
 	if err != nil {
 		return nil, fmt.Errorf("failed to create iptables client: %w", err)
 	}
-
-	return &FirewallRules{
-		ipt:          ipt,
-		subnet:       net.Subnet,
-		gateway:      net.Gateway,
+	rules := &FirewallRules{
+		families:     []*firewallFamily{{ipt: ipt, subnet: net.Subnet, gateway: net.Gateway, chain: "DOCKER-USER"}},
+		bridge:       net.Bridge,
 		allowedPorts: allowedPorts,
-	}, nil
+	}
+
+	ipt6, err := iptables.NewWithProtocol(iptables.ProtocolIPv6)
+	switch {
+	case err != nil && net.Subnet6 != "":
+		return nil, fmt.Errorf("failed to create ip6tables client: %w", err)
+	case err != nil:
+		slog.Debug("ip6tables not available, skipping IPv6 rules", "error", err)
+	case net.Subnet6 != "":
+		rules.families = append(rules.families, &firewallFamily{ipt: ipt6, subnet: net.Subnet6, gateway: net.Gateway6, chain: forwardChain(ipt6)})
+	default:
+		rules.ipt6 = ipt6
+	}
+	return rules, nil
+}
+
+// forwardChain returns the chain for filtering forwarded sandbox traffic:
+// DOCKER-USER, or FORWARD if Docker does not manage the table (as with
+// ip6tables disabled in the daemon).
+func forwardChain(ipt *iptables.IPTables) string {
+	if exists, err := ipt.ChainExists("filter", "DOCKER-USER"); err == nil && exists {
+		return "DOCKER-USER"
+	}
+	return "FORWARD"
 }
 
-// ensureRuleTop inserts a rule at the top of DOCKER-USER if not already present.
-func (f *FirewallRules) ensureRuleTop(rule []string) error {
-	const table = "filter"
-	const chain = "DOCKER-USER"
+// ensureRuleTop inserts a rule at the top of a family's forward chain if not
+// already present.
+func (fam *firewallFamily) ensureRuleTop(rule []string) error {
+	return ensureRule(fam.ipt, "filter", fam.chain, 1, rule)
+}
 
-	exists, err := f.ipt.Exists(table, chain, rule...)
+// ensureRule inserts a rule at pos of a chain if not already present.
+func ensureRule(ipt *iptables.IPTables, table, chain string, pos int, rule []string) error {
+	exists, err := ipt.Exists(table, chain, rule...)
 	if err != nil {
 		return fmt.Errorf("failed to check rule existence: %w", err)
 	}
 	if exists {
 		return nil
 	}
-	return f.ipt.Insert(table, chain, 1, rule...)
+	return ipt.Insert(table, chain, pos, rule...)
 }
 
 // Apply installs iptables rules to restrict sandbox egress.
@@ -61,22 +96,38 @@ func (f *FirewallRules) ensureRuleTop(rule []string) error {
 //
 // All other egress (internet, other containers, host services) is blocked.
 func (f *FirewallRules) Apply() error {
+	for _, fam := range f.families {
+		if err := f.applyFamily(fam); err != nil {
+			return err
+		}
+	}
+
+	// An IPv4-only network has no IPv6 rules to mirror; containers keep
+	// link-local IPv6, so drop all of it
+	if f.ipt6 != nil && f.bridge != "" {
+		for _, chain := range []string{forwardChain(f.ipt6), "INPUT"} {
+			if err := ensureRule(f.ipt6, "filter", chain, 1, []string{"-i", f.bridge, "-j", "DROP"}); err != nil {
+				return fmt.Errorf("failed to add IPv6 DROP rule for %s: %w", f.bridge, err)
+			}
+		}
+		slog.Info("Dropping IPv6 traffic from IPv4-only sandbox network", "bridge", f.bridge)
+	}
+
+	slog.Info("Firewall rules applied successfully")
+	return nil
+}
+
+// applyFamily installs the isolation rules for one IP family.
+func (f *FirewallRules) applyFamily(fam *firewallFamily) error {
 	slog.Info("Applying firewall rules for sandbox isolation",
-		"subnet", f.subnet,
-		"gateway", f.gateway,
+		"subnet", fam.subnet,
+		"gateway", fam.gateway,
 		"allowed_ports", f.allowedPorts,
 	)
 
-	// Build port list for multiport match
-	portStrs := make([]string, 0, len(f.allowedPorts))
-	for _, p := range f.allowedPorts {
-		portStrs = append(portStrs, fmt.Sprintf("%d", p))
-	}
-	portList := strings.Join(portStrs, ",")
-
 	// Rule 1: Allow established/related connections (for responses)
 	// This ensures that once a connection is allowed, return traffic works
-	if err := f.ensureRuleTop([]string{
+	if err := fam.ensureRuleTop([]string{
 		"-m", "conntrack", "--ctstate", "ESTABLISHED,RELATED", "-j", "ACCEPT",
 	}); err != nil {
 		return fmt.Errorf("failed to add ESTABLISHED rule: %w", err)
@@ -84,11 +135,11 @@ func (f *FirewallRules) Apply() error {
 
 	// Rule 2: Allow sandbox subnet -> host gateway on allowed ports only
 	// This is the ONLY permitted outbound path for sandboxes
-	if err := f.ensureRuleTop([]string{
-		"-s", f.subnet,
-		"-d", f.gateway,
+	if err := fam.ensureRuleTop([]string{
+		"-s", fam.subnet,
+		"-d", fam.gateway,
 		"-p", "tcp",
-		"-m", "multiport", "--dports", portList,
+		"-m", "multiport", "--dports", portList(f.allowedPorts),
 		"-j", "ACCEPT",
 	}); err != nil {
 		return fmt.Errorf("failed to add ACCEPT rule: %w", err)
@@ -96,9 +147,9 @@ func (f *FirewallRules) Apply() error {
 
 	// Rule 3: Block sandbox-to-sandbox (lateral movement prevention)
 	// Prevents one compromised sandbox from attacking another
-	if err := f.ensureRuleTop([]string{
-		"-s", f.subnet,
-		"-d", f.subnet,
+	if err := fam.ensureRuleTop([]string{
+		"-s", fam.subnet,
+		"-d", fam.subnet,
 		"-j", "DROP",
 	}); err != nil {
 		return fmt.Errorf("failed to add lateral DROP rule: %w", err)
@@ -106,14 +157,75 @@ func (f *FirewallRules) Apply() error {
 
 	// Rule 4: Drop all other egress from sandbox subnet
 	// This is what actually removes internet access
-	if err := f.ensureRuleTop([]string{
-		"-s", f.subnet,
+	if err := fam.ensureRuleTop([]string{
+		"-s", fam.subnet,
 		"-j", "DROP",
 	}); err != nil {
 		return fmt.Errorf("failed to add DROP rule: %w", err)
 	}
+	return nil
+}
+
+// ApplyRedirect redirects sandbox TCP traffic to ports 80 and 443 of any
+// address other than the gateway to the transparent proxy port on the
+// gateway, so agents that ignore proxy settings are proxied anyway. The
+// redirected connections are delivered locally and need an INPUT rule for
+// the port (see EnsureInputRules).
+func (f *FirewallRules) ApplyRedirect(port int) error {
+	for _, fam := range f.families {
+		rule := []string{
+			"-s", fam.subnet,
+			"!", "-d", fam.gateway,
+			"-p", "tcp",
+			"-m", "multiport", "--dports", "80,443",
+			"-j", "REDIRECT", "--to-ports", fmt.Sprintf("%d", port),
+		}
+		if err := ensureRule(fam.ipt, "nat", "PREROUTING", 1, rule); err != nil {
+			return fmt.Errorf("failed to add REDIRECT rule: %w", err)
+		}
+
+		slog.Info("Sandbox HTTP/HTTPS traffic redirected to transparent proxy",
+			"subnet", fam.subnet,
+			"port", port,
+		)
+	}
+	return nil
+}
 
-	slog.Info("Firewall rules applied successfully")
+// ApplyDNSRedirect redirects all sandbox DNS traffic, whichever resolver it
+// is addressed to, to the sandbox DNS server port on the gateway, and
+// accepts it in the INPUT chain. TCP input for the port is handled by
+// EnsureInputRules.
+func (f *FirewallRules) ApplyDNSRedirect(port int) error {
+	for _, fam := range f.families {
+		for _, proto := range []string{"udp", "tcp"} {
+			rule := []string{
+				"-s", fam.subnet,
+				"-p", proto,
+				"--dport", "53",
+				"-j", "REDIRECT", "--to-ports", fmt.Sprintf("%d", port),
+			}
+			if err := ensureRule(fam.ipt, "nat", "PREROUTING", 1, rule); err != nil {
+				return fmt.Errorf("failed to add DNS REDIRECT rule: %w", err)
+			}
+		}
+
+		input := []string{
+			"-s", fam.subnet,
+			"-d", fam.gateway,
+			"-p", "udp",
+			"--dport", fmt.Sprintf("%d", port),
+			"-j", "ACCEPT",
+		}
+		if err := ensureRule(fam.ipt, "filter", "INPUT", 1, input); err != nil {
+			return fmt.Errorf("failed to add DNS INPUT rule: %w", err)
+		}
+
+		slog.Info("Sandbox DNS traffic redirected to sandbox DNS server",
+			"subnet", fam.subnet,
+			"port", port,
+		)
+	}
 	return nil
 }
 
@@ -121,25 +233,31 @@ func (f *FirewallRules) Apply() error {
 // to reach host services (proxies) on the gateway IP. This is needed on
 // systems like COS where the INPUT chain policy is DROP.
 // Unlike Apply(), this is safe to call unconditionally — it only adds
-// ACCEPT rules for the specific subnet/ports and is idempotent.
+// ACCEPT rules for the specific subnet/ports and is idempotent. On a
+// dual-stack network the rule is mirrored for the IPv6 subnet.
 func EnsureInputRules(net *NetworkInfo, allowedPorts []int) error {
-	ipt, err := iptables.NewWithProtocol(iptables.ProtocolIPv4)
-	if err != nil {
-		slog.Warn("iptables not available, skipping INPUT rules", "error", err)
-		return nil
+	if err := ensureInputRule(iptables.ProtocolIPv4, net.Subnet, net.Gateway, allowedPorts); err != nil {
+		return err
+	}
+	if net.Subnet6 != "" {
+		return ensureInputRule(iptables.ProtocolIPv6, net.Subnet6, net.Gateway6, allowedPorts)
 	}
+	return nil
+}
 
-	portStrs := make([]string, 0, len(allowedPorts))
-	for _, p := range allowedPorts {
-		portStrs = append(portStrs, fmt.Sprintf("%d", p))
+// ensureInputRule adds the INPUT rule of EnsureInputRules for one IP family.
+func ensureInputRule(proto iptables.Protocol, subnet, gateway string, allowedPorts []int) error {
+	ipt, err := iptables.NewWithProtocol(proto)
+	if err != nil {
+		slog.Warn("iptables not available, skipping INPUT rules", "subnet", subnet, "error", err)
+		return nil
 	}
-	portList := strings.Join(portStrs, ",")
 
 	rule := []string{
-		"-s", net.Subnet,
-		"-d", net.Gateway,
+		"-s", subnet,
+		"-d", gateway,
 		"-p", "tcp",
-		"-m", "multiport", "--dports", portList,
+		"-m", "multiport", "--dports", portList(allowedPorts),
 		"-j", "ACCEPT",
 	}
 
@@ -158,9 +276,18 @@ func EnsureInputRules(net *NetworkInfo, allowedPorts []int) error {
 	}
 
 	slog.Info("Added INPUT rule for sandbox->host proxy traffic",
-		"subnet", net.Subnet,
-		"gateway", net.Gateway,
+		"subnet", subnet,
+		"gateway", gateway,
 		"ports", allowedPorts,
 	)
 	return nil
 }
+
+// portList formats ports for a multiport match.
+func portList(ports []int) string {
+	portStrs := make([]string, 0, len(ports))
+	for _, p := range ports {
+		portStrs = append(portStrs, fmt.Sprintf("%d", p))
+	}
+	return strings.Join(portStrs, ",")
+}
@@ -0,0 +1,225 @@
+package sandbox
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/elazarl/goproxy"
+)
+
+// proxyRequest is the per-request state of a proxied request or tunnel.
+type proxyRequest struct {
+	r        *http.Request
+	start    time.Time
+	client   *ProxyClient
+	bytesIn  atomic.Int64 // Read from the agent
+	bytesOut atomic.Int64 // Written to the agent
+	exceeded atomic.Bool  // A byte quota was exceeded
+	once     sync.Once
+}
+
+func newProxyRequest(r *http.Request, client *ProxyClient) *proxyRequest {
+	return &proxyRequest{r: r, start: time.Now(), client: client}
+}
+
+// admit applies the quotas to a new request or tunnel, returning the
+// exhausted quota or "".
+func (p *Proxy) admit(r *http.Request, client *ProxyClient) string {
+	if p.Quotas == nil {
+		return ""
+	}
+	reason := p.Quotas.Admit(client)
+	if reason != "" {
+		p.throttled(r, client, reason)
+	}
+	return reason
+}
+
+// count records n bytes transferred in one direction of a request and
+// charges them to the quotas. It returns ErrQuotaExceeded once a byte quota
+// is exceeded.
+func (p *Proxy) count(state *proxyRequest, counter *atomic.Int64, n int) error {
+	if n <= 0 {
+		return nil
+	}
+	counter.Add(int64(n))
+	if p.Quotas == nil || p.Quotas.Charge(state.client, int64(n)) == "" {
+		return nil
+	}
+	if state.exceeded.CompareAndSwap(false, true) {
+		p.throttled(state.r, state.client, QuotaBytes)
+	}
+	return ErrQuotaExceeded
+}
+
+func (p *Proxy) throttled(r *http.Request, client *ProxyClient, reason string) {
+	p.metrics.ThrottledCount.Add(1)
+	if p.OnThrottled != nil {
+		p.OnThrottled(r, client, reason)
+	}
+}
+
+// complete reports a finished request or tunnel, once.
+func (p *Proxy) complete(state *proxyRequest, statusCode int, err error) {
+	state.once.Do(func() {
+		if err == nil && state.exceeded.Load() {
+			err = ErrQuotaExceeded
+		}
+		if p.OnComplete != nil {
+			p.OnComplete(state.r, state.client, statusCode, state.bytesIn.Load(), state.bytesOut.Load(), time.Since(state.start), err)
+		}
+	})
+}
+
+// roundTrip sends a proxied request upstream, metering its request and
+// response bodies. Wrapping the response body here rather than in a
+// response handler keeps goproxy from dropping its Content-Length.
+func (p *Proxy) roundTrip(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Response, error) {
+	state, ok := ctx.UserData.(*proxyRequest)
+	if !ok {
+		return p.proxy.Tr.RoundTrip(req)
+	}
+
+	if req.Body != nil && req.Body != http.NoBody {
+		req.Body = &meteredBody{
+			ReadCloser: req.Body,
+			count:      func(n int) error { return p.count(state, &state.bytesIn, n) },
+		}
+	}
+	resp, err := p.fetch(req, state.client)
+	if err != nil {
+		// goproxy reports no response for intercepted requests that fail
+		p.complete(state, 0, err)
+		return nil, err
+	}
+	resp.Body = &meteredBody{
+		ReadCloser: resp.Body,
+		count:      func(n int) error { return p.count(state, &state.bytesOut, n) },
+		done:       func(err error) { p.complete(state, resp.StatusCode, err) },
+	}
+	return resp, nil
+}
+
+// serveConnect dials the destination of an accepted CONNECT and relays the
+// tunnel until either side is done.
+func (p *Proxy) serveConnect(state *proxyRequest, host string, conn net.Conn) {
+	defer conn.Close()
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		host = net.JoinHostPort(host, "80")
+	}
+
+	upstream, err := p.dialTunnel(state.r, host)
+	if err != nil {
+		p.metrics.ErrorCount.Add(1)
+		conn.Write([]byte("HTTP/1.1 502 Bad Gateway\r\n\r\n"))
+		p.complete(state, http.StatusBadGateway, err)
+		return
+	}
+	defer upstream.Close()
+
+	if _, err := conn.Write([]byte("HTTP/1.0 200 Connection established\r\n\r\n")); err != nil {
+		p.complete(state, http.StatusOK, err)
+		return
+	}
+	splice(conn, p.meterTunnel(state, conn, upstream))
+	p.complete(state, http.StatusOK, nil)
+}
+
+// dialTunnel dials a tunnel destination: the addresses the egress policy
+// pinned, or else through goproxy's dialer, which honors an upstream proxy
+// from the environment.
+func (p *Proxy) dialTunnel(r *http.Request, addr string) (net.Conn, error) {
+	if pinned, _ := r.Context().Value(pinnedAddrsKey{}).(*pinnedAddrs); pinned == nil && p.proxy.ConnectDial != nil {
+		return p.proxy.ConnectDial("tcp", addr)
+	}
+	return p.dialPinned(r.Context(), "tcp", addr)
+}
+
+// meterTunnel wraps the upstream connection of a tunnel to meter it. A
+// tunnel exceeding a byte quota is cut by closing both connections.
+func (p *Proxy) meterTunnel(state *proxyRequest, client, upstream net.Conn) net.Conn {
+	c := &meteredConn{Conn: upstream}
+	c.read = func(n int) error { return c.cut(client, p.count(state, &state.bytesOut, n)) }
+	c.write = func(n int) error { return c.cut(client, p.count(state, &state.bytesIn, n)) }
+	return c
+}
+
+// quotaExceeded returns a 429 response for an exhausted quota.
+func quotaExceeded(r *http.Request, reason string) *http.Response {
+	return goproxy.NewResponse(r, goproxy.ContentTypeText, http.StatusTooManyRequests, fmt.Sprintf("egress %s quota exceeded\n", reason))
+}
+
+// meteredBody counts the bytes read from a body. done, if set, is called at
+// EOF or on Close with the first read error other than EOF.
+type meteredBody struct {
+	io.ReadCloser
+	count func(n int) error
+	done  func(err error)
+	err   error
+}
+
+func (b *meteredBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if countErr := b.count(n); countErr != nil {
+		err = countErr
+	}
+	if err != nil && err != io.EOF && b.err == nil {
+		b.err = err
+	}
+	if err == io.EOF && b.done != nil {
+		b.done(b.err)
+	}
+	return n, err
+}
+
+func (b *meteredBody) Close() error {
+	err := b.ReadCloser.Close()
+	if b.done != nil {
+		b.done(b.err)
+	}
+	return err
+}
+
+// meteredConn counts the bytes read from and written to a connection.
+type meteredConn struct {
+	net.Conn
+	read  func(n int) error
+	write func(n int) error
+}
+
+func (c *meteredConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if countErr := c.read(n); countErr != nil {
+		return n, countErr
+	}
+	return n, err
+}
+
+func (c *meteredConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	if countErr := c.write(n); countErr != nil {
+		return n, countErr
+	}
+	return n, err
+}
+
+func (c *meteredConn) CloseWrite() error {
+	if tcp, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return tcp.CloseWrite()
+	}
+	return c.Conn.Close()
+}
+
+// cut closes both ends of the tunnel if err is set, and returns err.
+func (c *meteredConn) cut(peer net.Conn, err error) error {
+	if err != nil {
+		c.Conn.Close()
+		peer.Close()
+	}
+	return err
+}
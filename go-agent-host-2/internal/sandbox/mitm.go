@@ -0,0 +1,59 @@
+package sandbox
+
+import (
+	"crypto/tls"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"github.com/elazarl/goproxy"
+)
+
+// interceptedTunnel is the state goproxy hands from an intercepted CONNECT
+// to the requests decrypted from it.
+type interceptedTunnel struct {
+	client *ProxyClient
+}
+
+// interceptConnect terminates the TLS of an accepted CONNECT with a
+// certificate signed by the MITM CA, so its requests go through the request
+// handler one by one.
+func (p *Proxy) interceptConnect(ctx *goproxy.ProxyCtx, client *ProxyClient, host string) *goproxy.ConnectAction {
+	if client != nil {
+		slog.Debug("Intercepting CONNECT tunnel", "host", host, "agent_id", client.AgentID, "request_id", client.RequestID, "container", client.Container)
+	} else {
+		slog.Debug("Intercepting CONNECT tunnel", "host", host)
+	}
+	ctx.UserData = &interceptedTunnel{client: client}
+	return &goproxy.ConnectAction{
+		Action: goproxy.ConnectMitm,
+		TLSConfig: func(host string, _ *goproxy.ProxyCtx) (*tls.Config, error) {
+			return p.MITM.serverConfig(host), nil
+		},
+	}
+}
+
+// interceptedRequest pins a request decrypted from a CONNECT tunnel to the
+// tunnel's destination, so its Host header cannot reach another virtual
+// host on the same server.
+func interceptedRequest(r *http.Request) {
+	r.URL.Host = strings.TrimSuffix(r.URL.Host, ":"+defaultPort(r.URL.Scheme))
+	r.Host = r.URL.Host
+}
+
+// tunnelPath is the path tunnels are checked for: any path when their
+// requests are intercepted and checked one by one, else an opaque tunnel.
+func (p *Proxy) tunnelPath() string {
+	if p.MITM != nil {
+		return AnyPath
+	}
+	return ""
+}
+
+// requestPath returns the path of a request URL.
+func requestPath(r *http.Request) string {
+	if r.URL.Path == "" {
+		return "/"
+	}
+	return r.URL.Path
+}
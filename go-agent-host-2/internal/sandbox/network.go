@@ -6,10 +6,11 @@ import (
 	"fmt"
 	"log/slog"
 	"net"
+	"net/netip"
 	"strings"
 
 	"github.com/docker/docker/api/types/network"
-	"github.com/docker/docker/client"
+	"github.com/somnia-chain/agent-runner/internal/engine"
 )
 
 // DefaultSubnet is the default subnet for the sandbox network.
@@ -23,32 +24,52 @@ const DefaultNetworkName = "agent-sandbox"
 
 // NetworkInfo holds information about the sandbox network.
 type NetworkInfo struct {
-	Name    string
-	Subnet  string
-	Gateway string
+	Name     string
+	Subnet   string
+	Gateway  string
+	Subnet6  string // IPv6 subnet, "" if the network is IPv4 only
+	Gateway6 string // IPv6 gateway, "" if the network is IPv4 only
+	Bridge   string // Host bridge interface, "" if unknown
 }
 
 // EnsureNetwork creates or retrieves the sandbox Docker network.
 // The gateway IP is the host-side address that containers can use to reach
 // services running on the host (like the HTTP proxy).
-func EnsureNetwork(ctx context.Context, cli *client.Client, name, subnet, gateway string) (*NetworkInfo, error) {
+//
+// With subnet6 set the network is dual-stack, with gateway6 (default: the
+// first address of subnet6) as its IPv6 gateway. Otherwise IPv6 is disabled
+// on it explicitly, and an existing network with IPv6 enabled is refused, as
+// its IPv6 traffic would bypass the IPv4 firewall.
+func EnsureNetwork(ctx context.Context, cli engine.Runtime, name, subnet, gateway, subnet6, gateway6 string) (*NetworkInfo, error) {
+	if subnet6 != "" && gateway6 == "" {
+		var err error
+		if gateway6, err = firstAddress(subnet6); err != nil {
+			return nil, err
+		}
+	}
+
 	// Check if network already exists
 	nw, err := cli.NetworkInspect(ctx, name, network.InspectOptions{})
 	if err == nil {
 		// Network exists, validate it has proper IPAM config
-		if len(nw.IPAM.Config) == 0 || nw.IPAM.Config[0].Subnet == "" || nw.IPAM.Config[0].Gateway == "" {
-			return nil, fmt.Errorf("network %q exists but missing IPv4 subnet/gateway in IPAM config", name)
+		info, err := networkInfo(nw)
+		if err != nil {
+			return nil, fmt.Errorf("network %q exists but %w", name, err)
+		}
+		switch {
+		case subnet6 == "" && nw.EnableIPv6:
+			return nil, fmt.Errorf("network %q exists with IPv6 enabled; configure an IPv6 subnet to firewall it, or remove the network to recreate it IPv4 only", name)
+		case subnet6 != "" && (!nw.EnableIPv6 || info.Subnet6 == ""):
+			return nil, fmt.Errorf("network %q exists without IPv6; remove it to recreate it dual-stack", name)
 		}
 		slog.Info("Using existing sandbox network",
 			"name", name,
-			"subnet", nw.IPAM.Config[0].Subnet,
-			"gateway", nw.IPAM.Config[0].Gateway,
+			"subnet", info.Subnet,
+			"gateway", info.Gateway,
+			"subnet6", info.Subnet6,
+			"gateway6", info.Gateway6,
 		)
-		return &NetworkInfo{
-			Name:    name,
-			Subnet:  nw.IPAM.Config[0].Subnet,
-			Gateway: nw.IPAM.Config[0].Gateway,
-		}, nil
+		return info, nil
 	}
 
 	// Create network with deterministic IPAM so the host gateway IP is stable
@@ -56,15 +77,21 @@ func EnsureNetwork(ctx context.Context, cli *client.Client, name, subnet, gatewa
 		"name", name,
 		"subnet", subnet,
 		"gateway", gateway,
+		"subnet6", subnet6,
+		"gateway6", gateway6,
 	)
 
+	ipamConfig := []network.IPAMConfig{{Subnet: subnet, Gateway: gateway}}
+	if subnet6 != "" {
+		ipamConfig = append(ipamConfig, network.IPAMConfig{Subnet: subnet6, Gateway: gateway6})
+	}
+	enableIPv6 := subnet6 != ""
 	_, err = cli.NetworkCreate(ctx, name, network.CreateOptions{
-		Driver:   "bridge",
-		Internal: false, // Keep false; we enforce egress with firewall
+		Driver:     "bridge",
+		Internal:   false, // Keep false; we enforce egress with firewall
+		EnableIPv6: &enableIPv6,
 		IPAM: &network.IPAM{
-			Config: []network.IPAMConfig{
-				{Subnet: subnet, Gateway: gateway},
-			},
+			Config: ipamConfig,
 		},
 		Options: map[string]string{
 			"com.docker.network.bridge.enable_ip_masquerade": "true",
@@ -80,21 +107,63 @@ func EnsureNetwork(ctx context.Context, cli *client.Client, name, subnet, gatewa
 		return nil, fmt.Errorf("failed to inspect created network: %w", err)
 	}
 
-	if len(nw.IPAM.Config) == 0 || nw.IPAM.Config[0].Subnet == "" || nw.IPAM.Config[0].Gateway == "" {
-		return nil, fmt.Errorf("created network %q missing IPv4 subnet/gateway in IPAM config", name)
+	info, err := networkInfo(nw)
+	if err != nil {
+		return nil, fmt.Errorf("created network %q %w", name, err)
+	}
+	if nw.EnableIPv6 != enableIPv6 || (enableIPv6 && info.Subnet6 == "") {
+		return nil, fmt.Errorf("created network %q does not match the requested IPv6 configuration (enable_ipv6=%t)", name, enableIPv6)
 	}
 
 	slog.Info("Created sandbox network",
 		"name", name,
-		"subnet", nw.IPAM.Config[0].Subnet,
-		"gateway", nw.IPAM.Config[0].Gateway,
+		"subnet", info.Subnet,
+		"gateway", info.Gateway,
+		"subnet6", info.Subnet6,
+		"gateway6", info.Gateway6,
 	)
+	return info, nil
+}
 
-	return &NetworkInfo{
-		Name:    name,
-		Subnet:  nw.IPAM.Config[0].Subnet,
-		Gateway: nw.IPAM.Config[0].Gateway,
-	}, nil
+// networkInfo reads the subnets, gateways and bridge of a network. It fails
+// if the network has no IPv4 subnet and gateway.
+func networkInfo(nw network.Inspect) (*NetworkInfo, error) {
+	info := &NetworkInfo{Name: nw.Name}
+	for _, config := range nw.IPAM.Config {
+		prefix, err := netip.ParsePrefix(config.Subnet)
+		if err != nil {
+			continue
+		}
+		if prefix.Addr().Is4() {
+			if info.Subnet == "" {
+				info.Subnet, info.Gateway = config.Subnet, config.Gateway
+			}
+		} else if info.Subnet6 == "" {
+			info.Subnet6, info.Gateway6 = config.Subnet, config.Gateway
+		}
+	}
+	if info.Subnet == "" || info.Gateway == "" {
+		return nil, fmt.Errorf("missing IPv4 subnet/gateway in IPAM config")
+	}
+	if info.Subnet6 != "" && info.Gateway6 == "" {
+		return nil, fmt.Errorf("missing IPv6 gateway in IPAM config")
+	}
+
+	info.Bridge = nw.Options["com.docker.network.bridge.name"]
+	if info.Bridge == "" && nw.Driver == "bridge" && len(nw.ID) >= 12 {
+		info.Bridge = "br-" + nw.ID[:12]
+	}
+	return info, nil
+}
+
+// firstAddress returns the first host address of a subnet, its conventional
+// gateway.
+func firstAddress(subnet string) (string, error) {
+	prefix, err := netip.ParsePrefix(subnet)
+	if err != nil {
+		return "", fmt.Errorf("invalid subnet %q: %w", subnet, err)
+	}
+	return prefix.Masked().Addr().Next().String(), nil
 }
 
 // AssertGatewayIPOnHost verifies that the gateway IP is assigned to a host interface.
@@ -130,7 +199,7 @@ func AssertGatewayIPOnHost(gateway string) error {
 }
 
 // RemoveNetwork removes the sandbox network if it exists.
-func RemoveNetwork(ctx context.Context, cli *client.Client, name string) error {
+func RemoveNetwork(ctx context.Context, cli engine.Runtime, name string) error {
 	err := cli.NetworkRemove(ctx, name)
 	if err != nil {
 		// Ignore "not found" errors
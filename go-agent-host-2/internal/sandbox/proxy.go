@@ -3,10 +3,12 @@ package sandbox
 
 import (
 	"context"
+	"crypto/tls"
 	"fmt"
 	"log/slog"
 	"net"
 	"net/http"
+	"strconv"
 	"sync/atomic"
 	"time"
 
@@ -15,9 +17,11 @@ import (
 
 // ProxyMetrics holds metrics for proxy usage.
 type ProxyMetrics struct {
-	RequestCount atomic.Int64
-	ConnectCount atomic.Int64
-	ErrorCount   atomic.Int64
+	RequestCount   atomic.Int64
+	ConnectCount   atomic.Int64
+	ErrorCount     atomic.Int64
+	BlockedCount   atomic.Int64
+	ThrottledCount atomic.Int64
 }
 
 // Proxy is an HTTP/HTTPS forward proxy for sandbox containers.
@@ -28,12 +32,58 @@ type Proxy struct {
 	proxy      *goproxy.ProxyHttpServer
 	metrics    *ProxyMetrics
 
-	// Optional hooks for authorization and metering
+	// ListenAddr6 is an additional address on the IPv6 gateway of a
+	// dual-stack sandbox network ("" = IPv4 only).
+	ListenAddr6 string
+
+	// TransparentAddr is where connections the firewall redirects from ports
+	// 80 and 443 are accepted ("" = transparent mode disabled), and
+	// TransparentAddr6 its IPv6 counterpart.
+	TransparentAddr  string
+	TransparentAddr6 string
+	transparent      *http.Server
+
+	// Optional hooks for authorization and metering. ClientFunc identifies
+	// the agent and request behind a proxy request; the client is nil when
+	// unknown. OnComplete is called when a request or tunnel is done, with
+	// the body or tunnel bytes read from the agent (bytesIn) and written to
+	// it (bytesOut).
 	AuthFunc   func(r *http.Request) error
-	OnRequest  func(r *http.Request)
-	OnComplete func(r *http.Request, statusCode int, bytesIn, bytesOut int64, duration time.Duration, err error)
+	ClientFunc func(r *http.Request) *ProxyClient
+	OnRequest  func(r *http.Request, client *ProxyClient)
+	OnComplete func(r *http.Request, client *ProxyClient, statusCode int, bytesIn, bytesOut int64, duration time.Duration, err error)
+
+	// Optional egress policy (nil = every destination is allowed). OnBlocked
+	// is called for each blocked request.
+	Egress    *EgressPolicy
+	OnBlocked func(r *http.Request, client *ProxyClient, host string, decision EgressDecision)
+
+	// Optional request and byte quotas (nil = unlimited). Requests over
+	// quota are refused with 429 and transfers exceeding a byte quota are
+	// cut; OnThrottled is called for each.
+	Quotas      *Quotas
+	OnThrottled func(r *http.Request, client *ProxyClient, reason string)
+
+	// Optional record/replay cache for HTTP requests attributed to an agent
+	// request (nil = disabled). OnCache is called with each outcome.
+	Cache   *EgressCache
+	OnCache func(r *http.Request, client *ProxyClient, outcome string)
+
+	// Optional CA for intercepting HTTPS (nil = HTTPS tunnels are opaque).
+	// Intercepted requests are handled like HTTP requests: checked against
+	// path rules, metered per request and cached.
+	MITM *CA
+}
+
+// pinnedAddrs are the addresses a request's destination was checked against.
+// The proxy dials only those, so a second DNS answer cannot bypass the policy.
+type pinnedAddrs struct {
+	host string
+	ips  []net.IP
 }
 
+type pinnedAddrsKey struct{}
+
 // NewProxy creates a new HTTP/HTTPS proxy.
 // listenAddr should be the sandbox network gateway IP and port, e.g., "172.30.0.1:3128"
 func NewProxy(listenAddr string) *Proxy {
@@ -54,48 +104,69 @@ func (p *Proxy) Metrics() *ProxyMetrics {
 
 // Start starts the proxy server.
 func (p *Proxy) Start() error {
-	slog.Info("Starting HTTP/HTTPS proxy", "addr", p.listenAddr)
+	slog.Info("Starting HTTP/HTTPS proxy", "addr", p.listenAddr, "addr6", p.ListenAddr6)
 
 	// Set up request handler for auth and metering
 	p.proxy.OnRequest().DoFunc(func(r *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
 		p.metrics.RequestCount.Add(1)
 
-		// Auth check
-		if p.AuthFunc != nil {
-			if err := p.AuthFunc(r); err != nil {
-				p.metrics.ErrorCount.Add(1)
-				return r, goproxy.NewResponse(r, goproxy.ContentTypeText, http.StatusProxyAuthRequired, "proxy auth required\n")
+		// Requests decrypted from a CONNECT tunnel belong to its client
+		var client *ProxyClient
+		if tunnel, ok := ctx.UserData.(*interceptedTunnel); ok {
+			client = tunnel.client
+			interceptedRequest(r)
+		} else {
+			// Auth check (intercepted requests carry no proxy credentials)
+			if p.AuthFunc != nil && !isTransparent(r) {
+				if err := p.AuthFunc(r); err != nil {
+					p.metrics.ErrorCount.Add(1)
+					return r, proxyAuthRequired(r)
+				}
 			}
+			client = p.identify(r)
+		}
+
+		// Egress policy check
+		r, status, msg := p.checkEgress(r, client, r.URL.Host, defaultPort(r.URL.Scheme), requestPath(r))
+		if status != 0 {
+			return r, goproxy.NewResponse(r, goproxy.ContentTypeText, status, msg)
+		}
+
+		// Quota check
+		if reason := p.admit(r, client); reason != "" {
+			return r, quotaExceeded(r, reason)
 		}
 
 		// Request hook
 		if p.OnRequest != nil {
-			p.OnRequest(r)
+			p.OnRequest(r, client)
 		}
 
-		// Store start time in context for metering
-		ctx.UserData = time.Now()
+		// Meter the request and response bodies
+		ctx.UserData = newProxyRequest(r, client)
+		ctx.RoundTripper = goproxy.RoundTripperFunc(p.roundTrip)
 		return r, nil
 	})
 
-	// Set up response handler for metering
+	// Set up response handler for requests that got no upstream response;
+	// the others complete when their response body is closed
 	p.proxy.OnResponse().DoFunc(func(resp *http.Response, ctx *goproxy.ProxyCtx) *http.Response {
-		if p.OnComplete != nil && ctx.Req != nil {
-			start, ok := ctx.UserData.(time.Time)
-			if !ok {
-				start = time.Now()
-			}
-			duration := time.Since(start)
-
-			statusCode := 0
-			if resp != nil {
-				statusCode = resp.StatusCode
+		state, ok := ctx.UserData.(*proxyRequest)
+		if ok && resp != nil {
+			return resp
+		}
+		if !ok {
+			// Refused by the request handler
+			if ctx.Req == nil {
+				return resp
 			}
-
-			// Note: accurate byte counting for response bodies requires wrapping resp.Body
-			// For now we report 0 for bytes - can be enhanced if needed
-			p.OnComplete(ctx.Req, statusCode, ctx.Req.ContentLength, 0, duration, ctx.Error)
+			state = newProxyRequest(ctx.Req, nil)
+		}
+		statusCode := 0
+		if resp != nil {
+			statusCode = resp.StatusCode
 		}
+		p.complete(state, statusCode, ctx.Error)
 		return resp
 	})
 
@@ -107,14 +178,60 @@ func (p *Proxy) Start() error {
 		if p.AuthFunc != nil && ctx.Req != nil {
 			if err := p.AuthFunc(ctx.Req); err != nil {
 				p.metrics.ErrorCount.Add(1)
+				ctx.Resp = proxyAuthRequired(ctx.Req)
 				return goproxy.RejectConnect, host
 			}
 		}
 
-		slog.Debug("CONNECT tunnel", "host", host)
-		return goproxy.OkConnect, host
+		var client *ProxyClient
+		if ctx.Req != nil {
+			client = p.identify(ctx.Req)
+
+			// Egress policy check, per request once intercepted
+			req, status, msg := p.checkEgress(ctx.Req, client, host, "80", p.tunnelPath())
+			if status != 0 {
+				ctx.Resp = goproxy.NewResponse(ctx.Req, goproxy.ContentTypeText, status, msg)
+				return goproxy.RejectConnect, host
+			}
+			ctx.Req = req
+
+			// Intercepted requests are counted and metered one by one
+			if p.MITM != nil {
+				return p.interceptConnect(ctx, client, host), host
+			}
+
+			// Quota check
+			if reason := p.admit(ctx.Req, client); reason != "" {
+				ctx.Resp = quotaExceeded(ctx.Req, reason)
+				return goproxy.RejectConnect, host
+			}
+		}
+
+		if client != nil {
+			slog.Debug("CONNECT tunnel", "host", host, "agent_id", client.AgentID, "request_id", client.RequestID, "container", client.Container)
+		} else {
+			slog.Debug("CONNECT tunnel", "host", host)
+		}
+
+		// Relay the tunnel ourselves to meter it
+		state := newProxyRequest(ctx.Req, client)
+		return &goproxy.ConnectAction{
+			Action: goproxy.ConnectHijack,
+			Hijack: func(_ *http.Request, conn net.Conn, _ *goproxy.ProxyCtx) {
+				p.serveConnect(state, host, conn)
+			},
+		}, host
 	})
 
+	// Verify upstream certificates, which agents cannot check themselves
+	// behind interception
+	p.proxy.Tr.TLSClientConfig = &tls.Config{}
+
+	// Dial only the addresses the egress policy checked
+	if p.Egress != nil {
+		p.proxy.Tr.DialContext = p.dialPinned
+	}
+
 	p.server = &http.Server{
 		Addr:         p.listenAddr,
 		Handler:      p.proxy,
@@ -123,25 +240,144 @@ func (p *Proxy) Start() error {
 		IdleTimeout:  120 * time.Second,
 	}
 
-	listener, err := net.Listen("tcp", p.listenAddr)
+	listeners, err := listenAll(p.listenAddr, p.ListenAddr6)
 	if err != nil {
-		return fmt.Errorf("failed to listen on %s: %w", p.listenAddr, err)
+		return err
+	}
+
+	for _, listener := range listeners {
+		go func() {
+			if err := p.server.Serve(listener); err != nil && err != http.ErrServerClosed {
+				slog.Error("Proxy server error", "error", err)
+			}
+		}()
 	}
 
-	go func() {
-		if err := p.server.Serve(listener); err != nil && err != http.ErrServerClosed {
-			slog.Error("Proxy server error", "error", err)
+	if p.TransparentAddr != "" {
+		if err := p.startTransparent(); err != nil {
+			p.server.Close()
+			return err
 		}
-	}()
+	}
 
 	return nil
 }
 
+// checkEgress applies the egress policy to a request for reqPath on hostport
+// (see EgressPolicy.CheckRequest). It returns the request with the checked
+// addresses pinned, or a non-zero HTTP status and message if the request is
+// refused.
+func (p *Proxy) checkEgress(r *http.Request, client *ProxyClient, hostport, port, reqPath string) (*http.Request, int, string) {
+	if p.Egress == nil {
+		return r, 0, ""
+	}
+
+	host := hostport
+	if h, hp, err := net.SplitHostPort(hostport); err == nil {
+		host, port = h, hp
+	}
+	portNum, _ := strconv.Atoi(port)
+
+	var ips []net.IP
+	if ip := net.ParseIP(host); ip != nil {
+		ips = []net.IP{ip}
+	} else {
+		addrs, err := net.DefaultResolver.LookupIPAddr(r.Context(), host)
+		if err != nil || len(addrs) == 0 {
+			p.metrics.ErrorCount.Add(1)
+			return r, http.StatusBadGateway, fmt.Sprintf("cannot resolve %s\n", host)
+		}
+		for _, addr := range addrs {
+			ips = append(ips, addr.IP)
+		}
+	}
+
+	decision := p.Egress.CheckRequest(client, host, portNum, reqPath, ips)
+	if !decision.Allowed {
+		p.metrics.BlockedCount.Add(1)
+		if p.OnBlocked != nil {
+			p.OnBlocked(r, client, net.JoinHostPort(host, port), decision)
+		}
+		return r, http.StatusForbidden, fmt.Sprintf("egress to %s is blocked by policy\n", host)
+	}
+
+	pinned := &pinnedAddrs{host: host, ips: ips}
+	return r.WithContext(context.WithValue(r.Context(), pinnedAddrsKey{}, pinned)), 0, ""
+}
+
+// identify returns the client behind a request, or nil if unknown.
+func (p *Proxy) identify(r *http.Request) *ProxyClient {
+	if p.ClientFunc == nil {
+		return nil
+	}
+	return p.ClientFunc(r)
+}
+
+// proxyAuthRequired returns a 407 response asking for Basic proxy credentials.
+func proxyAuthRequired(r *http.Request) *http.Response {
+	resp := goproxy.NewResponse(r, goproxy.ContentTypeText, http.StatusProxyAuthRequired, "proxy auth required\n")
+	resp.Header.Set("Proxy-Authenticate", `Basic realm="sandbox"`)
+	return resp
+}
+
+// dialPinned dials the addresses pinned by checkEgress for addr's host, or
+// addr itself for connections the policy did not check (e.g. to an upstream
+// proxy).
+func (p *Proxy) dialPinned(ctx context.Context, network, addr string) (net.Conn, error) {
+	var dialer net.Dialer
+	pinned, _ := ctx.Value(pinnedAddrsKey{}).(*pinnedAddrs)
+	host, port, err := net.SplitHostPort(addr)
+	if pinned == nil || err != nil || host != pinned.host {
+		return dialer.DialContext(ctx, network, addr)
+	}
+
+	for _, ip := range pinned.ips {
+		var conn net.Conn
+		if conn, err = dialer.DialContext(ctx, network, net.JoinHostPort(ip.String(), port)); err == nil {
+			return conn, nil
+		}
+	}
+	return nil, err
+}
+
+// defaultPort returns the port of a URL scheme.
+func defaultPort(scheme string) string {
+	if scheme == "https" {
+		return "443"
+	}
+	return "80"
+}
+
 // Stop gracefully stops the proxy server.
 func (p *Proxy) Stop(ctx context.Context) error {
 	if p.server == nil {
 		return nil
 	}
 	slog.Info("Stopping HTTP/HTTPS proxy")
+	if p.transparent != nil {
+		if err := p.transparent.Shutdown(ctx); err != nil {
+			return err
+		}
+	}
 	return p.server.Shutdown(ctx)
 }
+
+// listenAll listens on TCP on each non-empty address, closing the listeners
+// already opened if one fails.
+func listenAll(addrs ...string) ([]net.Listener, error) {
+	var listeners []net.Listener
+	for _, addr := range addrs {
+		if addr == "" {
+			continue
+		}
+		listener, err := net.Listen("tcp", addr)
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, fmt.Errorf("failed to listen on %s: %w", addr, err)
+		}
+		listeners = append(listeners, listener)
+	}
+	return listeners, nil
+}
@@ -0,0 +1,164 @@
+package sandbox
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// Quotas a proxy request can exhaust.
+const (
+	QuotaRequests = "requests" // Request count quota
+	QuotaBytes    = "bytes"    // Byte quota
+)
+
+// ErrQuotaExceeded ends transfers that exhaust a byte quota.
+var ErrQuotaExceeded = errors.New("egress quota exceeded")
+
+// QuotaLimits bounds the proxy traffic of an agent or request. Bytes count
+// request and response bodies and tunneled data in both directions.
+type QuotaLimits struct {
+	Requests int64 // 0 = unlimited
+	Bytes    int64 // 0 = unlimited
+}
+
+// enabled reports whether any limit is set.
+func (l QuotaLimits) enabled() bool {
+	return l.Requests > 0 || l.Bytes > 0
+}
+
+// Quotas enforces sandbox proxy limits per agent, over a fixed window, and
+// per agent request. Requests and tunnels by unidentified clients are not
+// limited.
+type Quotas struct {
+	agent   QuotaLimits
+	request QuotaLimits
+	window  time.Duration
+
+	mu        sync.Mutex
+	agents    map[string]*quotaUsage // Keyed by agent URL
+	requests  map[string]*quotaUsage // Keyed by request ID
+	lastSweep time.Time
+}
+
+// quotaUsage is the traffic counted against a quota.
+type quotaUsage struct {
+	start    time.Time // Start of the agent window
+	seen     time.Time // Last use, to expire finished requests
+	requests int64
+	bytes    int64
+}
+
+// NewQuotas creates proxy quotas. Agent limits apply per window, request
+// limits to each agent request as a whole.
+func NewQuotas(agent, request QuotaLimits, window time.Duration) *Quotas {
+	return &Quotas{
+		agent:    agent,
+		request:  request,
+		window:   window,
+		agents:   make(map[string]*quotaUsage),
+		requests: make(map[string]*quotaUsage),
+	}
+}
+
+// Admit counts a new proxy request or tunnel by client. It returns the
+// exhausted quota, or "" if the request is admitted.
+func (q *Quotas) Admit(client *ProxyClient) string {
+	if client == nil {
+		return ""
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	agent, request := q.usage(client)
+	for _, u := range []struct {
+		usage  *quotaUsage
+		limits QuotaLimits
+	}{{agent, q.agent}, {request, q.request}} {
+		if u.usage == nil {
+			continue
+		}
+		if u.limits.Requests > 0 && u.usage.requests >= u.limits.Requests {
+			return QuotaRequests
+		}
+		if u.limits.Bytes > 0 && u.usage.bytes >= u.limits.Bytes {
+			return QuotaBytes
+		}
+	}
+
+	if agent != nil {
+		agent.requests++
+	}
+	if request != nil {
+		request.requests++
+	}
+	return ""
+}
+
+// Charge counts n bytes transferred by client. It returns QuotaBytes once a
+// byte limit is exceeded.
+func (q *Quotas) Charge(client *ProxyClient, n int64) string {
+	if client == nil || n == 0 {
+		return ""
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	agent, request := q.usage(client)
+	exceeded := ""
+	if agent != nil {
+		agent.bytes += n
+		if q.agent.Bytes > 0 && agent.bytes > q.agent.Bytes {
+			exceeded = QuotaBytes
+		}
+	}
+	if request != nil {
+		request.bytes += n
+		if q.request.Bytes > 0 && request.bytes > q.request.Bytes {
+			exceeded = QuotaBytes
+		}
+	}
+	return exceeded
+}
+
+// usage returns the agent and request usage of client, nil for quotas that
+// do not apply. Callers hold q.mu.
+func (q *Quotas) usage(client *ProxyClient) (agent, request *quotaUsage) {
+	now := time.Now()
+	if now.Sub(q.lastSweep) > time.Minute {
+		q.sweep(now)
+	}
+
+	if q.agent.enabled() && client.AgentURL != "" {
+		agent = q.agents[client.AgentURL]
+		if agent == nil || now.Sub(agent.start) >= q.window {
+			agent = &quotaUsage{start: now}
+			q.agents[client.AgentURL] = agent
+		}
+		agent.seen = now
+	}
+	if q.request.enabled() && client.RequestID != "" {
+		request = q.requests[client.RequestID]
+		if request == nil {
+			request = &quotaUsage{start: now}
+			q.requests[client.RequestID] = request
+		}
+		request.seen = now
+	}
+	return agent, request
+}
+
+// sweep drops expired agent windows and requests idle for a window.
+func (q *Quotas) sweep(now time.Time) {
+	q.lastSweep = now
+	for key, usage := range q.agents {
+		if now.Sub(usage.start) >= q.window {
+			delete(q.agents, key)
+		}
+	}
+	for key, usage := range q.requests {
+		if now.Sub(usage.seen) >= q.window {
+			delete(q.requests, key)
+		}
+	}
+}
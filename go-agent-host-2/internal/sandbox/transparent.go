@@ -0,0 +1,283 @@
+package sandbox
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// helloTimeout bounds how long a redirected connection may take to send its
+// TLS ClientHello or HTTP request line.
+const helloTimeout = 10 * time.Second
+
+// transparentKey marks requests that arrived on the transparent listener.
+type transparentKey struct{}
+
+// isTransparent reports whether a request was intercepted by the firewall
+// rather than sent to the proxy by the agent.
+func isTransparent(r *http.Request) bool {
+	transparent, _ := r.Context().Value(transparentKey{}).(bool)
+	return transparent
+}
+
+// startTransparent listens for sandbox connections the firewall redirected
+// from ports 80 and 443. TLS connections are tunneled to their SNI server
+// name, or intercepted with the MITM CA; plain HTTP requests are proxied by
+// their Host header. All go through the same client identification and
+// egress policy as proxied requests.
+func (p *Proxy) startTransparent() error {
+	listeners, err := listenAll(p.TransparentAddr, p.TransparentAddr6)
+	if err != nil {
+		return err
+	}
+	slog.Info("Starting transparent proxy", "addr", p.TransparentAddr, "addr6", p.TransparentAddr6)
+
+	httpConns := newConnListener(listeners[0].Addr())
+	p.transparent = &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Host == "" {
+				http.Error(w, "missing Host header", http.StatusBadRequest)
+				return
+			}
+			r.URL.Scheme = "http"
+			if r.TLS != nil {
+				r.URL.Scheme = "https"
+			}
+			r.URL.Host = r.Host
+			p.proxy.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), transparentKey{}, true)))
+		}),
+		ReadTimeout:  60 * time.Second,
+		WriteTimeout: 60 * time.Second,
+		IdleTimeout:  120 * time.Second,
+	}
+	p.transparent.RegisterOnShutdown(func() {
+		for _, listener := range listeners {
+			listener.Close()
+		}
+	})
+
+	go func() {
+		if err := p.transparent.Serve(httpConns); err != nil && err != http.ErrServerClosed {
+			slog.Error("Transparent proxy server error", "error", err)
+		}
+	}()
+	var accepting sync.WaitGroup
+	for _, listener := range listeners {
+		accepting.Add(1)
+		go func() {
+			defer accepting.Done()
+			for {
+				conn, err := listener.Accept()
+				if err != nil {
+					if !errors.Is(err, net.ErrClosed) {
+						slog.Error("Transparent proxy accept error", "error", err)
+					}
+					return
+				}
+				go p.handleTransparent(conn, httpConns)
+			}
+		}()
+	}
+	go func() {
+		accepting.Wait()
+		httpConns.Close()
+	}()
+	return nil
+}
+
+// handleTransparent tunnels a redirected TLS connection, or hands a plain
+// HTTP or intercepted TLS connection to the transparent HTTP server.
+func (p *Proxy) handleTransparent(conn net.Conn, httpConns *connListener) {
+	conn.SetReadDeadline(time.Now().Add(helloTimeout))
+	br := bufio.NewReader(conn)
+	first, err := br.Peek(1)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+	peeked := &peekedConn{Conn: conn, r: br}
+
+	// 0x16 is the TLS handshake record type
+	if first[0] != 0x16 {
+		httpConns.push(peeked)
+		return
+	}
+	p.metrics.ConnectCount.Add(1)
+
+	// Read the ClientHello for its server name, keeping the bytes to replay
+	var hello bytes.Buffer
+	conn.SetReadDeadline(time.Now().Add(helloTimeout))
+	serverName, err := readServerName(io.TeeReader(br, &hello))
+	conn.SetReadDeadline(time.Time{})
+	if err != nil || serverName == "" {
+		p.metrics.ErrorCount.Add(1)
+		slog.Debug("Transparent TLS connection without server name", "source", conn.RemoteAddr(), "error", err)
+		conn.Close()
+		return
+	}
+
+	hostport := net.JoinHostPort(serverName, "443")
+	r := (&http.Request{
+		Method:     http.MethodConnect,
+		Host:       hostport,
+		Header:     make(http.Header),
+		RemoteAddr: conn.RemoteAddr().String(),
+	}).WithContext(context.WithValue(context.Background(), transparentKey{}, true))
+	client := p.identify(r)
+
+	r, status, _ := p.checkEgress(r, client, hostport, "443", p.tunnelPath())
+	if status != 0 {
+		conn.Close()
+		return
+	}
+
+	// Terminate TLS and serve the requests like plain HTTP ones
+	if p.MITM != nil {
+		replayed := &peekedConn{Conn: conn, r: bufio.NewReader(io.MultiReader(&hello, br))}
+		httpConns.push(tls.Server(replayed, p.MITM.serverConfig(hostport)))
+		return
+	}
+	defer conn.Close()
+
+	if p.admit(r, client) != "" {
+		return
+	}
+	state := newProxyRequest(r, client)
+
+	upstream, err := p.dialPinned(r.Context(), "tcp", hostport)
+	if err != nil {
+		p.metrics.ErrorCount.Add(1)
+		slog.Debug("Transparent TLS dial failed", "host", hostport, "error", err)
+		p.complete(state, http.StatusBadGateway, err)
+		return
+	}
+	defer upstream.Close()
+
+	if client != nil {
+		slog.Debug("Transparent TLS tunnel", "host", hostport, "agent_id", client.AgentID, "request_id", client.RequestID, "container", client.Container)
+	} else {
+		slog.Debug("Transparent TLS tunnel", "host", hostport)
+	}
+	metered := p.meterTunnel(state, peeked, upstream)
+	if _, err := metered.Write(hello.Bytes()); err != nil {
+		p.complete(state, http.StatusOK, err)
+		return
+	}
+	splice(peeked, metered)
+	p.complete(state, http.StatusOK, nil)
+}
+
+// errHelloRead stops the TLS handshake once the ClientHello has been parsed.
+var errHelloRead = errors.New("client hello read")
+
+// readServerName parses a TLS ClientHello from r and returns its SNI.
+func readServerName(r io.Reader) (string, error) {
+	var serverName string
+	err := tls.Server(readOnlyConn{r: r}, &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			serverName = hello.ServerName
+			return nil, errHelloRead
+		},
+	}).Handshake()
+	if errors.Is(err, errHelloRead) {
+		err = nil
+	}
+	return serverName, err
+}
+
+// splice copies between two connections until both directions are done.
+func splice(a, b net.Conn) {
+	var wg sync.WaitGroup
+	wg.Add(2)
+	pipe := func(dst, src net.Conn) {
+		defer wg.Done()
+		io.Copy(dst, src)
+		if tcp, ok := dst.(interface{ CloseWrite() error }); ok {
+			tcp.CloseWrite()
+		} else {
+			dst.Close()
+		}
+	}
+	go pipe(a, b)
+	go pipe(b, a)
+	wg.Wait()
+}
+
+// peekedConn is a connection whose first bytes were read into a buffer.
+type peekedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *peekedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (c *peekedConn) CloseWrite() error {
+	if tcp, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return tcp.CloseWrite()
+	}
+	return c.Conn.Close()
+}
+
+// readOnlyConn feeds a reader to crypto/tls and discards its replies.
+type readOnlyConn struct {
+	r io.Reader
+}
+
+func (c readOnlyConn) Read(b []byte) (int, error)         { return c.r.Read(b) }
+func (c readOnlyConn) Write(b []byte) (int, error)        { return 0, io.ErrClosedPipe }
+func (c readOnlyConn) Close() error                       { return nil }
+func (c readOnlyConn) LocalAddr() net.Addr                { return nil }
+func (c readOnlyConn) RemoteAddr() net.Addr               { return nil }
+func (c readOnlyConn) SetDeadline(t time.Time) error      { return nil }
+func (c readOnlyConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c readOnlyConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// connListener is a net.Listener fed with already accepted connections.
+type connListener struct {
+	addr  net.Addr
+	conns chan net.Conn
+	done  chan struct{}
+	once  sync.Once
+}
+
+func newConnListener(addr net.Addr) *connListener {
+	return &connListener{addr: addr, conns: make(chan net.Conn), done: make(chan struct{})}
+}
+
+// push hands a connection to Accept, closing it if the listener is closed.
+func (l *connListener) push(conn net.Conn) {
+	select {
+	case l.conns <- conn:
+	case <-l.done:
+		conn.Close()
+	}
+}
+
+func (l *connListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *connListener) Close() error {
+	l.once.Do(func() { close(l.done) })
+	return nil
+}
+
+func (l *connListener) Addr() net.Addr {
+	return l.addr
+}
@@ -61,6 +61,34 @@ const SomniaAgentsABI = `[
 		"stateMutability": "view",
 		"type": "function"
 	},
+	{
+		"inputs": [{"internalType": "uint256", "name": "requestId", "type": "uint256"}],
+		"name": "getResponses",
+		"outputs": [
+			{
+				"components": [
+					{"internalType": "address", "name": "validator", "type": "address"},
+					{"internalType": "bytes", "name": "result", "type": "bytes"},
+					{"internalType": "enum ResponseStatus", "name": "status", "type": "uint8"},
+					{"internalType": "uint256", "name": "receipt", "type": "uint256"},
+					{"internalType": "uint256", "name": "cost", "type": "uint256"},
+					{"internalType": "uint256", "name": "timestamp", "type": "uint256"}
+				],
+				"internalType": "struct Response[]",
+				"name": "",
+				"type": "tuple[]"
+			}
+		],
+		"stateMutability": "view",
+		"type": "function"
+	},
+	{
+		"inputs": [],
+		"name": "requestTimeout",
+		"outputs": [{"internalType": "uint256", "name": "", "type": "uint256"}],
+		"stateMutability": "view",
+		"type": "function"
+	},
 	{
 		"inputs": [],
 		"name": "committee",
@@ -79,6 +107,46 @@ type RequestCreatedEvent struct {
 	Subcommittee []common.Address
 }
 
+// Response statuses, matching the contract's ResponseStatus enum.
+const (
+	StatusPending  uint8 = 0
+	StatusSuccess  uint8 = 1
+	StatusFailed   uint8 = 2
+	StatusTimedOut uint8 = 3
+)
+
+// StatusName returns the name of a ResponseStatus value.
+func StatusName(status uint8) string {
+	switch status {
+	case StatusPending:
+		return "pending"
+	case StatusSuccess:
+		return "success"
+	case StatusFailed:
+		return "failed"
+	case StatusTimedOut:
+		return "timed_out"
+	default:
+		return "unknown"
+	}
+}
+
+// RequestFinalizedEvent represents the RequestFinalized event from the contract.
+type RequestFinalizedEvent struct {
+	RequestId *big.Int
+	Status    uint8
+}
+
+// Response is a validator's response to a request, as stored by the contract.
+type Response struct {
+	Validator common.Address
+	Result    []byte
+	Status    uint8
+	Receipt   *big.Int
+	Cost      *big.Int
+	Timestamp *big.Int
+}
+
 // SomniaAgents is a Go binding for the SomniaAgents smart contract.
 type SomniaAgents struct {
 	SomniaAgentsCaller
@@ -162,6 +230,27 @@ func (c *SomniaAgentsCaller) Committee(opts *bind.CallOpts) (common.Address, err
 	return out[0].(common.Address), nil
 }
 
+// RequestTimeout returns how long, in seconds, validators have to respond to a request.
+func (c *SomniaAgentsCaller) RequestTimeout(opts *bind.CallOpts) (*big.Int, error) {
+	var out []interface{}
+	err := c.contract.Call(opts, &out, "requestTimeout")
+	if err != nil {
+		return nil, err
+	}
+	return out[0].(*big.Int), nil
+}
+
+// GetResponses returns the responses validators submitted for a request.
+func (c *SomniaAgentsCaller) GetResponses(opts *bind.CallOpts, requestId *big.Int) ([]Response, error) {
+	var out []interface{}
+	err := c.contract.Call(opts, &out, "getResponses", requestId)
+	if err != nil {
+		return nil, err
+	}
+	responses := *abi.ConvertType(out[0], new([]Response)).(*[]Response)
+	return responses, nil
+}
+
 // SubmitResponse submits a response for a request.
 func (t *SomniaAgentsTransactor) SubmitResponse(opts *bind.TransactOpts, requestId *big.Int, result []byte, receipt *big.Int, cost *big.Int, success bool) (*types.Transaction, error) {
 	return t.contract.Transact(opts, "submitResponse", requestId, result, receipt, cost, success)
@@ -187,3 +276,21 @@ func (f *SomniaAgentsFilterer) ParseRequestCreated(log types.Log) (*RequestCreat
 
 	return event, nil
 }
+
+// ParseRequestFinalized parses a RequestFinalized event from a log.
+func (f *SomniaAgentsFilterer) ParseRequestFinalized(log types.Log) (*RequestFinalizedEvent, error) {
+	event := new(RequestFinalizedEvent)
+
+	if len(log.Topics) < 2 {
+		return nil, nil
+	}
+
+	event.RequestId = new(big.Int).SetBytes(log.Topics[1].Bytes())
+
+	err := f.abi.UnpackIntoInterface(event, "RequestFinalized", log.Data)
+	if err != nil {
+		return nil, err
+	}
+
+	return event, nil
+}
@@ -12,9 +12,10 @@ import (
 	"strings"
 	"time"
 
+	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/api/types/container"
 	"github.com/docker/docker/api/types/filters"
-	"github.com/docker/docker/client"
+	"github.com/somnia-chain/agent-runner/internal/engine"
 	"github.com/somnia-chain/agent-runner/internal/sandbox"
 )
 
@@ -28,8 +29,8 @@ type CheckResult struct {
 
 // Checker runs startup checks and initialization.
 type Checker struct {
-	dockerClient *client.Client
-	results      []CheckResult
+	runtime engine.Runtime
+	results []CheckResult
 }
 
 // NewChecker creates a new startup checker.
@@ -44,9 +45,9 @@ func (c *Checker) Results() []CheckResult {
 	return c.results
 }
 
-// DockerClient returns the Docker client after CheckDocker has been called.
-func (c *Checker) DockerClient() *client.Client {
-	return c.dockerClient
+// Runtime returns the container engine after CheckContainerEngine has been called.
+func (c *Checker) Runtime() engine.Runtime {
+	return c.runtime
 }
 
 // addResult adds a check result and logs it.
@@ -70,21 +71,35 @@ func (c *Checker) addResult(name string, passed bool, message string, err error)
 	}
 }
 
-// CheckDocker verifies Docker daemon is running and accessible.
-func (c *Checker) CheckDocker(ctx context.Context) error {
-	const checkName = "Docker"
+// CheckContainerEngine connects to the container engine (docker or podman)
+// at host, or at the engine's default address if host is empty, and verifies
+// it is running.
+func (c *Checker) CheckContainerEngine(ctx context.Context, name, host string) error {
+	const checkName = "Container Engine"
 
-	slog.Info("Running startup check", "check", checkName)
+	slog.Info("Running startup check", "check", checkName, "engine", name)
 
-	dockerClient, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	rt, err := engine.New(name, host)
 	if err != nil {
-		c.addResult(checkName, false, "Failed to create Docker client", err)
-		return fmt.Errorf("failed to create Docker client: %w", err)
+		c.addResult(checkName, false, "Failed to create container engine client", err)
+		return fmt.Errorf("failed to create container engine client: %w", err)
 	}
 
-	// Verify Docker daemon is running
-	ping, err := dockerClient.Ping(ctx)
+	// Verify the engine is running
+	ping, err := rt.Ping(ctx)
 	if err != nil {
+		rt.Close()
+		if rt.Name() == engine.Podman {
+			c.addResult(checkName, false, "Podman API service is not running", err)
+			return fmt.Errorf(`Podman API service is not running.
+
+To fix this:
+  - Rootful: Run 'sudo systemctl enable --now podman.socket'
+  - Rootless: Run 'systemctl --user enable --now podman.socket'
+  - Or point --container-host at the socket of 'podman system service'
+
+Underlying error: %w`, err)
+		}
 		c.addResult(checkName, false, "Docker daemon is not running", err)
 		return fmt.Errorf(`Docker daemon is not running.
 
@@ -101,24 +116,25 @@ If Docker is not installed:
 Underlying error: %w`, err)
 	}
 
-	c.dockerClient = dockerClient
-	c.addResult(checkName, true, fmt.Sprintf("Docker daemon running (API %s)", ping.APIVersion), nil)
+	c.runtime = rt
+	c.addResult(checkName, true, fmt.Sprintf("%s running (API %s)", rt.Name(), ping.APIVersion), nil)
 	return nil
 }
 
 // CheckSandboxNetwork ensures the sandbox network exists and is properly configured.
-func (c *Checker) CheckSandboxNetwork(ctx context.Context, networkName, subnet, gateway string) (*sandbox.NetworkInfo, error) {
+// A non-empty subnet6 makes the network dual-stack.
+func (c *Checker) CheckSandboxNetwork(ctx context.Context, networkName, subnet, gateway, subnet6, gateway6 string) (*sandbox.NetworkInfo, error) {
 	const checkName = "Sandbox Network"
 
 	slog.Info("Running startup check", "check", checkName)
 
-	if c.dockerClient == nil {
-		c.addResult(checkName, false, "Docker client not initialized", nil)
-		return nil, fmt.Errorf("Docker client not initialized - run CheckDocker first")
+	if c.runtime == nil {
+		c.addResult(checkName, false, "Container engine not initialized", nil)
+		return nil, fmt.Errorf("Container engine not initialized - run CheckContainerEngine first")
 	}
 
 	// Ensure network exists
-	netInfo, err := sandbox.EnsureNetwork(ctx, c.dockerClient, networkName, subnet, gateway)
+	netInfo, err := sandbox.EnsureNetwork(ctx, c.runtime, networkName, subnet, gateway, subnet6, gateway6)
 	if err != nil {
 		c.addResult(checkName, false, "Failed to create/verify sandbox network", err)
 		return nil, err
@@ -127,36 +143,47 @@ func (c *Checker) CheckSandboxNetwork(ctx context.Context, networkName, subnet,
 	// Give the network interface a moment to come up
 	time.Sleep(100 * time.Millisecond)
 
-	// Verify gateway IP is on host
-	if err := sandbox.AssertGatewayIPOnHost(netInfo.Gateway); err != nil {
-		// This is a warning, not a failure - some platforms (macOS) work differently
-		slog.Warn("Gateway IP not found on host interface (may be expected on some platforms)",
-			"gateway", netInfo.Gateway,
-			"error", err,
-		)
+	// Verify gateway IPs are on host
+	for _, gw := range []string{netInfo.Gateway, netInfo.Gateway6} {
+		if gw == "" {
+			continue
+		}
+		if err := sandbox.AssertGatewayIPOnHost(gw); err != nil {
+			// This is a warning, not a failure - some platforms (macOS) work differently
+			slog.Warn("Gateway IP not found on host interface (may be expected on some platforms)",
+				"gateway", gw,
+				"error", err,
+			)
+		}
 	}
 
-	c.addResult(checkName, true, fmt.Sprintf("Network %s ready (gateway %s)", netInfo.Name, netInfo.Gateway), nil)
+	msg := fmt.Sprintf("Network %s ready (gateway %s)", netInfo.Name, netInfo.Gateway)
+	if netInfo.Gateway6 != "" {
+		msg = fmt.Sprintf("Network %s ready (gateways %s, %s)", netInfo.Name, netInfo.Gateway, netInfo.Gateway6)
+	}
+	c.addResult(checkName, true, msg, nil)
 	return netInfo, nil
 }
 
 // CheckStaleContainers finds and removes any old agent containers.
+// With keepRunning set, running containers are left for the agents manager to
+// adopt and only stopped ones are removed.
 // It looks for containers with the agent-host.version-hash label.
-func (c *Checker) CheckStaleContainers(ctx context.Context) (int, error) {
+func (c *Checker) CheckStaleContainers(ctx context.Context, keepRunning bool) (int, error) {
 	const checkName = "Stale Containers"
 
 	slog.Info("Running startup check", "check", checkName)
 
-	if c.dockerClient == nil {
-		c.addResult(checkName, false, "Docker client not initialized", nil)
-		return 0, fmt.Errorf("Docker client not initialized - run CheckDocker first")
+	if c.runtime == nil {
+		c.addResult(checkName, false, "Container engine not initialized", nil)
+		return 0, fmt.Errorf("Container engine not initialized - run CheckContainerEngine first")
 	}
 
 	// Find all containers with our agent-host label
 	filterArgs := filters.NewArgs()
 	filterArgs.Add("label", "agent-host.version-hash")
 
-	containers, err := c.dockerClient.ContainerList(ctx, container.ListOptions{
+	containers, err := c.runtime.ContainerList(ctx, container.ListOptions{
 		All:     true, // Include stopped containers
 		Filters: filterArgs,
 	})
@@ -165,8 +192,15 @@ func (c *Checker) CheckStaleContainers(ctx context.Context) (int, error) {
 		return 0, fmt.Errorf("failed to list containers: %w", err)
 	}
 
-	// All containers with the label are considered stale at startup
-	staleContainers := containers
+	// All containers with the label are considered stale at startup,
+	// except running ones that are about to be adopted
+	var staleContainers []types.Container
+	for _, ctr := range containers {
+		if keepRunning && ctr.State == "running" {
+			continue
+		}
+		staleContainers = append(staleContainers, ctr)
+	}
 
 	if len(staleContainers) == 0 {
 		c.addResult(checkName, true, "No stale containers found", nil)
@@ -191,13 +225,13 @@ func (c *Checker) CheckStaleContainers(ctx context.Context) (int, error) {
 		// Stop if running
 		if ctr.State == "running" {
 			timeout := 5
-			if err := c.dockerClient.ContainerStop(ctx, ctr.ID, container.StopOptions{Timeout: &timeout}); err != nil {
+			if err := c.runtime.ContainerStop(ctx, ctr.ID, container.StopOptions{Timeout: &timeout}); err != nil {
 				slog.Warn("Failed to stop container", "container", containerName, "error", err)
 			}
 		}
 
 		// Remove container
-		if err := c.dockerClient.ContainerRemove(ctx, ctr.ID, container.RemoveOptions{Force: true}); err != nil {
+		if err := c.runtime.ContainerRemove(ctx, ctr.ID, container.RemoveOptions{Force: true}); err != nil {
 			errors = append(errors, fmt.Sprintf("%s: %v", containerName, err))
 			slog.Error("Failed to remove container", "container", containerName, "error", err)
 		} else {
@@ -214,19 +248,39 @@ func (c *Checker) CheckStaleContainers(ctx context.Context) (int, error) {
 	return removed, nil
 }
 
-// CheckFirewall creates firewall rules (optionally applies them).
-func (c *Checker) CheckFirewall(netInfo *sandbox.NetworkInfo, allowedPorts []int, apply bool) (*sandbox.FirewallRules, error) {
+// CheckFirewall creates firewall rules (optionally applies them). If
+// redirectPort is set, sandbox HTTP/HTTPS traffic is redirected to it, and if
+// dnsPort is set, sandbox DNS traffic is redirected to it, even when the rules
+// are not applied.
+func (c *Checker) CheckFirewall(netInfo *sandbox.NetworkInfo, allowedPorts []int, apply bool, redirectPort, dnsPort int) (*sandbox.FirewallRules, error) {
 	const checkName = "Firewall"
 
 	slog.Info("Running startup check", "check", checkName)
 
 	rules, err := sandbox.NewFirewallRules(netInfo, allowedPorts)
 	if err != nil {
+		if redirectPort > 0 || dnsPort > 0 {
+			c.addResult(checkName, false, "iptables not available for sandbox traffic redirect", err)
+			return nil, err
+		}
 		// iptables not available - this is okay on non-Linux or without privileges
 		c.addResult(checkName, true, "iptables not available (firewall disabled)", nil)
 		return nil, nil
 	}
 
+	if redirectPort > 0 {
+		if err := rules.ApplyRedirect(redirectPort); err != nil {
+			c.addResult(checkName, false, "Failed to redirect sandbox traffic to transparent proxy", err)
+			return rules, err
+		}
+	}
+	if dnsPort > 0 {
+		if err := rules.ApplyDNSRedirect(dnsPort); err != nil {
+			c.addResult(checkName, false, "Failed to redirect sandbox DNS to sandbox DNS server", err)
+			return rules, err
+		}
+	}
+
 	if !apply {
 		c.addResult(checkName, true, "Firewall rules created (not applied)", nil)
 		return rules, nil
@@ -0,0 +1,237 @@
+//go:build conformance
+
+package test
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/somnia-chain/agent-runner/internal/agents"
+)
+
+// Conformance configuration, read from the environment
+var (
+	agentAddr         = os.Getenv("AGENT_ADDR")
+	agentRequestHex   = os.Getenv("AGENT_REQUEST_HEX")
+	agentExpectedHex  = os.Getenv("AGENT_EXPECTED_RESULT_HEX")
+	agentProtocolFlag = os.Getenv("AGENT_PROTOCOL")
+)
+
+var conformanceClient = &http.Client{Timeout: 60 * time.Second}
+
+// conformanceContext is a fixed execution context sent with every request
+var conformanceContext = &agents.ExecutionContext{
+	ChainID:         "50312",
+	AgentID:         "1",
+	Requester:       "0x0000000000000000000000000000000000000001",
+	BlockNumber:     1000000,
+	BlockTimestamp:  1700000000,
+	MaxCostPerAgent: "1000000000000000",
+}
+
+func requireAgent(t *testing.T) {
+	t.Helper()
+	if agentAddr == "" {
+		t.Skip("AGENT_ADDR not set")
+	}
+}
+
+// agentProtocol returns the version advertised on /protocol, or AGENT_PROTOCOL.
+func agentProtocol(t *testing.T) int {
+	t.Helper()
+	resp, err := conformanceClient.Get(fmt.Sprintf("http://%s%s", agentAddr, agents.ProtocolPath))
+	if err == nil {
+		defer resp.Body.Close()
+		var info agents.ProtocolInfo
+		if resp.StatusCode == http.StatusOK && json.NewDecoder(resp.Body).Decode(&info) == nil {
+			best := agents.ProtocolLegacy
+			for _, v := range info.Versions {
+				if v > best && v <= agents.LatestProtocol {
+					best = v
+				}
+			}
+			return best
+		}
+	}
+	if agentProtocolFlag != "" {
+		v, err := strconv.Atoi(agentProtocolFlag)
+		if err != nil {
+			t.Fatalf("Invalid AGENT_PROTOCOL %q", agentProtocolFlag)
+		}
+		return v
+	}
+	return agents.ProtocolV1
+}
+
+// execute sends a request envelope and decodes the response under the given version.
+// It is safe to call from multiple goroutines.
+func execute(version int, body []byte) (*agents.Response, error) {
+	resp, err := conformanceClient.Post(fmt.Sprintf("http://%s/", agentAddr), "application/json", bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response: %w", err)
+	}
+	return agents.DecodeResponse(version, resp.StatusCode, data, agents.DefaultMaxResultSize)
+}
+
+func decodeHex(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(strings.TrimPrefix(s, "0x"))
+	if err != nil {
+		t.Fatalf("Invalid hex %q: %v", s, err)
+	}
+	return b
+}
+
+func TestConformanceProtocolVersion(t *testing.T) {
+	requireAgent(t)
+
+	version := agentProtocol(t)
+	t.Logf("Agent protocol version: %d", version)
+	if version < agents.ProtocolV1 {
+		t.Errorf("Agent speaks the legacy protocol; declare version %d via /protocol or the %q label", agents.LatestProtocol, "agent-host.protocol")
+	}
+}
+
+func TestConformanceReadiness(t *testing.T) {
+	requireAgent(t)
+
+	resp, err := conformanceClient.Get(fmt.Sprintf("http://%s/", agentAddr))
+	if err != nil {
+		t.Fatalf("GET / failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 500 {
+		t.Errorf("GET / returned %d; the runner treats 5xx as not ready", resp.StatusCode)
+	}
+}
+
+func TestConformanceValidRequest(t *testing.T) {
+	requireAgent(t)
+	if agentRequestHex == "" {
+		t.Skip("AGENT_REQUEST_HEX not set")
+	}
+
+	version := agentProtocol(t)
+	body, err := agents.EncodeRequest(version, "conformance-valid", decodeHex(t, agentRequestHex), conformanceContext)
+	if err != nil {
+		t.Fatalf("Failed to encode request: %v", err)
+	}
+
+	response, err := execute(version, body)
+	if err != nil {
+		t.Fatalf("Response does not conform: %v", err)
+	}
+	if !response.Success {
+		t.Fatalf("Expected success, got error %v", response.Error)
+	}
+	if agentExpectedHex != "" && !bytes.Equal(response.Body, decodeHex(t, agentExpectedHex)) {
+		t.Errorf("Result mismatch\nExpected: %s\nGot:      0x%s", agentExpectedHex, hex.EncodeToString(response.Body))
+	}
+}
+
+func TestConformanceInvalidPayload(t *testing.T) {
+	requireAgent(t)
+
+	version := agentProtocol(t)
+	if version < agents.ProtocolV1 {
+		t.Skip("Typed errors require protocol v1")
+	}
+
+	// A selector no agent implements
+	body, err := agents.EncodeRequest(version, "conformance-invalid", []byte{0xde, 0xad, 0xbe, 0xef}, conformanceContext)
+	if err != nil {
+		t.Fatalf("Failed to encode request: %v", err)
+	}
+
+	response, err := execute(version, body)
+	if err != nil {
+		t.Fatalf("Response does not conform: %v", err)
+	}
+	if response.Success {
+		t.Errorf("Expected failure for an unknown function selector")
+	}
+}
+
+func TestConformanceMalformedEnvelope(t *testing.T) {
+	requireAgent(t)
+
+	version := agentProtocol(t)
+	if version < agents.ProtocolV1 {
+		t.Skip("Typed errors require protocol v1")
+	}
+
+	resp, err := conformanceClient.Post(fmt.Sprintf("http://%s/", agentAddr), "application/json", strings.NewReader("not json"))
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	defer resp.Body.Close()
+	data, _ := io.ReadAll(resp.Body)
+
+	// Either reject at the HTTP level or return a well-formed failure
+	if resp.StatusCode >= 400 && resp.StatusCode < 500 {
+		return
+	}
+	response, err := agents.DecodeResponse(version, resp.StatusCode, data, agents.DefaultMaxResultSize)
+	if err != nil {
+		t.Fatalf("Response does not conform: %v", err)
+	}
+	if response.Success {
+		t.Errorf("Expected failure for a malformed request body")
+	} else if response.Error.Code != agents.ErrorCodeInvalidRequest {
+		t.Errorf("Expected error code %q, got %q", agents.ErrorCodeInvalidRequest, response.Error.Code)
+	}
+}
+
+func TestConformanceConcurrentRequests(t *testing.T) {
+	requireAgent(t)
+	if agentRequestHex == "" {
+		t.Skip("AGENT_REQUEST_HEX not set")
+	}
+
+	version := agentProtocol(t)
+	payload := decodeHex(t, agentRequestHex)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 4)
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			body, err := agents.EncodeRequest(version, fmt.Sprintf("conformance-concurrent-%d", i), payload, conformanceContext)
+			if err != nil {
+				errs <- err
+				return
+			}
+			response, err := execute(version, body)
+			if err != nil {
+				errs <- err
+				return
+			}
+			if !response.Success {
+				errs <- fmt.Errorf("request %d failed: %v", i, response.Error)
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Error(err)
+	}
+}